@@ -5,18 +5,26 @@ import (
 	goflag "flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/judwhite/go-svc"
 	"github.com/ngaut/log"
+	"github.com/pkg/errors"
 	flag "github.com/spf13/pflag"
 
 	"github.com/mayooot/gpu-docker-api/internal/docker"
 	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/locker"
 	"github.com/mayooot/gpu-docker-api/internal/routers"
 	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	"github.com/mayooot/gpu-docker-api/internal/services"
+	"github.com/mayooot/gpu-docker-api/internal/snapshot"
+	"github.com/mayooot/gpu-docker-api/internal/store"
 	"github.com/mayooot/gpu-docker-api/internal/version"
 	"github.com/mayooot/gpu-docker-api/internal/workQueue"
 	"github.com/mayooot/gpu-docker-api/utils"
@@ -31,19 +39,58 @@ var (
 )
 
 var (
-	addr      = flag.StringP("addr", "a", "0.0.0.0:2378", "Address of gpu-docker-routers server, format: ip:port")
-	etcdAddr  = flag.StringP("etcd", "e", "0.0.0.0:2379", "Address of etcd server, format: ip:port")
-	portRange = flag.StringP("portRange", "p", "40000-65535", "Port range of docker container, format: startPort-endPort")
-	logLevel  = flag.StringP("logLevel", "l", "debug", "Log level, optional: release")
+	addr             = flag.StringP("addr", "a", "0.0.0.0:2378", "Address of gpu-docker-routers server, format: ip:port")
+	advertiseAddr    = flag.String("advertiseAddr", "", "Address that other instances redirect mutating requests to when this instance is the leader, format: ip:port, default is the value of addr")
+	etcdAddr         = flag.StringSliceP("etcd", "e", []string{"0.0.0.0:2379"}, "Addresses of etcd endpoints, format: ip:port, separated by comma")
+	etcdCACert       = flag.String("etcdCACert", "", "CA certificate file to verify etcd server, enables TLS")
+	etcdCert         = flag.String("etcdCert", "", "Client certificate file for etcd mutual TLS, must be set with etcdKey")
+	etcdKey          = flag.String("etcdKey", "", "Client key file for etcd mutual TLS, must be set with etcdCert")
+	etcdUser         = flag.String("etcdUser", "", "Username of etcd authentication")
+	etcdPassword     = flag.String("etcdPassword", "", "Password of etcd authentication, default is the value of env ETCD_PASSWORD")
+	etcdDialTimeout  = flag.Duration("etcdDialTimeout", 2*time.Second, "Timeout of connecting etcd")
+	operationTimeout = flag.Duration("operationTimeout", 1*time.Second, "Timeout of every single request to the store")
+	walPath          = flag.String("walPath", "workqueue.db", "Path of the write-ahead log of the operations that are not written to the store yet")
+	syncMaxAttempts  = flag.Int("syncMaxAttempts", 10, "How many times an operation is written to the store before it is moved to the dead letters")
+	syncWrites       = flag.Bool("syncWrites", false, "Whether mutating requests respond after their writes are saved to the store, it can be changed per request by ?sync=true|false")
+	syncTimeout      = flag.Duration("syncTimeout", 10*time.Second, "How long a mutating request waits for its writes to be saved to the store when syncWrites is enabled")
+	namespace        = flag.String("namespace", "gpu-docker-api", "Namespace of keys in the store, keys are saved under /<namespace>/apis/v1, so that several deployments can share one etcd")
+	portRange        = flag.StringP("portRange", "p", "40000-65535", "Port range of docker container, format: startPort-endPort")
+	logLevel         = flag.StringP("logLevel", "l", "debug", "Log level, optional: release")
+	cluster          = flag.Bool("cluster", false, "Whether several instances share the same etcd, if true, the operation lock of replicaSet and volume is backed by etcd")
+	lockTimeout      = flag.Duration("lockTimeout", 0, "How long an operation waits for another operation on the same replicaSet or volume, 0 means fail immediately")
+	keepLast         = flag.Int("keepLast", 0, "Default number of latest historical versions of a replicaSet to keep, 0 means the rule is disabled")
+	keepDays         = flag.Int("keepDays", 0, "Default days to keep historical versions of a replicaSet, 0 means the rule is disabled")
+	operationTTL     = flag.Duration("operationTTL", 7*24*time.Hour, "How long the finished operations started with ?async=true are kept, 0 means forever")
+	storeType        = flag.String("store", "etcd", "Where the state is saved, optional: etcd, bolt, memory. bolt and memory can only be used on a single node")
+	storePath        = flag.String("storePath", "gpu-docker-api.db", "Path of the bolt database file, only used when store is bolt")
+	snapshotStore    = flag.String("snapshotStore", "local", "Where the snapshots of replicaSets are saved, optional: local, s3. local saves them under merges/.store")
+	s3Endpoint       = flag.String("s3Endpoint", "", "Endpoint of the S3-compatible object storage, format: host:port, only used when snapshotStore is s3")
+	s3Bucket         = flag.String("s3Bucket", "gpu-docker-api", "Bucket of the snapshots, it is created if it does not exist")
+	s3Prefix         = flag.String("s3Prefix", "", "Prefix of the keys of the snapshots in the bucket, so that several deployments can share one bucket")
+	s3Region         = flag.String("s3Region", "", "Region of the bucket")
+	s3AccessKey      = flag.String("s3AccessKey", "", "Access key of the object storage, default is the value of env S3_ACCESS_KEY")
+	s3SecretKey      = flag.String("s3SecretKey", "", "Secret key of the object storage, default is the value of env S3_SECRET_KEY")
+	s3Secure         = flag.Bool("s3Secure", false, "Whether to connect to the object storage by https")
+	snapshotVolumes  = flag.Bool("snapshotVolumes", false, "Whether the data of the volumes bound to a replicaSet version is saved with its snapshot, so that rollback with withVolumes can restore it")
+	execTimeout      = flag.Duration("execTimeout", 10*time.Minute, "Default timeout of the commands executed in containers without timeoutSeconds, the command is killed when it expires, 0 means no timeout")
+	fileSizeLimit    = flag.String("fileSizeLimit", "1GB", "Size limit of the files uploaded to or downloaded from containers, supported units: KB, MB, GB, TB, 0 means no limit")
 )
 
 type program struct {
-	ctx context.Context
-	wg  sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 func main() {
 	fmt.Printf("GPU-DOCKER-API\n BRANCH: %s\n Version: %s\n COMMIT: %s\n GoVersion: %s\n BuildTime: %s\n\n", BRANCH, VERSION, COMMIT, GoVersion, BuildTime)
+	if len(os.Args) > 1 && (os.Args[1] == cmdBackup || os.Args[1] == cmdRestore) {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s failed, error: %+v", os.Args[1], err)
+		}
+		return
+	}
+
 	prg := &program{}
 	if err := svc.Run(prg, syscall.SIGINT, syscall.SIGTERM); err != nil {
 		log.Fatal(err.Error())
@@ -53,32 +100,61 @@ func main() {
 func (p *program) Init(svc.Environment) (err error) {
 	flag.CommandLine.AddGoFlagSet(goflag.CommandLine)
 	flag.Parse()
-	p.ctx = context.Background()
+	p.ctx, p.cancel = context.WithCancel(context.Background())
 	log.SetLevelByString(*logLevel)
+	if len(*advertiseAddr) == 0 {
+		*advertiseAddr = *addr
+	}
 
 	if err = docker.InitDockerClient(); err != nil {
 		return
 	}
 
-	if err = etcd.InitEtcdClient(*etcdAddr); err != nil {
+	if err = initStore(); err != nil {
 		return
 	}
+	// an embedded store is never shared, the records in etcd are migrated by the leader after it is elected
+	if *storeType != storeEtcd {
+		if err = services.MigrateRecords(); err != nil {
+			return
+		}
+	}
 
-	workQueue.InitWorkQueue()
-
-	if err = schedulers.InitGPuScheduler(); err != nil {
+	if *syncMaxAttempts < 1 {
+		return errors.Errorf("syncMaxAttempts: %d must be greater than 0", *syncMaxAttempts)
+	}
+	if err = workQueue.InitWorkQueue(*walPath, *syncMaxAttempts); err != nil {
 		return
 	}
 
-	if err = schedulers.InitPortScheduler(*portRange); err != nil {
+	if err = initSnapshotStore(); err != nil {
 		return
 	}
 
-	if err = version.InitVersionMap(); err != nil {
-		return
+	locker.InitLocker(*cluster, *lockTimeout)
+
+	services.InitRetentionPolicy(*keepLast, *keepDays)
+	// the instances sharing the etcd are alive while their election sessions are kept
+	var liveInstances func(ctx context.Context) ([]string, error)
+	if *storeType == storeEtcd {
+		liveInstances = etcd.Candidates
 	}
+	services.InitOperations(*operationTTL, *advertiseAddr, liveInstances)
+	services.InitSnapshots(*snapshotVolumes)
+	services.InitExec(*execTimeout)
+	var fileLimit int64
+	if *fileSizeLimit != "0" {
+		// ToBytes expects a number followed by a unit
+		if len(*fileSizeLimit) > 2 {
+			fileLimit, err = utils.ToBytes(*fileSizeLimit)
+		}
+		if err != nil || fileLimit <= 0 {
+			return errors.Errorf("fileSizeLimit: %s is invalid, supported units: KB, MB, GB, TB", *fileSizeLimit)
+		}
+	}
+	services.InitFiles(fileLimit)
 
-	if err = version.InitMergedMap(); err != nil {
+	if err = loadState(); err != nil {
 		return
 	}
 
@@ -97,9 +173,15 @@ func (p *program) Start() error {
 		ch routers.ReplicaSetHandler
 		vh routers.VolumeHandler
 		gh routers.Resource
+		wh routers.WatchHandler
+		oh routers.OperationHandler
+		ah = routers.AdminHandler{Reload: loadState}
 	)
 
-	fmt.Printf("CONFIG\n addr: %s\n etcdAddr: %s\n portRange: %s\n logLevel: %s\n\n", *addr, *etcdAddr, *portRange, *logLevel)
+	fmt.Printf("CONFIG\n addr: %s\n advertiseAddr: %s\n etcdAddr: %s\n etcdUser: %s\n etcdTLS: %t\n portRange: %s\n logLevel: %s\n cluster: %t\n lockTimeout: %s\n keepLast: %d\n keepDays: %d\n store: %s\n storePath: %s\n namespace: %s\n operationTimeout: %s\n walPath: %s\n syncMaxAttempts: %d\n syncWrites: %t\n syncTimeout: %s\n snapshotStore: %s\n s3Endpoint: %s\n s3Bucket: %s\n s3Prefix: %s\n snapshotVolumes: %t\n operationTTL: %s\n execTimeout: %s\n fileSizeLimit: %s\n\n",
+		*addr, *advertiseAddr, strings.Join(*etcdAddr, ","), *etcdUser, len(*etcdCACert) != 0 || len(*etcdCert) != 0, *portRange, *logLevel, *cluster, *lockTimeout,
+		*keepLast, *keepDays, *storeType, *storePath, *namespace, *operationTimeout, *walPath, *syncMaxAttempts, *syncWrites, *syncTimeout,
+		*snapshotStore, *s3Endpoint, *s3Bucket, *s3Prefix, *snapshotVolumes, *operationTTL, *execTimeout, *fileSizeLimit)
 	log.Infof("The number of available gpus is %d", schedulers.GpuScheduler.AvailableGpuNums)
 	log.Infof("The range of available ports is %d-%d, and the available number is %d",
 		schedulers.PortScheduler.StartPort,
@@ -112,6 +194,8 @@ func (p *program) Start() error {
 	gin.SetMode(*logLevel)
 	r := gin.New()
 	r.Use(routers.Cors())
+	r.Use(routers.LeaderOnly())
+	r.Use(routers.SyncWrites(*syncWrites, *syncTimeout))
 	r.GET("/ping", func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"message": "pong",
@@ -122,6 +206,9 @@ func (p *program) Start() error {
 	ch.RegisterRoute(apiv1)
 	vh.RegisterRoute(apiv1)
 	gh.RegisterRoute(apiv1)
+	wh.RegisterRoute(apiv1)
+	ah.RegisterRoute(apiv1)
+	oh.RegisterRoute(apiv1)
 
 	go func() {
 		_ = r.Run(*addr)
@@ -129,21 +216,229 @@ func (p *program) Start() error {
 
 	go workQueue.SyncLoop(p.ctx, &p.wg)
 
+	// in cluster mode, the snapshots are only collected by the admin api of the leader,
+	// and the operations are only pruned by the leader when it starts operations,
+	// because the replicaSets in the shared store may not be run by this instance
+	if !*cluster {
+		go collectSnapshots()
+		go pruneOperations()
+	}
+
+	// only the leader serves mutating requests, so that two instances
+	// pointing at the same etcd never allocate the same gpu or port,
+	// an embedded store is never shared, so the instance is always the leader
+	if *storeType != storeEtcd {
+		etcd.ElectSelf(*advertiseAddr)
+		return nil
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		etcd.RunElection(p.ctx, *advertiseAddr, p.onElected, p.reloadState)
+	}()
+
 	return nil
 }
 
 func (p *program) Stop() error {
 	log.Info("gpu-docker-routers is stopping...")
-	p.ctx.Done()
+	// a standby must not overwrite the state saved by the leader
+	isLeader := etcd.IsLeader()
+	p.cancel()
 	p.wg.Wait()
 
 	workQueue.Close()
 	docker.CloseDockerClient()
-	_ = schedulers.CloseGpuScheduler()
-	_ = schedulers.ClosePortScheduler()
-	_ = version.CloseVersionMap()
-	_ = version.CloseMergedMap()
-	_ = etcd.CloseEtcdClient()
+	if isLeader {
+		_ = schedulers.CloseGpuScheduler()
+		_ = schedulers.ClosePortScheduler()
+		_ = version.CloseVersionMap()
+	}
+	_ = store.CloseStore()
 	log.Info("gpu-docker-routers stopped successfully!")
 	return nil
 }
+
+// onElected is called when the instance becomes the leader, before it serves mutating requests,
+// the records are migrated here, so that a standby or an older leader never sees them half upgraded.
+func (p *program) onElected() {
+	if p.ctx.Err() != nil {
+		return
+	}
+	// the records are still upgraded when they are read, so a failed migration is only retried by the next leader
+	if err := services.MigrateRecords(); err != nil {
+		log.Errorf("failed to migrate records, error: %+v", err)
+	}
+	p.reloadState()
+}
+
+// reloadState is called when the leadership changes,
+// the in-memory state may be stale, so reload it from the store.
+func (p *program) reloadState() {
+	if p.ctx.Err() != nil {
+		return
+	}
+	if err := loadState(); err != nil {
+		log.Errorf("failed to reload state from store, error: %v", err)
+		return
+	}
+	log.Info("reload state from store successfully")
+}
+
+const (
+	cmdBackup  = "backup"
+	cmdRestore = "restore"
+)
+
+// runCommand runs the backup or restore subcommand against the store, the server is not started.
+// e.g. gpu-docker-api backup --file backup.tar.gz --merges
+func runCommand(cmd string, args []string) error {
+	file := flag.StringP("file", "f", "", "Path of the backup archive")
+	withMerges := flag.Bool("merges", false, "Whether to archive the merge snapshots on disk, only used by backup")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	log.SetLevelByString(*logLevel)
+	if len(*file) == 0 {
+		return errors.New("--file is required")
+	}
+
+	if err := initStore(); err != nil {
+		return err
+	}
+	defer func() { _ = store.CloseStore() }()
+
+	var as services.AdminService
+	if cmd == cmdBackup {
+		f, err := os.OpenFile(*file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create %s", *file)
+		}
+		defer f.Close()
+		return as.Backup(f, *withMerges)
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", *file)
+	}
+	defer f.Close()
+	return as.Restore(f)
+}
+
+const (
+	storeEtcd   = "etcd"
+	storeBolt   = "bolt"
+	storeMemory = "memory"
+)
+
+func initStore() error {
+	if *cluster && *storeType != storeEtcd {
+		return errors.Errorf("store %s can not be used in cluster mode, the state must be shared by etcd", *storeType)
+	}
+
+	switch *storeType {
+	case storeEtcd:
+		if len(*etcdPassword) == 0 {
+			*etcdPassword = os.Getenv("ETCD_PASSWORD")
+		}
+		err := etcd.InitEtcdClient(etcd.Config{
+			Endpoints:   *etcdAddr,
+			CACert:      *etcdCACert,
+			Cert:        *etcdCert,
+			Key:         *etcdKey,
+			Username:    *etcdUser,
+			Password:    *etcdPassword,
+			DialTimeout: *etcdDialTimeout,
+		})
+		if err != nil {
+			return err
+		}
+		store.InitStore(etcd.NewStore(), *namespace, *operationTimeout)
+		if err = etcd.MigrateVersionKeys(); err != nil {
+			return err
+		}
+	case storeBolt:
+		s, err := store.NewBoltStore(*storePath)
+		if err != nil {
+			return err
+		}
+		store.InitStore(s, *namespace, *operationTimeout)
+	case storeMemory:
+		log.Warn("the state is saved in memory, it is lost after restart")
+		store.InitStore(store.NewMemoryStore(), *namespace, *operationTimeout)
+	default:
+		return errors.Errorf("unknown store: %s, optional: etcd, bolt, memory", *storeType)
+	}
+	return nil
+}
+
+const (
+	snapshotLocal = "local"
+	snapshotS3    = "s3"
+)
+
+func initSnapshotStore() error {
+	var (
+		b   snapshot.Backend
+		err error
+	)
+	switch *snapshotStore {
+	case snapshotLocal:
+		// the leading dot keeps it apart from the legacy snapshot directories of replicaSets
+		b, err = snapshot.NewLocalBackend(filepath.Join("merges", ".store"))
+	case snapshotS3:
+		if len(*s3Endpoint) == 0 {
+			return errors.New("s3Endpoint is required when snapshotStore is s3")
+		}
+		if len(*s3AccessKey) == 0 {
+			*s3AccessKey = os.Getenv("S3_ACCESS_KEY")
+		}
+		if len(*s3SecretKey) == 0 {
+			*s3SecretKey = os.Getenv("S3_SECRET_KEY")
+		}
+		b, err = snapshot.NewS3Backend(snapshot.S3Config{
+			Endpoint:  *s3Endpoint,
+			Bucket:    *s3Bucket,
+			Region:    *s3Region,
+			AccessKey: *s3AccessKey,
+			SecretKey: *s3SecretKey,
+			Secure:    *s3Secure,
+			Prefix:    *s3Prefix,
+		})
+	default:
+		return errors.Errorf("unknown snapshotStore: %s, optional: local, s3", *snapshotStore)
+	}
+	if err != nil {
+		return err
+	}
+	snapshot.InitSnapshot(b)
+	return nil
+}
+
+func loadState() error {
+	if err := schedulers.InitGPuScheduler(); err != nil {
+		return err
+	}
+
+	if err := schedulers.InitPortScheduler(*portRange); err != nil {
+		return err
+	}
+
+	return version.InitVersionMap()
+}
+
+// collectSnapshots removes the merge snapshots of deleted replicaSets and pruned versions.
+func collectSnapshots() {
+	var as services.AdminService
+	if _, err := as.CollectSnapshots(); err != nil {
+		log.Errorf("failed to collect snapshots, error: %+v", err)
+	}
+}
+
+// pruneOperations deletes the expired operations, and fails the operations interrupted by the last stop.
+func pruneOperations() {
+	if err := services.PruneOperations(); err != nil {
+		log.Errorf("failed to prune operations, error: %+v", err)
+	}
+}
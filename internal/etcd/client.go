@@ -1,28 +1,57 @@
 package etcd
 
 import (
+	"crypto/tls"
 	"time"
 
 	"github.com/pkg/errors"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"google.golang.org/grpc"
 )
 
 var cli *clientv3.Client
 
-func InitEtcdClient(addr string) error {
+// Config is how to connect etcd, TLS is enabled if any of CACert, Cert and Key is set,
+// and Cert and Key are the client certificate for mutual TLS.
+type Config struct {
+	Endpoints   []string
+	CACert      string
+	Cert        string
+	Key         string
+	Username    string
+	Password    string
+	DialTimeout time.Duration
+}
+
+func InitEtcdClient(cfg Config) error {
+	var tlsConfig *tls.Config
+	if len(cfg.CACert) != 0 || len(cfg.Cert) != 0 || len(cfg.Key) != 0 {
+		if (len(cfg.Cert) == 0) != (len(cfg.Key) == 0) {
+			return errors.New("the cert and key of etcd must be set together")
+		}
+		tlsInfo := transport.TLSInfo{
+			TrustedCAFile: cfg.CACert,
+			CertFile:      cfg.Cert,
+			KeyFile:       cfg.Key,
+		}
+		var err error
+		if tlsConfig, err = tlsInfo.ClientConfig(); err != nil {
+			return errors.Wrap(err, "failed to load etcd tls config")
+		}
+	}
+
 	var err error
 	cli, err = clientv3.New(clientv3.Config{
-		Endpoints:   []string{addr},
-		DialTimeout: 2 * time.Second,
+		Endpoints:   cfg.Endpoints,
+		DialTimeout: cfg.DialTimeout,
 		DialOptions: []grpc.DialOption{grpc.WithBlock()},
+		TLS:         tlsConfig,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
 	})
 	if err != nil {
-		return errors.Wrap(err, "failed to connect etcd")
+		return errors.Wrapf(err, "failed to connect etcd, endpoints: %v", cfg.Endpoints)
 	}
 	return nil
 }
-
-func CloseEtcdClient() error {
-	return cli.Close()
-}
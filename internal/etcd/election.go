@@ -0,0 +1,126 @@
+package etcd
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/ngaut/log"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+
+	"github.com/mayooot/gpu-docker-api/internal/store"
+)
+
+const (
+	// leaderTTL is the lease ttl of the election session in seconds,
+	// if the leader can not keep alive within this time, a standby will take over.
+	leaderTTL = 10
+
+	campaignRetryInterval = 3 * time.Second
+)
+
+var (
+	isLeader   atomic.Bool
+	leaderAddr atomic.Value
+)
+
+// IsLeader reports whether the current instance is the leader,
+// only the leader is allowed to serve mutating requests.
+func IsLeader() bool {
+	return isLeader.Load()
+}
+
+// LeaderAddr returns the advertised address of the current leader,
+// it is empty if there is no leader yet.
+func LeaderAddr() string {
+	addr, _ := leaderAddr.Load().(string)
+	return addr
+}
+
+// RunElection campaigns for leadership with advertiseAddr as the value until ctx is done.
+// onElected is called before the instance starts serving as the leader,
+// onResigned is called after the instance lost its leadership.
+func RunElection(ctx context.Context, advertiseAddr string, onElected, onResigned func()) {
+	for {
+		if err := campaign(ctx, advertiseAddr, onElected, onResigned); err != nil {
+			log.Errorf("etcd.RunElection failed, error: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(campaignRetryInterval):
+		}
+	}
+}
+
+func campaign(ctx context.Context, advertiseAddr string, onElected, onResigned func()) error {
+	session, err := concurrency.NewSession(cli, concurrency.WithTTL(leaderTTL))
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	observeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	election := concurrency.NewElection(session, store.ResourcePrefix(store.Leader, ""))
+	go observe(observeCtx, election)
+
+	if err = election.Campaign(ctx, advertiseAddr); err != nil {
+		return err
+	}
+
+	onElected()
+	isLeader.Store(true)
+	log.Infof("etcd.RunElection, %s is elected as the leader", advertiseAddr)
+
+	select {
+	case <-session.Done():
+		log.Warnf("etcd.RunElection, %s lost the leadership, session expired", advertiseAddr)
+	case <-ctx.Done():
+		resignCtx, resignCancel := context.WithTimeout(context.Background(), store.OperationDuration)
+		_ = election.Resign(resignCtx)
+		resignCancel()
+		log.Infof("etcd.RunElection, %s resigned the leadership", advertiseAddr)
+	}
+
+	isLeader.Store(false)
+	onResigned()
+	return nil
+}
+
+func observe(ctx context.Context, election *concurrency.Election) {
+	for resp := range election.Observe(ctx) {
+		leaderAddr.Store(leaderValue(resp))
+	}
+}
+
+func leaderValue(resp clientv3.GetResponse) string {
+	if len(resp.Kvs) == 0 {
+		return ""
+	}
+	return string(resp.Kvs[0].Value)
+}
+
+// Candidates returns the advertised addresses of the instances that are campaigning for or holding the leadership,
+// an instance is gone once its election session expires.
+func Candidates(ctx context.Context) ([]string, error) {
+	resp, err := cli.Get(ctx, store.ResourcePrefix(store.Leader, "")+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		addrs = append(addrs, string(kv.Value))
+	}
+	return addrs, nil
+}
+
+// ElectSelf makes the current instance the leader without an election,
+// it is used when the state is saved in an embedded store which can not be shared with other instances.
+func ElectSelf(advertiseAddr string) {
+	leaderAddr.Store(advertiseAddr)
+	isLeader.Store(true)
+}
@@ -0,0 +1,55 @@
+package etcd
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/client/v3/concurrency"
+
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// lockTTL is the lease ttl of the lock session in seconds,
+// the lock is released automatically if the holder crashed.
+const lockTTL = 30
+
+// Lock acquires a distributed lock for the key of resource.
+// If timeout is 0, it returns immediately when the lock is held by others,
+// otherwise it waits until the lock is acquired or timeout.
+func Lock(resource store.Resource, key string, timeout time.Duration) (unlock func(), err error) {
+	session, err := concurrency.NewSession(cli, concurrency.WithTTL(lockTTL))
+	if err != nil {
+		return nil, errors.Wrapf(err, "concurrency.NewSession failed, resource: %s, key: %s", resource, key)
+	}
+	mutex := concurrency.NewMutex(session, store.ResourcePrefix(store.Locks, path.Join(resource, key)))
+
+	if timeout == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), store.OperationDuration)
+		defer cancel()
+		err = mutex.TryLock(ctx)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err = mutex.Lock(ctx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = concurrency.ErrLocked
+		}
+	}
+	if err != nil {
+		_ = session.Close()
+		if errors.Is(err, concurrency.ErrLocked) {
+			return nil, errors.Wrapf(xerrors.NewOperationInProgressError(), "resource: %s, key: %s", resource, key)
+		}
+		return nil, errors.Wrapf(err, "mutex.Lock failed, resource: %s, key: %s", resource, key)
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), store.OperationDuration)
+		defer cancel()
+		_ = mutex.Unlock(ctx)
+		_ = session.Close()
+	}, nil
+}
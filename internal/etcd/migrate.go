@@ -0,0 +1,137 @@
+package etcd
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const versionKeysMigrationKey = "versionKeys"
+
+// MigrateVersionKeys copies the history of every replicaSet and volume to the version keys.
+// The history used to be the mvcc revisions of the resource key, which are lost after etcd compacts,
+// so the revisions that are still available are migrated. It is only executed once.
+func MigrateVersionKeys() error {
+	_, err := store.GetValue(store.Migrations, versionKeysMigrationKey)
+	if err == nil {
+		return nil
+	}
+	if !xerrors.IsNotExistInStoreError(err) {
+		return errors.Wrap(err, "get migration record failed")
+	}
+
+	for _, resource := range []store.Resource{store.Containers, store.Volumes} {
+		keys, err := listResourceKeys(resource)
+		if err != nil {
+			return errors.WithMessagef(err, "listResourceKeys failed, resource: %s", resource)
+		}
+		for _, key := range keys {
+			if err = migrateVersionKeys(resource, key); err != nil {
+				return errors.WithMessagef(err, "migrateVersionKeys failed, resource: %s, key: %s", resource, key)
+			}
+		}
+	}
+
+	done := time.Now().Format("2006-01-02 15:04:05")
+	return store.Put(store.Migrations, versionKeysMigrationKey, &done)
+}
+
+func migrateVersionKeys(resource store.Resource, key string) error {
+	if _, err := store.GetVersionRange(resource, key); err == nil {
+		return nil
+	}
+	kind := models.KindContainer
+	if resource == store.Volumes {
+		kind = models.KindVolume
+	}
+
+	kvs, err := getWithRev(resource, key, 0)
+	if err != nil {
+		return err
+	}
+	createRev := kvs[0].CreateRevision
+
+	// the history is keyed by the version saved in every value, which is the version of new writes too,
+	// not by the modification count of etcd, which also counts the failed patches and the retried puts.
+	// The revisions are read from the newest, so the latest value of a version is kept.
+	migrated := make(map[int64]struct{})
+	for rev := kvs[0].ModRevision; rev >= createRev; {
+		kvs, err := getWithRev(resource, key, rev)
+		if err != nil {
+			if errors.Is(err, rpctypes.ErrCompacted) {
+				log.Warnf("etcd.MigrateVersionKeys, resource: %s, key: %s, revisions before %d are compacted", resource, key, rev+1)
+				break
+			}
+			return err
+		}
+		// the revisions between the modifications of the key are skipped
+		rev = kvs[0].ModRevision - 1
+
+		var value struct {
+			Version int64 `json:"version"`
+		}
+		if err = models.DecodeRecord(kind, kvs[0].Value, &value); err != nil || value.Version <= 0 {
+			log.Warnf("etcd.MigrateVersionKeys, resource: %s, key: %s, the value of revision %d has no version, skipped, error: %v",
+				resource, key, kvs[0].ModRevision, err)
+			continue
+		}
+		if _, ok := migrated[value.Version]; ok {
+			continue
+		}
+		if err = putKey(store.VersionKey(resource, key, value.Version), string(kvs[0].Value)); err != nil {
+			return err
+		}
+		migrated[value.Version] = struct{}{}
+	}
+	log.Infof("etcd.MigrateVersionKeys, resource: %s, key: %s migrated successfully, %d versions", resource, key, len(migrated))
+	return nil
+}
+
+// listResourceKeys returns the name of every resource, version keys are excluded.
+func listResourceKeys(resource store.Resource) ([]string, error) {
+	kvs, err := store.List(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(kvs))
+	for _, kv := range kvs {
+		key := kv.Key
+		if strings.Contains(key, "/") {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// getWithRev reads key at the mvcc revision rev, if rev is 0, the latest revision is read.
+func getWithRev(resource store.Resource, key string, rev int64) ([]*mvccpb.KeyValue, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), store.OperationDuration)
+	defer cancel()
+	resp, err := cli.Get(ctx, store.ResourcePrefix(resource, key), clientv3.WithRev(rev))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, xerrors.NewNotExistInStoreError()
+	}
+	return resp.Kvs, nil
+}
+
+func putKey(key, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), store.OperationDuration)
+	defer cancel()
+	_, err := cli.Put(ctx, key, value)
+	return err
+}
@@ -0,0 +1,122 @@
+package etcd
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// etcdStore saves the state in etcd, it is required in cluster mode.
+type etcdStore struct {
+	cli *clientv3.Client
+}
+
+// NewStore returns a store backed by the etcd client, InitEtcdClient must be called first.
+func NewStore() store.Store {
+	return &etcdStore{cli: cli}
+}
+
+func (s *etcdStore) Put(ctx context.Context, key string, value []byte) error {
+	_, err := s.cli.Put(ctx, key, string(value))
+	return err
+}
+
+func (s *etcdStore) Get(ctx context.Context, key string) (*store.KeyValue, error) {
+	resp, err := s.cli.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, xerrors.NewNotExistInStoreError()
+	}
+	return &store.KeyValue{
+		Key:      string(resp.Kvs[0].Key),
+		Value:    resp.Kvs[0].Value,
+		Revision: resp.Kvs[0].ModRevision,
+	}, nil
+}
+
+func (s *etcdStore) List(ctx context.Context, prefix string) ([]*store.KeyValue, error) {
+	resp, err := s.cli.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+	kvs := make([]*store.KeyValue, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs = append(kvs, &store.KeyValue{
+			Key:      string(kv.Key),
+			Value:    kv.Value,
+			Revision: kv.ModRevision,
+		})
+	}
+	return kvs, nil
+}
+
+func (s *etcdStore) Del(ctx context.Context, key string) error {
+	_, err := s.cli.Delete(ctx, key)
+	return err
+}
+
+func (s *etcdStore) Txn(ctx context.Context, ops ...store.Op) error {
+	etcdOps := make([]clientv3.Op, 0, len(ops))
+	for _, op := range ops {
+		switch op.Type {
+		case store.OpPut:
+			etcdOps = append(etcdOps, clientv3.OpPut(op.Key, string(op.Value)))
+		case store.OpDel:
+			etcdOps = append(etcdOps, clientv3.OpDelete(op.Key))
+		case store.OpDelPrefix:
+			etcdOps = append(etcdOps, clientv3.OpDelete(op.Key, clientv3.WithPrefix()))
+		}
+	}
+	_, err := s.cli.Txn(ctx).Then(etcdOps...).Commit()
+	return err
+}
+
+func (s *etcdStore) CompareAndPut(ctx context.Context, key string, value []byte, rev int64) (bool, error) {
+	resp, err := s.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+		Then(clientv3.OpPut(key, string(value))).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (s *etcdStore) Watch(ctx context.Context, prefix string, rev int64, fn func(*store.Event)) error {
+	opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithPrevKV()}
+	if rev > 0 {
+		opts = append(opts, clientv3.WithRev(rev+1))
+	}
+
+	for resp := range s.cli.Watch(clientv3.WithRequireLeader(ctx), prefix, opts...) {
+		if resp.CompactRevision != 0 {
+			return errors.Wrapf(xerrors.NewRevisionCompactedError(), "revision: %d, compact revision: %d", rev, resp.CompactRevision)
+		}
+		if err := resp.Err(); err != nil {
+			return errors.Wrapf(err, "etcd.Watch failed, revision: %d", rev)
+		}
+		for _, ev := range resp.Events {
+			event := &store.Event{
+				Key:      string(ev.Kv.Key),
+				Value:    ev.Kv.Value,
+				Deleted:  ev.Type == clientv3.EventTypeDelete,
+				Revision: ev.Kv.ModRevision,
+			}
+			if ev.PrevKv != nil {
+				event.PrevValue = ev.PrevKv.Value
+			}
+			fn(event)
+		}
+	}
+	return ctx.Err()
+}
+
+func (s *etcdStore) Close() error {
+	return s.cli.Close()
+}
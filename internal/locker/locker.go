@@ -0,0 +1,70 @@
+package locker
+
+import (
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+var (
+	cluster bool
+	timeout time.Duration
+
+	local = &localLocker{locks: make(map[string]chan struct{})}
+)
+
+// InitLocker sets how the operation lock is acquired.
+// In cluster mode, locks are backed by etcd, so they also work across instances.
+// If lockTimeout is 0, a concurrent operation fails immediately,
+// otherwise it waits for the lock until timeout.
+func InitLocker(isCluster bool, lockTimeout time.Duration) {
+	cluster = isCluster
+	timeout = lockTimeout
+}
+
+// Lock acquires the operation lock of a replicaSet or volume,
+// the caller must call unlock after the operation is finished.
+func Lock(resource store.Resource, name string) (unlock func(), err error) {
+	if cluster {
+		return etcd.Lock(resource, name, timeout)
+	}
+	return local.lock(path.Join(resource, name))
+}
+
+type localLocker struct {
+	sync.Mutex
+
+	locks map[string]chan struct{}
+}
+
+func (l *localLocker) lock(key string) (func(), error) {
+	l.Lock()
+	ch, ok := l.locks[key]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		l.locks[key] = ch
+	}
+	l.Unlock()
+
+	if timeout == 0 {
+		select {
+		case ch <- struct{}{}:
+		default:
+			return nil, errors.Wrapf(xerrors.NewOperationInProgressError(), "key: %s", key)
+		}
+	} else {
+		select {
+		case ch <- struct{}{}:
+		case <-time.After(timeout):
+			return nil, errors.Wrapf(xerrors.NewOperationInProgressError(), "key: %s, timeout: %s", key, timeout)
+		}
+	}
+
+	return func() { <-ch }, nil
+}
@@ -0,0 +1,17 @@
+package models
+
+// Backup is the index of a backup archive, it holds all keys of the store.
+type Backup struct {
+	// FormatVersion is the version of the archive layout, an archive with unknown version can't be restored
+	FormatVersion int          `json:"formatVersion"`
+	CreateTime    string       `json:"createTime"`
+	WithMerges    bool         `json:"withMerges"`
+	Keys          []*BackupKey `json:"keys"`
+}
+
+// BackupKey is a key of the store, Key is relative to the common prefix,
+// so that a backup can be restored to another namespace.
+type BackupKey struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
@@ -14,23 +14,74 @@ type GpuPatch struct {
 	GpuCount int `json:"gpuCount"`
 }
 
+// VolumePatch replaces OldBind with NewBind, in PatchRequest.VolumePatches,
+// a patch without OldBind adds NewBind and a patch without NewBind removes OldBind.
 type VolumePatch struct {
 	OldBind *Bind `json:"oldBind"`
 	NewBind *Bind `json:"newBind"`
 }
 
+// EnvPatch sets the environment variables in Set, e.g. FOO=bar, and removes the variables named in Remove, e.g. FOO.
+type EnvPatch struct {
+	Set    []string `json:"set,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+// CmdPatch replaces the cmd and the entrypoint of the container, a null one is not changed, an empty one is cleared.
+type CmdPatch struct {
+	Cmd        []string `json:"cmd"`
+	Entrypoint []string `json:"entrypoint"`
+}
+
+// PortPatch adds and removes container ports, e.g. 8080 or 8080/udp, the protocol is tcp if it is omitted.
+// Every container port is bound to a host port applied from the port scheduler.
+type PortPatch struct {
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
 type PatchRequest struct {
+	// ImageName changes the image of the container, the files changed in the old container are kept
+	ImageName   string       `json:"imageName"`
 	GpuPatch    *GpuPatch    `json:"gpuPatch"`
 	VolumePatch *VolumePatch `json:"volumePatch"`
+	// VolumePatches add, remove or replace any number of binds
+	VolumePatches []VolumePatch `json:"volumePatches"`
+	EnvPatch      *EnvPatch     `json:"envPatch"`
+	CmdPatch      *CmdPatch     `json:"cmdPatch"`
+	PortPatch     *PortPatch    `json:"portPatch"`
 }
 
 type RollbackRequest struct {
 	Version int64 `json:"version"`
+	// WithVolumes restores the docker volumes bound to the version from its snapshot too,
+	// a new version of every volume is created with the data of that time
+	WithVolumes bool `json:"withVolumes"`
 }
 
 type ContainerExecute struct {
 	WorkDir string   `json:"workDir,omitempty"`
 	Cmd     []string `json:"cmd,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	User    string   `json:"user,omitempty"`
+	// TimeoutSeconds is how long the command can run before it is killed, 0 means the default of the server
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+	// Stdin is written to the standard input of the command, then the input is closed
+	Stdin string `json:"stdin,omitempty"`
+	// OutputLimit is how many bytes of stdout and stderr are kept each, the rest is dropped, 0 means no limit
+	OutputLimit int `json:"outputLimit,omitempty"`
+}
+
+// ExecResult is the result of a command executed in a container.
+type ExecResult struct {
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+	// StdoutTruncated and StderrTruncated are true if the output is longer than the OutputLimit
+	StdoutTruncated bool `json:"stdoutTruncated"`
+	StderrTruncated bool `json:"stderrTruncated"`
+	ExitCode        int  `json:"exitCode"`
+	// TimedOut is true if the command is killed because it runs longer than the timeout
+	TimedOut bool `json:"timedOut"`
 }
 
 type ContainerCommit struct {
@@ -40,5 +91,76 @@ type ContainerCommit struct {
 type ContainerHistoryItem struct {
 	Version    int64             `json:"version"`
 	CreateTime string            `json:"createTime"`
+	Pinned     bool              `json:"pinned"`
 	Status     EtcdContainerInfo `json:"status"`
 }
+
+// RetentionPolicy decides which historical versions of a replicaSet are kept.
+// A version is pruned only if it is neither one of the last KeepLast versions nor younger than KeepDays days,
+// 0 means the rule is disabled. The current version and pinned versions are never pruned.
+type RetentionPolicy struct {
+	KeepLast int     `json:"keepLast"`
+	KeepDays int     `json:"keepDays"`
+	Pinned   []int64 `json:"pinned"`
+}
+
+func (p *RetentionPolicy) IsPinned(version int64) bool {
+	for _, v := range p.Pinned {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetentionPolicy) Serialize() *string {
+	return EncodeRecord(KindRetentionPolicy, p)
+}
+
+// the types of ExecMessage
+const (
+	ExecMessageStdin  = "stdin"
+	ExecMessageResize = "resize"
+	ExecMessageExit   = "exit"
+)
+
+// ExecMessage is a text message of an interactive exec session over websocket,
+// the client sends stdin and resize, and the server sends exit when the command exits.
+// The binary messages are the raw input and output of the tty.
+type ExecMessage struct {
+	Type string `json:"type"`
+	// Data is the input of stdin
+	Data string `json:"data,omitempty"`
+	// Cols and Rows are the size of the terminal of resize
+	Cols uint `json:"cols,omitempty"`
+	Rows uint `json:"rows,omitempty"`
+	// ExitCode and Error are sent with exit, Error is set if the session fails
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+const (
+	LogStreamStdout = "stdout"
+	LogStreamStderr = "stderr"
+)
+
+// LogsRequest is the options to read the logs of a container.
+type LogsRequest struct {
+	// Version is the version of the replicaSet whose container is read, 0 means the latest version
+	Version int64
+	// Tail is the number of lines from the end of the logs, "all" or empty means all lines
+	Tail string
+	// Since and Until are a RFC 3339 date, a unix timestamp or a duration relative to now, e.g. 10m
+	Since      string
+	Until      string
+	Timestamps bool
+	Follow     bool
+}
+
+// LogLine is a line of the logs of a container.
+type LogLine struct {
+	Stream string `json:"stream"`
+	// Timestamp is set only if the timestamps are requested
+	Timestamp string `json:"timestamp,omitempty"`
+	Line      string `json:"line"`
+}
@@ -1,8 +1,6 @@
 package models
 
 import (
-	"encoding/json"
-
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/api/types/volume"
@@ -17,12 +15,34 @@ type EtcdContainerInfo struct {
 	NetworkingConfig *network.NetworkingConfig `json:"networkingConfig"`
 	Platform         *ocispec.Platform         `json:"platform"`
 	ContainerName    string                    `json:"containerName"`
+	// ImageChange is set if the image is changed by the patch that creates this version
+	ImageChange *ImageChange `json:"imageChange,omitempty"`
+}
+
+// maxImageChangeConflicts is how many conflicts are recorded in an ImageChange.
+const maxImageChangeConflicts = 1000
+
+// ImageChange records that the image of a replicaSet is changed from Old to New,
+// the writable layer of the old container is replayed on top of the new image.
+type ImageChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+	// Conflicts are the paths changed by the old container that are changed by the new image too,
+	// the files of the old container are kept, only the first 1000 paths are recorded
+	Conflicts     []string `json:"conflicts"`
+	ConflictCount int      `json:"conflictCount"`
+}
+
+func (c *ImageChange) SetConflicts(conflicts []string) {
+	c.ConflictCount = len(conflicts)
+	if len(conflicts) > maxImageChangeConflicts {
+		conflicts = conflicts[:maxImageChangeConflicts]
+	}
+	c.Conflicts = conflicts
 }
 
 func (i *EtcdContainerInfo) Serialize() *string {
-	bytes, _ := json.Marshal(i)
-	tmp := string(bytes)
-	return &tmp
+	return EncodeRecord(KindContainer, i)
 }
 
 type EtcdVolumeInfo struct {
@@ -32,7 +52,5 @@ type EtcdVolumeInfo struct {
 }
 
 func (i *EtcdVolumeInfo) Serialize() *string {
-	bytes, _ := json.Marshal(i)
-	tmp := string(bytes)
-	return &tmp
+	return EncodeRecord(KindVolume, i)
 }
@@ -0,0 +1,46 @@
+package models
+
+type EventType = string
+
+const (
+	ReplicaSetCreated   EventType = "replicaSet.created"
+	ReplicaSetPatched   EventType = "replicaSet.patched"
+	ReplicaSetStopped   EventType = "replicaSet.stopped"
+	ReplicaSetPaused    EventType = "replicaSet.paused"
+	ReplicaSetContinued EventType = "replicaSet.continued"
+	ReplicaSetDeleted   EventType = "replicaSet.deleted"
+	VolumeCreated       EventType = "volume.created"
+	VolumeResized       EventType = "volume.resized"
+	VolumeDeleted       EventType = "volume.deleted"
+	GpuAllocated        EventType = "gpu.allocated"
+	GpuReleased         EventType = "gpu.released"
+)
+
+// Event is a change of replicaSet, volume or resource,
+// Revision is the etcd revision of the change, it can be used to resume watching after disconnects.
+type Event struct {
+	Type     EventType `json:"type"`
+	Name     string    `json:"name,omitempty"`
+	Version  int64     `json:"version,omitempty"`
+	Gpus     []string  `json:"gpus,omitempty"`
+	Revision int64     `json:"revision"`
+}
+
+type ContainerStateType = string
+
+const (
+	ContainerStopped ContainerStateType = "stopped"
+	ContainerPaused  ContainerStateType = "paused"
+	ContainerRunning ContainerStateType = "running"
+)
+
+// ContainerState is saved when the current version of the replicaSet is stopped, paused or continued.
+type ContainerState struct {
+	State      ContainerStateType `json:"state"`
+	Version    int64              `json:"version"`
+	UpdateTime string             `json:"updateTime"`
+}
+
+func (s *ContainerState) Serialize() *string {
+	return EncodeRecord(KindContainerState, s)
+}
@@ -0,0 +1,21 @@
+package models
+
+// FileInfo is the information of a file in a container.
+type FileInfo struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	Mode  string `json:"mode"`
+	IsDir bool   `json:"isDir"`
+	// ModTime is formatted as RFC 3339
+	ModTime string `json:"modTime"`
+	// LinkTarget is the target of a symbolic link
+	LinkTarget string `json:"linkTarget,omitempty"`
+}
+
+// FileList is the files in a directory of a container.
+type FileList struct {
+	Path    string      `json:"path"`
+	Entries []*FileInfo `json:"entries"`
+	// Truncated is true if the directory has more files than the entries
+	Truncated bool `json:"truncated"`
+}
@@ -0,0 +1,62 @@
+package models
+
+// OperationPhase is the step that a long-running operation is doing.
+type OperationPhase = string
+
+const (
+	PhasePending    OperationPhase = "pending"
+	PhaseAllocating OperationPhase = "allocating"
+	PhaseCreating   OperationPhase = "creating"
+	PhaseCopying    OperationPhase = "copying"
+	PhaseCleaningUp OperationPhase = "cleaningUp"
+	PhaseDone       OperationPhase = "done"
+)
+
+// the types of operations that can be run with `?async=true`
+const (
+	OperationPatch           = "patch"
+	OperationRollback        = "rollback"
+	OperationRestart         = "restart"
+	OperationCommit          = "commit"
+	OperationPatchVolumeSize = "patchVolumeSize"
+)
+
+// OperationStatus is the state of a long-running operation.
+type OperationStatus = string
+
+const (
+	OperationRunning   OperationStatus = "running"
+	OperationSucceeded OperationStatus = "succeeded"
+	OperationFailed    OperationStatus = "failed"
+)
+
+// Operation is a long-running request, such as patch, restart, rollback, commit or volume resize,
+// that is run in the background with `?async=true`, so that clients can poll it instead of waiting for the response.
+type Operation struct {
+	ID string `json:"id"`
+	// Type is the kind of request, e.g. patch, restart
+	Type string `json:"type"`
+	// Resource and Name are the replicaSet or volume that the operation changes
+	Resource string          `json:"resource"`
+	Name     string          `json:"name"`
+	Phase    OperationPhase  `json:"phase"`
+	Status   OperationStatus `json:"status"`
+	// Owner is the advertised address of the instance that runs the operation
+	Owner string `json:"owner,omitempty"`
+	// the files copied to the new container or volume
+	FilesCopied int64 `json:"filesCopied"`
+	TotalFiles  int64 `json:"totalFiles"`
+	BytesCopied int64 `json:"bytesCopied"`
+	TotalBytes  int64 `json:"totalBytes"`
+	// Result is the data that the request responds when it succeeds
+	Result interface{} `json:"result,omitempty"`
+	// Code and Error are the code that the request responds and the error when it fails
+	Code       int64  `json:"code"`
+	Error      string `json:"error,omitempty"`
+	CreateTime string `json:"createTime"`
+	UpdateTime string `json:"updateTime"`
+}
+
+func (o *Operation) Serialize() *string {
+	return EncodeRecord(KindOperation, o)
+}
@@ -0,0 +1,60 @@
+package models
+
+// the sources of the files copied to the new container
+const (
+	CopyFromUpperDir  = "upperDir"
+	CopyFromMergedDir = "mergedDir"
+	CopyFromSnapshot  = "snapshot"
+)
+
+// Plan is what a patch, rollback or restart of a replicaSet would do, it is computed by `?dryRun=true`
+// without changing docker or the schedulers.
+type Plan struct {
+	Type       string `json:"type"`
+	ReplicaSet string `json:"replicaSet"`
+	// ContainerName is the current container, it is replaced by NewContainerName
+	ContainerName    string       `json:"containerName"`
+	NewContainerName string       `json:"newContainerName"`
+	Gpus             GpuPlan      `json:"gpus"`
+	Binds            []BindChange `json:"binds"`
+	Ports            PortPlan     `json:"ports"`
+	Copy             CopyPlan     `json:"copy"`
+	// ImageChange is set if the image is changed by the patch, the conflicts are known after the patch
+	ImageChange *ImageChange `json:"imageChange,omitempty"`
+	// Feasible is false if the operation would fail, Problems tell why
+	Feasible bool     `json:"feasible"`
+	Problems []string `json:"problems"`
+}
+
+type GpuPlan struct {
+	// Current are the gpus used by the current container
+	Current []string `json:"current"`
+	// Acquire is the number of gpus to be acquired from the scheduler
+	Acquire int `json:"acquire"`
+	// Release are the gpus to be released to the scheduler
+	Release []string `json:"release"`
+	// Available is the number of free gpus now
+	Available int `json:"available"`
+}
+
+// BindChange is a bind that is changed, Old is empty if it is added, New is empty if it is removed.
+type BindChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+type PortPlan struct {
+	// ContainerPorts are the container ports to be bound to newly acquired host ports
+	ContainerPorts []string `json:"containerPorts"`
+	// Release are the host ports of the current container, they are released after it is replaced
+	Release []string `json:"release"`
+	// Available is the number of free ports now
+	Available int `json:"available"`
+}
+
+type CopyPlan struct {
+	// Source is where the files of the new container are copied from, optional: upperDir, mergedDir, snapshot
+	Source string `json:"source"`
+	// Size is the size of the files to be copied in bytes
+	Size int64 `json:"size"`
+}
@@ -0,0 +1,132 @@
+package models
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// Kind is the type of record saved in the store.
+type Kind = string
+
+const (
+	KindContainer       Kind = "container"
+	KindVolume          Kind = "volume"
+	KindContainerState  Kind = "containerState"
+	KindRetentionPolicy Kind = "retentionPolicy"
+	KindGpuStatus       Kind = "gpuStatus"
+	KindPortSet         Kind = "portSet"
+	KindVersionMap      Kind = "versionMap"
+	KindMergeMap        Kind = "mergeMap"
+	KindSnapshot        Kind = "snapshot"
+	KindOperation       Kind = "operation"
+)
+
+// Record is the envelope of every value saved in the store, Data is the JSON of the model
+// in the layout of SchemaVersion. Values saved before the envelope was introduced are
+// the bare JSON of the model, they are treated as schema version 0.
+type Record struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Kind          Kind            `json:"kind"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// Migration converts the data of a record from schema version N to N+1.
+type Migration func(data json.RawMessage) (json.RawMessage, error)
+
+// migrations of every kind, migrations[kind][N] upgrades a record from schema version N to N+1,
+// so the current schema version of a kind is the number of its migrations.
+// When the layout of a model changes, append a migration here instead of changing the old ones,
+// the old records in the store and in the backups are upgraded by it when they are decoded.
+var migrations = map[Kind][]Migration{
+	KindContainer:       {fromBare},
+	KindVolume:          {fromBare},
+	KindContainerState:  {fromBare},
+	KindRetentionPolicy: {fromBare},
+	KindGpuStatus:       {fromBare},
+	KindPortSet:         {fromBare},
+	KindVersionMap:      {fromBare},
+	KindMergeMap:        {fromBare},
+	KindSnapshot:        {fromBare},
+	KindOperation:       {fromBare},
+}
+
+// fromBare is the migration from schema version 0, the bare JSON is already the data.
+func fromBare(data json.RawMessage) (json.RawMessage, error) {
+	return data, nil
+}
+
+// SchemaVersion returns the current schema version of kind.
+func SchemaVersion(kind Kind) int {
+	return len(migrations[kind])
+}
+
+// SchemaVersions returns the current schema version of every kind.
+func SchemaVersions() map[Kind]int {
+	versions := make(map[Kind]int, len(migrations))
+	for kind := range migrations {
+		versions[kind] = SchemaVersion(kind)
+	}
+	return versions
+}
+
+// EncodeRecord wraps v in the envelope of the current schema version of kind.
+func EncodeRecord(kind Kind, v interface{}) *string {
+	data, _ := json.Marshal(v)
+	bytes, _ := json.Marshal(&Record{
+		SchemaVersion: SchemaVersion(kind),
+		Kind:          kind,
+		Data:          data,
+	})
+	tmp := string(bytes)
+	return &tmp
+}
+
+// DecodeRecord upgrades the record to the current schema version of kind and unmarshals its data into v.
+func DecodeRecord(kind Kind, bytes []byte, v interface{}) error {
+	record, _, err := UpgradeRecord(kind, bytes)
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(json.Unmarshal(record.Data, v), "json.Unmarshal failed, kind: %s", kind)
+}
+
+// UpgradeRecord runs the migrations of kind on the record, upgraded is false if it is already the current schema version.
+// A record of a newer schema version is rejected, it is written by a newer gpu-docker-api and can't be understood.
+func UpgradeRecord(kind Kind, bytes []byte) (record *Record, upgraded bool, err error) {
+	current := SchemaVersion(kind)
+	if current == 0 {
+		return nil, false, errors.Errorf("unknown record kind: %s", kind)
+	}
+
+	record = &Record{}
+	if err = json.Unmarshal(bytes, record); err != nil {
+		return nil, false, errors.Wrapf(err, "json.Unmarshal failed, kind: %s, value: %s", kind, bytes)
+	}
+	if record.SchemaVersion == 0 || len(record.Kind) == 0 {
+		record = &Record{Kind: kind, Data: bytes}
+	}
+	if record.Kind != kind {
+		return nil, false, errors.Errorf("record kind mismatch, expected: %s, got: %s", kind, record.Kind)
+	}
+	if record.SchemaVersion > current {
+		return nil, false, errors.Errorf("schema version %d of %s is newer than the supported version %d",
+			record.SchemaVersion, kind, current)
+	}
+
+	for version := record.SchemaVersion; version < current; version++ {
+		if record.Data, err = migrations[kind][version](record.Data); err != nil {
+			return nil, false, errors.WithMessagef(err, "failed to migrate %s from schema version %d to %d", kind, version, version+1)
+		}
+		upgraded = true
+	}
+	record.SchemaVersion = current
+	return record, upgraded, nil
+}
+
+// Serialize returns the JSON of the record.
+func (r *Record) Serialize() *string {
+	bytes, _ := json.Marshal(r)
+	tmp := string(bytes)
+	return &tmp
+}
@@ -0,0 +1,154 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// bareRecords are values of every kind as they were saved before the envelope was introduced.
+var bareRecords = map[Kind]string{
+	KindContainer:       `{"version":3,"createTime":"2024-01-02 15:04:05","config":{"Image":"ubuntu:22.04"},"containerName":"foo-3"}`,
+	KindVolume:          `{"version":2,"createTime":"2024-01-02 15:04:05","opt":{"Name":"bar-2","Driver":"local"}}`,
+	KindContainerState:  `{"state":"running","version":3,"updateTime":"2024-01-02 15:04:05"}`,
+	KindRetentionPolicy: `{"keepLast":5,"keepDays":7,"pinned":[1,3]}`,
+	KindGpuStatus:       `{"availableGpuNums":1,"gpuStatusMap":{"GPU-0":1,"GPU-1":0}}`,
+	KindPortSet:         `{"StartPort":40000,"EndPort":40010,"AvailableCount":9,"UsedPortSet":{"40001":{}}}`,
+	KindVersionMap:      `{"foo":3,"bar":2}`,
+	KindMergeMap:        `{"foo-3":"merges/foo-3"}`,
+	KindSnapshot:        `{"replicaSet":"foo","version":3,"location":"merges/foo-3","size":1024,"storedSize":512,"createTime":"2024-01-02 15:04:05"}`,
+	KindOperation:       `{"id":"op-1","type":"commit","resource":"containers","name":"foo","phase":"copying","status":"running","code":0}`,
+}
+
+func TestBareRecordsCoverEveryKind(t *testing.T) {
+	for kind := range migrations {
+		if _, ok := bareRecords[kind]; !ok {
+			t.Errorf("no bare record of kind %s", kind)
+		}
+	}
+}
+
+func TestUpgradeRecord(t *testing.T) {
+	for kind, bare := range bareRecords {
+		t.Run(kind, func(t *testing.T) {
+			record, upgraded, err := UpgradeRecord(kind, []byte(bare))
+			if err != nil {
+				t.Fatalf("UpgradeRecord of the bare record failed: %v", err)
+			}
+			if !upgraded || record.SchemaVersion != SchemaVersion(kind) || record.Kind != kind {
+				t.Fatalf("got upgraded: %t, schema version: %d, kind: %s, want true, %d, %s",
+					upgraded, record.SchemaVersion, record.Kind, SchemaVersion(kind), kind)
+			}
+			assertSameJSON(t, record.Data, bare)
+
+			// the upgraded record is the current envelope, it is not upgraded again
+			current := *record.Serialize()
+			if record, upgraded, err = UpgradeRecord(kind, []byte(current)); err != nil {
+				t.Fatalf("UpgradeRecord of the current record failed: %v", err)
+			}
+			if upgraded || record.SchemaVersion != SchemaVersion(kind) {
+				t.Fatalf("got upgraded: %t, schema version: %d, want false, %d", upgraded, record.SchemaVersion, SchemaVersion(kind))
+			}
+			assertSameJSON(t, record.Data, bare)
+		})
+	}
+}
+
+func TestDecodeRecord(t *testing.T) {
+	for kind, bare := range bareRecords {
+		t.Run(kind, func(t *testing.T) {
+			var want interface{}
+			if err := json.Unmarshal([]byte(bare), &want); err != nil {
+				t.Fatalf("json.Unmarshal failed: %v", err)
+			}
+			// the bare record and the envelope of the same data decode to the same value
+			for _, value := range []string{bare, *EncodeRecord(kind, want)} {
+				var got interface{}
+				if err := DecodeRecord(kind, []byte(value), &got); err != nil {
+					t.Fatalf("DecodeRecord of %s failed: %v", value, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("DecodeRecord of %s got %v, want %v", value, got, want)
+				}
+			}
+		})
+	}
+
+	// the bare records decode into their models
+	var info EtcdContainerInfo
+	if err := DecodeRecord(KindContainer, []byte(bareRecords[KindContainer]), &info); err != nil {
+		t.Fatalf("DecodeRecord failed: %v", err)
+	}
+	if info.Version != 3 || info.ContainerName != "foo-3" || info.Config.Image != "ubuntu:22.04" {
+		t.Fatalf("got %+v, want version 3 of foo-3 with image ubuntu:22.04", info)
+	}
+	var policy RetentionPolicy
+	if err := DecodeRecord(KindRetentionPolicy, []byte(bareRecords[KindRetentionPolicy]), &policy); err != nil {
+		t.Fatalf("DecodeRecord failed: %v", err)
+	}
+	if policy.KeepLast != 5 || policy.KeepDays != 7 || !policy.IsPinned(3) {
+		t.Fatalf("got %+v, want keepLast 5, keepDays 7 and version 3 pinned", policy)
+	}
+}
+
+func TestUpgradeRecordErrors(t *testing.T) {
+	newer := SchemaVersion(KindContainer) + 1
+	for _, tc := range []struct {
+		name  string
+		kind  Kind
+		value string
+		err   string
+	}{
+		{
+			name:  "KindMismatch",
+			kind:  KindVolume,
+			value: *EncodeRecord(KindContainer, json.RawMessage(bareRecords[KindContainer])),
+			err:   "record kind mismatch",
+		},
+		{
+			name:  "NewerSchemaVersion",
+			kind:  KindContainer,
+			value: fmt.Sprintf(`{"schemaVersion":%d,"kind":"container","data":%s}`, newer, bareRecords[KindContainer]),
+			err:   fmt.Sprintf("schema version %d of container is newer", newer),
+		},
+		{
+			name:  "UnknownKind",
+			kind:  "unknown",
+			value: `{}`,
+			err:   "unknown record kind",
+		},
+		{
+			name:  "InvalidJSON",
+			kind:  KindContainer,
+			value: `{"version":`,
+			err:   "json.Unmarshal failed",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := UpgradeRecord(tc.kind, []byte(tc.value))
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("UpgradeRecord returned %v, want an error containing %q", err, tc.err)
+			}
+			var v interface{}
+			if err = DecodeRecord(tc.kind, []byte(tc.value), &v); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("DecodeRecord returned %v, want an error containing %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func assertSameJSON(t *testing.T, got json.RawMessage, want string) {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("json.Unmarshal of %s failed: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("json.Unmarshal of %s failed: %v", want, err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Fatalf("got data %s, want %s", got, want)
+	}
+}
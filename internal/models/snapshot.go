@@ -0,0 +1,55 @@
+package models
+
+// The layers of a container that are saved by a snapshot.
+const (
+	// SnapshotLayerUpper is the writable layer of overlay2, the files deleted from the image are saved as whiteouts
+	SnapshotLayerUpper = "upper"
+	// SnapshotLayerMerged is all files seen by the container, it is saved if the storage driver is not overlay2
+	SnapshotLayerMerged = "merged"
+)
+
+// Snapshot is the copy of the files of a replicaSet version, it is saved before the container of
+// that version is replaced, so that the files can be brought back by rollback.
+// The files are compressed and deduplicated across all snapshots.
+type Snapshot struct {
+	ReplicaSet string `json:"replicaSet"`
+	Version    int64  `json:"version"`
+	// Location is where the manifest of the snapshot is saved, a local path or an s3 url
+	Location string `json:"location"`
+	// Size is the total size of the files in bytes
+	Size int64 `json:"size"`
+	// StoredSize is the size of the compressed contents stored by the snapshot,
+	// the contents which are already stored by other snapshots are not counted
+	StoredSize int64  `json:"storedSize"`
+	CreateTime string `json:"createTime"`
+	// Layer is the layer of the container that is saved, SnapshotLayerUpper or SnapshotLayerMerged,
+	// it is empty for the snapshots saved by older releases, which are merged layers
+	Layer string `json:"layer,omitempty"`
+	// Image is the ID of the image of the container, an upper layer only makes sense on top of it
+	Image string `json:"image,omitempty"`
+	// Volumes are the snapshots of the docker volumes bound to the version, they are saved if --snapshotVolumes is set
+	Volumes []*VolumeSnapshot `json:"volumes,omitempty"`
+}
+
+func (s *Snapshot) Serialize() *string {
+	return EncodeRecord(KindSnapshot, s)
+}
+
+// VolumeSnapshot is the copy of the data of a docker volume bound to a replicaSet version,
+// so that the volume can be restored together with the version by a rollback.
+type VolumeSnapshot struct {
+	// Volume is the name of the volume with its version, e.g. bar-2
+	Volume     string `json:"volume"`
+	Location   string `json:"location"`
+	Size       int64  `json:"size"`
+	StoredSize int64  `json:"storedSize"`
+}
+
+// SnapshotGC is the result of a snapshot garbage collection.
+type SnapshotGC struct {
+	// Removed are the snapshots of deleted replicaSets or pruned versions
+	Removed []*Snapshot `json:"removed"`
+	// Recorded are the snapshots found on disk without a record, e.g. saved by older releases
+	Recorded  []*Snapshot `json:"recorded"`
+	FreedSize int64       `json:"freedSize"`
+}
@@ -0,0 +1,170 @@
+package routers
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/services"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+type AdminHandler struct {
+	// Reload reloads the in-memory state from the store after it is restored
+	Reload func() error
+}
+
+var as services.AdminService
+
+func (ah *AdminHandler) RegisterRoute(g *gin.RouterGroup) {
+	// download a tar.gz archive of all keys in the store,
+	// with `?merges=true`, the merge snapshots on disk are also archived
+	g.GET("/admin/backup", ah.Backup)
+	// load an archive created by backup into an empty store, the archive is the request body
+	g.POST("/admin/restore", ah.Restore)
+
+	// get the operations that are not written to the store yet, and the dead letters
+	g.GET("/admin/workQueue", ah.WorkQueue)
+	// put all dead letters back to the work queue
+	g.POST("/admin/workQueue/deadLetters/retry", ah.RetryDeadLetters)
+	// put a dead letter back to the work queue
+	g.POST("/admin/workQueue/deadLetters/:id/retry", ah.RetryDeadLetter)
+
+	// get the merge snapshots of all replicaSets and their total size
+	g.GET("/admin/snapshots", ah.Snapshots)
+	// remove the merge snapshots of deleted replicaSets and pruned versions
+	g.POST("/admin/snapshots/gc", ah.CollectSnapshots)
+}
+
+func (ah *AdminHandler) Backup(c *gin.Context) {
+	withMerges, _ := strconv.ParseBool(c.Query("merges"))
+
+	filename := fmt.Sprintf("gpu-docker-api-backup-%s.tar.gz", time.Now().Format("20060102150405"))
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	if err := as.Backup(c.Writer, withMerges); err != nil {
+		log.Errorf("services.Backup failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		// the archive is partially sent, the client can only notice it by the broken archive
+		if c.Writer.Written() {
+			c.Abort()
+			return
+		}
+		c.Header("Content-Type", "")
+		c.Header("Content-Disposition", "")
+		ResponseError(c, CodeAdminBackupFailed)
+	}
+}
+
+func (ah *AdminHandler) Restore(c *gin.Context) {
+	if err := as.Restore(c.Request.Body); err != nil {
+		log.Errorf("services.Restore failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsStoreNotEmptyError(err) {
+			ResponseError(c, CodeAdminRestoreStoreNotEmpty)
+			return
+		}
+		ResponseError(c, CodeAdminRestoreFailed)
+		return
+	}
+
+	if err := ah.Reload(); err != nil {
+		log.Errorf("failed to reload state after restore, error: %+v", err)
+		ResponseError(c, CodeAdminRestoreFailed)
+		return
+	}
+	ResponseSuccess(c, nil)
+}
+
+func (ah *AdminHandler) WorkQueue(c *gin.Context) {
+	pending, deadLetters, err := as.WorkQueue()
+	if err != nil {
+		log.Errorf("services.WorkQueue failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeAdminWorkQueueGetFailed)
+		return
+	}
+	ResponseSuccess(c, gin.H{
+		"pending":     pending,
+		"deadLetters": deadLetters,
+	})
+}
+
+func (ah *AdminHandler) RetryDeadLetters(c *gin.Context) {
+	retried, err := as.RetryDeadLetters()
+	if err != nil {
+		log.Errorf("services.RetryDeadLetters failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeAdminDeadLetterRetryFailed)
+		return
+	}
+	ResponseSuccess(c, gin.H{
+		"retried": retried,
+	})
+}
+
+func (ah *AdminHandler) RetryDeadLetter(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		log.Errorf("failed to retry dead letter, id: %s is invalid", c.Param("id"))
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	retried, err := as.RetryDeadLetters(id)
+	if err != nil {
+		log.Errorf("services.RetryDeadLetters failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsDeadLetterNotFoundError(err) {
+			ResponseError(c, CodeAdminDeadLetterNotFound)
+			return
+		}
+		if xerrors.IsDeadLetterOutOfDateError(err) {
+			ResponseError(c, CodeAdminDeadLetterOutOfDate)
+			return
+		}
+		ResponseError(c, CodeAdminDeadLetterRetryFailed)
+		return
+	}
+	ResponseSuccess(c, gin.H{
+		"retried": retried,
+	})
+}
+
+func (ah *AdminHandler) Snapshots(c *gin.Context) {
+	snapshots, err := as.Snapshots()
+	if err != nil {
+		log.Errorf("services.Snapshots failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeAdminGetSnapshotsFailed)
+		return
+	}
+
+	var totalSize int64
+	for _, s := range snapshots {
+		totalSize += s.Size
+	}
+	ResponseSuccess(c, gin.H{
+		"snapshots": snapshots,
+		"totalSize": totalSize,
+	})
+}
+
+func (ah *AdminHandler) CollectSnapshots(c *gin.Context) {
+	gc, err := as.CollectSnapshots()
+	if err != nil {
+		log.Errorf("services.CollectSnapshots failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsSnapshotLockedError(err) {
+			ResponseError(c, CodeAdminSnapshotsLocked)
+			return
+		}
+		ResponseError(c, CodeAdminCollectSnapshotsFailed)
+		return
+	}
+	ResponseSuccess(c, gc)
+}
@@ -41,6 +41,40 @@ const (
 	CodeVolumeGetInfoFailed                          ResCode = 1033
 	CodeVolumeGetHistoryFailed                       ResCode = 1034
 	CodeVolumePatchFailed                            ResCode = 1035
+	CodeNotLeader                                    ResCode = 1036
+	CodeOperationInProgress                          ResCode = 1037
+	CodeContainerGetRetentionFailed                  ResCode = 1038
+	CodeContainerSetRetentionFailed                  ResCode = 1039
+	CodeContainerRetentionInvalid                    ResCode = 1040
+	CodeContainerPinFailed                           ResCode = 1041
+	CodeWatchFailed                                  ResCode = 1042
+	CodeWatchRevisionCompacted                       ResCode = 1043
+	CodeAdminBackupFailed                            ResCode = 1044
+	CodeAdminRestoreFailed                           ResCode = 1045
+	CodeAdminRestoreStoreNotEmpty                    ResCode = 1046
+	CodeAdminWorkQueueGetFailed                      ResCode = 1047
+	CodeAdminDeadLetterRetryFailed                   ResCode = 1048
+	CodeAdminDeadLetterNotFound                      ResCode = 1049
+	CodeSyncWritesFailed                             ResCode = 1050
+	CodeContainerGetSnapshotsFailed                  ResCode = 1051
+	CodeContainerDeleteSnapshotFailed                ResCode = 1052
+	CodeContainerSnapshotNotFound                    ResCode = 1053
+	CodeAdminGetSnapshotsFailed                      ResCode = 1054
+	CodeAdminCollectSnapshotsFailed                  ResCode = 1055
+	CodeOperationGetFailed                           ResCode = 1056
+	CodeOperationNotFound                            ResCode = 1057
+	CodeOperationListFailed                          ResCode = 1058
+	CodeContainerPlanFailed                          ResCode = 1059
+	CodeContainerImageNotFound                       ResCode = 1060
+	CodeContainerLogsFailed                          ResCode = 1061
+	CodeContainerVersionNotFound                     ResCode = 1062
+	CodeContainerFileNotFound                        ResCode = 1063
+	CodeContainerFileTooLarge                        ResCode = 1064
+	CodeContainerUploadFileFailed                    ResCode = 1065
+	CodeContainerDownloadFileFailed                  ResCode = 1066
+	CodeContainerStatFileFailed                      ResCode = 1067
+	CodeAdminDeadLetterOutOfDate                     ResCode = 1068
+	CodeAdminSnapshotsLocked                         ResCode = 1069
 )
 
 var codeMsgMap = map[ResCode]string{
@@ -82,6 +116,40 @@ var codeMsgMap = map[ResCode]string{
 	CodeVolumeGetInfoFailed:                          "Failed to get volume info",
 	CodeVolumeGetHistoryFailed:                       "Failed to get volume history",
 	CodeVolumePatchFailed:                            "Failed to patch volume",
+	CodeNotLeader:                                    "This instance is not the leader and the leader is unknown, please try again later",
+	CodeOperationInProgress:                          "Another operation on the same resource is in progress, please try again later",
+	CodeContainerGetRetentionFailed:                  "Failed to get container retention policy",
+	CodeContainerSetRetentionFailed:                  "Failed to set container retention policy",
+	CodeContainerRetentionInvalid:                    "Container retention keepLast and keepDays must be greater than or equal to 0",
+	CodeContainerPinFailed:                           "Failed to pin or unpin container version",
+	CodeWatchFailed:                                  "Failed to watch changes",
+	CodeWatchRevisionCompacted:                       "The revision to resume from has been compacted, please get the latest state and watch again",
+	CodeAdminBackupFailed:                            "Failed to backup",
+	CodeAdminRestoreFailed:                           "Failed to restore",
+	CodeAdminRestoreStoreNotEmpty:                    "Failed to restore, the store must not contain any replicaSet, volume or their versions",
+	CodeAdminWorkQueueGetFailed:                      "Failed to get work queue",
+	CodeAdminDeadLetterRetryFailed:                   "Failed to retry dead letter",
+	CodeAdminDeadLetterNotFound:                      "Dead letter not found",
+	CodeSyncWritesFailed:                             "The operation is done, but its writes are not saved to the store in time",
+	CodeContainerGetSnapshotsFailed:                  "Failed to get container snapshots",
+	CodeContainerDeleteSnapshotFailed:                "Failed to delete container snapshot",
+	CodeContainerSnapshotNotFound:                    "Container snapshot of the version not found, it may be deleted or pruned",
+	CodeAdminGetSnapshotsFailed:                      "Failed to get snapshots",
+	CodeAdminCollectSnapshotsFailed:                  "Failed to collect snapshots",
+	CodeOperationGetFailed:                           "Failed to get operation",
+	CodeOperationNotFound:                            "Operation not found, it may be expired",
+	CodeOperationListFailed:                          "Failed to list operations",
+	CodeContainerPlanFailed:                          "Failed to plan container patch, rollback or restart",
+	CodeContainerImageNotFound:                       "Image not found, pull it first",
+	CodeContainerLogsFailed:                          "Failed to get container logs",
+	CodeContainerVersionNotFound:                     "The container of the version does not exist",
+	CodeContainerFileNotFound:                        "File not found in container",
+	CodeContainerFileTooLarge:                        "File is larger than the size limit",
+	CodeContainerUploadFileFailed:                    "Failed to upload file to container",
+	CodeContainerDownloadFileFailed:                  "Failed to download file from container",
+	CodeContainerStatFileFailed:                      "Failed to get file info of container",
+	CodeAdminDeadLetterOutOfDate:                     "Dead letter is out of date, a later write of the same resource is saved",
+	CodeAdminSnapshotsLocked:                         "Snapshots are being saved or collected, please try again later",
 }
 
 func (c ResCode) Msg() string {
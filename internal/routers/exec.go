@@ -0,0 +1,188 @@
+package routers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/services"
+)
+
+const (
+	// execPingInterval is how often a ping is sent to keep the websocket of an idle exec session alive
+	execPingInterval = 30 * time.Second
+	execWriteTimeout = 10 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// every origin is allowed, the same as Cors
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// execConn serializes the writes to the websocket, which are made by the output, the pings and the exit.
+type execConn struct {
+	sync.Mutex
+	*websocket.Conn
+}
+
+func (ec *execConn) write(messageType int, data []byte) error {
+	ec.Lock()
+	defer ec.Unlock()
+	_ = ec.SetWriteDeadline(time.Now().Add(execWriteTimeout))
+	return ec.WriteMessage(messageType, data)
+}
+
+func (ec *execConn) writeJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ec.write(websocket.TextMessage, data)
+}
+
+// ExecWebSocket runs an interactive command with a tty in the latest version of the container over websocket,
+// e.g. `GET /api/v1/replicaSet/foo/exec/ws?cmd=/bin/bash&rows=24&cols=80`, `cmd` can be repeated for the arguments.
+// The binary messages are the raw input and output of the tty, the text messages are models.ExecMessage.
+// The session is closed when the command exits or the websocket is closed.
+func (rh *ReplicaSetHandler) ExecWebSocket(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to exec container, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	rows, errRows := strconv.ParseUint(c.DefaultQuery("rows", "0"), 10, 32)
+	cols, errCols := strconv.ParseUint(c.DefaultQuery("cols", "0"), 10, 32)
+	if errRows != nil || errCols != nil {
+		log.Errorf("failed to exec container, rows: %s or cols: %s is invalid", c.Query("rows"), c.Query("cols"))
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+	spec := models.ContainerExecute{
+		WorkDir: c.Query("workDir"),
+		Cmd:     c.QueryArray("cmd"),
+	}
+
+	// the session is started before upgrading, so that a failure is responded as usual
+	session, err := cs.StartExecSession(name, &spec, uint(rows), uint(cols))
+	if err != nil {
+		log.Errorf("services.StartExecSession failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeContainerExecuteFailed)
+		return
+	}
+	defer session.Close()
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// the upgrader has responded the error
+		log.Errorf("failed to upgrade exec session of container: %s to websocket, error: %v", name, err)
+		return
+	}
+	defer conn.Close()
+	ec := &execConn{Conn: conn}
+
+	done := make(chan struct{})
+	go rh.pumpExecOutput(ec, session, done)
+	go func() {
+		ticker := time.NewTicker(execPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := ec.write(websocket.PingMessage, nil); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	// the input is read until the websocket is closed, it is closed after the exit is sent
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if messageType == websocket.BinaryMessage {
+			if _, err = session.Write(data); err != nil {
+				break
+			}
+			continue
+		}
+
+		var msg models.ExecMessage
+		if err = json.Unmarshal(data, &msg); err != nil {
+			log.Errorf("exec session: %s of container: %s, invalid message: %s", session.ID, name, data)
+			continue
+		}
+		switch msg.Type {
+		case models.ExecMessageStdin:
+			_, err = session.Write([]byte(msg.Data))
+		case models.ExecMessageResize:
+			if msg.Rows != 0 && msg.Cols != 0 {
+				if err := session.Resize(msg.Rows, msg.Cols); err != nil {
+					log.Errorf("exec session: %s of container: %s, failed to resize, error: %v", session.ID, name, err)
+				}
+			}
+		default:
+			log.Errorf("exec session: %s of container: %s, unknown message type: %s", session.ID, name, msg.Type)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	select {
+	case <-done:
+		log.Infof("exec session: %s of container: %s is finished", session.ID, name)
+	default:
+		log.Infof("exec session: %s of container: %s is closed by the client", session.ID, name)
+	}
+}
+
+// pumpExecOutput sends the output of the session until the command exits, then sends the exit and closes the websocket.
+func (rh *ReplicaSetHandler) pumpExecOutput(ec *execConn, session *services.ExecSession, done chan struct{}) {
+	defer close(done)
+
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := session.Read(buf)
+		if n > 0 {
+			if err := ec.write(websocket.BinaryMessage, buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			exit := models.ExecMessage{Type: models.ExecMessageExit}
+			if err == io.EOF {
+				code, err := session.ExitCode()
+				if err != nil {
+					exit.Error = err.Error()
+				} else {
+					exit.ExitCode = &code
+				}
+			} else {
+				exit.Error = err.Error()
+			}
+			_ = ec.writeJSON(exit)
+			_ = ec.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			// unblock the reading of the input if the client does not close the websocket
+			time.AfterFunc(time.Second, func() { _ = ec.Close() })
+			return
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package routers
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const tarContentType = "application/x-tar"
+
+// DownloadFile reads a file of the latest version of the container, e.g. `GET /api/v1/replicaSet/foo/files?path=/root/model.pt`,
+// a file is responded as it is, a directory, or a file with `archive=true`, is responded as a tar archive.
+func (rh *ReplicaSetHandler) DownloadFile(c *gin.Context) {
+	name, p, ok := fileRequest(c, "download")
+	if !ok {
+		return
+	}
+	archive, err := strconv.ParseBool(c.DefaultQuery("archive", "false"))
+	if err != nil {
+		log.Errorf("failed to download file, archive: %s is invalid", c.Query("archive"))
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	download, err := cs.DownloadContainerPath(c.Request.Context(), name, p, archive)
+	if err != nil {
+		log.Errorf("services.DownloadContainerPath failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, fileResCode(err, CodeContainerDownloadFileFailed))
+		return
+	}
+	defer download.Close()
+
+	contentType := "application/octet-stream"
+	if download.Archive {
+		contentType = tarContentType
+	}
+	c.DataFromReader(http.StatusOK, download.Size, contentType, download, map[string]string{
+		"Content-Disposition": fmt.Sprintf("attachment; filename=%q", download.Name),
+	})
+}
+
+// UploadFile writes the body to the latest version of the container, e.g. `PUT /api/v1/replicaSet/foo/files?path=/root/config.yaml`,
+// the body is written to the file at path, or extracted into the directory at path if it is a tar archive,
+// which is marked by `archive=true` or the Content-Type application/x-tar.
+func (rh *ReplicaSetHandler) UploadFile(c *gin.Context) {
+	name, p, ok := fileRequest(c, "upload")
+	if !ok {
+		return
+	}
+	archive, err := strconv.ParseBool(c.DefaultQuery("archive", "false"))
+	if err != nil {
+		log.Errorf("failed to upload file, archive: %s is invalid", c.Query("archive"))
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+	archive = archive || c.ContentType() == tarContentType
+	if !archive && path.Clean(p) == "/" {
+		log.Errorf("failed to upload file, path: %s is not a file", p)
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	err = cs.UploadContainerPath(c.Request.Context(), name, p, c.Request.Body, c.Request.ContentLength, archive)
+	if err != nil {
+		log.Errorf("services.UploadContainerPath failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, fileResCode(err, CodeContainerUploadFileFailed))
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"path": p,
+	})
+}
+
+// StatFile returns the information of a file of the latest version of the container.
+func (rh *ReplicaSetHandler) StatFile(c *gin.Context) {
+	name, p, ok := fileRequest(c, "stat")
+	if !ok {
+		return
+	}
+
+	info, err := cs.StatContainerPath(name, p)
+	if err != nil {
+		log.Errorf("services.StatContainerPath failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, fileResCode(err, CodeContainerStatFileFailed))
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"file": info,
+	})
+}
+
+// ListFiles returns the files in a directory of the latest version of the container.
+func (rh *ReplicaSetHandler) ListFiles(c *gin.Context) {
+	name, p, ok := fileRequest(c, "list")
+	if !ok {
+		return
+	}
+
+	list, err := cs.ListContainerPath(c.Request.Context(), name, p)
+	if err != nil {
+		log.Errorf("services.ListContainerPath failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, fileResCode(err, CodeContainerStatFileFailed))
+		return
+	}
+
+	ResponseSuccess(c, list)
+}
+
+// fileRequest returns the replicaSet name and the path of a file request, it responds the error if they are invalid.
+func fileRequest(c *gin.Context, action string) (name, p string, ok bool) {
+	name = c.Param("name")
+	if len(name) == 0 {
+		log.Errorf("failed to %s file, name is empty", action)
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+	p = c.Query("path")
+	if !path.IsAbs(p) {
+		log.Errorf("failed to %s file, path: %s must be absolute", action, p)
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+	return name, p, true
+}
+
+func fileResCode(err error, code ResCode) ResCode {
+	switch {
+	case xerrors.IsContainerNotFoundError(err):
+		return CodeContainerVersionNotFound
+	case xerrors.IsFileNotFoundError(err):
+		return CodeContainerFileNotFound
+	case xerrors.IsFileTooLargeError(err):
+		return CodeContainerFileTooLarge
+	default:
+		return code
+	}
+}
@@ -0,0 +1,40 @@
+package routers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/mayooot/gpu-docker-api/internal/etcd"
+)
+
+// leaderReads are the GET requests that a standby can't serve either,
+// the exec starts a command in a container, and the status of gpus and ports
+// is read from the in-memory schedulers which are only kept up to date by the leader.
+var leaderReads = map[string]bool{
+	"/api/v1/replicaSet/:name/exec/ws": true,
+	"/api/v1/resources/gpus":           true,
+	"/api/v1/resources/ports":          true,
+}
+
+// LeaderOnly makes sure that only the leader serves mutating requests,
+// because gpu and port are allocated from the in-memory state of the leader.
+// A standby only serves the GET requests that read the store,
+// it redirects the others to the leader, or rejects them if there is no leader yet.
+func LeaderOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if etcd.IsLeader() || (c.Request.Method == http.MethodGet && !leaderReads[c.FullPath()]) {
+			c.Next()
+			return
+		}
+
+		leader := etcd.LeaderAddr()
+		if len(leader) == 0 {
+			ResponseError(c, CodeNotLeader)
+			c.Abort()
+			return
+		}
+		c.Redirect(http.StatusTemporaryRedirect, "http://"+leader+c.Request.URL.RequestURI())
+		c.Abort()
+	}
+}
@@ -0,0 +1,230 @@
+package routers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	timetypes "github.com/docker/docker/api/types/time"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const (
+	// defaultLogsTail is how many lines from the end are returned if tail is not set and the logs are not followed
+	defaultLogsTail = "1000"
+	// logsBufferLines is how many lines are responded as a whole, the logs with more lines are streamed
+	logsBufferLines = 1000
+)
+
+// Logs returns the logs of the latest version of the container, e.g. `GET /api/v1/replicaSet/foo/logs?tail=100&timestamps=true`,
+// the container of a previous version is read by `version` if it still exists.
+// With `follow=true`, the lines are streamed as server-sent events until the container stops or the client disconnects.
+func (rh *ReplicaSetHandler) Logs(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to get container logs, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	spec, code := parseLogsRequest(c)
+	if code != CodeSuccess {
+		ResponseError(c, code)
+		return
+	}
+
+	ctx := c.Request.Context()
+	reader, err := cs.ContainerLogs(ctx, name, spec)
+	if err != nil {
+		log.Errorf("services.ContainerLogs failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsContainerNotFoundError(err) {
+			ResponseError(c, CodeContainerVersionNotFound)
+			return
+		}
+		ResponseError(c, CodeContainerLogsFailed)
+		return
+	}
+	defer reader.Close()
+
+	if !spec.Follow {
+		w := &logsWriter{c: c, container: reader.Container, lines: make([]*models.LogLine, 0)}
+		w.finish(reader.Each(w.add))
+		return
+	}
+
+	lines := make(chan *models.LogLine, 64)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- reader.Each(func(line *models.LogLine) {
+			select {
+			case lines <- line:
+			case <-ctx.Done():
+			}
+		})
+	}()
+
+	ticker := time.NewTicker(watchKeepAliveInterval)
+	defer ticker.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case line := <-lines:
+			c.Render(-1, sse.Event{Event: line.Stream, Data: line})
+			return true
+		case <-ticker.C:
+			_, _ = w.Write([]byte(": keepalive\n\n"))
+			return true
+		case err := <-errCh:
+			if ctx.Err() != nil {
+				return false
+			}
+			// the lines sent before the end are not dropped
+			for len(lines) != 0 {
+				line := <-lines
+				c.Render(-1, sse.Event{Event: line.Stream, Data: line})
+			}
+			if err != nil {
+				log.Errorf("services.LogReader.Each failed, original error: %T %v", errors.Cause(err), err)
+				log.Errorf("stack trace: \n%+v\n", err)
+				c.SSEvent("error", &ResponseData{Code: CodeContainerLogsFailed, Msg: CodeContainerLogsFailed.Msg()})
+				return false
+			}
+			// the container is stopped
+			c.SSEvent("end", gin.H{"containerName": reader.Container})
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	})
+}
+
+// logsWriter responds the lines of the logs that are not followed. Up to logsBufferLines lines are responded as a whole,
+// the logs with more lines are streamed in the same format with chunked encoding, so they are not held in memory.
+type logsWriter struct {
+	c         *gin.Context
+	container string
+	lines     []*models.LogLine
+	streaming bool
+	written   int
+}
+
+func (w *logsWriter) add(line *models.LogLine) {
+	if w.streaming {
+		w.write(line)
+		return
+	}
+	w.lines = append(w.lines, line)
+	if len(w.lines) <= logsBufferLines {
+		return
+	}
+
+	w.streaming = true
+	// e.g. {"code":200,"msg":"Success","data":{"containerName":"foo-2"}}, the logs are appended to the data
+	head, _ := json.Marshal(&ResponseData{Code: CodeSuccess, Msg: CodeSuccess.Msg(), Data: gin.H{"containerName": w.container}})
+	w.c.Header("Content-Type", "application/json; charset=utf-8")
+	w.c.Status(http.StatusOK)
+	_, _ = w.c.Writer.Write(head[:len(head)-2])
+	_, _ = w.c.Writer.WriteString(`,"logs":[`)
+	for _, l := range w.lines {
+		w.write(l)
+	}
+	w.lines = nil
+}
+
+func (w *logsWriter) write(line *models.LogLine) {
+	data, _ := json.Marshal(line)
+	if w.written != 0 {
+		_, _ = w.c.Writer.WriteString(",")
+	}
+	_, _ = w.c.Writer.Write(data)
+	w.written++
+}
+
+// finish responds the buffered lines, or ends the streamed lines. If the logs fail after the lines are streamed,
+// the code and message are set as the error of the data.
+func (w *logsWriter) finish(err error) {
+	if err != nil {
+		log.Errorf("services.LogReader.Each failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+	}
+	if !w.streaming {
+		if err != nil {
+			ResponseError(w.c, CodeContainerLogsFailed)
+			return
+		}
+		ResponseSuccess(w.c, gin.H{
+			"containerName": w.container,
+			"logs":          w.lines,
+		})
+		return
+	}
+
+	if err != nil {
+		failed, _ := json.Marshal(gin.H{"code": CodeContainerLogsFailed, "msg": CodeContainerLogsFailed.Msg()})
+		_, _ = w.c.Writer.WriteString(`],"error":` + string(failed) + `}}`)
+		return
+	}
+	_, _ = w.c.Writer.WriteString(`]}}`)
+}
+
+// parseLogsRequest parses the query of Logs, the code is CodeSuccess if the query is valid.
+func parseLogsRequest(c *gin.Context) (*models.LogsRequest, ResCode) {
+	spec := &models.LogsRequest{
+		Tail:  c.Query("tail"),
+		Since: c.Query("since"),
+		Until: c.Query("until"),
+	}
+
+	if version := c.Query("version"); len(version) != 0 {
+		var err error
+		if spec.Version, err = strconv.ParseInt(version, 10, 64); err != nil {
+			log.Errorf("failed to get container logs, version: %s is invalid", version)
+			return nil, CodeInvalidParams
+		}
+		if spec.Version < 0 {
+			log.Errorf("failed to get container logs, version: %d must be greater than or equal to 0", spec.Version)
+			return nil, CodeContainerVersionMustBeGreaterThanOrEqualZero
+		}
+	}
+	if len(spec.Tail) != 0 && spec.Tail != "all" {
+		if _, err := strconv.ParseUint(spec.Tail, 10, 64); err != nil {
+			log.Errorf("failed to get container logs, tail: %s is invalid", spec.Tail)
+			return nil, CodeInvalidParams
+		}
+	}
+	now := time.Now()
+	for _, value := range []string{spec.Since, spec.Until} {
+		if len(value) == 0 {
+			continue
+		}
+		if _, err := timetypes.GetTimestamp(value, now); err != nil {
+			log.Errorf("failed to get container logs, time: %s is invalid, error: %v", value, err)
+			return nil, CodeInvalidParams
+		}
+	}
+
+	var err error
+	if spec.Timestamps, err = strconv.ParseBool(c.DefaultQuery("timestamps", "false")); err != nil {
+		log.Errorf("failed to get container logs, timestamps: %s is invalid", c.Query("timestamps"))
+		return nil, CodeInvalidParams
+	}
+	if spec.Follow, err = strconv.ParseBool(c.DefaultQuery("follow", "false")); err != nil {
+		log.Errorf("failed to get container logs, follow: %s is invalid", c.Query("follow"))
+		return nil, CodeInvalidParams
+	}
+	if len(spec.Tail) == 0 && !spec.Follow {
+		spec.Tail = defaultLogsTail
+	}
+	return spec, CodeSuccess
+}
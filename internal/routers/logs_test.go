@@ -0,0 +1,124 @@
+package routers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+)
+
+// logsResponse is the body responded by Logs when the logs are not followed.
+type logsResponse struct {
+	Code ResCode `json:"code"`
+	Data struct {
+		ContainerName string            `json:"containerName"`
+		Logs          []*models.LogLine `json:"logs"`
+		Error         *ResponseData     `json:"error"`
+	} `json:"data"`
+}
+
+func writeLogs(t *testing.T, lines int, err error) (*logsWriter, *logsResponse) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+
+	w := &logsWriter{c: c, container: "foo-2", lines: make([]*models.LogLine, 0)}
+	for i := 0; i < lines; i++ {
+		w.add(&models.LogLine{Stream: models.LogStreamStdout, Line: fmt.Sprintf("line %d", i)})
+	}
+	w.finish(err)
+
+	resp := &logsResponse{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), resp); err != nil {
+		t.Fatalf("the response is not json: %v, body: %s", err, recorder.Body.String())
+	}
+	return w, resp
+}
+
+func TestLogsWriter(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		lines         int
+		wantStreaming bool
+	}{
+		{"no lines", 0, false},
+		{"buffered", logsBufferLines, false},
+		{"streamed", logsBufferLines + 1, true},
+		{"streamed many", 3*logsBufferLines + 7, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w, resp := writeLogs(t, tc.lines, nil)
+			if w.streaming != tc.wantStreaming {
+				t.Errorf("got streaming %t, want %t", w.streaming, tc.wantStreaming)
+			}
+			if resp.Code != CodeSuccess || resp.Data.ContainerName != "foo-2" || resp.Data.Error != nil {
+				t.Errorf("got code %d, container %s, error %+v, want a success of foo-2", resp.Code, resp.Data.ContainerName, resp.Data.Error)
+			}
+			if len(resp.Data.Logs) != tc.lines {
+				t.Fatalf("got %d lines, want %d", len(resp.Data.Logs), tc.lines)
+			}
+			for i, line := range resp.Data.Logs {
+				if want := fmt.Sprintf("line %d", i); line.Line != want {
+					t.Fatalf("got line %q at %d, want %q", line.Line, i, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLogsWriterError(t *testing.T) {
+	// the error before streaming is responded as a whole
+	if _, resp := writeLogs(t, logsBufferLines, errors.New("broken")); resp.Code != CodeContainerLogsFailed {
+		t.Errorf("got code %d, want %d", resp.Code, CodeContainerLogsFailed)
+	}
+
+	// the error after streaming is set in the data, after the lines already sent
+	_, resp := writeLogs(t, logsBufferLines+1, errors.New("broken"))
+	if resp.Code != CodeSuccess || len(resp.Data.Logs) != logsBufferLines+1 {
+		t.Errorf("got code %d and %d lines, want a success with %d lines", resp.Code, len(resp.Data.Logs), logsBufferLines+1)
+	}
+	if resp.Data.Error == nil || resp.Data.Error.Code != CodeContainerLogsFailed {
+		t.Errorf("got error %+v, want code %d", resp.Data.Error, CodeContainerLogsFailed)
+	}
+}
+
+func TestParseLogsRequest(t *testing.T) {
+	for _, tc := range []struct {
+		query    string
+		want     models.LogsRequest
+		wantCode ResCode
+	}{
+		{"", models.LogsRequest{Tail: defaultLogsTail}, CodeSuccess},
+		// the followed logs start from the beginning unless tail is set
+		{"follow=true", models.LogsRequest{Follow: true}, CodeSuccess},
+		{"follow=true&tail=10", models.LogsRequest{Follow: true, Tail: "10"}, CodeSuccess},
+		{"tail=all", models.LogsRequest{Tail: "all"}, CodeSuccess},
+		{"version=3&timestamps=true", models.LogsRequest{Version: 3, Tail: defaultLogsTail, Timestamps: true}, CodeSuccess},
+		{"since=10m&until=2024-06-10T12:00:00Z", models.LogsRequest{Since: "10m", Until: "2024-06-10T12:00:00Z", Tail: defaultLogsTail}, CodeSuccess},
+		{"version=foo", models.LogsRequest{}, CodeInvalidParams},
+		{"version=-1", models.LogsRequest{}, CodeContainerVersionMustBeGreaterThanOrEqualZero},
+		{"tail=-1", models.LogsRequest{}, CodeInvalidParams},
+		{"since=yesterday", models.LogsRequest{}, CodeInvalidParams},
+		{"follow=maybe", models.LogsRequest{}, CodeInvalidParams},
+		{"timestamps=maybe", models.LogsRequest{}, CodeInvalidParams},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/api/v1/replicaSet/foo/logs?"+tc.query, nil)
+
+			spec, code := parseLogsRequest(c)
+			if code != tc.wantCode {
+				t.Fatalf("got code %d, want %d", code, tc.wantCode)
+			}
+			if code == CodeSuccess && *spec != tc.want {
+				t.Errorf("got request %+v, want %+v", *spec, tc.want)
+			}
+		})
+	}
+}
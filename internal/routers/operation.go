@@ -0,0 +1,96 @@
+package routers
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/services"
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+type OperationHandler struct{}
+
+var ops services.OperationService
+
+func (oh *OperationHandler) RegisterRoute(g *gin.RouterGroup) {
+	// get the phase, progress and result of an operation started with `?async=true`
+	g.GET("/operations/:id", oh.Get)
+	// list the operations, the latest one comes first,
+	// with `?replicaSet=` or `?volume=`, only the operations of that replicaSet or volume are listed
+	g.GET("/operations", oh.List)
+}
+
+// operationFunc is the body of a long-running request, it returns the data to respond, or the code and error when it fails.
+type operationFunc func(ctx context.Context) (interface{}, ResCode, error)
+
+// runOperation runs fn and responds its result, with `?async=true`, fn is run in the background,
+// and it responds 202 with the operation immediately, the result can be got by `GET /api/v1/operations/:id`.
+func runOperation(c *gin.Context, typ string, resource store.Resource, name string, fn operationFunc) {
+	if async, _ := strconv.ParseBool(c.Query("async")); !async {
+		data, code, err := fn(writeContext(c))
+		if err != nil {
+			ResponseError(c, code)
+			return
+		}
+		ResponseSuccess(c, data)
+		return
+	}
+
+	op := ops.StartOperation(writeContext(c), typ, resource, name, func(ctx context.Context) (interface{}, int64, error) {
+		data, code, err := fn(ctx)
+		return data, int64(code), err
+	})
+	ResponseAccepted(c, gin.H{
+		"operation": op,
+	})
+}
+
+// isDryRun reports whether the request is `?dryRun=true`, then only the plan of the request is responded,
+// nothing is changed.
+func isDryRun(c *gin.Context) bool {
+	dryRun, _ := strconv.ParseBool(c.Query("dryRun"))
+	return dryRun
+}
+
+func (oh *OperationHandler) Get(c *gin.Context) {
+	id := c.Param("id")
+	op, err := ops.GetOperation(id)
+	if err != nil {
+		log.Errorf("services.GetOperation failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsOperationNotFoundError(err) {
+			ResponseError(c, CodeOperationNotFound)
+			return
+		}
+		ResponseError(c, CodeOperationGetFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"operation": op,
+	})
+}
+
+func (oh *OperationHandler) List(c *gin.Context) {
+	resource, name := store.Containers, c.Query("replicaSet")
+	if volume := c.Query("volume"); len(volume) != 0 {
+		resource, name = store.Volumes, volume
+	}
+
+	list, err := ops.ListOperations(resource, name)
+	if err != nil {
+		log.Errorf("services.ListOperations failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeOperationListFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"operations": list,
+	})
+}
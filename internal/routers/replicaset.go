@@ -1,6 +1,8 @@
 package routers
 
 import (
+	"context"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -9,6 +11,7 @@ import (
 
 	"github.com/mayooot/gpu-docker-api/internal/models"
 	"github.com/mayooot/gpu-docker-api/internal/services"
+	"github.com/mayooot/gpu-docker-api/internal/store"
 	"github.com/mayooot/gpu-docker-api/internal/xerrors"
 )
 
@@ -26,6 +29,18 @@ func (rh *ReplicaSetHandler) RegisterRoute(g *gin.RouterGroup) {
 	g.POST("/replicaSet/:name/commit", rh.Commit)
 	// execute a command in the replicaSet current version of the container
 	g.POST("/replicaSet/:name/execute", rh.Execute)
+	// run an interactive command with a tty in the replicaSet current version of the container over websocket
+	g.GET("/replicaSet/:name/exec/ws", rh.ExecWebSocket)
+	// get the logs of the replicaSet current version of the container, or follow them as server-sent events
+	g.GET("/replicaSet/:name/logs", rh.Logs)
+
+	// download a file or a directory from the replicaSet current version of the container
+	g.GET("/replicaSet/:name/files", rh.DownloadFile)
+	// upload a file, or a tar archive extracted into a directory, to the replicaSet current version of the container
+	g.PUT("/replicaSet/:name/files", rh.UploadFile)
+	// get the information of a file, or list the files in a directory, of the replicaSet current version of the container
+	g.GET("/replicaSet/:name/files/stat", rh.StatFile)
+	g.GET("/replicaSet/:name/files/list", rh.ListFiles)
 
 	// update the replicaSet, such as change gpu, volume
 	// or replicating the container by create a new container.
@@ -52,6 +67,20 @@ func (rh *ReplicaSetHandler) RegisterRoute(g *gin.RouterGroup) {
 	// get information about all historical versions of the replicaSet
 	g.GET("/replicaSet/:name/history", rh.History)
 
+	// get the retention policy of the replicaSet historical versions
+	g.GET("/replicaSet/:name/retention", rh.GetRetention)
+	// change the retention policy, historical versions out of the policy will be pruned
+	g.PATCH("/replicaSet/:name/retention", rh.SetRetention)
+	// pin a historical version of the replicaSet, so that it will never be pruned
+	g.PATCH("/replicaSet/:name/versions/:version/pin", rh.Pin)
+	// unpin a historical version of the replicaSet
+	g.PATCH("/replicaSet/:name/versions/:version/unpin", rh.Unpin)
+
+	// get the merge snapshots of the replicaSet historical versions, which are used by rollback
+	g.GET("/replicaSet/:name/snapshots", rh.Snapshots)
+	// delete the merge snapshot of a historical version, the version can't be rolled back to after that
+	g.DELETE("/replicaSet/:name/snapshots/:version", rh.DeleteSnapshot)
+
 	// delete a replicaSet also delete the container and cannot be recovered.
 	g.DELETE("/replicaSet/:name", rh.Delete)
 }
@@ -131,10 +160,14 @@ func (rh *ReplicaSetHandler) Run(c *gin.Context) {
 		return
 	}
 
-	_, containerName, err := cs.RunGpuContainer(&spec)
+	_, containerName, err := cs.RunGpuContainer(writeContext(c), &spec)
 	if err != nil {
 		log.Errorf("services.RunGpuContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsOperationInProgressError(err) {
+			ResponseError(c, CodeOperationInProgress)
+			return
+		}
 		if xerrors.IsContainerExistedError(err) {
 			ResponseError(c, CodeContainerAlreadyExist)
 			return
@@ -173,16 +206,20 @@ func (rh *ReplicaSetHandler) Commit(c *gin.Context) {
 		return
 	}
 
-	imageName, err := cs.CommitContainer(name, spec)
-	if err != nil {
-		log.Errorf("services.RestartContainer failed, original error: %T %v", errors.Cause(err), err)
-		log.Errorf("stack trace: \n%+v\n", err)
-		ResponseError(c, CodeContainerCommitFailed)
-		return
-	}
+	runOperation(c, models.OperationCommit, store.Containers, name, func(ctx context.Context) (interface{}, ResCode, error) {
+		imageName, err := cs.CommitContainer(ctx, name, spec)
+		if err != nil {
+			log.Errorf("services.RestartContainer failed, original error: %T %v", errors.Cause(err), err)
+			log.Errorf("stack trace: \n%+v\n", err)
+			if xerrors.IsOperationInProgressError(err) {
+				return nil, CodeOperationInProgress, err
+			}
+			return nil, CodeContainerCommitFailed, err
+		}
 
-	ResponseSuccess(c, gin.H{
-		"imageName": imageName,
+		return gin.H{
+			"imageName": imageName,
+		}, CodeSuccess, nil
 	})
 }
 
@@ -201,8 +238,14 @@ func (rh *ReplicaSetHandler) Execute(c *gin.Context) {
 		ResponseError(c, CodeInvalidParams)
 		return
 	}
+	if spec.TimeoutSeconds < 0 || spec.OutputLimit < 0 {
+		log.Errorf("failed to execute container, timeoutSeconds: %d or outputLimit: %d is negative",
+			spec.TimeoutSeconds, spec.OutputLimit)
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
 
-	resp, err := cs.ExecuteContainer(name, &spec)
+	result, err := cs.ExecuteContainer(name, &spec)
 	if err != nil {
 		log.Errorf("services.ExecuteContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
@@ -210,9 +253,7 @@ func (rh *ReplicaSetHandler) Execute(c *gin.Context) {
 		return
 	}
 
-	ResponseSuccess(c, gin.H{
-		"stdout": resp,
-	})
+	ResponseSuccess(c, result)
 }
 
 // Patch to change the configuration of the latest version of an existing container.
@@ -247,19 +288,101 @@ func (rh *ReplicaSetHandler) Patch(c *gin.Context) {
 		return
 	}
 
-	_, containerName, err := cs.PatchContainer(name, &spec)
-	if err != nil {
-		log.Errorf("services.PatchContainer failed, original error: %T %v", errors.Cause(err), err)
-		log.Errorf("stack trace: \n%+v\n", err)
-		ResponseError(c, CodeContainerPatchFailed)
+	if err := checkPatchRequest(&spec); err != nil {
+		log.Errorf("failed to patch container, error: %v", err)
+		ResponseError(c, CodeInvalidParams)
 		return
 	}
 
-	ResponseSuccess(c, gin.H{
-		"containerName": containerName,
+	if isDryRun(c) {
+		plan, err := cs.PlanPatch(name, &spec)
+		if err != nil {
+			log.Errorf("services.PlanPatch failed, original error: %T %v", errors.Cause(err), err)
+			log.Errorf("stack trace: \n%+v\n", err)
+			ResponseError(c, CodeContainerPlanFailed)
+			return
+		}
+		ResponseSuccess(c, gin.H{
+			"plan": plan,
+		})
+		return
+	}
+
+	runOperation(c, models.OperationPatch, store.Containers, name, func(ctx context.Context) (interface{}, ResCode, error) {
+		_, containerName, imageChange, err := cs.PatchContainer(ctx, name, &spec)
+		if err != nil {
+			log.Errorf("services.PatchContainer failed, original error: %T %v", errors.Cause(err), err)
+			log.Errorf("stack trace: \n%+v\n", err)
+			if xerrors.IsOperationInProgressError(err) {
+				return nil, CodeOperationInProgress, err
+			}
+			if xerrors.IsImageNotFoundError(err) {
+				return nil, CodeContainerImageNotFound, err
+			}
+			return nil, CodeContainerPatchFailed, err
+		}
+
+		data := gin.H{
+			"containerName": containerName,
+		}
+		if imageChange != nil {
+			// the files changed in the old container that are changed by the new image too
+			data["imageChange"] = imageChange
+		}
+		return data, CodeSuccess, nil
 	})
 }
 
+// containerVersionEnv is set to the version of the container by the server
+const containerVersionEnv = "CONTAINER_VERSION"
+
+// checkPatchRequest checks the volume, env and port patches of spec.
+func checkPatchRequest(spec *models.PatchRequest) error {
+	for _, patch := range spec.VolumePatches {
+		if patch.OldBind == nil && patch.NewBind == nil {
+			return errors.New("oldBind and newBind of a volume patch cannot both be empty")
+		}
+		if (patch.OldBind != nil && patch.OldBind.Format() == "") || (patch.NewBind != nil && patch.NewBind.Format() == "") {
+			return errors.Errorf("volume patch: %+v is invalid, src and dest of a bind cannot be empty", patch)
+		}
+	}
+
+	if spec.EnvPatch != nil {
+		for _, env := range spec.EnvPatch.Set {
+			key, _, ok := strings.Cut(env, "=")
+			if !ok || len(key) == 0 {
+				return errors.Errorf("env: %s is invalid, it must be KEY=VALUE", env)
+			}
+			if key == containerVersionEnv {
+				return errors.Errorf("env: %s is set by the server", key)
+			}
+		}
+		for _, key := range spec.EnvPatch.Remove {
+			if len(key) == 0 || strings.Contains(key, "=") || key == containerVersionEnv {
+				return errors.Errorf("env: %s cannot be removed", key)
+			}
+		}
+	}
+
+	if spec.PortPatch != nil {
+		for _, port := range append(spec.PortPatch.Add, spec.PortPatch.Remove...) {
+			if !validContainerPort(port) {
+				return errors.Errorf("container port: %s is invalid, it must be like 8080 or 8080/udp", port)
+			}
+		}
+	}
+	return nil
+}
+
+func validContainerPort(port string) bool {
+	number, proto, ok := strings.Cut(port, "/")
+	if ok && proto != "tcp" && proto != "udp" && proto != "sctp" {
+		return false
+	}
+	n, err := strconv.Atoi(number)
+	return err == nil && n > 0 && n <= 65535
+}
+
 // Rollback a container to a specific version
 func (rh *ReplicaSetHandler) Rollback(c *gin.Context) {
 	name := c.Param("name")
@@ -282,21 +405,44 @@ func (rh *ReplicaSetHandler) Rollback(c *gin.Context) {
 		return
 	}
 
-	containerName, err := cs.RollbackContainer(name, &spec)
-
-	if err != nil {
-		log.Errorf("services.RollbackContainer failed, original error: %T %v", errors.Cause(err), err)
-		log.Errorf("stack trace: \n%+v\n", err)
-		if xerrors.IsNoRollbackRequiredError(err) {
-			ResponseError(c, CodeContainerNoNeedRollback)
+	if isDryRun(c) {
+		plan, err := cs.PlanRollback(name, &spec)
+		if err != nil {
+			log.Errorf("services.PlanRollback failed, original error: %T %v", errors.Cause(err), err)
+			log.Errorf("stack trace: \n%+v\n", err)
+			if xerrors.IsNoRollbackRequiredError(err) {
+				ResponseError(c, CodeContainerNoNeedRollback)
+				return
+			}
+			ResponseError(c, CodeContainerPlanFailed)
 			return
 		}
-		ResponseError(c, CodeContainerRollbackFailed)
-		return
-	}
+		ResponseSuccess(c, gin.H{
+			"plan": plan,
+		})
+		return
+	}
+
+	runOperation(c, models.OperationRollback, store.Containers, name, func(ctx context.Context) (interface{}, ResCode, error) {
+		containerName, err := cs.RollbackContainer(ctx, name, &spec)
+		if err != nil {
+			log.Errorf("services.RollbackContainer failed, original error: %T %v", errors.Cause(err), err)
+			log.Errorf("stack trace: \n%+v\n", err)
+			if xerrors.IsOperationInProgressError(err) {
+				return nil, CodeOperationInProgress, err
+			}
+			if xerrors.IsNoRollbackRequiredError(err) {
+				return nil, CodeContainerNoNeedRollback, err
+			}
+			if xerrors.IsSnapshotNotFoundError(err) {
+				return nil, CodeContainerSnapshotNotFound, err
+			}
+			return nil, CodeContainerRollbackFailed, err
+		}
 
-	ResponseSuccess(c, gin.H{
-		"containerName": containerName,
+		return gin.H{
+			"containerName": containerName,
+		}, CodeSuccess, nil
 	})
 }
 
@@ -310,9 +456,13 @@ func (rh *ReplicaSetHandler) Pause(c *gin.Context) {
 		return
 	}
 
-	if err := cs.StopContainer(name, false, false, true); err != nil {
+	if err := cs.StopContainer(writeContext(c), name, false, false, true); err != nil {
 		log.Errorf("services.StopContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsOperationInProgressError(err) {
+			ResponseError(c, CodeOperationInProgress)
+			return
+		}
 		ResponseError(c, CodeContainerShutDownFailed)
 		return
 	}
@@ -330,9 +480,13 @@ func (rh *ReplicaSetHandler) Continue(c *gin.Context) {
 		return
 	}
 
-	if err := cs.StartupContainer(name); err != nil {
+	if err := cs.StartupContainer(writeContext(c), name); err != nil {
 		log.Errorf("services.StartupContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsOperationInProgressError(err) {
+			ResponseError(c, CodeOperationInProgress)
+			return
+		}
 		ResponseError(c, CodeContainerRestartFailed)
 		return
 	}
@@ -350,9 +504,13 @@ func (rh *ReplicaSetHandler) Stop(c *gin.Context) {
 		return
 	}
 
-	if err := cs.StopContainer(name, true, true, true); err != nil {
+	if err := cs.StopContainer(writeContext(c), name, true, true, true); err != nil {
 		log.Errorf("services.StopContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsOperationInProgressError(err) {
+			ResponseError(c, CodeOperationInProgress)
+			return
+		}
 		ResponseError(c, CodeContainerStopFailed)
 		return
 	}
@@ -370,16 +528,34 @@ func (rh *ReplicaSetHandler) Restart(c *gin.Context) {
 		return
 	}
 
-	_, containerName, err := cs.RestartContainer(name)
-	if err != nil {
-		log.Errorf("services.RestartContainer failed, original error: %T %v", errors.Cause(err), err)
-		log.Errorf("stack trace: \n%+v\n", err)
-		ResponseError(c, CodeContainerRestartFailed)
+	if isDryRun(c) {
+		plan, err := cs.PlanRestart(name)
+		if err != nil {
+			log.Errorf("services.PlanRestart failed, original error: %T %v", errors.Cause(err), err)
+			log.Errorf("stack trace: \n%+v\n", err)
+			ResponseError(c, CodeContainerPlanFailed)
+			return
+		}
+		ResponseSuccess(c, gin.H{
+			"plan": plan,
+		})
 		return
 	}
 
-	ResponseSuccess(c, gin.H{
-		"containerName": containerName,
+	runOperation(c, models.OperationRestart, store.Containers, name, func(ctx context.Context) (interface{}, ResCode, error) {
+		_, containerName, err := cs.RestartContainer(ctx, name)
+		if err != nil {
+			log.Errorf("services.RestartContainer failed, original error: %T %v", errors.Cause(err), err)
+			log.Errorf("stack trace: \n%+v\n", err)
+			if xerrors.IsOperationInProgressError(err) {
+				return nil, CodeOperationInProgress, err
+			}
+			return nil, CodeContainerRestartFailed, err
+		}
+
+		return gin.H{
+			"containerName": containerName,
+		}, CodeSuccess, nil
 	})
 }
 
@@ -392,12 +568,181 @@ func (rh *ReplicaSetHandler) Delete(c *gin.Context) {
 		return
 	}
 
-	if err := cs.DeleteContainer(name); err != nil {
+	if err := cs.DeleteContainer(writeContext(c), name); err != nil {
 		log.Errorf("services.DeleteContainer failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsOperationInProgressError(err) {
+			ResponseError(c, CodeOperationInProgress)
+			return
+		}
 		ResponseError(c, CodeContainerDeleteFailed)
 		return
 	}
 
 	ResponseSuccess(c, nil)
 }
+
+func (rh *ReplicaSetHandler) GetRetention(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to get container retention policy, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	policy, err := cs.GetRetentionPolicy(name)
+	if err != nil {
+		log.Errorf("services.GetRetentionPolicy failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeContainerGetRetentionFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"retention": policy,
+	})
+}
+
+// SetRetention changes how many historical versions of the replicaSet are kept,
+// a version is pruned only if it is neither one of the last keepLast versions nor younger than keepDays days.
+func (rh *ReplicaSetHandler) SetRetention(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to set container retention policy, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	var spec models.RetentionPolicy
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		log.Errorf("failed to set container retention policy, error: %v", err)
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	if spec.KeepLast < 0 || spec.KeepDays < 0 {
+		log.Errorf("failed to set container retention policy, keepLast: %d and keepDays: %d must be greater than or equal to 0",
+			spec.KeepLast, spec.KeepDays)
+		ResponseError(c, CodeContainerRetentionInvalid)
+		return
+	}
+
+	policy, err := cs.SetRetentionPolicy(writeContext(c), name, &spec)
+	if err != nil {
+		log.Errorf("services.SetRetentionPolicy failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsOperationInProgressError(err) {
+			ResponseError(c, CodeOperationInProgress)
+			return
+		}
+		ResponseError(c, CodeContainerSetRetentionFailed)
+		return
+	}
+
+	ResponseSuccess(c, gin.H{
+		"retention": policy,
+	})
+}
+
+// Pin a historical version, it will never be pruned by the retention policy
+func (rh *ReplicaSetHandler) Pin(c *gin.Context) {
+	rh.pin(c, true)
+}
+
+// Unpin a historical version, it can be pruned by the retention policy again
+func (rh *ReplicaSetHandler) Unpin(c *gin.Context) {
+	rh.pin(c, false)
+}
+
+func (rh *ReplicaSetHandler) pin(c *gin.Context, pinned bool) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to pin container version, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	version, err := strconv.ParseInt(c.Param("version"), 10, 64)
+	if err != nil {
+		log.Errorf("failed to pin container version, version: %s is invalid", c.Param("version"))
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+	if version < 0 {
+		log.Errorf("failed to pin container version, version: %d must be greater than or equal to 0", version)
+		ResponseError(c, CodeContainerVersionMustBeGreaterThanOrEqualZero)
+		return
+	}
+
+	if err = cs.PinVersion(name, version, pinned); err != nil {
+		log.Errorf("services.PinVersion failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsOperationInProgressError(err) {
+			ResponseError(c, CodeOperationInProgress)
+			return
+		}
+		ResponseError(c, CodeContainerPinFailed)
+		return
+	}
+
+	ResponseSuccess(c, nil)
+}
+
+func (rh *ReplicaSetHandler) Snapshots(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to get container snapshots, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	snapshots, err := cs.ListSnapshots(name)
+	if err != nil {
+		log.Errorf("services.ListSnapshots failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		ResponseError(c, CodeContainerGetSnapshotsFailed)
+		return
+	}
+
+	var totalSize int64
+	for _, s := range snapshots {
+		totalSize += s.Size
+	}
+	ResponseSuccess(c, gin.H{
+		"snapshots": snapshots,
+		"totalSize": totalSize,
+	})
+}
+
+func (rh *ReplicaSetHandler) DeleteSnapshot(c *gin.Context) {
+	name := c.Param("name")
+	if len(name) == 0 {
+		log.Error("failed to delete container snapshot, name is empty")
+		ResponseError(c, CodeContainerNameCannotBeEmpty)
+		return
+	}
+
+	version, err := strconv.ParseInt(c.Param("version"), 10, 64)
+	if err != nil {
+		log.Errorf("failed to delete container snapshot, version: %s is invalid", c.Param("version"))
+		ResponseError(c, CodeInvalidParams)
+		return
+	}
+
+	if err = cs.DeleteSnapshot(writeContext(c), name, version); err != nil {
+		log.Errorf("services.DeleteSnapshot failed, original error: %T %v", errors.Cause(err), err)
+		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsOperationInProgressError(err) {
+			ResponseError(c, CodeOperationInProgress)
+			return
+		}
+		if xerrors.IsSnapshotNotFoundError(err) {
+			ResponseError(c, CodeContainerSnapshotNotFound)
+			return
+		}
+		ResponseError(c, CodeContainerDeleteSnapshotFailed)
+		return
+	}
+
+	ResponseSuccess(c, nil)
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
 )
 
 type ResponseData struct {
@@ -20,10 +21,31 @@ func ResponseError(c *gin.Context, code ResCode) {
 	})
 }
 
+// ResponseSuccess responds the data, if the request enables SyncWrites,
+// it responds after the writes of the request are saved to the store.
 func ResponseSuccess(c *gin.Context, data interface{}) {
+	if err := waitWrites(c); err != nil {
+		log.Errorf("failed to wait for writes to be saved to the store, error: %v", err)
+		ResponseError(c, CodeSyncWritesFailed)
+		return
+	}
 	c.JSON(http.StatusOK, &ResponseData{
 		Code: CodeSuccess,
 		Msg:  CodeSuccess.Msg(),
 		Data: data,
 	})
 }
+
+// ResponseAccepted responds 202 with the data, it is used when the request is run in the background.
+func ResponseAccepted(c *gin.Context, data interface{}) {
+	if err := waitWrites(c); err != nil {
+		log.Errorf("failed to wait for writes to be saved to the store, error: %v", err)
+		ResponseError(c, CodeSyncWritesFailed)
+		return
+	}
+	c.JSON(http.StatusAccepted, &ResponseData{
+		Code: CodeSuccess,
+		Msg:  CodeSuccess.Msg(),
+		Data: data,
+	})
+}
@@ -0,0 +1,55 @@
+package routers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+)
+
+const syncWritesKey = "syncWrites"
+
+// SyncWrites makes a mutating request respond after its writes are saved to the store,
+// so that the following reads from any instance see them.
+// It is enabled for every request if global is true, or for a single request by `?sync=true`,
+// and `?sync=false` disables it for a single request.
+func SyncWrites(global bool, timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodGet {
+			c.Next()
+			return
+		}
+
+		enabled := global
+		if v, err := strconv.ParseBool(c.Query("sync")); err == nil {
+			enabled = v
+		}
+		if enabled {
+			c.Set(syncWritesKey, timeout)
+			// the writes of the request are collected, so that it does not wait for those of the concurrent requests
+			c.Request = c.Request.WithContext(workQueue.WithCollector(c.Request.Context()))
+		}
+		c.Next()
+	}
+}
+
+// waitWrites waits until the writes queued during the request are saved to the store if SyncWrites is enabled.
+func waitWrites(c *gin.Context) error {
+	timeout, ok := c.Get(syncWritesKey)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout.(time.Duration))
+	defer cancel()
+	return workQueue.Wait(ctx, workQueue.Collected(c.Request.Context()))
+}
+
+// writeContext returns the context that the services enqueue the writes of the request with, see waitWrites.
+// It is not canceled when the client goes away, so that a change is never stopped halfway.
+func writeContext(c *gin.Context) context.Context {
+	return context.WithoutCancel(c.Request.Context())
+}
@@ -1,6 +1,7 @@
 package routers
 
 import (
+	"context"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/mayooot/gpu-docker-api/internal/models"
 	"github.com/mayooot/gpu-docker-api/internal/services"
+	"github.com/mayooot/gpu-docker-api/internal/store"
 	"github.com/mayooot/gpu-docker-api/internal/xerrors"
 )
 
@@ -46,10 +48,14 @@ func (vh *VolumeHandler) Create(c *gin.Context) {
 		return
 	}
 
-	resp, err := vs.CreateVolume(&spec)
+	resp, err := vs.CreateVolume(writeContext(c), &spec)
 	if err != nil {
 		log.Errorf("services.CreateVolume failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsOperationInProgressError(err) {
+			ResponseError(c, CodeOperationInProgress)
+			return
+		}
 		if xerrors.IsVolumeExistedError(err) {
 			ResponseError(c, CodeVolumeExisted)
 			return
@@ -89,25 +95,27 @@ func (vh *VolumeHandler) Patch(c *gin.Context) {
 		return
 	}
 
-	resp, err := vs.PatchVolumeSize(name, &spec)
-	if err != nil {
-		log.Errorf("services.PatchVolumeSize failed, original error: %T %v", errors.Cause(err), err)
-		log.Errorf("stack trace: \n%+v\n", err)
-		if xerrors.IsNoPatchRequiredError(err) {
-			ResponseError(c, CodeVolumeSizeNoNeedPatch)
-			return
-		}
-		if xerrors.IsVolumeSizeUsedGreaterThanReduced(err) {
-			ResponseError(c, CodeVolumePatchFailed)
-			return
+	runOperation(c, models.OperationPatchVolumeSize, store.Volumes, name, func(ctx context.Context) (interface{}, ResCode, error) {
+		resp, err := vs.PatchVolumeSize(ctx, name, &spec)
+		if err != nil {
+			log.Errorf("services.PatchVolumeSize failed, original error: %T %v", errors.Cause(err), err)
+			log.Errorf("stack trace: \n%+v\n", err)
+			if xerrors.IsOperationInProgressError(err) {
+				return nil, CodeOperationInProgress, err
+			}
+			if xerrors.IsNoPatchRequiredError(err) {
+				return nil, CodeVolumeSizeNoNeedPatch, err
+			}
+			if xerrors.IsVolumeSizeUsedGreaterThanReduced(err) {
+				return nil, CodeVolumePatchFailed, err
+			}
+			return nil, CodeVolumePatchFailed, err
 		}
-		ResponseError(c, CodeVolumePatchFailed)
-		return
-	}
 
-	ResponseSuccess(c, gin.H{
-		"name": resp.Name,
-		"size": resp.Options["size"],
+		return gin.H{
+			"name": resp.Name,
+			"size": resp.Options["size"],
+		}, CodeSuccess, nil
 	})
 }
 
@@ -120,9 +128,13 @@ func (vh *VolumeHandler) Delete(c *gin.Context) {
 		return
 	}
 
-	if err := vs.DeleteVolume(name, true, true); err != nil {
+	if err := vs.DeleteVolume(writeContext(c), name, true, true); err != nil {
 		log.Errorf("services.DeleteVolume failed, original error: %T %v", errors.Cause(err), err)
 		log.Errorf("stack trace: \n%+v\n", err)
+		if xerrors.IsOperationInProgressError(err) {
+			ResponseError(c, CodeOperationInProgress)
+			return
+		}
 		ResponseError(c, CodeVolumeDeleteFailed)
 		return
 	}
@@ -0,0 +1,91 @@
+package routers
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/services"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const watchKeepAliveInterval = 15 * time.Second
+
+type WatchHandler struct{}
+
+var ws services.WatchService
+
+func (wh *WatchHandler) RegisterRoute(g *gin.RouterGroup) {
+	// stream changes of replicaSet, volume and gpu as server-sent events
+	g.GET("/watch", wh.Watch)
+}
+
+// Watch streams typed events as server-sent events, the id of each event is its revision.
+// To resume after disconnects, pass the last seen revision via `?revision=` or the `Last-Event-ID` header.
+func (wh *WatchHandler) Watch(c *gin.Context) {
+	revision := c.Query("revision")
+	if len(revision) == 0 {
+		revision = c.GetHeader("Last-Event-ID")
+	}
+	var rev int64
+	if len(revision) != 0 {
+		var err error
+		rev, err = strconv.ParseInt(revision, 10, 64)
+		if err != nil || rev < 0 {
+			log.Errorf("failed to watch, revision: %s is invalid", revision)
+			ResponseError(c, CodeInvalidParams)
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	events := make(chan *models.Event, 64)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ws.Watch(ctx, rev, func(event *models.Event) {
+			select {
+			case events <- event:
+			case <-ctx.Done():
+			}
+		})
+	}()
+
+	ticker := time.NewTicker(watchKeepAliveInterval)
+	defer ticker.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-events:
+			c.Render(-1, sse.Event{
+				Id:    strconv.FormatInt(event.Revision, 10),
+				Event: event.Type,
+				Data:  event,
+			})
+			return true
+		case <-ticker.C:
+			_, _ = w.Write([]byte(": keepalive\n\n"))
+			return true
+		case err := <-errCh:
+			if err != nil && ctx.Err() == nil {
+				log.Errorf("services.Watch failed, original error: %T %v", errors.Cause(err), err)
+				log.Errorf("stack trace: \n%+v\n", err)
+				code := CodeWatchFailed
+				if xerrors.IsRevisionCompactedError(err) {
+					code = CodeWatchRevisionCompacted
+				}
+				c.SSEvent("error", &ResponseData{Code: code, Msg: code.Msg()})
+			}
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	})
+}
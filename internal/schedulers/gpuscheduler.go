@@ -1,7 +1,7 @@
 package schedulers
 
 import (
-	"encoding/json"
+	"context"
 	"strconv"
 	"strings"
 	"sync"
@@ -9,7 +9,9 @@ import (
 	"github.com/commander-cli/cmd"
 	"github.com/pkg/errors"
 
-	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
 	"github.com/mayooot/gpu-docker-api/internal/xerrors"
 )
 
@@ -56,13 +58,13 @@ func InitGPuScheduler() error {
 }
 
 func CloseGpuScheduler() error {
-	return etcd.Put(etcd.Gpus, gpuStatusMapKey, GpuScheduler.serialize())
+	return store.Put(store.Gpus, gpuStatusMapKey, GpuScheduler.serialize())
 }
 
 func initGpuFormEtcd() (s *gpuScheduler, err error) {
-	bytes, err := etcd.GetValue(etcd.Gpus, gpuStatusMapKey)
+	bytes, err := store.GetValue(store.Gpus, gpuStatusMapKey)
 	if err != nil {
-		if xerrors.IsNotExistInEtcdError(err) {
+		if xerrors.IsNotExistInStoreError(err) {
 			err = nil
 		} else {
 			return s, err
@@ -73,17 +75,18 @@ func initGpuFormEtcd() (s *gpuScheduler, err error) {
 		GpuStatusMap: make(map[string]byte),
 	}
 	if len(bytes) != 0 {
-		err = json.Unmarshal(bytes, &s)
+		err = models.DecodeRecord(models.KindGpuStatus, bytes, &s)
 	}
 	return s, err
 }
 
 // Apply for a specified number of gpus
-func (gs *gpuScheduler) Apply(num int) ([]string, error) {
+func (gs *gpuScheduler) Apply(ctx context.Context, num int) ([]string, error) {
 	if num <= 0 || num > gs.AvailableGpuNums {
 		return nil, errors.New("num must be greater than 0 and less than " + strconv.Itoa(gs.AvailableGpuNums))
 	}
 
+	defer gs.persist(ctx)
 	gs.Lock()
 	defer gs.Unlock()
 
@@ -106,11 +109,12 @@ func (gs *gpuScheduler) Apply(num int) ([]string, error) {
 }
 
 // Restore a specified number of gpu
-func (gs *gpuScheduler) Restore(gpus []string) {
+func (gs *gpuScheduler) Restore(ctx context.Context, gpus []string) {
 	if len(gpus) <= 0 || len(gpus) > gs.AvailableGpuNums {
 		return
 	}
 
+	defer gs.persist(ctx)
 	gs.Lock()
 	defer gs.Unlock()
 
@@ -123,9 +127,17 @@ func (gs *gpuScheduler) serialize() *string {
 	gs.RLock()
 	defer gs.RUnlock()
 
-	bytes, _ := json.Marshal(gs)
-	tmp := string(bytes)
-	return &tmp
+	return models.EncodeRecord(models.KindGpuStatus, gs)
+}
+
+// persist saves the gpu status to etcd asynchronously,
+// so that a standby can reload the latest state when it becomes the leader.
+func (gs *gpuScheduler) persist(ctx context.Context) {
+	workQueue.Enqueue(ctx, store.PutKeyValue{
+		Resource: store.Gpus,
+		Key:      gpuStatusMapKey,
+		Value:    gs.serialize(),
+	})
 }
 
 func (gs *gpuScheduler) GetGpuStatus() map[string]byte {
@@ -140,6 +152,18 @@ func (gs *gpuScheduler) GetGpuStatus() map[string]byte {
 	return copyMap
 }
 
+// ParseGpuStatus parses the gpu status saved in etcd, the key is uuid of gpu, the value is whether it is used.
+func ParseGpuStatus(bytes []byte) (map[string]byte, error) {
+	s := &gpuScheduler{
+		GpuStatusMap: make(map[string]byte),
+	}
+	if len(bytes) == 0 {
+		return s.GpuStatusMap, nil
+	}
+	err := models.DecodeRecord(models.KindGpuStatus, bytes, &s)
+	return s.GpuStatusMap, err
+}
+
 func getAllGpuUUID() ([]*gpu, error) {
 	c := cmd.NewCommand(allGpuUUIDCommand)
 	err := c.Execute()
@@ -1,7 +1,7 @@
 package schedulers
 
 import (
-	"encoding/json"
+	"context"
 	"sort"
 	"strconv"
 	"strings"
@@ -9,7 +9,9 @@ import (
 
 	"github.com/pkg/errors"
 
-	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
 	"github.com/mayooot/gpu-docker-api/internal/xerrors"
 )
 
@@ -48,13 +50,13 @@ func InitPortScheduler(portRange string) error {
 }
 
 func ClosePortScheduler() error {
-	return etcd.Put(etcd.Ports, usedPortSetKey, PortScheduler.serialize())
+	return store.Put(store.Ports, usedPortSetKey, PortScheduler.serialize())
 }
 
 func initPortFormEtcd() (s *portScheduler, err error) {
-	bytes, err := etcd.GetValue(etcd.Ports, usedPortSetKey)
+	bytes, err := store.GetValue(store.Ports, usedPortSetKey)
 	if err != nil {
-		if xerrors.IsNotExistInEtcdError(err) {
+		if xerrors.IsNotExistInStoreError(err) {
 			err = nil
 		} else {
 			return s, err
@@ -65,17 +67,18 @@ func initPortFormEtcd() (s *portScheduler, err error) {
 		UsedPortSet: make(map[string]struct{}),
 	}
 	if len(bytes) != 0 {
-		err = json.Unmarshal(bytes, &s)
+		err = models.DecodeRecord(models.KindPortSet, bytes, &s)
 	}
 	return s, err
 }
 
 // Apply for a specified number of ports
-func (ps *portScheduler) Apply(num int) ([]string, error) {
+func (ps *portScheduler) Apply(ctx context.Context, num int) ([]string, error) {
 	if num <= 0 || num > ps.AvailableCount {
 		return nil, errors.New("num must be greater than 0 and less than " + strconv.Itoa(ps.AvailableCount))
 	}
 
+	defer ps.persist(ctx)
 	ps.Lock()
 	defer ps.Unlock()
 
@@ -98,11 +101,12 @@ func (ps *portScheduler) Apply(num int) ([]string, error) {
 }
 
 // Restore a specified number of ports
-func (ps *portScheduler) Restore(ports []string) {
+func (ps *portScheduler) Restore(ctx context.Context, ports []string) {
 	if len(ports) <= 0 || len(ports) > ps.AvailableCount {
 		return
 	}
 
+	defer ps.persist(ctx)
 	ps.Lock()
 	defer ps.Unlock()
 
@@ -115,9 +119,17 @@ func (ps *portScheduler) serialize() *string {
 	ps.RLock()
 	defer ps.RUnlock()
 
-	bytes, _ := json.Marshal(ps)
-	tmp := string(bytes)
-	return &tmp
+	return models.EncodeRecord(models.KindPortSet, ps)
+}
+
+// persist saves the used ports to etcd asynchronously,
+// so that a standby can reload the latest state when it becomes the leader.
+func (ps *portScheduler) persist(ctx context.Context) {
+	workQueue.Enqueue(ctx, store.PutKeyValue{
+		Resource: store.Ports,
+		Key:      usedPortSetKey,
+		Value:    ps.serialize(),
+	})
 }
 
 // GetPortStatus get all ports status
@@ -0,0 +1,418 @@
+package services
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const (
+	backupFormatVersion = 1
+
+	// backupIndexFile is the first entry of a backup archive, it holds all keys of the store
+	backupIndexFile = "keys.json"
+	// mergesDir is where the merge snapshots are saved, it is relative to the working directory
+	mergesDir = "merges"
+)
+
+type AdminService struct{}
+
+// Backup writes a tar.gz archive of all keys of the store to w,
+// if withMerges is true, the merge snapshots on disk are also archived.
+func (as *AdminService) Backup(w io.Writer, withMerges bool) error {
+	kvs, err := store.Dump()
+	if err != nil {
+		return errors.WithMessage(err, "store.Dump failed")
+	}
+
+	backup := models.Backup{
+		FormatVersion: backupFormatVersion,
+		CreateTime:    time.Now().Format("2006-01-02 15:04:05"),
+		WithMerges:    withMerges,
+		Keys:          make([]*models.BackupKey, 0, len(kvs)),
+	}
+	for _, kv := range kvs {
+		backup.Keys = append(backup.Keys, &models.BackupKey{Key: kv.Key, Value: kv.Value})
+	}
+	index, err := json.Marshal(&backup)
+	if err != nil {
+		return errors.WithMessage(err, "json.Marshal failed")
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     backupIndexFile,
+		Mode:     0600,
+		Size:     int64(len(index)),
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "tar.WriteHeader failed, name: %s", backupIndexFile)
+	}
+	if _, err = tw.Write(index); err != nil {
+		return errors.Wrapf(err, "tar.Write failed, name: %s", backupIndexFile)
+	}
+
+	if withMerges {
+		if err = archiveDir(tw, mergesDir); err != nil {
+			return errors.WithMessage(err, "services.archiveDir failed")
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return errors.Wrap(err, "tar.Close failed")
+	}
+	if err = gw.Close(); err != nil {
+		return errors.Wrap(err, "gzip.Close failed")
+	}
+	log.Infof("services.Backup, %d keys are backed up, withMerges: %t", len(backup.Keys), withMerges)
+	return nil
+}
+
+// Restore loads a tar.gz archive created by Backup into the store,
+// the merge snapshots in the archive are extracted to the working directory.
+// The keys are validated before anything is extracted or loaded, and if any step fails,
+// the extracted files are removed and the store is left as it was.
+// It fails with StoreNotEmptyError if there is any replicaSet or volume in the store.
+func (as *AdminService) Restore(r io.Reader) (err error) {
+	empty, err := store.IsEmpty()
+	if err != nil {
+		return errors.WithMessage(err, "store.IsEmpty failed")
+	}
+	if !empty {
+		return xerrors.NewStoreNotEmptyError()
+	}
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Wrap(err, "gzip.NewReader failed")
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return errors.Wrap(err, "tar.Next failed")
+	}
+	if hdr.Name != backupIndexFile {
+		return errors.Errorf("invalid backup archive, the first entry is %s, expected %s", hdr.Name, backupIndexFile)
+	}
+	var backup models.Backup
+	if err = json.NewDecoder(tr).Decode(&backup); err != nil {
+		return errors.Wrapf(err, "json.Decode failed, name: %s", backupIndexFile)
+	}
+	if backup.FormatVersion != backupFormatVersion {
+		return errors.Errorf("unsupported backup format version: %d", backup.FormatVersion)
+	}
+
+	kvs := make([]*store.KeyValue, 0, len(backup.Keys))
+	for _, key := range backup.Keys {
+		// a key is put under the common prefix, it must not escape from it
+		if len(key.Key) == 0 || path.IsAbs(key.Key) || path.Clean(key.Key) != key.Key || strings.HasPrefix(key.Key, "..") {
+			return errors.Errorf("invalid backup archive, key: %q is invalid", key.Key)
+		}
+		if key.Value == nil {
+			return errors.Errorf("invalid backup archive, key: %s has no value", key.Key)
+		}
+		kvs = append(kvs, &store.KeyValue{Key: key.Key, Value: key.Value})
+	}
+	// records of an older schema version are upgraded, and a backup of a newer version is rejected before loading
+	upgraded, err := upgradeRecords(kvs)
+	if err != nil {
+		return errors.WithMessage(err, "services.upgradeRecords failed")
+	}
+	values := make(map[string][]byte, len(upgraded))
+	for _, kv := range upgraded {
+		values[kv.Key] = kv.Value
+	}
+	for _, kv := range kvs {
+		if value, ok := values[kv.Key]; ok {
+			kv.Value = value
+		}
+	}
+
+	// only the files that did not exist before are removed, in the reverse order, so directories are emptied first
+	extracted := make([]string, 0)
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(extracted) - 1; i >= 0; i-- {
+			_ = os.Remove(extracted[i])
+		}
+	}()
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "tar.Next failed")
+		}
+		name := filepath.Clean(hdr.Name)
+		_, statErr := os.Lstat(name)
+		if err = extractEntry(tr, hdr); err != nil {
+			return errors.WithMessagef(err, "services.extractEntry failed, name: %s", hdr.Name)
+		}
+		if os.IsNotExist(statErr) {
+			extracted = append(extracted, name)
+		}
+	}
+
+	prev, err := store.Dump()
+	if err != nil {
+		return errors.WithMessage(err, "store.Dump failed")
+	}
+	if err = store.Load(kvs); err != nil {
+		if unloadErr := unload(prev, kvs); unloadErr != nil {
+			log.Errorf("services.Restore, failed to remove the restored keys, error: %v", unloadErr)
+		}
+		return errors.WithMessage(err, "store.Load failed")
+	}
+	log.Infof("services.Restore, %d keys are restored, backup created at %s, withMerges: %t",
+		len(kvs), backup.CreateTime, backup.WithMerges)
+	return nil
+}
+
+// unload undoes a failed load of kvs, the keys that are in prev are put back, and the others are removed.
+func unload(prev, kvs []*store.KeyValue) error {
+	values := make(map[string][]byte, len(prev))
+	for _, kv := range prev {
+		values[kv.Key] = kv.Value
+	}
+	puts := make([]*store.KeyValue, 0)
+	dels := make([]string, 0)
+	for _, kv := range kvs {
+		if value, ok := values[kv.Key]; ok {
+			puts = append(puts, &store.KeyValue{Key: kv.Key, Value: value})
+		} else {
+			dels = append(dels, kv.Key)
+		}
+	}
+	if err := store.Load(puts); err != nil {
+		return errors.WithMessage(err, "store.Load failed")
+	}
+	return errors.WithMessage(store.Remove(dels), "store.Remove failed")
+}
+
+// WorkQueue returns the operations that are not written to the store yet,
+// and the dead letters, which are the operations that failed too many times.
+func (as *AdminService) WorkQueue() (pending, deadLetters []*workQueue.Entry, err error) {
+	if pending, err = workQueue.Pending(); err != nil {
+		return nil, nil, errors.Wrap(err, "workQueue.Pending failed")
+	}
+	if deadLetters, err = workQueue.DeadLetters(); err != nil {
+		return nil, nil, errors.Wrap(err, "workQueue.DeadLetters failed")
+	}
+	return pending, deadLetters, nil
+}
+
+// RetryDeadLetters puts the dead letters back to the work queue, all dead letters are retried if ids is empty.
+// When all are retried, the out of date ones are skipped, they can never be written, see workQueue.Retry.
+func (as *AdminService) RetryDeadLetters(ids ...uint64) ([]*workQueue.Entry, error) {
+	all := len(ids) == 0
+	if all {
+		deadLetters, err := workQueue.DeadLetters()
+		if err != nil {
+			return nil, errors.Wrap(err, "workQueue.DeadLetters failed")
+		}
+		for _, e := range deadLetters {
+			ids = append(ids, e.ID)
+		}
+	}
+
+	retried := make([]*workQueue.Entry, 0, len(ids))
+	for _, id := range ids {
+		e, err := workQueue.Retry(id)
+		if err != nil {
+			if all && xerrors.IsDeadLetterOutOfDateError(err) {
+				log.Warnf("services.RetryDeadLetters, dead letter: %d is skipped, error: %v", id, err)
+				continue
+			}
+			return retried, errors.Wrapf(err, "workQueue.Retry failed, id: %d", id)
+		}
+		retried = append(retried, e)
+		log.Infof("services.RetryDeadLetters, dead letter: %d is retried", e.ID)
+	}
+	return retried, nil
+}
+
+// archiveDir adds dir and everything under it to the archive, ownership, modes and links are kept.
+func archiveDir(tw *tar.Writer, dir string) error {
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		return nil
+	}
+
+	return filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode()&(fs.ModeSocket|fs.ModeDevice|fs.ModeNamedPipe) != 0 {
+			log.Warnf("services.Backup, %s is skipped, file mode: %s is not supported", name, info.Mode())
+			return nil
+		}
+
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(name); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// extractEntry extracts an entry of the archive, only entries under mergesDir are allowed.
+// The files are created without following symlinks, so an entry can't write out of mergesDir
+// through a symlink extracted before, whatever the archive contains.
+func extractEntry(tr *tar.Reader, hdr *tar.Header) error {
+	name := filepath.Clean(hdr.Name)
+	if name != mergesDir && !strings.HasPrefix(name, mergesDir+string(filepath.Separator)) {
+		return errors.Errorf("entry is out of %s", mergesDir)
+	}
+	// the checks below resolve the entries against mergesDir, so it must not be replaced
+	if name == mergesDir && hdr.Typeflag != tar.TypeDir {
+		return errors.Errorf("entry %s must be a directory", mergesDir)
+	}
+	// a symlink extracted before must not redirect the entry out of mergesDir
+	if err := checkParentInMerges(name); err != nil {
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := removeNonDir(name); err != nil {
+			return err
+		}
+		if err := os.Mkdir(name, hdr.FileInfo().Mode().Perm()); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg:
+		if err := removeNonDir(name); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, hdr.FileInfo().Mode().Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		_ = f.Close()
+		if err != nil {
+			// a truncated file is not left behind
+			_ = os.Remove(name)
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := removeNonDir(name); err != nil {
+			return err
+		}
+		if err := os.Symlink(hdr.Linkname, name); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		target := filepath.Clean(hdr.Linkname)
+		if !strings.HasPrefix(target, mergesDir+string(filepath.Separator)) {
+			return errors.Errorf("hard link target: %s is out of %s", hdr.Linkname, mergesDir)
+		}
+		// the target may be a symlink or under a symlink extracted before
+		if err := checkInMerges(target); err != nil {
+			return errors.WithMessagef(err, "hard link target: %s", hdr.Linkname)
+		}
+		if err := removeNonDir(name); err != nil {
+			return err
+		}
+		if err := os.Link(target, name); err != nil {
+			return err
+		}
+		return nil
+	default:
+		log.Warnf("services.Restore, %s is skipped, entry type: %c is not supported", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+
+	// the ownership can only be kept by root
+	_ = os.Lchown(name, hdr.Uid, hdr.Gid)
+	if hdr.Typeflag != tar.TypeSymlink {
+		_ = os.Chtimes(name, hdr.ModTime, hdr.ModTime)
+	}
+	return nil
+}
+
+// removeNonDir removes the file at name if it is not a directory, so that the entry replaces it instead of
+// writing through it, it fails if name is a directory.
+func removeNonDir(name string) error {
+	st, err := os.Lstat(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		return errors.Errorf("%s is a directory", name)
+	}
+	return os.Remove(name)
+}
+
+func checkParentInMerges(name string) error {
+	if name == mergesDir {
+		return nil
+	}
+	return checkInMerges(filepath.Dir(name))
+}
+
+// checkInMerges checks that name, with all symlinks resolved, is under mergesDir.
+func checkInMerges(name string) error {
+	root, err := filepath.EvalSymlinks(mergesDir)
+	if err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return err
+	}
+	if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return errors.Errorf("%s resolves to %s, which is out of %s", name, resolved, mergesDir)
+	}
+	return nil
+}
@@ -0,0 +1,439 @@
+package services
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// entry is an entry of a test archive, typ is one of tar.TypeDir, tar.TypeReg, tar.TypeSymlink and tar.TypeLink.
+type entry struct {
+	typ  byte
+	name string
+	// link is the target of a symlink or a hard link, or the content of a regular file
+	link string
+}
+
+// extractArchive builds an archive of entries and extracts it in a temporary working directory,
+// it returns the directory out of mergesDir that the archives try to write to, and the error of the first failed entry.
+func extractArchive(t *testing.T, entries func(outside string) []entry) (string, error) {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	outside := filepath.Join(dir, "outside")
+	if err = os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(outside, "passwd"), []byte("root"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries(outside) {
+		hdr := &tar.Header{Typeflag: e.typ, Name: e.name, Mode: 0644}
+		switch e.typ {
+		case tar.TypeDir:
+			hdr.Mode = 0755
+		case tar.TypeReg:
+			hdr.Size = int64(len(e.link))
+		default:
+			hdr.Linkname = e.link
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if e.typ == tar.TypeReg {
+			if _, err = tw.Write([]byte(e.link)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return outside, nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = extractEntry(tr, hdr); err != nil {
+			return outside, err
+		}
+	}
+}
+
+func assertOutsideUntouched(t *testing.T, outside string) {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join(outside, "passwd"))
+	if err != nil || string(content) != "root" {
+		t.Fatalf("the file out of merges is changed to %q, error: %v", content, err)
+	}
+	files, err := os.ReadDir(outside)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("%d files are out of merges, want 1, error: %v", len(files), err)
+	}
+}
+
+func TestExtractEntry(t *testing.T) {
+	_, err := extractArchive(t, func(string) []entry {
+		return []entry{
+			{tar.TypeDir, "merges", ""},
+			{tar.TypeDir, "merges/foo-1", ""},
+			{tar.TypeReg, "merges/foo-1/a", "hello"},
+			{tar.TypeSymlink, "merges/foo-1/b", "a"},
+			{tar.TypeLink, "merges/foo-1/c", "merges/foo-1/a"},
+			// an existing file is replaced
+			{tar.TypeReg, "merges/foo-1/a", "world"},
+		}
+	})
+	if err != nil {
+		t.Fatalf("extractEntry failed: %v", err)
+	}
+
+	for name, want := range map[string]string{"a": "world", "b": "world", "c": "hello"} {
+		content, err := os.ReadFile(filepath.Join("merges/foo-1", name))
+		if err != nil || string(content) != want {
+			t.Fatalf("%s is %q, error: %v, want %q", name, content, err, want)
+		}
+	}
+}
+
+func TestExtractEntryMalicious(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entries func(outside string) []entry
+		// fails is whether the archive is rejected, an archive that is not rejected must not write out of merges
+		fails bool
+	}{
+		{
+			name: "out of merges",
+			entries: func(outside string) []entry {
+				return []entry{{tar.TypeReg, "merges/../outside/passwd", "pwned"}}
+			},
+			fails: true,
+		},
+		{
+			name: "absolute path",
+			entries: func(outside string) []entry {
+				return []entry{{tar.TypeReg, filepath.Join(outside, "passwd"), "pwned"}}
+			},
+			fails: true,
+		},
+		{
+			name: "merges replaced by symlink",
+			entries: func(outside string) []entry {
+				return []entry{
+					{tar.TypeSymlink, "merges", outside},
+					{tar.TypeReg, "merges/passwd", "pwned"},
+				}
+			},
+			fails: true,
+		},
+		{
+			name: "file written through symlink",
+			entries: func(outside string) []entry {
+				return []entry{
+					{tar.TypeDir, "merges", ""},
+					{tar.TypeSymlink, "merges/x", filepath.Join(outside, "passwd")},
+					{tar.TypeReg, "merges/x", "pwned"},
+				}
+			},
+		},
+		{
+			name: "file written under symlinked directory",
+			entries: func(outside string) []entry {
+				return []entry{
+					{tar.TypeDir, "merges", ""},
+					{tar.TypeSymlink, "merges/d", outside},
+					{tar.TypeReg, "merges/d/passwd", "pwned"},
+				}
+			},
+			fails: true,
+		},
+		{
+			name: "directory created under symlinked directory",
+			entries: func(outside string) []entry {
+				return []entry{
+					{tar.TypeDir, "merges", ""},
+					{tar.TypeSymlink, "merges/d", outside},
+					{tar.TypeDir, "merges/d/sub", ""},
+				}
+			},
+			fails: true,
+		},
+		{
+			name: "directory over symlink",
+			entries: func(outside string) []entry {
+				return []entry{
+					{tar.TypeDir, "merges", ""},
+					{tar.TypeSymlink, "merges/d", outside},
+					{tar.TypeDir, "merges/d", ""},
+					{tar.TypeReg, "merges/d/passwd", "pwned"},
+				}
+			},
+		},
+		{
+			name: "hard link to symlink out of merges",
+			entries: func(outside string) []entry {
+				return []entry{
+					{tar.TypeDir, "merges", ""},
+					{tar.TypeSymlink, "merges/s", filepath.Join(outside, "passwd")},
+					{tar.TypeLink, "merges/h", "merges/s"},
+				}
+			},
+			fails: true,
+		},
+		{
+			name: "hard link under symlinked directory",
+			entries: func(outside string) []entry {
+				return []entry{
+					{tar.TypeDir, "merges", ""},
+					{tar.TypeSymlink, "merges/d", outside},
+					{tar.TypeLink, "merges/h", "merges/d/passwd"},
+					{tar.TypeReg, "merges/h", "pwned"},
+				}
+			},
+			fails: true,
+		},
+		{
+			name: "hard link out of merges",
+			entries: func(outside string) []entry {
+				return []entry{
+					{tar.TypeDir, "merges", ""},
+					{tar.TypeLink, "merges/h", filepath.Join(outside, "passwd")},
+				}
+			},
+			fails: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			outside, err := extractArchive(t, tc.entries)
+			if tc.fails && err == nil {
+				t.Fatal("the archive is extracted, want an error")
+			}
+			if !tc.fails && err != nil {
+				t.Fatalf("extractEntry failed: %v", err)
+			}
+			assertOutsideUntouched(t, outside)
+		})
+	}
+}
+
+// backupArchive builds a backup archive of kvs followed by entries.
+func backupArchive(t *testing.T, kvs map[string]string, entries []entry) io.Reader {
+	t.Helper()
+	backup := models.Backup{FormatVersion: backupFormatVersion, Keys: make([]*models.BackupKey, 0, len(kvs))}
+	for key, value := range kvs {
+		backup.Keys = append(backup.Keys, &models.BackupKey{Key: key, Value: []byte(value)})
+	}
+	index, err := json.Marshal(&backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	if err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: backupIndexFile, Mode: 0600, Size: int64(len(index))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tw.Write(index); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		hdr := &tar.Header{Typeflag: e.typ, Name: e.name, Mode: 0755}
+		if e.typ == tar.TypeReg {
+			hdr.Size = int64(len(e.link))
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tw.Write([]byte(e.link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestRestore(t *testing.T) {
+	newer := fmt.Sprintf(`{"schemaVersion":%d,"kind":"container","data":{"version":1}}`, models.SchemaVersion(models.KindContainer)+1)
+	for _, tc := range []struct {
+		name    string
+		kvs     map[string]string
+		entries []entry
+		fails   bool
+	}{
+		{
+			name: "restored",
+			kvs:  map[string]string{"containers/foo": `{"version":1}`, "versions/containerVersionMapKey": `{"foo":1}`},
+			entries: []entry{
+				{tar.TypeDir, "merges", ""},
+				{tar.TypeDir, "merges/foo-1", ""},
+				{tar.TypeReg, "merges/foo-1/a", "hello"},
+			},
+		},
+		{
+			name:    "newer schema version",
+			kvs:     map[string]string{"containers/foo": `{"version":1}`, "containers/foo/versions/1": newer},
+			entries: []entry{{tar.TypeDir, "merges", ""}, {tar.TypeReg, "merges/a", "hello"}},
+			fails:   true,
+		},
+		{
+			name:    "key out of the common prefix",
+			kvs:     map[string]string{"../other/containers/foo": `{"version":1}`},
+			entries: []entry{{tar.TypeDir, "merges", ""}, {tar.TypeReg, "merges/a", "hello"}},
+			fails:   true,
+		},
+		{
+			name: "entry out of merges",
+			kvs:  map[string]string{"containers/foo": `{"version":1}`},
+			entries: []entry{
+				{tar.TypeDir, "merges", ""},
+				{tar.TypeDir, "merges/foo-1", ""},
+				{tar.TypeReg, "merges/foo-1/a", "hello"},
+				{tar.TypeReg, "outside", "pwned"},
+			},
+			fails: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store.InitStore(store.NewMemoryStore(), "test", time.Second)
+			defer store.CloseStore()
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = os.Chdir(t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = os.Chdir(wd) }()
+
+			var as AdminService
+			err = as.Restore(backupArchive(t, tc.kvs, tc.entries))
+			if !tc.fails {
+				if err != nil {
+					t.Fatalf("Restore failed: %v", err)
+				}
+				if content, err := os.ReadFile("merges/foo-1/a"); err != nil || string(content) != "hello" {
+					t.Fatalf("got %q of the extracted file, error: %v, want hello", content, err)
+				}
+				if empty, err := store.IsEmpty(); err != nil || empty {
+					t.Fatalf("store.IsEmpty returned %t, %v after restore, want false", empty, err)
+				}
+				// the store is not empty any more
+				if err = as.Restore(backupArchive(t, tc.kvs, nil)); !xerrors.IsStoreNotEmptyError(err) {
+					t.Fatalf("Restore into a restored store returned %v, want StoreNotEmptyError", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatal("the archive is restored, want an error")
+			}
+			if _, err = os.Lstat("merges"); !os.IsNotExist(err) {
+				t.Fatalf("the extracted files are left behind, error: %v", err)
+			}
+			if kvs, err := store.Dump(); err != nil || len(kvs) != 0 {
+				t.Fatalf("got %d keys after a failed restore, error: %v, want none", len(kvs), err)
+			}
+		})
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+	store.InitStore(store.NewMemoryStore(), "test", time.Second)
+	defer store.CloseStore()
+
+	// the version maps and the scheduler state are saved even if there is nothing
+	for key, value := range map[string]string{
+		"versionMap": *models.EncodeRecord(models.KindVersionMap, map[string]int64{}),
+		"gpus":       `{"availableGpuNums":1,"gpuStatusMap":{"GPU-0":0}}`,
+	} {
+		resource := store.Versions
+		if key == "gpus" {
+			resource = store.Gpus
+		}
+		if err := store.Put(resource, key, &value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if empty, err := store.IsEmpty(); err != nil || !empty {
+		t.Fatalf("store.IsEmpty returned %t, %v, want true", empty, err)
+	}
+
+	for resource, value := range map[store.Resource]string{
+		store.Versions: *models.EncodeRecord(models.KindVersionMap, map[string]int64{"foo": 2}),
+		store.Merges:   `{}`,
+	} {
+		if err := store.Put(resource, "key", &value); err != nil {
+			t.Fatal(err)
+		}
+		if empty, err := store.IsEmpty(); err != nil || empty {
+			t.Fatalf("store.IsEmpty returned %t, %v with a key of %s, want false", empty, err, resource)
+		}
+		if err := store.Del(resource, "key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUnload(t *testing.T) {
+	store.InitStore(store.NewMemoryStore(), "test", time.Second)
+	defer store.CloseStore()
+
+	if err := store.Load([]*store.KeyValue{{Key: "gpus/gpuStatusMapKey", Value: []byte("before")}}); err != nil {
+		t.Fatal(err)
+	}
+	prev, err := store.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs := []*store.KeyValue{
+		{Key: "gpus/gpuStatusMapKey", Value: []byte("restored")},
+		{Key: "containers/foo", Value: []byte("restored")},
+	}
+	if err = store.Load(kvs); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = unload(prev, kvs); err != nil {
+		t.Fatalf("unload failed: %v", err)
+	}
+	if value, err := store.GetValue(store.Gpus, "gpuStatusMapKey"); err != nil || string(value) != "before" {
+		t.Fatalf("got %s, error: %v, want the value before the load", value, err)
+	}
+	if _, err = store.GetValue(store.Containers, "foo"); !xerrors.IsNotExistInStoreError(err) {
+		t.Fatalf("the loaded key is not removed, error: %v", err)
+	}
+}
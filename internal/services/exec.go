@@ -0,0 +1,222 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+)
+
+// execKillTimeout is how long a command left running by a closed session has to exit after SIGHUP before it is killed.
+const execKillTimeout = 5 * time.Second
+
+// execTimeout is the default timeout of the commands executed by ExecuteContainer, 0 means no timeout.
+var execTimeout time.Duration
+
+func InitExec(timeout time.Duration) {
+	execTimeout = timeout
+}
+
+// ExecSession is an interactive command running in a container with a tty,
+// the output of the tty is read from it, and the input is written to it.
+type ExecSession struct {
+	ID        string
+	Container string
+	resp      types.HijackedResponse
+	closeOnce sync.Once
+}
+
+// StartExecSession runs the command of spec in the latest version of the container with a tty of rows and cols,
+// the shell /bin/sh is run if there is no command. The session must be closed by Close.
+func (rs *ReplicaSetService) StartExecSession(name string, spec *models.ContainerExecute, rows, cols uint) (*ExecSession, error) {
+	// get the latest version number
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return nil, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+	}
+	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+
+	workDir := "/"
+	cmd := []string{"/bin/sh"}
+	if len(spec.WorkDir) != 0 {
+		workDir = spec.WorkDir
+	}
+	if len(spec.Cmd) != 0 {
+		cmd = spec.Cmd
+	}
+	var size *[2]uint
+	if rows != 0 && cols != 0 {
+		size = &[2]uint{rows, cols}
+	}
+
+	ctx := context.Background()
+	execCreate, err := docker.Cli.ContainerExecCreate(ctx, ctrVersionName, types.ExecConfig{
+		Tty:          true,
+		ConsoleSize:  size,
+		AttachStdin:  true,
+		AttachStderr: true,
+		AttachStdout: true,
+		Env:          []string{"TERM=xterm"},
+		WorkingDir:   workDir,
+		Cmd:          cmd,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerExecCreate failed, name: %s, cmd: %v", ctrVersionName, cmd)
+	}
+
+	resp, err := docker.Cli.ContainerExecAttach(ctx, execCreate.ID, types.ExecStartCheck{Tty: true, ConsoleSize: size})
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerExecAttach failed, name: %s, exec: %s", ctrVersionName, execCreate.ID)
+	}
+
+	log.Infof("services.StartExecSession, container: %s exec session: %s started, cmd: %v", ctrVersionName, execCreate.ID, cmd)
+	return &ExecSession{ID: execCreate.ID, Container: ctrVersionName, resp: resp}, nil
+}
+
+// Read reads the output of the tty, it returns io.EOF when the command exits.
+func (s *ExecSession) Read(p []byte) (int, error) {
+	return s.resp.Reader.Read(p)
+}
+
+// Write writes to the input of the tty.
+func (s *ExecSession) Write(p []byte) (int, error) {
+	return s.resp.Conn.Write(p)
+}
+
+var _ io.ReadWriter = (*ExecSession)(nil)
+
+// Resize changes the size of the tty.
+func (s *ExecSession) Resize(rows, cols uint) error {
+	err := docker.Cli.ContainerExecResize(context.TODO(), s.ID, types.ResizeOptions{Height: rows, Width: cols})
+	return errors.Wrapf(err, "docker.ContainerExecResize failed, exec: %s", s.ID)
+}
+
+// ExitCode returns the exit code of the command, it should be called after the output reaches io.EOF.
+func (s *ExecSession) ExitCode() (int, error) {
+	resp, err := docker.Cli.ContainerExecInspect(context.TODO(), s.ID)
+	if err != nil {
+		return 0, errors.Wrapf(err, "docker.ContainerExecInspect failed, exec: %s", s.ID)
+	}
+	return resp.ExitCode, nil
+}
+
+// Close detaches from the session, the command is hung up like a closed terminal if it is still running,
+// and killed if it does not exit in execKillTimeout.
+func (s *ExecSession) Close() {
+	s.closeOnce.Do(func() {
+		s.resp.Close()
+
+		resp, err := docker.Cli.ContainerExecInspect(context.TODO(), s.ID)
+		if err != nil {
+			log.Errorf("services.ExecSession.Close, failed to inspect exec: %s, error: %v", s.ID, err)
+			return
+		}
+		if !resp.Running || resp.Pid == 0 {
+			return
+		}
+
+		if err = signalExec(resp, syscall.SIGHUP); err != nil {
+			log.Warnf("services.ExecSession.Close, exec: %s of container: %s is left running, error: %v", s.ID, s.Container, err)
+			return
+		}
+		go func() {
+			if waitExec(s.ID, execKillTimeout) {
+				return
+			}
+			log.Warnf("services.ExecSession.Close, exec: %s of container: %s is killed, it does not exit after hangup",
+				s.ID, s.Container)
+			if err := signalExec(resp, syscall.SIGKILL); err != nil {
+				log.Errorf("services.ExecSession.Close, failed to kill exec: %s, error: %v", s.ID, err)
+			}
+		}()
+	})
+}
+
+// waitExec waits at most timeout for the command of the exec to exit, it reports whether the command is not running.
+func waitExec(id string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if resp, err := docker.Cli.ContainerExecInspect(context.TODO(), id); err != nil || !resp.Running {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// killExec kills the command of the exec if it is running, and waits for it to exit.
+func killExec(id string) error {
+	resp, err := docker.Cli.ContainerExecInspect(context.TODO(), id)
+	if err != nil {
+		return errors.Wrapf(err, "docker.ContainerExecInspect failed, exec: %s", id)
+	}
+	if !resp.Running || resp.Pid == 0 {
+		return nil
+	}
+	if err = signalExec(resp, syscall.SIGKILL); err != nil {
+		return errors.WithMessagef(err, "services.signalExec failed, exec: %s", id)
+	}
+	if !waitExec(id, execKillTimeout) {
+		return errors.Errorf("exec: %s does not exit after it is killed", id)
+	}
+	return nil
+}
+
+// signalExec sends sig to the command of the exec. The pid of the command is in the pid namespace of the docker daemon,
+// so it is only signalled if the daemon listens on a local unix socket and the process with that pid, as seen by us,
+// is in the pid namespace of the container, i.e. we share the pid namespace with the daemon, e.g. run on the host.
+// Otherwise the pid may belong to an unrelated process, and nothing is signalled.
+func signalExec(resp types.ContainerExecInspect, sig syscall.Signal) error {
+	if !strings.HasPrefix(docker.Cli.DaemonHost(), "unix://") {
+		return errors.Errorf("the docker daemon: %s is not local, pid: %d can't be signalled", docker.Cli.DaemonHost(), resp.Pid)
+	}
+	ctr, err := docker.Cli.ContainerInspect(context.TODO(), resp.ContainerID)
+	if err != nil {
+		return errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", resp.ContainerID)
+	}
+	if ctr.State == nil || ctr.State.Pid == 0 {
+		return errors.Errorf("container: %s is not running", resp.ContainerID)
+	}
+	execNs, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", resp.Pid))
+	if err != nil {
+		return errors.Wrapf(err, "pid: %d is not found, the docker daemon is in another pid namespace", resp.Pid)
+	}
+	ctrNs, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", ctr.State.Pid))
+	if err != nil || execNs != ctrNs {
+		return errors.Errorf("pid: %d is not in container: %s, the docker daemon is in another pid namespace",
+			resp.Pid, resp.ContainerID)
+	}
+	return errors.Wrapf(syscall.Kill(resp.Pid, sig), "syscall.Kill failed, pid: %d", resp.Pid)
+}
+
+// limitedBuffer keeps the first limit bytes written to it and drops the rest, 0 means no limit.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.limit > 0 && b.Len()+len(p) > b.limit {
+		b.truncated = true
+		_, _ = b.Buffer.Write(p[:b.limit-b.Len()])
+		// the rest is consumed, so that the command is not blocked by its output
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,384 @@
+package services
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const (
+	// maxListEntries is the number of files returned by ListContainerPath at most.
+	maxListEntries = 1000
+	// listArchiveLimit is the size in bytes of the archive of the directory read by ListContainerPath at most,
+	// the content of the files is read through to get to the next header.
+	listArchiveLimit = 64 << 20
+)
+
+// fileSizeLimit is the size in bytes of the files uploaded to or downloaded from a container at most, 0 means no limit.
+var fileSizeLimit int64
+
+func InitFiles(limit int64) {
+	fileSizeLimit = limit
+}
+
+// FileDownload is the content of a file or an archive of a directory downloaded from a container,
+// it must be closed by Close.
+type FileDownload struct {
+	io.ReadCloser
+	Name string
+	// Size is -1 if it is unknown
+	Size int64
+	// Archive is true if the content is a tar archive
+	Archive bool
+}
+
+// StatContainerPath returns the information of the file at p in the latest version of the container.
+func (rs *ReplicaSetService) StatContainerPath(name, p string) (*models.FileInfo, error) {
+	ctrVersionName, err := latestContainer(name)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := docker.Cli.ContainerStatPath(context.TODO(), ctrVersionName, p)
+	if err != nil {
+		return nil, wrapPathError(err, "docker.ContainerStatPath", ctrVersionName, p)
+	}
+	return statFileInfo(stat), nil
+}
+
+// ListContainerPath returns the files in the directory at p in the latest version of the container,
+// or the file itself if p is not a directory.
+// The files are read from the headers of the archive of the directory, so that it works in a stopped container too,
+// the list stops after maxListEntries files, or listArchiveLimit bytes of the archive, and is truncated.
+func (rs *ReplicaSetService) ListContainerPath(ctx context.Context, name, p string) (*models.FileList, error) {
+	ctrVersionName, err := latestContainer(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p = path.Clean(p)
+	stat, err := docker.Cli.ContainerStatPath(ctx, ctrVersionName, p)
+	if err != nil {
+		return nil, wrapPathError(err, "docker.ContainerStatPath", ctrVersionName, p)
+	}
+	list := &models.FileList{Path: p, Entries: make([]*models.FileInfo, 0)}
+	if !stat.Mode.IsDir() {
+		list.Entries = append(list.Entries, statFileInfo(stat))
+		return list, nil
+	}
+
+	rc, _, err := docker.Cli.CopyFromContainer(ctx, ctrVersionName, p)
+	if err != nil {
+		return nil, wrapPathError(err, "docker.CopyFromContainer", ctrVersionName, p)
+	}
+	// the rest of the archive is not sent once it is closed
+	defer rc.Close()
+
+	list.Entries, list.Truncated, err = listArchive(rc, maxListEntries, listArchiveLimit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read archive of container: %s, path: %s", ctrVersionName, p)
+	}
+	return list, nil
+}
+
+// listArchive returns the files directly in the directory archived in r, whose first entry is the directory itself.
+// The files in the subdirectories are skipped, it stops after limit files or size bytes of r and the list is truncated.
+func listArchive(r io.Reader, limit int, size int64) ([]*models.FileInfo, bool, error) {
+	limited := &limitedReader{Reader: r, n: size}
+	tr := tar.NewReader(limited)
+	entries := make([]*models.FileInfo, 0)
+	root := ""
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, false, nil
+		}
+		if err != nil {
+			if limited.exceeded {
+				return entries, true, nil
+			}
+			return nil, false, err
+		}
+
+		name := strings.Trim(path.Clean(hdr.Name), "/")
+		if name == "." {
+			name = ""
+		}
+		if i == 0 {
+			root = name
+			continue
+		}
+		if root != "" {
+			if !strings.HasPrefix(name, root+"/") {
+				continue
+			}
+			name = name[len(root)+1:]
+		}
+		if strings.Contains(name, "/") {
+			continue
+		}
+
+		if len(entries) == limit {
+			return entries, true, nil
+		}
+		entries = append(entries, headerFileInfo(hdr, name))
+	}
+}
+
+// DownloadContainerPath reads the file at p in the latest version of the container,
+// a directory, or a file if archive is true, is read as a tar archive.
+func (rs *ReplicaSetService) DownloadContainerPath(ctx context.Context, name, p string, archive bool) (*FileDownload, error) {
+	ctrVersionName, err := latestContainer(name)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, stat, err := docker.Cli.CopyFromContainer(ctx, ctrVersionName, p)
+	if err != nil {
+		return nil, wrapPathError(err, "docker.CopyFromContainer", ctrVersionName, p)
+	}
+	// the archive of a symbolic link only has the link, the file it points to is read instead
+	if stat.Mode&os.ModeSymlink != 0 && !archive {
+		_ = rc.Close()
+		p = stat.LinkTarget
+		if rc, stat, err = docker.Cli.CopyFromContainer(ctx, ctrVersionName, p); err != nil {
+			return nil, wrapPathError(err, "docker.CopyFromContainer", ctrVersionName, p)
+		}
+	}
+
+	if archive || !stat.Mode.IsRegular() {
+		return archiveDownload(rc, stat.Name)
+	}
+
+	if fileSizeLimit > 0 && stat.Size > fileSizeLimit {
+		_ = rc.Close()
+		return nil, errors.Wrapf(xerrors.NewFileTooLargeError(), "container: %s, path: %s, size: %d, limit: %d",
+			ctrVersionName, p, stat.Size, fileSizeLimit)
+	}
+	tr := tar.NewReader(rc)
+	hdr, err := tr.Next()
+	if err != nil {
+		_ = rc.Close()
+		return nil, errors.Wrapf(err, "failed to read archive of container: %s, path: %s", ctrVersionName, p)
+	}
+	return &FileDownload{
+		ReadCloser: struct {
+			io.Reader
+			io.Closer
+		}{tr, rc},
+		Name: stat.Name,
+		Size: hdr.Size,
+	}, nil
+}
+
+// archiveDownload returns the archive of rc, it is saved in a temporary file first if there is a size limit,
+// so that a too large archive is rejected before it is sent.
+func archiveDownload(rc io.ReadCloser, name string) (*FileDownload, error) {
+	download := &FileDownload{Name: name + ".tar", Size: -1, Archive: true}
+	if fileSizeLimit <= 0 {
+		download.ReadCloser = rc
+		return download, nil
+	}
+	defer rc.Close()
+
+	f, size, err := spool(rc)
+	if err != nil {
+		return nil, err
+	}
+	download.ReadCloser, download.Size = f, size
+	return download, nil
+}
+
+// UploadContainerPath writes content to the latest version of the container.
+// If archive is true, content is a tar archive extracted into the directory p,
+// otherwise it is a file of size bytes written to p, size is -1 if it is unknown.
+func (rs *ReplicaSetService) UploadContainerPath(ctx context.Context, name, p string, content io.Reader, size int64, archive bool) error {
+	ctrVersionName, err := latestContainer(name)
+	if err != nil {
+		return err
+	}
+	if fileSizeLimit > 0 && size > fileSizeLimit {
+		return errors.Wrapf(xerrors.NewFileTooLargeError(), "container: %s, path: %s, size: %d, limit: %d",
+			ctrVersionName, p, size, fileSizeLimit)
+	}
+
+	dest := p
+	var limited *limitedReader
+	if archive {
+		if fileSizeLimit > 0 {
+			limited = &limitedReader{Reader: content, n: fileSizeLimit}
+			content = limited
+		}
+	} else {
+		// the size is written before the content in the tar header
+		if size < 0 {
+			f, n, err := spool(content)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			content, size = f, n
+		}
+		dest = path.Dir(p)
+		pr := tarFile(path.Base(p), content, size)
+		// the writing of the archive is stopped if the request fails
+		defer pr.Close()
+		content = pr
+	}
+
+	err = docker.Cli.CopyToContainer(ctx, ctrVersionName, dest, content, types.CopyToContainerOptions{})
+	if err != nil {
+		// the error of reading the content is wrapped by the request
+		if limited != nil && limited.exceeded {
+			return errors.Wrapf(xerrors.NewFileTooLargeError(), "container: %s, path: %s, limit: %d",
+				ctrVersionName, p, fileSizeLimit)
+		}
+		return wrapPathError(err, "docker.CopyToContainer", ctrVersionName, dest)
+	}
+	log.Infof("services.UploadContainerPath, container: %s path: %s uploaded, archive: %t", ctrVersionName, p, archive)
+	return nil
+}
+
+// latestContainer returns the name of the latest version of the container of the replicaSet.
+func latestContainer(name string) (string, error) {
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return "", errors.Wrapf(xerrors.NewContainerNotFoundError(), "container: %s not found in ContainerVersionMap", name)
+	}
+	return fmt.Sprintf("%s-%d", name, version), nil
+}
+
+func wrapPathError(err error, op, container, p string) error {
+	if client.IsErrNotFound(err) {
+		return errors.Wrapf(xerrors.NewFileNotFoundError(), "%s failed, container: %s, path: %s, error: %v", op, container, p, err)
+	}
+	return errors.Wrapf(err, "%s failed, container: %s, path: %s", op, container, p)
+}
+
+func statFileInfo(stat types.ContainerPathStat) *models.FileInfo {
+	return &models.FileInfo{
+		Name:       stat.Name,
+		Size:       stat.Size,
+		Mode:       stat.Mode.String(),
+		IsDir:      stat.Mode.IsDir(),
+		ModTime:    stat.Mtime.Format(time.RFC3339),
+		LinkTarget: stat.LinkTarget,
+	}
+}
+
+func headerFileInfo(hdr *tar.Header, name string) *models.FileInfo {
+	info := &models.FileInfo{
+		Name:    name,
+		Size:    hdr.Size,
+		Mode:    hdr.FileInfo().Mode().String(),
+		IsDir:   hdr.Typeflag == tar.TypeDir,
+		ModTime: hdr.ModTime.Format(time.RFC3339),
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		info.LinkTarget = hdr.Linkname
+	}
+	return info
+}
+
+// tarFile returns a tar archive that has only the file name with the content of size bytes.
+func tarFile(name string, content io.Reader, size int64) *io.PipeReader {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     size,
+			ModTime:  time.Now(),
+		})
+		if err == nil {
+			// the content shorter than size must fail the archive, not end it
+			if _, err = io.CopyN(tw, content, size); err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		_ = pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// spool saves r in a temporary file, which is removed when it is closed, and returns the file at the beginning,
+// it fails if r is larger than fileSizeLimit.
+func spool(r io.Reader) (*tempFile, int64, error) {
+	f, err := os.CreateTemp("", "gpu-docker-api-file-")
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "os.CreateTemp failed")
+	}
+	tf := &tempFile{f}
+
+	src := r
+	if fileSizeLimit > 0 {
+		src = &limitedReader{Reader: r, n: fileSizeLimit}
+	}
+	n, err := io.Copy(f, src)
+	if err != nil {
+		_ = tf.Close()
+		if xerrors.IsFileTooLargeError(err) {
+			return nil, 0, errors.Wrapf(err, "limit: %d", fileSizeLimit)
+		}
+		return nil, 0, errors.Wrapf(err, "failed to write temporary file: %s", f.Name())
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		_ = tf.Close()
+		return nil, 0, errors.Wrapf(err, "failed to seek temporary file: %s", f.Name())
+	}
+	return tf, n, nil
+}
+
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	_ = os.Remove(f.Name())
+	return err
+}
+
+// limitedReader reads at most n bytes from Reader, it fails with the FileTooLarge error if there are more.
+type limitedReader struct {
+	io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.exceeded {
+		return 0, xerrors.NewFileTooLargeError()
+	}
+	// one more byte is read to know whether there are more
+	if int64(len(p)) > r.n+1 {
+		p = p[:r.n+1]
+	}
+	n, err := r.Reader.Read(p)
+	r.n -= int64(n)
+	if r.n < 0 {
+		r.exceeded = true
+		return n + int(r.n), xerrors.NewFileTooLargeError()
+	}
+	return n, err
+}
@@ -0,0 +1,134 @@
+package services
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+}
+
+// dirArchive returns an archive like the one of a directory copied from a container.
+func dirArchive(t *testing.T, entries ...tarEntry) *bytes.Buffer {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Typeflag: e.typeflag,
+			Name:     e.name,
+			Linkname: e.linkname,
+			Mode:     0644,
+			Size:     int64(len(e.content)),
+			ModTime:  time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC),
+		}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestListArchive(t *testing.T) {
+	checkpoints := []tarEntry{
+		{name: "checkpoints/", typeflag: tar.TypeDir},
+		{name: "checkpoints/model.pt", typeflag: tar.TypeReg, content: strings.Repeat("m", 1024)},
+		{name: "checkpoints/epoch-1/", typeflag: tar.TypeDir},
+		{name: "checkpoints/epoch-1/model.pt", typeflag: tar.TypeReg, content: "epoch-1"},
+		{name: "checkpoints/latest", typeflag: tar.TypeSymlink, linkname: "model.pt"},
+		{name: "checkpoints/log.txt", typeflag: tar.TypeReg, content: "loss"},
+	}
+	for _, tc := range []struct {
+		name          string
+		entries       []tarEntry
+		limit         int
+		size          int64
+		want          []string
+		wantTruncated bool
+	}{
+		{"direct children only", checkpoints, 10, 1 << 20, []string{"model.pt", "epoch-1", "latest", "log.txt"}, false},
+		{"stop at limit", checkpoints, 2, 1 << 20, []string{"model.pt", "epoch-1"}, true},
+		{"limit is the number of children", checkpoints, 4, 1 << 20, []string{"model.pt", "epoch-1", "latest", "log.txt"}, false},
+		// the content of model.pt is larger than the size
+		{"stop at size", checkpoints, 10, 1024, []string{"model.pt"}, true},
+		{"empty directory", checkpoints[:1], 10, 1 << 20, []string{}, false},
+		{"root directory", []tarEntry{
+			{name: "/", typeflag: tar.TypeDir},
+			{name: "/etc/", typeflag: tar.TypeDir},
+			{name: "/etc/hosts", typeflag: tar.TypeReg, content: "localhost"},
+			{name: "/root/", typeflag: tar.TypeDir},
+		}, 10, 1 << 20, []string{"etc", "root"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			entries, truncated, err := listArchive(dirArchive(t, tc.entries...), tc.limit, tc.size)
+			if err != nil {
+				t.Fatalf("listArchive failed: %v", err)
+			}
+			names := make([]string, 0, len(entries))
+			for _, e := range entries {
+				names = append(names, e.Name)
+			}
+			if !reflect.DeepEqual(names, tc.want) {
+				t.Errorf("got entries %v, want %v", names, tc.want)
+			}
+			if truncated != tc.wantTruncated {
+				t.Errorf("got truncated %t, want %t", truncated, tc.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestListArchiveFileInfo(t *testing.T) {
+	entries, _, err := listArchive(dirArchive(t,
+		tarEntry{name: "checkpoints/", typeflag: tar.TypeDir},
+		tarEntry{name: "checkpoints/epoch-1/", typeflag: tar.TypeDir},
+		tarEntry{name: "checkpoints/latest", typeflag: tar.TypeSymlink, linkname: "model.pt"},
+		tarEntry{name: "checkpoints/log.txt", typeflag: tar.TypeReg, content: "loss"},
+	), 10, 1<<20)
+	if err != nil {
+		t.Fatalf("listArchive failed: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+
+	dir, link, file := entries[0], entries[1], entries[2]
+	if !dir.IsDir || dir.Mode != "drwxr-xr-x" {
+		t.Errorf("got directory %+v", dir)
+	}
+	if link.IsDir || link.LinkTarget != "model.pt" || !strings.HasPrefix(link.Mode, "L") {
+		t.Errorf("got symbolic link %+v", link)
+	}
+	if file.IsDir || file.Size != 4 || file.Mode != "-rw-r--r--" || file.ModTime != "2024-06-10T12:00:00Z" {
+		t.Errorf("got file %+v", file)
+	}
+}
+
+func TestListArchiveBroken(t *testing.T) {
+	buf := dirArchive(t,
+		tarEntry{name: "checkpoints/", typeflag: tar.TypeDir},
+		tarEntry{name: "checkpoints/log.txt", typeflag: tar.TypeReg, content: strings.Repeat("l", 1024)},
+	)
+	// the archive is cut in the content of log.txt
+	broken := bytes.NewReader(buf.Bytes()[:1024])
+	if _, _, err := listArchive(broken, 10, 1<<20); err == nil {
+		t.Error("listArchive of a broken archive succeeded")
+	}
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// maxLogLineSize is the size of a line of the logs, a longer line is split.
+const maxLogLineSize = 64 << 10
+
+// LogReader reads the logs of a container line by line, it must be closed by Close.
+type LogReader struct {
+	Container  string
+	rc         io.ReadCloser
+	tty        bool
+	timestamps bool
+}
+
+// ContainerLogs opens the logs of the container of the replicaSet version in spec,
+// the container of a previous version can be read only if it is not deleted.
+func (rs *ReplicaSetService) ContainerLogs(ctx context.Context, name string, spec *models.LogsRequest) (*LogReader, error) {
+	// get the latest version number
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return nil, errors.Wrapf(xerrors.NewContainerNotFoundError(), "container: %s not found in ContainerVersionMap", name)
+	}
+	if spec.Version != 0 {
+		version = spec.Version
+	}
+	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+
+	resp, err := docker.Cli.ContainerInspect(ctx, ctrVersionName)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil, errors.Wrapf(xerrors.NewContainerNotFoundError(), "container: %s", ctrVersionName)
+		}
+		return nil, errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", ctrVersionName)
+	}
+
+	rc, err := docker.Cli.ContainerLogs(ctx, ctrVersionName, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Since:      spec.Since,
+		Until:      spec.Until,
+		Timestamps: spec.Timestamps,
+		Follow:     spec.Follow,
+		Tail:       spec.Tail,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerLogs failed, name: %s, spec: %+v", ctrVersionName, spec)
+	}
+	return &LogReader{Container: ctrVersionName, rc: rc, tty: resp.Config.Tty, timestamps: spec.Timestamps}, nil
+}
+
+// Each calls fn with every line of the logs until the end of the logs,
+// when following, the end is reached after the container stops.
+func (r *LogReader) Each(fn func(line *models.LogLine)) error {
+	stdout := &logLineWriter{stream: models.LogStreamStdout, timestamps: r.timestamps, fn: fn}
+	stderr := &logLineWriter{stream: models.LogStreamStderr, timestamps: r.timestamps, fn: fn}
+
+	var err error
+	// the output of a container with a tty is not multiplexed, stderr is a part of stdout
+	if r.tty {
+		_, err = io.Copy(stdout, r.rc)
+	} else {
+		_, err = stdcopy.StdCopy(stdout, stderr, r.rc)
+	}
+	stdout.flush()
+	stderr.flush()
+	return errors.Wrapf(err, "failed to read logs of container: %s", r.Container)
+}
+
+func (r *LogReader) Close() error {
+	return r.rc.Close()
+}
+
+// logLineWriter splits the output of a stream written to it into lines.
+type logLineWriter struct {
+	stream     string
+	timestamps bool
+	buf        []byte
+	fn         func(line *models.LogLine)
+}
+
+func (w *logLineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) >= maxLogLineSize {
+		w.flush()
+	}
+	return len(p), nil
+}
+
+// flush emits the incomplete line.
+func (w *logLineWriter) flush() {
+	if len(w.buf) != 0 {
+		w.emit(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *logLineWriter) emit(b []byte) {
+	// a tty ends the lines with \r\n
+	b = bytes.TrimSuffix(b, []byte("\r"))
+	line := &models.LogLine{Stream: w.stream}
+	if w.timestamps {
+		// the timestamp is separated from the line by a space, e.g. 2024-01-22T03:01:02.123456789Z hello
+		if ts, rest, ok := bytes.Cut(b, []byte(" ")); ok {
+			line.Timestamp, b = string(ts), rest
+		}
+	}
+	line.Line = string(b)
+	w.fn(line)
+}
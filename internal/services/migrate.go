@@ -0,0 +1,145 @@
+package services
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const (
+	// recordSchemaMigrationKey saves the schema versions that the records in the store have been upgraded to.
+	recordSchemaMigrationKey = "recordSchema"
+
+	// migrateAttempts is how many times the store is dumped and upgraded
+	// while records keep being changed by others during the migration.
+	migrateAttempts = 3
+)
+
+// MigrateRecords upgrades every record in the store to the current schema version of its kind.
+// Records are also upgraded when they are decoded, so it only saves the upgrade from being repeated on every read.
+// It is skipped if the schema versions have not changed since the last run.
+// It must only be run by the leader, because older instances can't decode the upgraded records,
+// and every record is only replaced if it has not been changed since it was read.
+func MigrateRecords() error {
+	current := models.SchemaVersions()
+	bytes, err := store.GetValue(store.Migrations, recordSchemaMigrationKey)
+	if err != nil && !xerrors.IsNotExistInStoreError(err) {
+		return errors.WithMessage(err, "store.GetValue failed")
+	}
+	if err == nil {
+		var migrated map[models.Kind]int
+		if err = json.Unmarshal(bytes, &migrated); err == nil && reflect.DeepEqual(migrated, current) {
+			return nil
+		}
+	}
+
+	var total int
+	for attempt := 1; ; attempt++ {
+		kvs, err := store.Dump()
+		if err != nil {
+			return errors.WithMessage(err, "store.Dump failed")
+		}
+		upgraded, err := upgradeRecords(kvs)
+		if err != nil {
+			return errors.WithMessage(err, "services.upgradeRecords failed")
+		}
+		saved, err := putRecords(upgraded)
+		if err != nil {
+			return errors.WithMessage(err, "services.putRecords failed")
+		}
+		total += saved
+		if saved == len(upgraded) {
+			break
+		}
+		if attempt == migrateAttempts {
+			return errors.Errorf("%d records are still changed by others after %d attempts", len(upgraded)-saved, attempt)
+		}
+		log.Warnf("services.MigrateRecords, %d records are changed during the migration, try again", len(upgraded)-saved)
+	}
+
+	bytes, _ = json.Marshal(current)
+	done := string(bytes)
+	if err = store.Put(store.Migrations, recordSchemaMigrationKey, &done); err != nil {
+		return errors.WithMessage(err, "store.Put failed")
+	}
+	log.Infof("services.MigrateRecords, %d records are upgraded, schema versions: %s", total, done)
+	return nil
+}
+
+// putRecords replaces every record of kvs if it is still at the revision it was read at,
+// it returns the number of replaced records, the others have been changed since then.
+func putRecords(kvs []*store.KeyValue) (int, error) {
+	var saved int
+	for _, kv := range kvs {
+		ok, err := store.CompareAndPut(kv.Key, kv.Value, kv.Revision)
+		if err != nil {
+			return saved, err
+		}
+		if ok {
+			saved++
+		}
+	}
+	return saved, nil
+}
+
+// upgradeRecords upgrades the records of kvs and returns the upgraded ones, keys are relative to CommonPrefix,
+// the revisions are kept so that the records are only replaced if they are not changed since then.
+func upgradeRecords(kvs []*store.KeyValue) ([]*store.KeyValue, error) {
+	upgraded := make([]*store.KeyValue, 0)
+	for _, kv := range kvs {
+		kind, ok := recordKind(kv.Key)
+		if !ok {
+			continue
+		}
+		record, changed, err := models.UpgradeRecord(kind, kv.Value)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "key: %s", kv.Key)
+		}
+		if changed {
+			upgraded = append(upgraded, &store.KeyValue{Key: kv.Key, Value: []byte(*record.Serialize()), Revision: kv.Revision})
+		}
+	}
+	return upgraded, nil
+}
+
+// recordKind returns the kind of record saved in key, key is relative to CommonPrefix,
+// e.g. containers/foo/versions/1.
+func recordKind(key string) (models.Kind, bool) {
+	resource, rest, _ := strings.Cut(key, "/")
+	parts := strings.Split(rest, "/")
+	switch resource {
+	case store.Containers:
+		switch {
+		case len(parts) == 1, len(parts) == 3 && parts[1] == "versions":
+			return models.KindContainer, true
+		case len(parts) == 2 && parts[1] == retentionKey:
+			return models.KindRetentionPolicy, true
+		case len(parts) == 2 && parts[1] == containerStateKey:
+			return models.KindContainerState, true
+		case len(parts) == 3 && parts[1] == snapshotsKey:
+			return models.KindSnapshot, true
+		}
+	case store.Volumes:
+		if len(parts) == 1 || len(parts) == 3 && parts[1] == "versions" {
+			return models.KindVolume, true
+		}
+	case store.Gpus:
+		return models.KindGpuStatus, true
+	case store.Ports:
+		return models.KindPortSet, true
+	case store.Versions:
+		return models.KindVersionMap, true
+	case store.Merges:
+		return models.KindMergeMap, true
+	case store.Operations:
+		return models.KindOperation, true
+	}
+	return "", false
+}
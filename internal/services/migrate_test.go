@@ -0,0 +1,168 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/store"
+)
+
+func TestRecordKind(t *testing.T) {
+	for key, want := range map[string]models.Kind{
+		"containers/foo":                         models.KindContainer,
+		"containers/foo/versions/3":              models.KindContainer,
+		"containers/foo/retention":               models.KindRetentionPolicy,
+		"containers/foo/state":                   models.KindContainerState,
+		"containers/foo/snapshots/3":             models.KindSnapshot,
+		"volumes/bar":                            models.KindVolume,
+		"volumes/bar/versions/2":                 models.KindVolume,
+		"gpus/gpuStatusMapKey":                   models.KindGpuStatus,
+		"ports/usedPortSetKey":                   models.KindPortSet,
+		"versions/containerVersionMapKey":        models.KindVersionMap,
+		"merges/foo":                             models.KindMergeMap,
+		"operations/op-1":                        models.KindOperation,
+		"containers/foo/unknown":                 "",
+		"volumes/bar/unknown/2":                  "",
+		"migrations/" + recordSchemaMigrationKey: "",
+	} {
+		kind, ok := recordKind(key)
+		if kind != want || ok != (len(want) != 0) {
+			t.Errorf("recordKind(%s) = %s, %t, want %s", key, kind, ok, want)
+		}
+	}
+}
+
+func TestMigrateRecords(t *testing.T) {
+	store.InitStore(store.NewMemoryStore(), "test", time.Second)
+	defer store.CloseStore()
+
+	bare := map[string]string{
+		"containers/foo":                  `{"version":3,"containerName":"foo-3"}`,
+		"containers/foo/versions/3":       `{"version":3,"containerName":"foo-3"}`,
+		"containers/foo/retention":        `{"keepLast":5,"keepDays":7,"pinned":[3]}`,
+		"containers/foo/state":            `{"state":"running","version":3}`,
+		"containers/foo/snapshots/3":      `{"replicaSet":"foo","version":3,"location":"merges/foo-3"}`,
+		"volumes/bar":                     `{"version":2,"opt":{"Name":"bar-2"}}`,
+		"gpus/gpuStatusMapKey":            `{"availableGpuNums":1,"gpuStatusMap":{"GPU-0":1}}`,
+		"ports/usedPortSetKey":            `{"StartPort":40000,"EndPort":40010,"AvailableCount":10,"UsedPortSet":{}}`,
+		"versions/containerVersionMapKey": `{"foo":3}`,
+		"operations/op-1":                 `{"id":"op-1","type":"commit","status":"running"}`,
+	}
+	current := `{"keepLast":1,"keepDays":0,"pinned":null}`
+	kvs := []*store.KeyValue{{Key: "containers/baz/retention", Value: []byte(*models.EncodeRecord(models.KindRetentionPolicy, json.RawMessage(current)))}}
+	for key, value := range bare {
+		kvs = append(kvs, &store.KeyValue{Key: key, Value: []byte(value)})
+	}
+	if err := store.Load(kvs); err != nil {
+		t.Fatalf("store.Load failed: %v", err)
+	}
+	bare["containers/baz/retention"] = current
+
+	if err := MigrateRecords(); err != nil {
+		t.Fatalf("MigrateRecords failed: %v", err)
+	}
+	for key, value := range bare {
+		kind, _ := recordKind(key)
+		resource, name, _ := strings.Cut(key, "/")
+		bytes, err := store.GetValue(resource, name)
+		if err != nil {
+			t.Fatalf("store.GetValue of %s failed: %v", key, err)
+		}
+		var record models.Record
+		if err = json.Unmarshal(bytes, &record); err != nil {
+			t.Fatalf("json.Unmarshal of %s failed: %v", key, err)
+		}
+		if record.Kind != kind || record.SchemaVersion != models.SchemaVersion(kind) {
+			t.Fatalf("got kind %s, schema version %d of %s, want %s, %d",
+				record.Kind, record.SchemaVersion, key, kind, models.SchemaVersion(kind))
+		}
+		var got, want interface{}
+		_ = json.Unmarshal(record.Data, &got)
+		_ = json.Unmarshal([]byte(value), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got data %s of %s, want %s", record.Data, key, value)
+		}
+	}
+
+	bytes, err := store.GetValue(store.Migrations, recordSchemaMigrationKey)
+	if err != nil {
+		t.Fatalf("store.GetValue failed: %v", err)
+	}
+	var migrated map[models.Kind]int
+	if err = json.Unmarshal(bytes, &migrated); err != nil || !reflect.DeepEqual(migrated, models.SchemaVersions()) {
+		t.Fatalf("got migrated schema versions %s, error: %v, want %v", bytes, err, models.SchemaVersions())
+	}
+}
+
+func TestMigrateRecordsNewerSchemaVersion(t *testing.T) {
+	store.InitStore(store.NewMemoryStore(), "test", time.Second)
+	defer store.CloseStore()
+
+	bare := `{"version":1}`
+	newer := fmt.Sprintf(`{"schemaVersion":%d,"kind":"container","data":{"version":2}}`, models.SchemaVersion(models.KindContainer)+1)
+	err := store.Load([]*store.KeyValue{
+		{Key: "containers/foo", Value: []byte(bare)},
+		{Key: "containers/foo/versions/2", Value: []byte(newer)},
+	})
+	if err != nil {
+		t.Fatalf("store.Load failed: %v", err)
+	}
+
+	if err = MigrateRecords(); err == nil || !strings.Contains(err.Error(), "is newer than the supported version") {
+		t.Fatalf("MigrateRecords returned %v, want the error of a newer schema version", err)
+	}
+	// nothing is written if any record can't be upgraded
+	if value, _ := store.GetValue(store.Containers, "foo"); string(value) != bare {
+		t.Fatalf("got %s, want the bare record %s", value, bare)
+	}
+	if _, err = store.GetValue(store.Migrations, recordSchemaMigrationKey); err == nil {
+		t.Fatalf("the schema versions are saved after a failed migration")
+	}
+}
+
+func TestMigrateRecordsConcurrentWrite(t *testing.T) {
+	store.InitStore(store.NewMemoryStore(), "test", time.Second)
+	defer store.CloseStore()
+
+	err := store.Load([]*store.KeyValue{
+		{Key: "containers/foo", Value: []byte(`{"version":1}`)},
+		{Key: "containers/bar", Value: []byte(`{"version":1}`)},
+	})
+	if err != nil {
+		t.Fatalf("store.Load failed: %v", err)
+	}
+	kvs, err := store.Dump()
+	if err != nil {
+		t.Fatalf("store.Dump failed: %v", err)
+	}
+	upgraded, err := upgradeRecords(kvs)
+	if err != nil || len(upgraded) != 2 {
+		t.Fatalf("upgradeRecords returned %d records, error: %v, want 2", len(upgraded), err)
+	}
+
+	// the leader writes foo after it is read by the migration
+	newer := *models.EncodeRecord(models.KindContainer, json.RawMessage(`{"version":2}`))
+	if err = store.Put(store.Containers, "foo", &newer); err != nil {
+		t.Fatalf("store.Put failed: %v", err)
+	}
+	saved, err := putRecords(upgraded)
+	if err != nil || saved != 1 {
+		t.Fatalf("putRecords saved %d records, error: %v, want 1", saved, err)
+	}
+	if value, _ := store.GetValue(store.Containers, "foo"); string(value) != newer {
+		t.Fatalf("got %s, want the newer write %s", value, newer)
+	}
+
+	// the next attempt reads the newer write, which needs no upgrade
+	if err = MigrateRecords(); err != nil {
+		t.Fatalf("MigrateRecords failed: %v", err)
+	}
+	if value, _ := store.GetValue(store.Containers, "foo"); string(value) != newer {
+		t.Fatalf("got %s, want the newer write %s", value, newer)
+	}
+}
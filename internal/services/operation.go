@@ -0,0 +1,321 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+const (
+	// operationSaveInterval is how often the progress of a running operation is saved to the store,
+	// the phase changes are saved immediately.
+	operationSaveInterval = 5 * time.Second
+	// operationPruneInterval is how often the expired operations are pruned when operations are started.
+	operationPruneInterval = time.Hour
+)
+
+type OperationService struct{}
+
+var (
+	// operationTTL is how long the finished operations are kept, 0 means forever.
+	operationTTL time.Duration
+	// operationOwner is the advertised address of this instance, it is recorded as the owner of the operations run by it.
+	operationOwner string
+	// liveInstances returns the advertised addresses of the instances that are alive,
+	// it is nil if the store is not shared, then only this instance is alive.
+	liveInstances func(ctx context.Context) ([]string, error)
+)
+
+func InitOperations(ttl time.Duration, owner string, instances func(ctx context.Context) ([]string, error)) {
+	operationTTL = ttl
+	operationOwner = owner
+	liveInstances = instances
+}
+
+// operation is an operation running on this instance, its progress is newer than the record in the store.
+type operation struct {
+	sync.Mutex
+	op    models.Operation
+	saved time.Time
+}
+
+var running = struct {
+	sync.Mutex
+	ops       map[string]*operation
+	lastPrune time.Time
+	// the operations created since then are run by this instance
+	since time.Time
+}{ops: make(map[string]*operation), since: time.Now()}
+
+type operationKey struct{}
+
+// RunFunc is the body of an operation, it returns the result and the code that the request responds,
+// err is the reason when it fails.
+type RunFunc func(ctx context.Context) (result interface{}, code int64, err error)
+
+// StartOperation records a new operation of the replicaSet or volume with ctx and runs it in the background.
+// The phases and the copy progress reported by the services through the ctx of run are saved to the operation.
+func (ops *OperationService) StartOperation(ctx context.Context, typ string, resource store.Resource, name string, run RunFunc) models.Operation {
+	now := time.Now().Format("2006-01-02 15:04:05")
+	o := &operation{op: models.Operation{
+		ID:         newOperationID(),
+		Type:       typ,
+		Resource:   resource,
+		Name:       name,
+		Owner:      operationOwner,
+		Phase:      models.PhasePending,
+		Status:     models.OperationRunning,
+		CreateTime: now,
+		UpdateTime: now,
+	}}
+	o.save(ctx)
+
+	running.Lock()
+	running.ops[o.op.ID] = o
+	if time.Since(running.lastPrune) > operationPruneInterval {
+		running.lastPrune = time.Now()
+		go func() {
+			if err := PruneOperations(); err != nil {
+				log.Errorf("services.PruneOperations failed, error: %v", err)
+			}
+		}()
+	}
+	running.Unlock()
+
+	go func() {
+		defer func() {
+			running.Lock()
+			delete(running.ops, o.op.ID)
+			running.Unlock()
+		}()
+
+		result, code, err := run(context.WithValue(context.Background(), operationKey{}, o))
+		o.update(true, func(op *models.Operation) {
+			op.Phase = models.PhaseDone
+			op.Code = code
+			if err != nil {
+				op.Status = models.OperationFailed
+				op.Error = err.Error()
+				return
+			}
+			op.Status = models.OperationSucceeded
+			op.Result = result
+		})
+		log.Infof("services.StartOperation, operation: %s %s of %s: %s is %s", o.op.ID, typ, resource, name, o.get().Status)
+	}()
+	return o.get()
+}
+
+func (o *operation) get() models.Operation {
+	o.Lock()
+	defer o.Unlock()
+	return o.op
+}
+
+// update changes the operation, it is saved to the store if force is true or operationSaveInterval has passed.
+func (o *operation) update(force bool, f func(op *models.Operation)) {
+	o.Lock()
+	defer o.Unlock()
+	f(&o.op)
+	o.op.UpdateTime = time.Now().Format("2006-01-02 15:04:05")
+	// the updates are made in the background, no request waits for them
+	if force || time.Since(o.saved) >= operationSaveInterval {
+		o.save(context.Background())
+	}
+}
+
+// save must be called with the lock held, so that the records are enqueued in order.
+func (o *operation) save(ctx context.Context) {
+	o.saved = time.Now()
+	workQueue.Enqueue(ctx, store.PutKeyValue{
+		Resource: store.Operations,
+		Key:      o.op.ID,
+		Value:    o.op.Serialize(),
+	})
+}
+
+func operationFrom(ctx context.Context) *operation {
+	o, _ := ctx.Value(operationKey{}).(*operation)
+	return o
+}
+
+// setPhase reports the phase of the operation that ctx belongs to, it does nothing if ctx has no operation.
+func setPhase(ctx context.Context, phase models.OperationPhase) {
+	if o := operationFrom(ctx); o != nil {
+		o.update(true, func(op *models.Operation) {
+			op.Phase = phase
+		})
+	}
+}
+
+// copyProgress returns the function that reports the copy progress to the operation that ctx belongs to,
+// it returns nil if ctx has no operation.
+func copyProgress(ctx context.Context) utils.ProgressFunc {
+	o := operationFrom(ctx)
+	if o == nil {
+		return nil
+	}
+	return func(p utils.CopyProgress) {
+		o.update(false, func(op *models.Operation) {
+			op.FilesCopied, op.TotalFiles = p.Files, p.TotalFiles
+			op.BytesCopied, op.TotalBytes = p.Bytes, p.TotalBytes
+		})
+	}
+}
+
+// GetOperation returns the operation, the progress of a running operation on this instance is the latest one.
+func (ops *OperationService) GetOperation(id string) (models.Operation, error) {
+	running.Lock()
+	o, ok := running.ops[id]
+	running.Unlock()
+	if ok {
+		return o.get(), nil
+	}
+
+	var op models.Operation
+	bytes, err := store.GetValue(store.Operations, id)
+	if err != nil {
+		if xerrors.IsNotExistInStoreError(err) {
+			return op, errors.Wrapf(xerrors.NewOperationNotFoundError(), "operation: %s", id)
+		}
+		return op, errors.WithMessage(err, "store.GetValue failed")
+	}
+	if err = models.DecodeRecord(models.KindOperation, bytes, &op); err != nil {
+		return op, errors.WithMessage(err, "models.DecodeRecord failed")
+	}
+	return op, nil
+}
+
+// ListOperations returns the operations of the replicaSet or volume name, all operations if name is empty,
+// the latest operation comes first.
+func (ops *OperationService) ListOperations(resource store.Resource, name string) ([]models.Operation, error) {
+	all, err := listOperations()
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.listOperations failed")
+	}
+
+	list := make([]models.Operation, 0, len(all))
+	for _, op := range all {
+		if len(name) != 0 && (op.Resource != resource || op.Name != name) {
+			continue
+		}
+		list = append(list, op)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreateTime != list[j].CreateTime {
+			return list[i].CreateTime > list[j].CreateTime
+		}
+		return list[i].ID > list[j].ID
+	})
+	return list, nil
+}
+
+func listOperations() (map[string]models.Operation, error) {
+	kvs, err := store.List(store.Operations)
+	if err != nil {
+		return nil, errors.WithMessage(err, "store.List failed")
+	}
+	ops := make(map[string]models.Operation, len(kvs))
+	for _, kv := range kvs {
+		var op models.Operation
+		if err = models.DecodeRecord(models.KindOperation, kv.Value, &op); err != nil {
+			return nil, errors.Wrapf(err, "models.DecodeRecord failed, value: %s", kv.Value)
+		}
+		ops[op.ID] = op
+	}
+
+	running.Lock()
+	for id, o := range running.ops {
+		ops[id] = o.get()
+	}
+	running.Unlock()
+	return ops, nil
+}
+
+// PruneOperations deletes the operations finished longer than operationTTL ago,
+// and marks the operations that are left running by a stopped instance as failed.
+// An operation is left by a stopped instance if it is run by this instance before the last start,
+// or by another instance whose election session has expired, the operations of the live instances are kept.
+func PruneOperations() error {
+	ops, err := listOperations()
+	if err != nil {
+		return errors.WithMessage(err, "services.listOperations failed")
+	}
+
+	ctx := context.Background()
+	live := map[string]bool{operationOwner: true}
+	if liveInstances != nil {
+		timeoutCtx, cancel := context.WithTimeout(ctx, store.OperationDuration)
+		instances, err := liveInstances(timeoutCtx)
+		cancel()
+		if err != nil {
+			return errors.Wrap(err, "failed to list the live instances")
+		}
+		for _, addr := range instances {
+			live[addr] = true
+		}
+	}
+
+	running.Lock()
+	defer running.Unlock()
+	var pruned int
+	for id, op := range ops {
+		if op.Status == models.OperationRunning {
+			if !interrupted(op, live) {
+				continue
+			}
+			o := &operation{op: op}
+			o.op.Status = models.OperationFailed
+			o.op.Error = "the operation is interrupted, the instance running it is stopped"
+			o.op.UpdateTime = time.Now().Format("2006-01-02 15:04:05")
+			o.save(ctx)
+			continue
+		}
+
+		updated, err := time.ParseInLocation("2006-01-02 15:04:05", op.UpdateTime, time.Local)
+		if err != nil || operationTTL == 0 || time.Since(updated) < operationTTL {
+			continue
+		}
+		workQueue.Enqueue(ctx, store.DelKey{
+			Resource: store.Operations,
+			Key:      id,
+		})
+		pruned++
+	}
+	if pruned > 0 {
+		log.Infof("services.PruneOperations, %d expired operations are deleted", pruned)
+	}
+	return nil
+}
+
+// interrupted reports whether the running operation is left by a stopped instance, it must be called with running locked.
+func interrupted(op models.Operation, live map[string]bool) bool {
+	if _, ok := running.ops[op.ID]; ok {
+		return false
+	}
+	// the operations recorded by older releases have no owner, they are taken as run by this instance
+	if len(op.Owner) != 0 && op.Owner != operationOwner {
+		return !live[op.Owner]
+	}
+	// the record of an operation just finished by this instance may not be saved yet
+	created, err := time.ParseInLocation("2006-01-02 15:04:05", op.CreateTime, time.Local)
+	return err == nil && created.Before(running.since.Truncate(time.Second))
+}
+
+func newOperationID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
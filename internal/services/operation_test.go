@@ -0,0 +1,42 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+)
+
+func TestInterrupted(t *testing.T) {
+	operationOwner = "10.0.0.1:2378"
+	defer func() { operationOwner = "" }()
+	before := time.Now().Add(-time.Hour).Format("2006-01-02 15:04:05")
+	after := time.Now().Add(time.Hour).Format("2006-01-02 15:04:05")
+	running.Lock()
+	running.ops["op-running"] = &operation{}
+	defer func() {
+		delete(running.ops, "op-running")
+		running.Unlock()
+	}()
+
+	live := map[string]bool{operationOwner: true, "10.0.0.2:2378": true}
+	for _, c := range []struct {
+		op   models.Operation
+		want bool
+	}{
+		{models.Operation{ID: "op-1", Owner: operationOwner, CreateTime: before}, true},
+		{models.Operation{ID: "op-2", Owner: operationOwner, CreateTime: after}, false},
+		{models.Operation{ID: "op-running", Owner: operationOwner, CreateTime: before}, false},
+		// the old leader is still running it
+		{models.Operation{ID: "op-3", Owner: "10.0.0.2:2378", CreateTime: before}, false},
+		// the session of the owner has expired
+		{models.Operation{ID: "op-4", Owner: "10.0.0.3:2378", CreateTime: after}, true},
+		// recorded by an older release
+		{models.Operation{ID: "op-5", CreateTime: before}, true},
+		{models.Operation{ID: "op-6", CreateTime: after}, false},
+	} {
+		if got := interrupted(c.op, live); got != c.want {
+			t.Errorf("interrupted(%s of %q) = %t, want %t", c.op.ID, c.op.Owner, got, c.want)
+		}
+	}
+}
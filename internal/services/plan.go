@@ -0,0 +1,292 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+// The plans are computed from the current state without holding the lock of the replicaSet,
+// so the result of the operation may differ if the replicaSet or the schedulers are changed in the meantime.
+
+// PlanPatch returns what PatchContainer would do with spec, nothing is changed.
+func (rs *ReplicaSetService) PlanPatch(name string, spec *models.PatchRequest) (*models.Plan, error) {
+	plan, info, err := rs.newPlan(models.OperationPatch, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// the same as patchGpu
+	if spec.GpuPatch != nil && spec.GpuPatch.GpuCount != len(plan.Gpus.Current) {
+		if spec.GpuPatch.GpuCount > len(plan.Gpus.Current) {
+			plan.Gpus.Acquire = spec.GpuPatch.GpuCount - len(plan.Gpus.Current)
+		} else {
+			plan.Gpus.Release = plan.Gpus.Current[:len(plan.Gpus.Current)-spec.GpuPatch.GpuCount]
+		}
+	}
+
+	// the writable layer is replayed on the new image
+	if len(spec.ImageName) != 0 && spec.ImageName != info.Config.Image {
+		plan.ImageChange = &models.ImageChange{Old: info.Config.Image, New: spec.ImageName, Conflicts: []string{}}
+		if err = rs.checkImage(plan.ContainerName, spec.ImageName); err != nil {
+			plan.Problems = append(plan.Problems, err.Error())
+		}
+	}
+
+	// the binds and ports of the patched info
+	oldBinds := append([]string(nil), info.HostConfig.Binds...)
+	if info, err = rs.patchConfig(spec, info); err != nil {
+		return nil, errors.WithMessage(err, "patchConfig failed")
+	}
+	plan.Binds = bindChanges(oldBinds, info.HostConfig.Binds)
+	plan.Ports.ContainerPorts = containerPorts(info)
+
+	if err = rs.planCopy(plan); err != nil {
+		return nil, err
+	}
+	rs.checkPlan(plan)
+	return plan, nil
+}
+
+// PlanRollback returns what RollbackContainer would do with spec, nothing is changed.
+func (rs *ReplicaSetService) PlanRollback(name string, spec *models.RollbackRequest) (*models.Plan, error) {
+	plan, info, err := rs.newPlan(models.OperationRollback, name)
+	if err != nil {
+		return nil, err
+	}
+	if version, _ := vmap.ContainerVersionMap.Get(name); spec.Version == version {
+		return nil, xerrors.NewNoRollbackRequiredError()
+	}
+
+	value, err := store.GetVersion(store.Containers, name, spec.Version)
+	if err != nil {
+		return nil, errors.WithMessage(err, "store.GetVersion failed")
+	}
+	target := &models.EtcdContainerInfo{}
+	if err = models.DecodeRecord(models.KindContainer, value, &target); err != nil {
+		return nil, errors.WithMessage(err, "models.DecodeRecord failed")
+	}
+
+	// the gpu count of the version is restored
+	var gpuCount int
+	if len(target.HostConfig.Resources.DeviceRequests) != 0 {
+		gpuCount = len(target.HostConfig.Resources.DeviceRequests[0].DeviceIDs)
+	}
+	if gpuCount > len(plan.Gpus.Current) {
+		plan.Gpus.Acquire = gpuCount - len(plan.Gpus.Current)
+	} else {
+		plan.Gpus.Release = plan.Gpus.Current[:len(plan.Gpus.Current)-gpuCount]
+	}
+	plan.Copy.Source = models.CopyFromSnapshot
+	s, err := getSnapshot(name, spec.Version)
+	if err != nil {
+		if !xerrors.IsSnapshotNotFoundError(err) {
+			return nil, errors.WithMessage(err, "services.getSnapshot failed")
+		}
+		plan.Problems = append(plan.Problems, fmt.Sprintf("the snapshot of version %d is not found", spec.Version))
+	} else {
+		plan.Copy.Size = s.Size
+		// the same as restoreVolumes, a new version of every saved volume is bound instead
+		if spec.WithVolumes {
+			planVolumes(plan, s, target)
+		}
+	}
+
+	// the binds and ports of the version are restored
+	plan.Binds = bindChanges(info.HostConfig.Binds, target.HostConfig.Binds)
+	plan.Ports.ContainerPorts = containerPorts(target)
+
+	rs.checkPlan(plan)
+	return plan, nil
+}
+
+// PlanRestart returns what RestartContainer would do, nothing is changed.
+func (rs *ReplicaSetService) PlanRestart(name string) (*models.Plan, error) {
+	plan, _, err := rs.newPlan(models.OperationRestart, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// the gpus are released when the container is stopped, and the same number of gpus is acquired again
+	plan.Gpus.Acquire = len(plan.Gpus.Current)
+
+	if err = rs.planCopy(plan); err != nil {
+		return nil, err
+	}
+	rs.checkPlan(plan)
+	return plan, nil
+}
+
+// planVolumes replaces the saved volumes in the binds of target with their next versions,
+// and adds the size of the saved volumes to the copy.
+func planVolumes(plan *models.Plan, s *models.Snapshot, target *models.EtcdContainerInfo) {
+	saved := make(map[string]*models.VolumeSnapshot, len(s.Volumes))
+	for _, v := range s.Volumes {
+		saved[v.Volume] = v
+	}
+	for i, bind := range target.HostConfig.Binds {
+		src, rest, _ := strings.Cut(bind, ":")
+		v, ok := saved[src]
+		if !ok {
+			if isManagedVolume(src) {
+				plan.Problems = append(plan.Problems, fmt.Sprintf("volume %s of version %d is not saved", src, s.Version))
+			}
+			continue
+		}
+		plan.Copy.Size += v.Size
+		name := strings.Split(src, "-")[0]
+		version, _ := vmap.VolumeVersionMap.Get(name)
+		target.HostConfig.Binds[i] = fmt.Sprintf("%s-%d:%s", name, version+1, rest)
+	}
+}
+
+// newPlan returns the plan filled with the current container of the replicaSet and the free resources,
+// and the info of the replicaSet.
+func (rs *ReplicaSetService) newPlan(typ, name string) (*models.Plan, *models.EtcdContainerInfo, error) {
+	version, ok := vmap.ContainerVersionMap.Get(name)
+	if !ok {
+		return nil, nil, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+	}
+	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+
+	infoBytes, err := store.GetValue(store.Containers, name)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "store.GetValue failed, key: %s", store.ResourcePrefix(store.Containers, name))
+	}
+	info := &models.EtcdContainerInfo{}
+	if err = models.DecodeRecord(models.KindContainer, infoBytes, &info); err != nil {
+		return nil, nil, errors.WithMessage(err, "models.DecodeRecord failed")
+	}
+
+	uuids, err := rs.containerDeviceRequestsDeviceIDs(ctrVersionName)
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
+	}
+	ports, err := rs.containerPortBindings(ctrVersionName)
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "services.containerPortBindings failed")
+	}
+
+	var freeGpus int
+	for _, used := range schedulers.GpuScheduler.GetGpuStatus() {
+		if used == 0 {
+			freeGpus++
+		}
+	}
+	portStatus := schedulers.PortScheduler.GetPortStatus()
+
+	plan := &models.Plan{
+		Type:             typ,
+		ReplicaSet:       name,
+		ContainerName:    ctrVersionName,
+		NewContainerName: fmt.Sprintf("%s-%d", name, version+1),
+		Gpus: models.GpuPlan{
+			Current:   uuids,
+			Release:   []string{},
+			Available: freeGpus,
+		},
+		Binds: []models.BindChange{},
+		Ports: models.PortPlan{
+			ContainerPorts: containerPorts(info),
+			Release:        ports,
+			Available:      portStatus.AvailableCount - len(portStatus.UsedPortSet),
+		},
+		Problems: []string{},
+	}
+	return plan, info, nil
+}
+
+// planCopy fills the size of the files that runContainer copies from the current container,
+// only the writable layer is copied if the storage driver is overlay2.
+func (rs *ReplicaSetService) planCopy(plan *models.Plan) error {
+	dir, err := utils.GetContainerUpperLayer(plan.ContainerName)
+	if err != nil {
+		return errors.WithMessage(err, "utils.GetContainerUpperLayer failed")
+	}
+	plan.Copy.Source = models.CopyFromUpperDir
+	if len(dir) == 0 {
+		if dir, err = utils.GetContainerMergedLayer(plan.ContainerName); err != nil {
+			return errors.WithMessage(err, "utils.GetContainerMergedLayer failed")
+		}
+		plan.Copy.Source = models.CopyFromMergedDir
+	}
+
+	if plan.Copy.Size, err = utils.DirSize(dir); err != nil {
+		return errors.Wrapf(err, "utils.DirSize failed, container: %s, dir: %s", plan.ContainerName, dir)
+	}
+	return nil
+}
+
+// checkPlan checks whether there are enough free gpus and ports for the plan.
+func (rs *ReplicaSetService) checkPlan(plan *models.Plan) {
+	if plan.Gpus.Acquire > plan.Gpus.Available {
+		plan.Problems = append(plan.Problems, fmt.Sprintf("%d gpus are needed, but only %d gpus are available",
+			plan.Gpus.Acquire, plan.Gpus.Available))
+	}
+	// the ports of the current container are released after the new container is running
+	if len(plan.Ports.ContainerPorts) > plan.Ports.Available {
+		plan.Problems = append(plan.Problems, fmt.Sprintf("%d ports are needed, but only %d ports are available",
+			len(plan.Ports.ContainerPorts), plan.Ports.Available))
+	}
+	plan.Feasible = len(plan.Problems) == 0
+}
+
+func containerPorts(info *models.EtcdContainerInfo) []string {
+	ports := make([]string, 0, len(info.HostConfig.PortBindings))
+	for port := range info.HostConfig.PortBindings {
+		ports = append(ports, string(port))
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// bindChanges returns the binds that are changed from old to new,
+// a removed bind and an added bind of the same destination are one change.
+func bindChanges(old, new []string) []models.BindChange {
+	inOld := make(map[string]struct{}, len(old))
+	for _, bind := range old {
+		inOld[bind] = struct{}{}
+	}
+	inNew := make(map[string]struct{}, len(new))
+	for _, bind := range new {
+		inNew[bind] = struct{}{}
+	}
+
+	changes := make([]models.BindChange, 0)
+	added := make(map[string]int)
+	for _, bind := range new {
+		if _, ok := inOld[bind]; !ok {
+			added[bindDest(bind)] = len(changes)
+			changes = append(changes, models.BindChange{New: bind})
+		}
+	}
+	for _, bind := range old {
+		if _, ok := inNew[bind]; ok {
+			continue
+		}
+		if i, ok := added[bindDest(bind)]; ok && len(changes[i].Old) == 0 {
+			changes[i].Old = bind
+			continue
+		}
+		changes = append(changes, models.BindChange{Old: bind})
+	}
+	return changes
+}
+
+// bindDest returns the destination of a bind, e.g. /data of foo:/data:ro.
+func bindDest(bind string) string {
+	parts := strings.SplitN(bind, ":", 3)
+	if len(parts) < 2 {
+		return bind
+	}
+	return parts[1]
+}
@@ -1,12 +1,11 @@
 package services
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,6 +13,8 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
 	"github.com/ngaut/log"
@@ -21,26 +22,35 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/mayooot/gpu-docker-api/internal/docker"
-	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/locker"
 	"github.com/mayooot/gpu-docker-api/internal/models"
 	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	"github.com/mayooot/gpu-docker-api/internal/snapshot"
+	"github.com/mayooot/gpu-docker-api/internal/store"
 	vmap "github.com/mayooot/gpu-docker-api/internal/version"
 	"github.com/mayooot/gpu-docker-api/internal/workQueue"
 	"github.com/mayooot/gpu-docker-api/internal/xerrors"
 	"github.com/mayooot/gpu-docker-api/utils"
 )
 
+const containerStateKey = "state"
+
 type ReplicaSetService struct{}
 
 // RunGpuContainer just sets the parameters, the real run a container is in the `runContainer`
-func (rs *ReplicaSetService) RunGpuContainer(spec *models.ContainerRun) (id, containerName string, err error) {
+func (rs *ReplicaSetService) RunGpuContainer(ctx context.Context, spec *models.ContainerRun) (id, containerName string, err error) {
 	var (
 		config           container.Config
 		hostConfig       container.HostConfig
 		networkingConfig network.NetworkingConfig
 		platform         ocispec.Platform
 	)
-	ctx := context.Background()
+
+	unlock, err := locker.Lock(store.Containers, spec.ReplicaSetName)
+	if err != nil {
+		return id, containerName, errors.WithMessage(err, "locker.Lock failed")
+	}
+	defer unlock()
 
 	if rs.existContainer(spec.ReplicaSetName) {
 		return id, containerName, errors.Wrapf(xerrors.NewContainerExistedError(), "container %s", spec.ReplicaSetName)
@@ -66,7 +76,7 @@ func (rs *ReplicaSetService) RunGpuContainer(spec *models.ContainerRun) (id, con
 
 	// bind gpu resource
 	if spec.GpuCount > 0 {
-		uuids, err := schedulers.GpuScheduler.Apply(spec.GpuCount)
+		uuids, err := schedulers.GpuScheduler.Apply(ctx, spec.GpuCount)
 		if err != nil {
 			return id, containerName, errors.Wrapf(err, "GpuScheduler.Apply failed, spec: %+v", spec)
 		}
@@ -87,20 +97,27 @@ func (rs *ReplicaSetService) RunGpuContainer(spec *models.ContainerRun) (id, con
 		HostConfig:       &hostConfig,
 		NetworkingConfig: &networkingConfig,
 		Platform:         &platform,
-	})
+	}, "")
 	if err != nil {
 		return id, containerName, errors.Wrapf(err, "serivce.runContainer failed, spec: %+v", spec)
 	}
 
-	workQueue.Queue <- etcd.PutKeyValue{
-		Resource: etcd.Containers,
+	workQueue.Enqueue(ctx, store.PutKeyValue{
+		Resource: store.Containers,
 		Key:      kv.Key,
 		Value:    kv.Value,
-	}
+		Version:  kv.Version,
+	})
 	return
 }
 
-func (rs *ReplicaSetService) DeleteContainer(name string) error {
+func (rs *ReplicaSetService) DeleteContainer(ctx context.Context, name string) error {
+	unlock, err := locker.Lock(store.Containers, name)
+	if err != nil {
+		return errors.WithMessage(err, "locker.Lock failed")
+	}
+	defer unlock()
+
 	// get the latest version number
 	version, ok := vmap.ContainerVersionMap.Get(name)
 	if !ok {
@@ -113,20 +130,20 @@ func (rs *ReplicaSetService) DeleteContainer(name string) error {
 	if err != nil {
 		return errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
 	}
-	schedulers.GpuScheduler.Restore(uuids)
+	schedulers.GpuScheduler.Restore(ctx, uuids)
 
 	ports, err := rs.containerPortBindings(ctrVersionName)
 	if err != nil {
 		return errors.WithMessage(err, "services.containerPortBindings failed")
 	}
-	schedulers.PortScheduler.Restore(ports)
+	schedulers.PortScheduler.Restore(ctx, ports)
 
 	// delete the version number and asynchronously delete the container info in etcd
-	vmap.ContainerVersionMap.Remove(strings.Split(name, "-")[0])
-	workQueue.Queue <- etcd.DelKey{
-		Resource: etcd.Containers,
+	vmap.ContainerVersionMap.Remove(ctx, strings.Split(name, "-")[0])
+	workQueue.Enqueue(ctx, store.DelKey{
+		Resource: store.Containers,
 		Key:      name,
-	}
+	})
 
 	err = docker.Cli.ContainerRemove(context.TODO(),
 		fmt.Sprintf("%s-%d", name, version),
@@ -134,18 +151,22 @@ func (rs *ReplicaSetService) DeleteContainer(name string) error {
 	if err != nil {
 		return errors.WithMessage(err, "docker.Cli.ContainerRemove failed")
 	}
+	removeSnapshots(name)
 
 	log.Infof("services.DeleteContainer, container: %s delete successfully", fmt.Sprintf("%s-%d", name, version))
 	log.Infof("services.DeleteContainer, container: %s will be del etcd info and version record", name)
 	return nil
 }
 
-func (rs *ReplicaSetService) ExecuteContainer(name string, exec *models.ContainerExecute) (resp *string, err error) {
+// ExecuteContainer runs the command of exec in the latest version of the container and waits for it to exit,
+// the command is killed if it runs longer than the timeout of exec or execTimeout.
+func (rs *ReplicaSetService) ExecuteContainer(name string, exec *models.ContainerExecute) (*models.ExecResult, error) {
 	// get the latest version number
 	version, ok := vmap.ContainerVersionMap.Get(name)
 	if !ok {
 		return nil, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
 	}
+	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
 
 	workDir := "/"
 	var cmd []string
@@ -155,100 +176,171 @@ func (rs *ReplicaSetService) ExecuteContainer(name string, exec *models.Containe
 	if len(exec.Cmd) != 0 {
 		cmd = exec.Cmd
 	}
+	timeout := execTimeout
+	if exec.TimeoutSeconds > 0 {
+		timeout = time.Duration(exec.TimeoutSeconds) * time.Second
+	}
 
 	ctx := context.Background()
-	execCreate, err := docker.Cli.ContainerExecCreate(ctx, fmt.Sprintf("%s-%d", name, version), types.ExecConfig{
+	execCreate, err := docker.Cli.ContainerExecCreate(ctx, ctrVersionName, types.ExecConfig{
+		User:         exec.User,
+		AttachStdin:  len(exec.Stdin) != 0,
 		AttachStderr: true,
 		AttachStdout: true,
-		Detach:       true,
-		DetachKeys:   "ctrl-p,q",
+		Env:          exec.Env,
 		WorkingDir:   workDir,
 		Cmd:          cmd,
 	})
 	if err != nil {
-		return resp, errors.Wrapf(err, "docker.ContainerExecCreate failed, name: %s, spec: %+v", name, exec)
+		return nil, errors.Wrapf(err, "docker.ContainerExecCreate failed, name: %s, cmd: %v", ctrVersionName, cmd)
 	}
 
 	hijackedResp, err := docker.Cli.ContainerExecAttach(ctx, execCreate.ID, types.ExecStartCheck{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerExecAttach failed, name: %s, exec: %s", ctrVersionName, execCreate.ID)
+	}
 	defer hijackedResp.Close()
+
+	// the input is written while the output is read, so that a command writing before reading all input is not blocked
+	if len(exec.Stdin) != 0 {
+		go func() {
+			_, _ = io.WriteString(hijackedResp.Conn, exec.Stdin)
+			_ = hijackedResp.CloseWrite()
+		}()
+	}
+	stdout := &limitedBuffer{limit: exec.OutputLimit}
+	stderr := &limitedBuffer{limit: exec.OutputLimit}
+	copied := make(chan error, 1)
+	go func() {
+		_, err := stdcopy.StdCopy(stdout, stderr, hijackedResp.Reader)
+		copied <- err
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	result := &models.ExecResult{}
+	select {
+	case err = <-copied:
+		if err != nil {
+			return nil, errors.Wrapf(err, "stdcopy.StdCopy failed, name: %s, exec: %s", ctrVersionName, execCreate.ID)
+		}
+	case <-expired:
+		result.TimedOut = true
+		log.Warnf("services.ExecuteContainer, container: %s exec: %s is killed, it runs longer than %s, cmd: %v",
+			ctrVersionName, execCreate.ID, timeout, cmd)
+		if err = killExec(execCreate.ID); err != nil {
+			log.Errorf("services.ExecuteContainer, failed to kill exec: %s, error: %v", execCreate.ID, err)
+		}
+		// the output may be kept open by the processes started by the command
+		hijackedResp.Close()
+		<-copied
+	}
+
+	// the exit code is set shortly after the output is closed
+	waitExec(execCreate.ID, execKillTimeout)
+	inspect, err := docker.Cli.ContainerExecInspect(ctx, execCreate.ID)
 	if err != nil {
-		return resp, errors.Wrapf(err, "docker.ContainerExecAttach failed, name: %s, spec: %+v", name, exec)
+		return nil, errors.Wrapf(err, "docker.ContainerExecInspect failed, exec: %s", execCreate.ID)
 	}
 
-	var buf bytes.Buffer
-	_, _ = stdcopy.StdCopy(&buf, &buf, hijackedResp.Reader)
-	str := buf.String()
-	resp = &str
-	log.Infof("services.ExecuteContainer, container: %s execute successfully, exec: %+v", name, exec)
-	return
+	result.Stdout, result.StdoutTruncated = stdout.String(), stdout.truncated
+	result.Stderr, result.StderrTruncated = stderr.String(), stderr.truncated
+	result.ExitCode = inspect.ExitCode
+	// the env and stdin of exec may carry secrets, so they are not logged
+	log.Infof("services.ExecuteContainer, container: %s execute successfully, exec: %s, cmd: %v, exit code: %d, timed out: %t",
+		ctrVersionName, execCreate.ID, cmd, result.ExitCode, result.TimedOut)
+	return result, nil
 }
 
-func (rs *ReplicaSetService) PatchContainer(name string, spec *models.PatchRequest) (id, newContainerName string, err error) {
+func (rs *ReplicaSetService) PatchContainer(ctx context.Context, name string, spec *models.PatchRequest) (id, newContainerName string, imageChange *models.ImageChange, err error) {
+	unlock, err := locker.Lock(store.Containers, name)
+	if err != nil {
+		return id, newContainerName, imageChange, errors.WithMessage(err, "locker.Lock failed")
+	}
+	defer unlock()
+
 	// get the latest version number
 	version, ok := vmap.ContainerVersionMap.Get(name)
 	if !ok {
-		return id, newContainerName, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
+		return id, newContainerName, imageChange, errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
 	}
 	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
 
 	// get the container info
-	ctx := context.Background()
-	infoBytes, err := etcd.GetValue(etcd.Containers, name)
+	infoBytes, err := store.GetValue(store.Containers, name)
 	if err != nil {
-		return id, newContainerName, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Containers, name))
+		return id, newContainerName, imageChange, errors.Wrapf(err, "store.GetValue failed, key: %s", store.ResourcePrefix(store.Containers, name))
 	}
 	info := &models.EtcdContainerInfo{}
-	if err = json.Unmarshal(infoBytes, &info); err != nil {
-		return id, newContainerName, errors.WithMessage(err, "json.Unmarshal failed")
+	if err = models.DecodeRecord(models.KindContainer, infoBytes, &info); err != nil {
+		return id, newContainerName, imageChange, errors.WithMessage(err, "models.DecodeRecord failed")
 	}
 
-	// update gpu info
-	info, err = rs.patchGpu(ctrVersionName, spec.GpuPatch, info)
+	// update image info, it is checked before the gpus are applied
+	info.ImageChange = nil
+	info, err = rs.patchImage(ctrVersionName, spec.ImageName, info)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "patchGpu failed")
+		return id, newContainerName, imageChange, errors.WithMessage(err, "patchImage failed")
 	}
 
-	// update volume info
-	info, err = rs.patchVolume(spec.VolumePatch, info)
+	// update gpu info
+	setPhase(ctx, models.PhaseAllocating)
+	info, err = rs.patchGpu(ctx, ctrVersionName, spec.GpuPatch, info)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "patchVolume failed")
+		return id, newContainerName, imageChange, errors.WithMessage(err, "patchGpu failed")
 	}
 
-	// create a new container to replace the old one
-	id, newContainerName, kv, err := rs.runContainer(ctx, name, info)
+	// update volume, env, cmd and port info
+	info, err = rs.patchConfig(spec, info)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "runContainer failed")
+		return id, newContainerName, imageChange, errors.WithMessage(err, "patchConfig failed")
 	}
 
-	// copy the old container's merged files to the new container
-	err = utils.CopyOldMergedToNewContainerMerged(info.ContainerName, newContainerName)
+	// create a new container to replace the old one
+	// the old container's files are copied to the new container
+	id, newContainerName, kv, err := rs.runContainer(ctx, name, info, info.ContainerName)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
+		return id, newContainerName, imageChange, errors.WithMessage(err, "runContainer failed")
 	}
 
 	// delete the old container
 	// no gpu resources are returned because they are already returned when the gpu is lowered
 	// or when upgrading the gpu, the original gpu will be used.
-	err = setToMergeMap(ctrVersionName, version)
+	setPhase(ctx, models.PhaseCleaningUp)
+	snapshotReplaced(ctx, name, version)
+	err = rs.DeleteContainerForUpdate(ctx, ctrVersionName)
 	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "setToMergeMap failed")
-	}
-	err = rs.DeleteContainerForUpdate(ctrVersionName)
-	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "DeleteContainerForUpdate failed")
+		return id, newContainerName, imageChange, errors.WithMessage(err, "DeleteContainerForUpdate failed")
 	}
 
-	workQueue.Queue <- etcd.PutKeyValue{
-		Resource: etcd.Containers,
+	workQueue.Enqueue(ctx, store.PutKeyValue{
+		Resource: store.Containers,
 		Key:      kv.Key,
 		Value:    kv.Value,
+		Version:  kv.Version,
+	})
+
+	if err := rs.pruneHistory(ctx, name); err != nil {
+		log.Errorf("services.pruneHistory failed, container: %s, error: %v", name, err)
 	}
 
+	imageChange = info.ImageChange
 	log.Infof("services.PatchContainer, container: %s patch configuration successfully", name)
 	return
 }
 
-func (rs *ReplicaSetService) RollbackContainer(name string, spec *models.RollbackRequest) (string, error) {
+func (rs *ReplicaSetService) RollbackContainer(ctx context.Context, name string, spec *models.RollbackRequest) (newContainerName string, err error) {
+	unlock, err := locker.Lock(store.Containers, name)
+	if err != nil {
+		return "", errors.WithMessage(err, "locker.Lock failed")
+	}
+	defer unlock()
+
 	// check that the version to be rolled back is the same as the current version
 	version, ok := vmap.ContainerVersionMap.Get(name)
 	if !ok {
@@ -259,18 +351,44 @@ func (rs *ReplicaSetService) RollbackContainer(name string, spec *models.Rollbac
 	}
 
 	// get revision info form etcd
-	value, err := etcd.GetRevision(etcd.Containers, name, spec.Version)
+	value, err := store.GetVersion(store.Containers, name, spec.Version)
 	if err != nil {
-		return "", errors.WithMessage(err, "etcd.GetRevisionRange failed")
+		return "", errors.WithMessage(err, "store.GetVersion failed")
 	}
 	info := &models.EtcdContainerInfo{}
-	if err = json.Unmarshal(value, &info); err != nil {
-		return "", errors.WithMessage(err, "json.Unmarshal failed")
+	if err = models.DecodeRecord(models.KindContainer, value, &info); err != nil {
+		return "", errors.WithMessage(err, "models.DecodeRecord failed")
 	}
 
+	info.ImageChange = nil
+
+	// the files of the version are restored from its snapshot
+	s, err := getSnapshot(name, spec.Version)
+	if err != nil {
+		return "", errors.WithMessage(err, "services.getSnapshot failed")
+	}
+
+	// the volumes bound to the version are restored from its snapshot too, and bound instead,
+	// they are only saved if the rollback succeeds
+	var restored []*restoredVolume
+	if spec.WithVolumes {
+		setPhase(ctx, models.PhaseCopying)
+		if restored, err = rs.restoreVolumes(ctx, s, info); err != nil {
+			return "", errors.WithMessage(err, "services.restoreVolumes failed")
+		}
+	}
+	defer func() {
+		if err != nil {
+			discardVolumes(ctx, restored)
+			return
+		}
+		saveVolumes(ctx, restored)
+	}()
+
 	// compare gpu info
 	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
-	info, err = rs.patchGpu(ctrVersionName, &models.GpuPatch{
+	setPhase(ctx, models.PhaseAllocating)
+	info, err = rs.patchGpu(ctx, ctrVersionName, &models.GpuPatch{
 		GpuCount: len(info.HostConfig.Resources.DeviceRequests[0].DeviceIDs),
 	}, info)
 	if err != nil {
@@ -278,49 +396,182 @@ func (rs *ReplicaSetService) RollbackContainer(name string, spec *models.Rollbac
 	}
 
 	// create a new container to replace the old one
-	_, newContainerName, kv, err := rs.runContainer(context.TODO(), name, info)
+	_, newContainerName, kv, err := rs.runContainer(ctx, name, info, "")
 	if err != nil {
 		return "", errors.WithMessage(err, "runContainer failed")
 	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// the new container is removed before the restored volumes bound to it
+		if removeErr := rs.DeleteContainerForUpdate(ctx, newContainerName); removeErr != nil {
+			log.Errorf("services.RollbackContainer, failed to remove container: %s, error: %v", newContainerName, removeErr)
+			return
+		}
+		vmap.ContainerVersionMap.Set(ctx, name, version)
+	}()
 
-	// copy the old container's merged files to the new container
-	src, ok := vmap.ContainerMergeMap.Get(info.Version)
-	if !ok {
-		return "", errors.Errorf("container: %s version: %d merge path not found in ContainerMergeMap", info.ContainerName, info.Version)
-	}
+	// copy the snapshot files of the version to the new container
+	setPhase(ctx, models.PhaseCopying)
 	dest, err := utils.GetContainerMergedLayer(newContainerName)
 	if err != nil {
 		return "", errors.WithMessage(err, "utils.GetContainerMergedLayer failed")
 	}
+	// the upper layer only holds the files changed on top of the image it was saved from
+	if _, _, image, err := utils.GetContainerChangedLayer(newContainerName); err == nil &&
+		s.Layer == models.SnapshotLayerUpper && image != s.Image {
+		log.Warnf("services.RollbackContainer, container: %s is created from image %s, but the snapshot of version: %d "+
+			"is saved from image %s, the files of the image may differ", newContainerName, image, spec.Version, s.Image)
+	}
 
-	err = utils.CopyDir(src, dest)
+	err = snapshot.Restore(ctx, name, spec.Version, dest)
 	if err != nil {
-		return "", errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
+		return "", errors.WithMessage(err, "snapshot.Restore failed")
 	}
 
 	// delete the old container
 	// no gpu resources are returned because they are already returned when the gpu is lowered
 	// or when upgrading the gpu, the original gpu will be used.
-	err = setToMergeMap(ctrVersionName, version)
-	if err != nil {
-		return "", errors.WithMessage(err, "setToMergeMap failed")
-	}
-	err = rs.DeleteContainerForUpdate(ctrVersionName)
+	setPhase(ctx, models.PhaseCleaningUp)
+	snapshotReplaced(ctx, name, version)
+	err = rs.DeleteContainerForUpdate(ctx, ctrVersionName)
 	if err != nil {
 		return "", errors.WithMessage(err, "DeleteContainerForUpdate failed")
 	}
 
-	workQueue.Queue <- etcd.PutKeyValue{
-		Resource: etcd.Containers,
+	workQueue.Enqueue(ctx, store.PutKeyValue{
+		Resource: store.Containers,
 		Key:      kv.Key,
 		Value:    kv.Value,
+		Version:  kv.Version,
+	})
+
+	if err := rs.pruneHistory(ctx, name); err != nil {
+		log.Errorf("services.pruneHistory failed, container: %s, error: %v", name, err)
 	}
 
 	log.Infof("services.RollbackContainer, container: %s patch configuration successfully", ctrVersionName)
 	return newContainerName, nil
 }
 
-func (rs *ReplicaSetService) patchGpu(name string, spec *models.GpuPatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
+// restoredVolume is a new version of a volume restored from a snapshot, the lock of the volume is held
+// until the version is saved by saveVolumes or removed by discardVolumes.
+type restoredVolume struct {
+	name    string
+	version int64
+	kv      store.PutKeyValue
+	unlock  func()
+}
+
+// restoreVolumes creates a new version of every volume bound to the version of snapshot s,
+// with the data of the volume saved in s, and binds the new versions in info instead.
+// A volume that is deleted since then is created again. If any volume fails, the restored ones are removed.
+func (rs *ReplicaSetService) restoreVolumes(ctx context.Context, s *models.Snapshot, info *models.EtcdContainerInfo) ([]*restoredVolume, error) {
+	saved := make(map[string]*models.VolumeSnapshot, len(s.Volumes))
+	for _, v := range s.Volumes {
+		saved[v.Volume] = v
+	}
+	for _, bind := range info.HostConfig.Binds {
+		src := strings.SplitN(bind, ":", 2)[0]
+		if _, ok := saved[src]; !ok && isManagedVolume(src) {
+			return nil, errors.Wrapf(xerrors.NewSnapshotNotFoundError(), "volume: %s of container: %s version: %d is not saved",
+				src, s.ReplicaSet, s.Version)
+		}
+	}
+
+	restored := make([]*restoredVolume, 0, len(s.Volumes))
+	for i, bind := range info.HostConfig.Binds {
+		src, rest, _ := strings.Cut(bind, ":")
+		v, ok := saved[src]
+		if !ok {
+			continue
+		}
+		r, err := rs.restoreVolume(ctx, s, v)
+		if err != nil {
+			discardVolumes(ctx, restored)
+			return nil, errors.WithMessagef(err, "services.restoreVolume failed, volume: %s", v.Volume)
+		}
+		restored = append(restored, r)
+		info.HostConfig.Binds[i] = fmt.Sprintf("%s-%d:%s", r.name, r.version, rest)
+	}
+	return restored, nil
+}
+
+func (rs *ReplicaSetService) restoreVolume(ctx context.Context, s *models.Snapshot, v *models.VolumeSnapshot) (r *restoredVolume, err error) {
+	name := strings.Split(v.Volume, "-")[0]
+	unlock, err := locker.Lock(store.Volumes, name)
+	if err != nil {
+		return nil, errors.WithMessage(err, "locker.Lock failed")
+	}
+	defer func() {
+		if err != nil {
+			unlock()
+		}
+	}()
+
+	// the new version is created with the options of the latest version, e.g. its size
+	var vs VolumeService
+	info, err := vs.GetVolumeInfo(name)
+	if err != nil {
+		if !xerrors.IsNotExistInStoreError(err) {
+			return nil, errors.WithMessage(err, "services.GetVolumeInfo failed")
+		}
+		info = models.EtcdVolumeInfo{Opt: &volume.CreateOptions{Driver: "local"}}
+	}
+
+	resp, kv, err := vs.createVolume(ctx, name, info)
+	if err != nil {
+		return nil, errors.WithMessage(err, "services.createVolume failed")
+	}
+	r = &restoredVolume{name: name, version: kv.Version, kv: kv, unlock: unlock}
+	defer func() {
+		if err != nil {
+			r.unlock = func() {}
+			discardVolumes(ctx, []*restoredVolume{r})
+		}
+	}()
+
+	mountpoint, err := utils.GetVolumeMountPoint(resp.Name)
+	if err != nil {
+		return nil, errors.WithMessage(err, "utils.GetVolumeMountPoint failed")
+	}
+	if err = snapshot.RestoreVolume(ctx, s.ReplicaSet, s.Version, v.Volume, mountpoint); err != nil {
+		return nil, errors.WithMessage(err, "snapshot.RestoreVolume failed")
+	}
+
+	log.Infof("services.restoreVolume, volume: %s of container: %s version: %d is restored as %s",
+		v.Volume, s.ReplicaSet, s.Version, resp.Name)
+	return r, nil
+}
+
+// saveVolumes saves the versions of the restored volumes to the store and releases their locks.
+func saveVolumes(ctx context.Context, restored []*restoredVolume) {
+	for _, r := range restored {
+		workQueue.Enqueue(ctx, r.kv)
+		r.unlock()
+	}
+}
+
+// discardVolumes removes the restored volumes, the latest versions of them are set back, and releases their locks.
+func discardVolumes(ctx context.Context, restored []*restoredVolume) {
+	for i := len(restored) - 1; i >= 0; i-- {
+		r := restored[i]
+		volVersionName := fmt.Sprintf("%s-%d", r.name, r.version)
+		if err := docker.Cli.VolumeRemove(context.TODO(), volVersionName, true); err != nil {
+			log.Errorf("services.discardVolumes, failed to remove volume: %s, error: %v", volVersionName, err)
+		}
+		if r.version == 1 {
+			vmap.VolumeVersionMap.Remove(ctx, r.name)
+		} else {
+			vmap.VolumeVersionMap.Set(ctx, r.name, r.version-1)
+		}
+		r.unlock()
+		log.Infof("services.discardVolumes, volume: %s is removed", volVersionName)
+	}
+}
+
+func (rs *ReplicaSetService) patchGpu(ctx context.Context, name string, spec *models.GpuPatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
 	if spec == nil {
 		return info, nil
 	}
@@ -336,7 +587,7 @@ func (rs *ReplicaSetService) patchGpu(name string, spec *models.GpuPatch, info *
 	if spec.GpuCount > len(uuids) {
 		// lift gpu configuration
 		applyGpus := spec.GpuCount - len(uuids)
-		uuids, err := schedulers.GpuScheduler.Apply(applyGpus)
+		uuids, err := schedulers.GpuScheduler.Apply(ctx, applyGpus)
 		log.Infof("services.PatchContainerGpuInfo, container: %s apply %d gpus, uuids: %+v", name, applyGpus, uuids)
 		if err != nil {
 			return info, errors.WithMessage(err, "GpuScheduler.Apply failed")
@@ -354,7 +605,7 @@ func (rs *ReplicaSetService) patchGpu(name string, spec *models.GpuPatch, info *
 		}
 	} else {
 		restoreGpus := len(uuids) - spec.GpuCount
-		schedulers.GpuScheduler.Restore(uuids[:restoreGpus])
+		schedulers.GpuScheduler.Restore(ctx, uuids[:restoreGpus])
 		log.Infof("services.PatchContainerGpuInfo, container: %s restore %d gpus, uuids: %+v",
 			name, len(uuids[:restoreGpus]), uuids[:restoreGpus])
 		if len(uuids[:spec.GpuCount]) == 0 {
@@ -372,25 +623,212 @@ func (rs *ReplicaSetService) patchGpu(name string, spec *models.GpuPatch, info *
 	return info, nil
 }
 
+// patchImage changes the image of the container name, the writable layer of it is replayed on the new image by runContainer,
+// so the storage driver must be overlay2.
+func (rs *ReplicaSetService) patchImage(name, imageName string, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
+	if len(imageName) == 0 || imageName == info.Config.Image {
+		return info, nil
+	}
+
+	if err := rs.checkImage(name, imageName); err != nil {
+		return info, err
+	}
+
+	info.ImageChange = &models.ImageChange{Old: info.Config.Image, New: imageName}
+	info.Config.Image = imageName
+	log.Infof("services.patchImage, container: %s change image from %s to %s", name, info.ImageChange.Old, imageName)
+	return info, nil
+}
+
+// checkImage checks whether the image of the container name can be changed to imageName.
+func (rs *ReplicaSetService) checkImage(name, imageName string) error {
+	if _, _, err := docker.Cli.ImageInspectWithRaw(context.TODO(), imageName); err != nil {
+		if client.IsErrNotFound(err) {
+			return errors.Wrapf(xerrors.NewImageNotFoundError(), "image: %s", imageName)
+		}
+		return errors.Wrapf(err, "docker.ImageInspectWithRaw failed, image: %s", imageName)
+	}
+
+	upper, err := utils.GetContainerUpperLayer(name)
+	if err != nil {
+		return errors.WithMessage(err, "utils.GetContainerUpperLayer failed")
+	}
+	if len(upper) == 0 {
+		return errors.Errorf("container: %s is not stored by overlay2, its image can't be changed", name)
+	}
+	return nil
+}
+
+// patchConfig applies the patches of spec except the gpu patch to info.
+func (rs *ReplicaSetService) patchConfig(spec *models.PatchRequest, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
+	info, err := rs.patchVolume(spec.VolumePatch, info)
+	if err != nil {
+		return info, errors.WithMessage(err, "patchVolume failed")
+	}
+	for i := range spec.VolumePatches {
+		if info, err = rs.patchVolume(&spec.VolumePatches[i], info); err != nil {
+			return info, errors.WithMessage(err, "patchVolume failed")
+		}
+	}
+
+	info, err = rs.patchEnv(spec.EnvPatch, info)
+	if err != nil {
+		return info, errors.WithMessage(err, "patchEnv failed")
+	}
+
+	info, err = rs.patchCmd(spec.CmdPatch, info)
+	if err != nil {
+		return info, errors.WithMessage(err, "patchCmd failed")
+	}
+
+	info, err = rs.patchPort(spec.PortPatch, info)
+	if err != nil {
+		return info, errors.WithMessage(err, "patchPort failed")
+	}
+	return info, nil
+}
+
+// patchVolume replaces the old bind with the new bind,
+// the new bind is added if there is no old bind, and the old bind is removed if there is no new bind.
 func (rs *ReplicaSetService) patchVolume(spec *models.VolumePatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
 	if spec == nil {
 		return info, nil
 	}
 
-	if spec.OldBind.Format() == spec.NewBind.Format() {
+	var oldBind, newBind string
+	if spec.OldBind != nil {
+		oldBind = spec.OldBind.Format()
+	}
+	if spec.NewBind != nil {
+		newBind = spec.NewBind.Format()
+	}
+	if oldBind == newBind {
+		return info, nil
+	}
+
+	if len(oldBind) == 0 {
+		for _, bind := range info.HostConfig.Binds {
+			if bind == newBind {
+				return info, nil
+			}
+		}
+		info.HostConfig.Binds = append(info.HostConfig.Binds, newBind)
 		return info, nil
 	}
 
 	for i := range info.HostConfig.Binds {
-		if info.HostConfig.Binds[i] == spec.OldBind.Format() {
-			info.HostConfig.Binds[i] = spec.NewBind.Format()
+		if info.HostConfig.Binds[i] == oldBind {
+			if len(newBind) == 0 {
+				info.HostConfig.Binds = append(info.HostConfig.Binds[:i], info.HostConfig.Binds[i+1:]...)
+			} else {
+				info.HostConfig.Binds[i] = newBind
+			}
 			break
 		}
 	}
 	return info, nil
 }
 
-func (rs *ReplicaSetService) StopContainer(name string, restoreGpu, restorePort, isLatest bool) error {
+// patchEnv sets and removes the environment variables, CONTAINER_VERSION is set by runContainer.
+func (rs *ReplicaSetService) patchEnv(spec *models.EnvPatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
+	if spec == nil {
+		return info, nil
+	}
+
+	remove := make(map[string]struct{}, len(spec.Remove))
+	for _, key := range spec.Remove {
+		remove[key] = struct{}{}
+	}
+	set := make(map[string]string, len(spec.Set))
+	for _, env := range spec.Set {
+		set[envKey(env)] = env
+	}
+
+	env := make([]string, 0, len(info.Config.Env)+len(spec.Set))
+	for _, e := range info.Config.Env {
+		key := envKey(e)
+		if _, ok := remove[key]; ok {
+			continue
+		}
+		if v, ok := set[key]; ok {
+			// replaced in place
+			e = v
+			delete(set, key)
+		}
+		env = append(env, e)
+	}
+	// the new variables are appended in the order of spec.Set
+	for _, e := range spec.Set {
+		if v, ok := set[envKey(e)]; ok {
+			env = append(env, v)
+			delete(set, envKey(e))
+		}
+	}
+	info.Config.Env = env
+	return info, nil
+}
+
+func envKey(env string) string {
+	return strings.SplitN(env, "=", 2)[0]
+}
+
+// patchCmd replaces the cmd and the entrypoint.
+func (rs *ReplicaSetService) patchCmd(spec *models.CmdPatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
+	if spec == nil {
+		return info, nil
+	}
+
+	if spec.Cmd != nil {
+		info.Config.Cmd = spec.Cmd
+	}
+	if spec.Entrypoint != nil {
+		info.Config.Entrypoint = spec.Entrypoint
+	}
+	return info, nil
+}
+
+// patchPort adds and removes the container ports, the host ports are applied by runContainer.
+func (rs *ReplicaSetService) patchPort(spec *models.PortPatch, info *models.EtcdContainerInfo) (*models.EtcdContainerInfo, error) {
+	if spec == nil {
+		return info, nil
+	}
+
+	for _, p := range spec.Remove {
+		port := natPort(p)
+		delete(info.Config.ExposedPorts, port)
+		delete(info.HostConfig.PortBindings, port)
+	}
+	for _, p := range spec.Add {
+		port := natPort(p)
+		if info.Config.ExposedPorts == nil {
+			info.Config.ExposedPorts = make(nat.PortSet)
+		}
+		if info.HostConfig.PortBindings == nil {
+			info.HostConfig.PortBindings = make(nat.PortMap)
+		}
+		info.Config.ExposedPorts[port] = struct{}{}
+		if _, ok := info.HostConfig.PortBindings[port]; !ok {
+			info.HostConfig.PortBindings[port] = nil
+		}
+	}
+	return info, nil
+}
+
+// natPort returns the container port with its protocol, e.g. 8080/tcp of 8080.
+func natPort(port string) nat.Port {
+	if !strings.Contains(port, "/") {
+		port += "/tcp"
+	}
+	return nat.Port(port)
+}
+
+func (rs *ReplicaSetService) StopContainer(ctx context.Context, name string, restoreGpu, restorePort, isLatest bool) error {
+	unlock, err := locker.Lock(store.Containers, strings.Split(name, "-")[0])
+	if err != nil {
+		return errors.WithMessage(err, "locker.Lock failed")
+	}
+	defer unlock()
+
 	if isLatest {
 		// get the latest version number
 		version, ok := vmap.ContainerVersionMap.Get(name)
@@ -406,7 +844,7 @@ func (rs *ReplicaSetService) StopContainer(name string, restoreGpu, restorePort,
 		if err != nil {
 			return errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
 		}
-		schedulers.GpuScheduler.Restore(uuids)
+		schedulers.GpuScheduler.Restore(ctx, uuids)
 		log.Infof("services.StopContainer, container: %s restore %d gpus, uuids: %+v",
 			name, len(uuids), uuids)
 	}
@@ -417,28 +855,33 @@ func (rs *ReplicaSetService) StopContainer(name string, restoreGpu, restorePort,
 		if err != nil {
 			return errors.WithMessage(err, "services.containerPortBindings failed")
 		}
-		schedulers.PortScheduler.Restore(ports)
+		schedulers.PortScheduler.Restore(ctx, ports)
 		log.Infof("services.StopContainer, container: %s restore %d ports: %+v",
 			name, len(ports), ports)
 	}
 
 	// stop container
-	ctx := context.Background()
 	if err := docker.Cli.ContainerStop(ctx, name, container.StopOptions{}); err != nil {
 		return errors.WithMessage(err, "docker.ContainerStop failed")
 	}
 
+	state := models.ContainerStopped
+	if !restoreGpu && !restorePort {
+		state = models.ContainerPaused
+	}
+	saveContainerState(ctx, name, state)
+
 	log.Infof("services.StopContainer, container: %s stop successfully", name)
 	return nil
 }
 
-func (rs *ReplicaSetService) DeleteContainerForUpdate(name string) error {
+func (rs *ReplicaSetService) DeleteContainerForUpdate(ctx context.Context, name string) error {
 	// restore port resources
 	ports, err := rs.containerPortBindings(name)
 	if err != nil {
 		return errors.WithMessage(err, "services.containerPortBindings failed")
 	}
-	schedulers.PortScheduler.Restore(ports)
+	schedulers.PortScheduler.Restore(ctx, ports)
 	log.Infof("services.DeleteContainerForUpdate, container: %s restore %d ports: %+v",
 		name, len(ports), ports)
 
@@ -453,51 +896,55 @@ func (rs *ReplicaSetService) DeleteContainerForUpdate(name string) error {
 	return nil
 }
 
-func setToMergeMap(name string, version int64) error {
-	var err error
-	defer func() {
-		if err != nil {
-			vmap.ContainerMergeMap.Remove(version)
-		}
-	}()
-
-	mergedDir, err := utils.GetContainerMergedLayer(name)
+func (rs *ReplicaSetService) StartupContainer(ctx context.Context, name string) error {
+	unlock, err := locker.Lock(store.Containers, name)
 	if err != nil {
-		return errors.WithMessagef(err, "utils.GetContainerMergedLayer failed, container: %s", name)
+		return errors.WithMessage(err, "locker.Lock failed")
 	}
-	layer := "merges"
-	dir, _ := os.Getwd()
-	path := filepath.Join(dir, layer, strings.Split(name, "-")[0], name)
-	_ = os.MkdirAll(path, 0755)
+	defer unlock()
 
-	err = utils.CopyDir(mergedDir, path)
-	if err != nil {
-		return errors.WithMessagef(err, "utils.CopyDir failed, container: %s", name)
-	}
-	vmap.ContainerMergeMap.Set(version, path)
-	return nil
-}
-
-func (rs *ReplicaSetService) StartupContainer(name string) error {
 	// get the latest version number
 	version, ok := vmap.ContainerVersionMap.Get(name)
 	if !ok {
 		return errors.Errorf("container: %s version: %d not found in ContainerVersionMap", name, version)
 	}
 
-	err := docker.Cli.ContainerRestart(context.TODO(),
+	err = docker.Cli.ContainerRestart(context.TODO(),
 		fmt.Sprintf("%s-%d", name, version),
 		container.StopOptions{})
 	if err != nil {
 		return errors.WithMessagef(err, "docker.ContainerRestart failed, name: %s", name)
 	}
 
+	saveContainerState(ctx, fmt.Sprintf("%s-%d", name, version), models.ContainerRunning)
 	return nil
 }
 
+// saveContainerState asynchronously saves the state of a specific version of the container to etcd,
+// watchers are notified by the change of the state.
+func saveContainerState(ctx context.Context, name string, state models.ContainerStateType) {
+	version, _ := strconv.ParseInt(name[strings.LastIndex(name, "-")+1:], 10, 64)
+	val := &models.ContainerState{
+		State:      state,
+		Version:    version,
+		UpdateTime: time.Now().Format("2006-01-02 15:04:05"),
+	}
+	workQueue.Enqueue(ctx, store.PutKeyValue{
+		Resource: store.Containers,
+		Key:      path.Join(strings.Split(name, "-")[0], containerStateKey),
+		Value:    val.Serialize(),
+	})
+}
+
 // RestartContainer will reapply gpu and port,
 // but the logic for applying port is in the runContainer function
-func (rs *ReplicaSetService) RestartContainer(name string) (id, newContainerName string, err error) {
+func (rs *ReplicaSetService) RestartContainer(ctx context.Context, name string) (id, newContainerName string, err error) {
+	unlock, err := locker.Lock(store.Containers, name)
+	if err != nil {
+		return id, newContainerName, errors.WithMessage(err, "locker.Lock failed")
+	}
+	defer unlock()
+
 	// get the latest version number
 	version, ok := vmap.ContainerVersionMap.Get(name)
 	if !ok {
@@ -506,26 +953,27 @@ func (rs *ReplicaSetService) RestartContainer(name string) (id, newContainerName
 	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
 
 	// get info about used gpus
-	ctx := context.Background()
 	uuids, err := rs.containerDeviceRequestsDeviceIDs(ctrVersionName)
 	if err != nil {
 		return id, newContainerName, errors.WithMessage(err, "services.containerDeviceRequestsDeviceIDs failed")
 	}
 
 	// get creation info from etcd
-	infoBytes, err := etcd.GetValue(etcd.Containers, name)
+	infoBytes, err := store.GetValue(store.Containers, name)
 	if err != nil {
-		return id, newContainerName, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Containers, name))
+		return id, newContainerName, errors.Wrapf(err, "store.GetValue failed, key: %s", store.ResourcePrefix(store.Containers, name))
 	}
 	info := &models.EtcdContainerInfo{}
-	if err = json.Unmarshal(infoBytes, &info); err != nil {
-		return id, newContainerName, errors.WithMessage(err, "json.Unmarshal failed")
+	if err = models.DecodeRecord(models.KindContainer, infoBytes, &info); err != nil {
+		return id, newContainerName, errors.WithMessage(err, "models.DecodeRecord failed")
 	}
+	info.ImageChange = nil
 
 	// check whether the container is using gpu
+	setPhase(ctx, models.PhaseAllocating)
 	if len(uuids) != 0 {
 		// apply for gpu
-		availableGpus, err := schedulers.GpuScheduler.Apply(len(uuids))
+		availableGpus, err := schedulers.GpuScheduler.Apply(ctx, len(uuids))
 		if err != nil {
 			return id, newContainerName, errors.WithMessage(err, "GpuScheduler.Apply failed")
 		}
@@ -534,33 +982,31 @@ func (rs *ReplicaSetService) RestartContainer(name string) (id, newContainerName
 	}
 
 	//  create a container to replace the old one
-	id, newContainerName, kv, err := rs.runContainer(ctx, name, info)
+	// the old container's files are copied to the new container
+	id, newContainerName, kv, err := rs.runContainer(ctx, name, info, info.ContainerName)
 	if err != nil {
 		return id, newContainerName, errors.WithMessage(err, "services.runContainer failed")
 	}
 
-	// copy the old container's merged files to the new container
-	err = utils.CopyOldMergedToNewContainerMerged(info.ContainerName, newContainerName)
-	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
-	}
-
 	// delete the old container
 	// no gpu resources are returned because they are already returned when the gpu is lowered
 	// or when upgrading the gpu, the original gpu will be used.
-	err = setToMergeMap(ctrVersionName, version)
-	if err != nil {
-		return id, newContainerName, errors.WithMessage(err, "setToMergeMap failed")
-	}
-	err = rs.DeleteContainerForUpdate(ctrVersionName)
+	setPhase(ctx, models.PhaseCleaningUp)
+	snapshotReplaced(ctx, name, version)
+	err = rs.DeleteContainerForUpdate(ctx, ctrVersionName)
 	if err != nil {
 		return id, newContainerName, errors.WithMessage(err, "DeleteContainerForUpdate failed")
 	}
 
-	workQueue.Queue <- etcd.PutKeyValue{
-		Resource: etcd.Containers,
+	workQueue.Enqueue(ctx, store.PutKeyValue{
+		Resource: store.Containers,
 		Key:      kv.Key,
 		Value:    kv.Value,
+		Version:  kv.Version,
+	})
+
+	if err := rs.pruneHistory(ctx, name); err != nil {
+		log.Errorf("services.pruneHistory failed, container: %s, error: %v", name, err)
 	}
 
 	log.Infof("services.RestartContainer, container restart successfully, "+
@@ -569,7 +1015,13 @@ func (rs *ReplicaSetService) RestartContainer(name string) (id, newContainerName
 	return
 }
 
-func (rs *ReplicaSetService) CommitContainer(name string, spec models.ContainerCommit) (imageName string, err error) {
+func (rs *ReplicaSetService) CommitContainer(ctx context.Context, name string, spec models.ContainerCommit) (imageName string, err error) {
+	unlock, err := locker.Lock(store.Containers, name)
+	if err != nil {
+		return imageName, errors.WithMessage(err, "locker.Lock failed")
+	}
+	defer unlock()
+
 	// get the latest version number
 	version, ok := vmap.ContainerVersionMap.Get(name)
 	if !ok {
@@ -577,7 +1029,7 @@ func (rs *ReplicaSetService) CommitContainer(name string, spec models.ContainerC
 	}
 
 	// commit image
-	ctx := context.Background()
+	setPhase(ctx, models.PhaseCreating)
 	resp, err := docker.Cli.ContainerCommit(ctx, fmt.Sprintf("%s-%d", name, version), types.ContainerCommitOptions{
 		Comment: fmt.Sprintf("container name %s, commit time: %s", fmt.Sprintf("%s-%d", name, version), time.Now().Format("2006-01-02 15:04:05")),
 	})
@@ -597,34 +1049,40 @@ func (rs *ReplicaSetService) CommitContainer(name string, spec models.ContainerC
 }
 
 func (rs *ReplicaSetService) GetContainerInfo(name string) (info models.EtcdContainerInfo, err error) {
-	infoBytes, err := etcd.GetValue(etcd.Containers, name)
+	infoBytes, err := store.GetValue(store.Containers, name)
 	if err != nil {
-		return info, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Containers, name))
+		return info, errors.Wrapf(err, "store.GetValue failed, key: %s", store.ResourcePrefix(store.Containers, name))
 	}
 
-	if err = json.Unmarshal(infoBytes, &info); err != nil {
-		return info, errors.WithMessage(err, "json.Unmarshal failed")
+	if err = models.DecodeRecord(models.KindContainer, infoBytes, &info); err != nil {
+		return info, errors.WithMessage(err, "models.DecodeRecord failed")
 	}
 	return
 }
 
 func (rs *ReplicaSetService) GetContainerHistory(name string) ([]*models.ContainerHistoryItem, error) {
-	replicaSet, err := etcd.GetRevisionRange(etcd.Containers, name)
+	replicaSet, err := store.GetVersionRange(store.Containers, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "store.GetVersionRange failed, key: %s",
+			store.ResourcePrefix(store.Containers, name))
+	}
+
+	policy, err := rs.GetRetentionPolicy(name)
 	if err != nil {
-		return nil, errors.Wrapf(err, "etcd.GetRevisionRange failed, key: %s",
-			etcd.ResourcePrefix(etcd.Containers, name))
+		return nil, errors.WithMessage(err, "services.GetRetentionPolicy failed")
 	}
 
 	resp := make([]*models.ContainerHistoryItem, 0, len(replicaSet))
 	for _, combine := range replicaSet {
 		var info models.EtcdContainerInfo
-		err := json.Unmarshal(combine.Value, &info)
+		err := models.DecodeRecord(models.KindContainer, combine.Value, &info)
 		if err != nil {
-			return nil, errors.Wrapf(err, "json.Unmarshal failed, value: %s", combine.Value)
+			return nil, errors.Wrapf(err, "models.DecodeRecord failed, value: %s", combine.Value)
 		}
 		resp = append(resp, &models.ContainerHistoryItem{
 			Version:    combine.Version,
 			CreateTime: info.CreateTime,
+			Pinned:     policy.IsPinned(combine.Version),
 			Status:     info,
 		})
 	}
@@ -632,11 +1090,13 @@ func (rs *ReplicaSetService) GetContainerHistory(name string) ([]*models.Contain
 }
 
 // It will only be executed based on the `docker.client.ContainerCreate`
-func (rs *ReplicaSetService) runContainer(ctx context.Context, name string, info *models.EtcdContainerInfo) (string, string, etcd.PutKeyValue, error) {
+// If copyFrom is not empty, the files of the container copyFrom are copied to the new container,
+// only its writable layer is copied before the new container is started if possible.
+func (rs *ReplicaSetService) runContainer(ctx context.Context, name string, info *models.EtcdContainerInfo, copyFrom string) (string, string, store.PutKeyValue, error) {
 	// set the version number
 	version, _ := vmap.ContainerVersionMap.Get(name)
 	version = version + 1
-	vmap.ContainerVersionMap.Set(name, version)
+	vmap.ContainerVersionMap.Set(ctx, name, version)
 
 	// add the version number to the env
 	isExist := false
@@ -656,18 +1116,18 @@ func (rs *ReplicaSetService) runContainer(ctx context.Context, name string, info
 		// if run container failed, clear the version number
 		if err != nil {
 			if version == 1 {
-				vmap.ContainerVersionMap.Remove(name)
+				vmap.ContainerVersionMap.Remove(ctx, name)
 			} else {
-				vmap.ContainerVersionMap.Set(name, version-1)
+				vmap.ContainerVersionMap.Set(ctx, name, version-1)
 			}
 		}
 	}()
 
 	// apply for some host port
 	if info.HostConfig.PortBindings != nil && len(info.HostConfig.PortBindings) > 0 {
-		availableOSPorts, err := schedulers.PortScheduler.Apply(len(info.HostConfig.PortBindings))
+		availableOSPorts, err := schedulers.PortScheduler.Apply(ctx, len(info.HostConfig.PortBindings))
 		if err != nil {
-			return "", "", etcd.PutKeyValue{}, errors.Wrapf(err, "Portscheduler.Apply failed, info: %+v", info)
+			return "", "", store.PutKeyValue{}, errors.Wrapf(err, "Portscheduler.Apply failed, info: %+v", info)
 		}
 		var index int
 		for k := range info.HostConfig.PortBindings {
@@ -683,9 +1143,34 @@ func (rs *ReplicaSetService) runContainer(ctx context.Context, name string, info
 	info.CreateTime = time.Now().Format("2006-01-02 15:04:05")
 
 	// create container
+	setPhase(ctx, models.PhaseCreating)
 	resp, err := docker.Cli.ContainerCreate(ctx, info.Config, info.HostConfig, info.NetworkingConfig, info.Platform, ctrVersionName)
 	if err != nil {
-		return "", "", etcd.PutKeyValue{}, errors.Wrapf(err, "docker.ContainerCreate failed, name: %s", ctrVersionName)
+		return "", "", store.PutKeyValue{}, errors.Wrapf(err, "docker.ContainerCreate failed, name: %s", ctrVersionName)
+	}
+
+	// copy the writable layer of the old container to the new container
+	var copied bool
+	if len(copyFrom) != 0 && info.ImageChange != nil {
+		// the image is changed by the patch, the changes of the old container are replayed on the new image
+		setPhase(ctx, models.PhaseCopying)
+		var conflicts []string
+		if conflicts, err = utils.ReplayOldUpperOnNewContainerUpper(ctx, copyFrom, ctrVersionName, copyProgress(ctx)); err != nil {
+			_ = docker.Cli.ContainerRemove(ctx,
+				resp.ID,
+				types.ContainerRemoveOptions{Force: true})
+			return "", "", store.PutKeyValue{}, errors.WithMessage(err, "utils.ReplayOldUpperOnNewContainerUpper failed")
+		}
+		info.ImageChange.SetConflicts(conflicts)
+		copied = true
+	} else if len(copyFrom) != 0 {
+		setPhase(ctx, models.PhaseCopying)
+		if copied, err = utils.CopyOldUpperToNewContainerUpper(ctx, copyFrom, ctrVersionName, copyProgress(ctx)); err != nil {
+			_ = docker.Cli.ContainerRemove(ctx,
+				resp.ID,
+				types.ContainerRemoveOptions{Force: true})
+			return "", "", store.PutKeyValue{}, errors.WithMessage(err, "utils.CopyOldUpperToNewContainerUpper failed")
+		}
 	}
 
 	// start container
@@ -693,7 +1178,18 @@ func (rs *ReplicaSetService) runContainer(ctx context.Context, name string, info
 		_ = docker.Cli.ContainerRemove(ctx,
 			resp.ID,
 			types.ContainerRemoveOptions{Force: true})
-		return "", "", etcd.PutKeyValue{}, errors.Wrapf(err, "docker.ContainerStart failed, id: %s, name: %s", resp.ID, ctrVersionName)
+		return "", "", store.PutKeyValue{}, errors.Wrapf(err, "docker.ContainerStart failed, id: %s, name: %s", resp.ID, ctrVersionName)
+	}
+
+	// the image is changed or the storage driver is not overlay2, copy all files of the old container
+	if len(copyFrom) != 0 && !copied {
+		setPhase(ctx, models.PhaseCopying)
+		if err = utils.CopyOldMergedToNewContainerMerged(ctx, copyFrom, ctrVersionName, copyProgress(ctx)); err != nil {
+			_ = docker.Cli.ContainerRemove(ctx,
+				resp.ID,
+				types.ContainerRemoveOptions{Force: true})
+			return "", "", store.PutKeyValue{}, errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
+		}
 	}
 
 	// creation info is added to etcd asynchronously
@@ -705,15 +1201,17 @@ func (rs *ReplicaSetService) runContainer(ctx context.Context, name string, info
 		ContainerName:    ctrVersionName,
 		Version:          version,
 		CreateTime:       info.CreateTime,
+		ImageChange:      info.ImageChange,
 	}
 
 	log.Infof("services.runContainer, container: %s run successfully", ctrVersionName)
 	return resp.ID,
 		ctrVersionName,
-		etcd.PutKeyValue{
-			Resource: etcd.Containers,
+		store.PutKeyValue{
+			Resource: store.Containers,
 			Key:      name,
 			Value:    val.Serialize(),
+			Version:  version,
 		},
 		nil
 }
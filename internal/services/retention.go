@@ -0,0 +1,190 @@
+package services
+
+import (
+	"context"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/locker"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const retentionKey = "retention"
+
+// defaultRetentionPolicy is used by the replicaSet which has not set its own policy.
+var defaultRetentionPolicy models.RetentionPolicy
+
+func InitRetentionPolicy(keepLast, keepDays int) {
+	defaultRetentionPolicy = models.RetentionPolicy{
+		KeepLast: keepLast,
+		KeepDays: keepDays,
+	}
+}
+
+func (rs *ReplicaSetService) GetRetentionPolicy(name string) (models.RetentionPolicy, error) {
+	policy := defaultRetentionPolicy
+	policy.Pinned = []int64{}
+
+	bytes, err := store.GetValue(store.Containers, path.Join(name, retentionKey))
+	if err != nil {
+		if xerrors.IsNotExistInStoreError(err) {
+			return policy, nil
+		}
+		return policy, errors.Wrapf(err, "store.GetValue failed, key: %s",
+			store.ResourcePrefix(store.Containers, path.Join(name, retentionKey)))
+	}
+	if err = models.DecodeRecord(models.KindRetentionPolicy, bytes, &policy); err != nil {
+		return policy, errors.WithMessage(err, "models.DecodeRecord failed")
+	}
+	return policy, nil
+}
+
+// SetRetentionPolicy changes the retention rules of the replicaSet, the pinned versions are left as is.
+// The historical versions are pruned immediately by the new rules.
+func (rs *ReplicaSetService) SetRetentionPolicy(ctx context.Context, name string, spec *models.RetentionPolicy) (models.RetentionPolicy, error) {
+	unlock, err := locker.Lock(store.Containers, name)
+	if err != nil {
+		return models.RetentionPolicy{}, errors.WithMessage(err, "locker.Lock failed")
+	}
+	defer unlock()
+
+	if !vmap.ContainerVersionMap.Exist(name) {
+		return models.RetentionPolicy{}, errors.Errorf("container: %s not found in ContainerVersionMap", name)
+	}
+
+	policy, err := rs.GetRetentionPolicy(name)
+	if err != nil {
+		return policy, errors.WithMessage(err, "services.GetRetentionPolicy failed")
+	}
+	policy.KeepLast = spec.KeepLast
+	policy.KeepDays = spec.KeepDays
+	if err = store.Put(store.Containers, path.Join(name, retentionKey), policy.Serialize()); err != nil {
+		return policy, errors.WithMessage(err, "store.Put failed")
+	}
+
+	if err = rs.pruneHistory(ctx, name); err != nil {
+		return policy, errors.WithMessage(err, "services.pruneHistory failed")
+	}
+	log.Infof("services.SetRetentionPolicy, container: %s set retention policy successfully, policy: %+v", name, policy)
+	return policy, nil
+}
+
+// PinVersion pins or unpins a historical version of the replicaSet, a pinned version is never pruned.
+func (rs *ReplicaSetService) PinVersion(name string, version int64, pinned bool) error {
+	unlock, err := locker.Lock(store.Containers, name)
+	if err != nil {
+		return errors.WithMessage(err, "locker.Lock failed")
+	}
+	defer unlock()
+
+	if _, err = store.GetVersion(store.Containers, name, version); err != nil {
+		return errors.WithMessage(err, "store.GetVersion failed")
+	}
+
+	policy, err := rs.GetRetentionPolicy(name)
+	if err != nil {
+		return errors.WithMessage(err, "services.GetRetentionPolicy failed")
+	}
+	if policy.IsPinned(version) == pinned {
+		return nil
+	}
+
+	if pinned {
+		policy.Pinned = append(policy.Pinned, version)
+	} else {
+		for i := range policy.Pinned {
+			if policy.Pinned[i] == version {
+				policy.Pinned = append(policy.Pinned[:i], policy.Pinned[i+1:]...)
+				break
+			}
+		}
+	}
+	if err = store.Put(store.Containers, path.Join(name, retentionKey), policy.Serialize()); err != nil {
+		return errors.WithMessage(err, "store.Put failed")
+	}
+
+	log.Infof("services.PinVersion, container: %s version: %d pinned: %t", name, version, pinned)
+	return nil
+}
+
+// pruneHistory deletes the historical versions that are out of the retention policy,
+// including the spec in the store and the merge snapshot on disk.
+// The caller must hold the lock of the replicaSet.
+func (rs *ReplicaSetService) pruneHistory(ctx context.Context, name string) error {
+	policy, err := rs.GetRetentionPolicy(name)
+	if err != nil {
+		return errors.WithMessage(err, "services.GetRetentionPolicy failed")
+	}
+	if policy.KeepLast == 0 && policy.KeepDays == 0 {
+		return nil
+	}
+
+	current, _ := vmap.ContainerVersionMap.Get(name)
+	replicaSet, err := store.GetVersionRange(store.Containers, name)
+	if err != nil {
+		return errors.WithMessage(err, "store.GetVersionRange failed")
+	}
+
+	// the current version may not be written to etcd yet
+	versions := []int64{current}
+	createTimes := make(map[int64]string, len(replicaSet))
+	for _, combine := range replicaSet {
+		if combine.Version != current {
+			versions = append(versions, combine.Version)
+		}
+		var info models.EtcdContainerInfo
+		if err = models.DecodeRecord(models.KindContainer, combine.Value, &info); err != nil {
+			return errors.Wrapf(err, "models.DecodeRecord failed, value: %s", combine.Value)
+		}
+		createTimes[combine.Version] = info.CreateTime
+	}
+	for _, version := range prunedVersions(policy, current, versions, createTimes, time.Now()) {
+		workQueue.Enqueue(ctx, store.DelKey{
+			Resource: store.Containers,
+			Key:      name,
+			Version:  version,
+		})
+		removeSnapshot(ctx, name, version)
+		log.Infof("services.pruneHistory, container: %s version: %d is pruned", name, version)
+	}
+	return nil
+}
+
+// prunedVersions returns the versions that are out of the retention policy, createTimes are the create times of versions.
+// The current and pinned versions are never pruned, and they are not counted in the latest keepLast historical versions.
+func prunedVersions(policy models.RetentionPolicy, current int64, versions []int64, createTimes map[int64]string, now time.Time) []int64 {
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i] > versions[j]
+	})
+
+	var (
+		pruned []int64
+		kept   int
+	)
+	deadline := now.AddDate(0, 0, -policy.KeepDays)
+	for _, version := range versions {
+		if version == current || policy.IsPinned(version) {
+			continue
+		}
+		if policy.KeepLast > 0 && kept < policy.KeepLast {
+			kept++
+			continue
+		}
+		if policy.KeepDays > 0 {
+			createTime, err := time.ParseInLocation("2006-01-02 15:04:05", createTimes[version], time.Local)
+			if err == nil && createTime.After(deadline) {
+				continue
+			}
+		}
+		pruned = append(pruned, version)
+	}
+	return pruned
+}
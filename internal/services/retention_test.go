@@ -0,0 +1,42 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+)
+
+func TestPrunedVersions(t *testing.T) {
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.Local)
+	createTimes := map[int64]string{
+		1: "2024-06-01 12:00:00",
+		2: "2024-06-02 12:00:00",
+		3: "2024-06-08 12:00:00",
+		4: "2024-06-09 12:00:00",
+		5: "2024-06-10 11:00:00",
+	}
+	for _, tc := range []struct {
+		name    string
+		policy  models.RetentionPolicy
+		current int64
+		want    []int64
+	}{
+		{"keep the last historical version", models.RetentionPolicy{KeepLast: 1}, 5, []int64{3, 2, 1}},
+		{"keep the last two historical versions", models.RetentionPolicy{KeepLast: 2}, 5, []int64{2, 1}},
+		// after a rollback the current version is not the latest one
+		{"current is not counted", models.RetentionPolicy{KeepLast: 1}, 2, []int64{4, 3, 1}},
+		{"pinned is not counted", models.RetentionPolicy{KeepLast: 1, Pinned: []int64{4}}, 5, []int64{2, 1}},
+		{"keep the young versions", models.RetentionPolicy{KeepDays: 3}, 5, []int64{2, 1}},
+		{"keep the last or the young versions", models.RetentionPolicy{KeepLast: 1, KeepDays: 3}, 5, []int64{2, 1}},
+		{"keep more than the history", models.RetentionPolicy{KeepLast: 10}, 5, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := prunedVersions(tc.policy, tc.current, []int64{1, 2, 3, 4, 5}, createTimes, now)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got pruned versions %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,429 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+	"github.com/mayooot/gpu-docker-api/internal/locker"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/snapshot"
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	vmap "github.com/mayooot/gpu-docker-api/internal/version"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+	"github.com/mayooot/gpu-docker-api/utils"
+)
+
+// The changed files of every replaced version of a replicaSet are saved as a snapshot, see snapshot.SaveLayer,
+// and recorded in the store under the replicaSet, e.g. containers/foo/snapshots/1,
+// so the record is deleted together with the replicaSet.
+const snapshotsKey = "snapshots"
+
+// legacyMergeMapKey is where older releases recorded the snapshots, it is replaced by the snapshot records.
+const legacyMergeMapKey = "containerMergeMapKey"
+
+// snapshotVolumes is whether the docker volumes bound to a replicaSet version are saved with its snapshot.
+var snapshotVolumes bool
+
+func InitSnapshots(volumes bool) {
+	snapshotVolumes = volumes
+}
+
+// saveSnapshot saves the writable layer of the container of the replicaSet version as its snapshot,
+// or the merged layer if the storage driver is not overlay2,
+// and the docker volumes managed by us that are bound to it if snapshotVolumes is true.
+func saveSnapshot(ctx context.Context, name string, version int64) (*models.Snapshot, error) {
+	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+	dir, upper, image, err := utils.GetContainerChangedLayer(ctrVersionName)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "utils.GetContainerChangedLayer failed, container: %s", ctrVersionName)
+	}
+
+	layer := models.SnapshotLayerMerged
+	if upper {
+		layer = models.SnapshotLayerUpper
+	}
+	s, err := snapshot.SaveLayer(context.TODO(), name, version, dir, layer, image)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "snapshot.Save failed, container: %s", ctrVersionName)
+	}
+	if snapshotVolumes {
+		if s.Volumes, err = saveVolumeSnapshots(name, version); err != nil {
+			return nil, errors.WithMessagef(err, "services.saveVolumeSnapshots failed, container: %s", ctrVersionName)
+		}
+	}
+	recordSnapshot(ctx, s)
+	log.Infof("services.saveSnapshot, container: %s snapshot of %s layer saved, size: %d, stored size: %d",
+		ctrVersionName, s.Layer, s.Size, s.StoredSize)
+	return s, nil
+}
+
+// snapshotReplaced saves the snapshot of the replicaSet version whose container is being replaced.
+// The replacement is not failed by the snapshot, the new container is already running,
+// so the error is logged and the version is left without a snapshot, it can't be rolled back to.
+func snapshotReplaced(ctx context.Context, name string, version int64) {
+	if _, err := saveSnapshot(ctx, name, version); err != nil {
+		log.Errorf("services.saveSnapshot failed, container: %s version: %d is left without a snapshot, error: %v",
+			name, version, err)
+		removeSnapshot(ctx, name, version)
+	}
+}
+
+// saveVolumeSnapshots saves the docker volumes managed by us that are bound to the container of the replicaSet version.
+func saveVolumeSnapshots(name string, version int64) ([]*models.VolumeSnapshot, error) {
+	ctrVersionName := fmt.Sprintf("%s-%d", name, version)
+	resp, err := docker.Cli.ContainerInspect(context.TODO(), ctrVersionName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", ctrVersionName)
+	}
+
+	volumes := make([]*models.VolumeSnapshot, 0)
+	for _, m := range resp.Mounts {
+		if m.Type != mount.TypeVolume || !isManagedVolume(m.Name) {
+			continue
+		}
+		vs, err := snapshot.SaveVolume(context.TODO(), name, version, m.Name, m.Source)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "snapshot.SaveVolume failed, volume: %s", m.Name)
+		}
+		log.Infof("services.saveVolumeSnapshots, container: %s volume: %s snapshot saved, size: %d, stored size: %d",
+			ctrVersionName, m.Name, vs.Size, vs.StoredSize)
+		volumes = append(volumes, vs)
+	}
+	return volumes, nil
+}
+
+// isManagedVolume reports whether the docker volume is a version of a volume created by us, e.g. bar-2.
+func isManagedVolume(name string) bool {
+	base, v, ok := strings.Cut(name, "-")
+	if !ok {
+		return false
+	}
+	if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+		return false
+	}
+	_, ok = vmap.VolumeVersionMap.Get(base)
+	return ok
+}
+
+func recordSnapshot(ctx context.Context, s *models.Snapshot) {
+	workQueue.Enqueue(ctx, store.PutKeyValue{
+		Resource: store.Containers,
+		Key:      snapshotKey(s.ReplicaSet, s.Version),
+		Value:    s.Serialize(),
+	})
+}
+
+// getSnapshot returns the snapshot of the replicaSet version,
+// it fails with SnapshotNotFoundError if the snapshot is not recorded or its manifest is gone.
+func getSnapshot(name string, version int64) (*models.Snapshot, error) {
+	bytes, err := store.GetValue(store.Containers, snapshotKey(name, version))
+	if err != nil {
+		if xerrors.IsNotExistInStoreError(err) {
+			return nil, errors.Wrapf(xerrors.NewSnapshotNotFoundError(), "container: %s version: %d", name, version)
+		}
+		return nil, errors.WithMessage(err, "store.GetValue failed")
+	}
+	var s models.Snapshot
+	if err = models.DecodeRecord(models.KindSnapshot, bytes, &s); err != nil {
+		return nil, errors.WithMessage(err, "models.DecodeRecord failed")
+	}
+
+	exist, err := snapshot.Exists(context.TODO(), name, version)
+	if err != nil {
+		return nil, errors.WithMessage(err, "snapshot.Exists failed")
+	}
+	if !exist {
+		return nil, errors.Wrapf(xerrors.NewSnapshotNotFoundError(), "container: %s version: %d, location: %s",
+			name, version, snapshot.Location(name, version))
+	}
+	s.Location = snapshot.Location(name, version)
+	return &s, nil
+}
+
+// ListSnapshots returns the snapshots of the replicaSet, the latest version comes first.
+func (rs *ReplicaSetService) ListSnapshots(name string) ([]*models.Snapshot, error) {
+	kvs, err := store.ListChildren(store.Containers, path.Join(name, snapshotsKey))
+	if err != nil {
+		return nil, errors.Wrapf(err, "store.ListChildren failed, key: %s",
+			store.ResourcePrefix(store.Containers, path.Join(name, snapshotsKey)))
+	}
+
+	snapshots := make([]*models.Snapshot, 0, len(kvs))
+	for _, kv := range kvs {
+		var s models.Snapshot
+		if err = models.DecodeRecord(models.KindSnapshot, kv.Value, &s); err != nil {
+			return nil, errors.Wrapf(err, "models.DecodeRecord failed, value: %s", kv.Value)
+		}
+		s.Location = snapshot.Location(name, s.Version)
+		snapshots = append(snapshots, &s)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Version > snapshots[j].Version
+	})
+	return snapshots, nil
+}
+
+// DeleteSnapshot deletes the snapshot of a historical version of the replicaSet,
+// the version can't be rolled back to after that.
+func (rs *ReplicaSetService) DeleteSnapshot(ctx context.Context, name string, version int64) error {
+	unlock, err := locker.Lock(store.Containers, name)
+	if err != nil {
+		return errors.WithMessage(err, "locker.Lock failed")
+	}
+	defer unlock()
+
+	if _, err = getSnapshot(name, version); err != nil {
+		return errors.WithMessage(err, "services.getSnapshot failed")
+	}
+	removeSnapshot(ctx, name, version)
+	log.Infof("services.DeleteSnapshot, container: %s version: %d snapshot is deleted", name, version)
+	return nil
+}
+
+// removeSnapshot deletes the snapshot of the replicaSet version and its record.
+func removeSnapshot(ctx context.Context, name string, version int64) {
+	if err := snapshot.Remove(context.TODO(), name, version); err != nil {
+		log.Errorf("services.removeSnapshot, failed to remove snapshot of container: %s version: %d, error: %v",
+			name, version, err)
+	}
+	workQueue.Enqueue(ctx, store.DelKey{
+		Resource: store.Containers,
+		Key:      snapshotKey(name, version),
+	})
+}
+
+// removeSnapshots deletes all snapshots of the replicaSet, the records are deleted together with the replicaSet.
+func removeSnapshots(name string) {
+	if err := os.RemoveAll(filepath.Dir(legacySnapshotPath(name))); err != nil {
+		log.Errorf("services.removeSnapshots, failed to remove legacy snapshots of container: %s, error: %v", name, err)
+	}
+
+	all, err := snapshot.List(context.TODO())
+	if err != nil {
+		log.Errorf("services.removeSnapshots, failed to list snapshots, error: %v", err)
+		return
+	}
+	for _, version := range all[name] {
+		if err = snapshot.Remove(context.TODO(), name, version); err != nil {
+			log.Errorf("services.removeSnapshots, failed to remove snapshot of container: %s version: %d, error: %v",
+				name, version, err)
+		}
+	}
+}
+
+// Snapshots returns the snapshots of all replicaSets.
+func (as *AdminService) Snapshots() ([]*models.Snapshot, error) {
+	kvs, err := store.List(store.Containers)
+	if err != nil {
+		return nil, errors.WithMessage(err, "store.List failed")
+	}
+
+	snapshots := make([]*models.Snapshot, 0)
+	for _, kv := range kvs {
+		if parts := strings.Split(kv.Key, "/"); len(parts) != 3 || parts[1] != snapshotsKey {
+			continue
+		}
+		var s models.Snapshot
+		if err = models.DecodeRecord(models.KindSnapshot, kv.Value, &s); err != nil {
+			return nil, errors.Wrapf(err, "models.DecodeRecord failed, value: %s", kv.Value)
+		}
+		s.Location = snapshot.Location(s.ReplicaSet, s.Version)
+		snapshots = append(snapshots, &s)
+	}
+	return snapshots, nil
+}
+
+// CollectSnapshots reconciles the snapshots with their records in the store.
+// Snapshots of deleted replicaSets or pruned versions are removed, records without snapshots are deleted,
+// and snapshots without records are recorded. The snapshots saved as plain directories by older releases,
+// e.g. merges/foo/foo-1, are converted. At last, the contents not referenced by any snapshot are swept.
+// A replicaSet with an operation in progress is skipped.
+func (as *AdminService) CollectSnapshots() (*models.SnapshotGC, error) {
+	gc := &models.SnapshotGC{
+		Removed:  make([]*models.Snapshot, 0),
+		Recorded: make([]*models.Snapshot, 0),
+	}
+
+	saved, err := snapshot.List(context.TODO())
+	if err != nil {
+		return nil, errors.WithMessage(err, "snapshot.List failed")
+	}
+	names := make(map[string]struct{}, len(saved))
+	for name := range saved {
+		names[name] = struct{}{}
+	}
+	kvs, err := store.List(store.Containers)
+	if err != nil {
+		return nil, errors.WithMessage(err, "store.List failed")
+	}
+	for _, kv := range kvs {
+		if parts := strings.Split(kv.Key, "/"); len(parts) == 3 && parts[1] == snapshotsKey {
+			names[parts[0]] = struct{}{}
+		}
+	}
+	entries, err := os.ReadDir(mergesDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "os.ReadDir failed, path: %s", mergesDir)
+	}
+	for _, entry := range entries {
+		// the directories of the local snapshot backend are hidden
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			names[entry.Name()] = struct{}{}
+		}
+	}
+
+	for name := range names {
+		if err = collectSnapshots(name, saved[name], gc); err != nil {
+			if xerrors.IsOperationInProgressError(err) {
+				log.Warnf("services.CollectSnapshots, container: %s is skipped, another operation is in progress", name)
+				continue
+			}
+			return gc, errors.WithMessagef(err, "services.collectSnapshots failed, container: %s", name)
+		}
+	}
+
+	freed, err := snapshot.Sweep(context.TODO())
+	if err != nil {
+		return gc, errors.WithMessage(err, "snapshot.Sweep failed")
+	}
+	gc.FreedSize += freed
+
+	// the snapshots recorded by older releases are converted above
+	if err = store.Del(store.Merges, legacyMergeMapKey); err != nil {
+		return gc, errors.WithMessage(err, "store.Del failed")
+	}
+	log.Infof("services.CollectSnapshots, %d snapshots are removed, %d bytes are freed, %d snapshots are recorded",
+		len(gc.Removed), gc.FreedSize, len(gc.Recorded))
+	return gc, nil
+}
+
+func collectSnapshots(name string, saved []int64, gc *models.SnapshotGC) error {
+	unlock, err := locker.Lock(store.Containers, name)
+	if err != nil {
+		return errors.WithMessage(err, "locker.Lock failed")
+	}
+	defer unlock()
+
+	// versions that still exist in the history, the current version may not be written to the store yet
+	versions := make(map[int64]struct{})
+	if current, ok := vmap.ContainerVersionMap.Get(name); ok {
+		versions[current] = struct{}{}
+		replicaSet, err := store.GetVersionRange(store.Containers, name)
+		if err != nil {
+			return errors.WithMessage(err, "store.GetVersionRange failed")
+		}
+		for _, combine := range replicaSet {
+			versions[combine.Version] = struct{}{}
+		}
+	}
+
+	recorded, err := (&ReplicaSetService{}).ListSnapshots(name)
+	if err != nil {
+		return errors.WithMessage(err, "services.ListSnapshots failed")
+	}
+	records := make(map[int64]*models.Snapshot, len(recorded))
+	for _, s := range recorded {
+		records[s.Version] = s
+	}
+
+	exists := make(map[int64]struct{}, len(saved))
+	for _, version := range saved {
+		exists[version] = struct{}{}
+	}
+	if err = convertLegacySnapshots(name, versions, exists, gc); err != nil {
+		return err
+	}
+
+	ctx := context.TODO()
+	for version := range exists {
+		_, inHistory := versions[version]
+		_, isRecorded := records[version]
+		if inHistory && isRecorded {
+			continue
+		}
+		s, err := snapshot.Get(ctx, name, version)
+		if err != nil {
+			return errors.WithMessage(err, "snapshot.Get failed")
+		}
+		if !inHistory {
+			removeSnapshot(ctx, name, version)
+			gc.Removed = append(gc.Removed, s)
+			continue
+		}
+		recordSnapshot(ctx, s)
+		gc.Recorded = append(gc.Recorded, s)
+	}
+
+	for version, s := range records {
+		if _, ok := exists[version]; !ok {
+			removeSnapshot(ctx, name, version)
+			gc.Removed = append(gc.Removed, s)
+		}
+	}
+	return nil
+}
+
+// convertLegacySnapshots saves the plain directories of the replicaSet saved by older releases, e.g. merges/foo/foo-1,
+// as snapshots if the versions are still in the history, and removes the directories.
+func convertLegacySnapshots(name string, versions, exists map[int64]struct{}, gc *models.SnapshotGC) error {
+	dir := filepath.Dir(legacySnapshotPath(name))
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "os.ReadDir failed, path: %s", dir)
+	}
+
+	for _, entry := range entries {
+		v, ok := strings.CutPrefix(entry.Name(), name+"-")
+		version, err := strconv.ParseInt(v, 10, 64)
+		if !entry.IsDir() || !ok || err != nil {
+			log.Warnf("services.CollectSnapshots, %s is skipped, it is not a snapshot", filepath.Join(dir, entry.Name()))
+			continue
+		}
+
+		legacy := filepath.Join(dir, entry.Name())
+		if _, ok = versions[version]; ok {
+			if _, ok = exists[version]; !ok {
+				if _, err = snapshot.Save(context.TODO(), name, version, legacy); err != nil {
+					return errors.WithMessagef(err, "snapshot.Save failed, path: %s", legacy)
+				}
+				exists[version] = struct{}{}
+			}
+		} else {
+			size, _ := utils.DirSize(legacy)
+			gc.Removed = append(gc.Removed, &models.Snapshot{ReplicaSet: name, Version: version, Location: legacy, Size: size})
+			gc.FreedSize += size
+		}
+		if err = os.RemoveAll(legacy); err != nil {
+			return errors.Wrapf(err, "os.RemoveAll failed, path: %s", legacy)
+		}
+		log.Infof("services.CollectSnapshots, legacy snapshot: %s is converted or removed", legacy)
+	}
+	_ = os.Remove(dir)
+	return nil
+}
+
+func snapshotKey(name string, version int64) string {
+	return path.Join(name, snapshotsKey, strconv.FormatInt(version, 10))
+}
+
+// legacySnapshotPath returns where older releases saved the merged layer of the container,
+// e.g. merges/foo/foo-1
+func legacySnapshotPath(name string) string {
+	dir, _ := os.Getwd()
+	return filepath.Join(dir, mergesDir, strings.Split(name, "-")[0], name)
+}
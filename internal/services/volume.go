@@ -2,7 +2,6 @@ package services
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -13,8 +12,9 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/mayooot/gpu-docker-api/internal/docker"
-	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/locker"
 	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/store"
 	vmap "github.com/mayooot/gpu-docker-api/internal/version"
 	"github.com/mayooot/gpu-docker-api/internal/workQueue"
 	"github.com/mayooot/gpu-docker-api/internal/xerrors"
@@ -23,8 +23,13 @@ import (
 
 type VolumeService struct{}
 
-func (vs *VolumeService) CreateVolume(spec *models.VolumeCreate) (resp volume.Volume, err error) {
-	ctx := context.Background()
+func (vs *VolumeService) CreateVolume(ctx context.Context, spec *models.VolumeCreate) (resp volume.Volume, err error) {
+	unlock, err := locker.Lock(store.Volumes, spec.Name)
+	if err != nil {
+		return resp, errors.WithMessage(err, "locker.Lock failed")
+	}
+	defer unlock()
+
 	if vs.existVolume(spec.Name) {
 		return resp, errors.Wrapf(xerrors.NewVolumeExistedError(), "volume %s", spec.Name)
 	}
@@ -42,28 +47,29 @@ func (vs *VolumeService) CreateVolume(spec *models.VolumeCreate) (resp volume.Vo
 		return resp, errors.WithMessage(err, "services.createVolume failed")
 	}
 
-	workQueue.Queue <- etcd.PutKeyValue{
-		Resource: etcd.Volumes,
+	workQueue.Enqueue(ctx, store.PutKeyValue{
+		Resource: store.Volumes,
 		Key:      kv.Key,
 		Value:    kv.Value,
-	}
+		Version:  kv.Version,
+	})
 	return
 }
 
 // It will only be executed based on the `docker.client.ContainerCreate`
-func (vs *VolumeService) createVolume(ctx context.Context, name string, info models.EtcdVolumeInfo) (resp volume.Volume, kv etcd.PutKeyValue, err error) {
+func (vs *VolumeService) createVolume(ctx context.Context, name string, info models.EtcdVolumeInfo) (resp volume.Volume, kv store.PutKeyValue, err error) {
 	// set the version number
 	version, _ := vmap.VolumeVersionMap.Get(name)
 	version = version + 1
-	vmap.VolumeVersionMap.Set(name, version)
+	vmap.VolumeVersionMap.Set(ctx, name, version)
 
 	defer func() {
 		// if run container failed, clear the version number
 		if err != nil {
 			if version == 1 {
-				vmap.VolumeVersionMap.Remove(name)
+				vmap.VolumeVersionMap.Remove(ctx, name)
 			} else {
-				vmap.VolumeVersionMap.Set(name, version-1)
+				vmap.VolumeVersionMap.Set(ctx, name, version-1)
 			}
 		}
 	}()
@@ -84,17 +90,24 @@ func (vs *VolumeService) createVolume(ctx context.Context, name string, info mod
 		Version:    version,
 		CreateTime: info.CreateTime,
 	}
-	kv = etcd.PutKeyValue{
-		Resource: etcd.Volumes,
+	kv = store.PutKeyValue{
+		Resource: store.Volumes,
 		Key:      name,
 		Value:    val.Serialize(),
+		Version:  version,
 	}
 
 	log.Infof("serivce.createVolume, volume created successfully, name: %s, opt: %+v, version: %d", resp.Name, *info.Opt, info.Version)
 	return
 }
 
-func (vs *VolumeService) PatchVolumeSize(name string, spec *models.VolumeSize) (resp volume.Volume, err error) {
+func (vs *VolumeService) PatchVolumeSize(ctx context.Context, name string, spec *models.VolumeSize) (resp volume.Volume, err error) {
+	unlock, err := locker.Lock(store.Volumes, name)
+	if err != nil {
+		return resp, errors.WithMessage(err, "locker.Lock failed")
+	}
+	defer unlock()
+
 	// get the latest version number
 	version, ok := vmap.VolumeVersionMap.Get(name)
 	if !ok {
@@ -102,14 +115,13 @@ func (vs *VolumeService) PatchVolumeSize(name string, spec *models.VolumeSize) (
 	}
 	volVersionName := fmt.Sprintf("%s-%d", name, version)
 
-	ctx := context.Background()
-	infoBytes, err := etcd.GetValue(etcd.Volumes, name)
+	infoBytes, err := store.GetValue(store.Volumes, name)
 	if err != nil {
-		return resp, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Containers, name))
+		return resp, errors.Wrapf(err, "store.GetValue failed, key: %s", store.ResourcePrefix(store.Containers, name))
 	}
 	var info models.EtcdVolumeInfo
-	if err = json.Unmarshal(infoBytes, &info); err != nil {
-		return resp, errors.WithMessage(err, "json.Unmarshal failed")
+	if err = models.DecodeRecord(models.KindVolume, infoBytes, &info); err != nil {
+		return resp, errors.WithMessage(err, "models.DecodeRecord failed")
 	}
 
 	preSize := info.Opt.DriverOpts["size"]
@@ -122,6 +134,7 @@ func (vs *VolumeService) PatchVolumeSize(name string, spec *models.VolumeSize) (
 	}
 
 	// check whether the size after shrink is larger than used size
+	setPhase(ctx, models.PhaseAllocating)
 	if patchSizeBytes < preSizeBytes {
 		mountpoint, err := utils.GetVolumeMountPoint(volVersionName)
 		if err != nil {
@@ -141,27 +154,31 @@ func (vs *VolumeService) PatchVolumeSize(name string, spec *models.VolumeSize) (
 	info.Opt.DriverOpts["size"] = patchSize
 
 	// create a new volume to replace the old one
+	setPhase(ctx, models.PhaseCreating)
 	resp, kv, err := vs.createVolume(ctx, name, info)
 	if err != nil {
 		return resp, errors.WithMessage(err, "services.createVolume failed")
 	}
 
-	err = utils.CopyOldMountPointToContainerMountPoint(resp.Name, resp.Name)
+	setPhase(ctx, models.PhaseCopying)
+	err = utils.CopyOldMountPointToContainerMountPoint(ctx, volVersionName, resp.Name, copyProgress(ctx))
 	if err != nil {
-		return resp, errors.WithMessage(err, "utils.CopyOldMergedToNewContainerMerged failed")
+		return resp, errors.WithMessage(err, "utils.CopyOldMountPointToContainerMountPoint failed")
 	}
 
 	// delete the old volume
-	err = vs.DeleteVolume(volVersionName, false, false)
+	setPhase(ctx, models.PhaseCleaningUp)
+	err = vs.deleteVolume(ctx, volVersionName, false, false)
 	if err != nil {
-		return resp, errors.WithMessage(err, "services.DeleteVolume failed")
+		return resp, errors.WithMessage(err, "services.deleteVolume failed")
 	}
 
-	workQueue.Queue <- etcd.PutKeyValue{
-		Resource: etcd.Volumes,
+	workQueue.Enqueue(ctx, store.PutKeyValue{
+		Resource: store.Volumes,
 		Key:      kv.Key,
 		Value:    kv.Value,
-	}
+		Version:  kv.Version,
+	})
 
 	log.Infof("services.PatchVolumeSize, volume size patched successfully, old name: %s, old size: %s, new name: %s, new size: %s",
 		name, preSize, resp.Name, patchSize)
@@ -170,7 +187,18 @@ func (vs *VolumeService) PatchVolumeSize(name string, spec *models.VolumeSize) (
 
 // DeleteVolume deletes a specific version of volume or the latest version of volume.
 // If deleteRecord is true, etcd info about this volume and VolumeVersionMap record are deleted.
-func (vs *VolumeService) DeleteVolume(name string, isLatest, deleteRecord bool) error {
+func (vs *VolumeService) DeleteVolume(ctx context.Context, name string, isLatest, deleteRecord bool) error {
+	unlock, err := locker.Lock(store.Volumes, strings.Split(name, "-")[0])
+	if err != nil {
+		return errors.WithMessage(err, "locker.Lock failed")
+	}
+	defer unlock()
+
+	return vs.deleteVolume(ctx, name, isLatest, deleteRecord)
+}
+
+// deleteVolume is the same as DeleteVolume, but the caller must hold the lock of the volume.
+func (vs *VolumeService) deleteVolume(ctx context.Context, name string, isLatest, deleteRecord bool) error {
 	if isLatest {
 		// get the last version number
 		version, ok := vmap.VolumeVersionMap.Get(name)
@@ -181,11 +209,11 @@ func (vs *VolumeService) DeleteVolume(name string, isLatest, deleteRecord bool)
 	}
 	if deleteRecord {
 		log.Infof("services.DeleteVolume, volume: %s will be del etcd info and version record", name)
-		vmap.VolumeVersionMap.Remove(strings.Split(name, "-")[0])
-		workQueue.Queue <- etcd.DelKey{
-			Resource: etcd.Volumes,
-			Key:      name,
-		}
+		vmap.VolumeVersionMap.Remove(ctx, strings.Split(name, "-")[0])
+		workQueue.Enqueue(ctx, store.DelKey{
+			Resource: store.Volumes,
+			Key:      strings.Split(name, "-")[0],
+		})
 	}
 
 	err := docker.Cli.VolumeRemove(context.TODO(), name, true)
@@ -198,30 +226,30 @@ func (vs *VolumeService) DeleteVolume(name string, isLatest, deleteRecord bool)
 }
 
 func (vs *VolumeService) GetVolumeInfo(name string) (info models.EtcdVolumeInfo, err error) {
-	infoBytes, err := etcd.GetValue(etcd.Volumes, name)
+	infoBytes, err := store.GetValue(store.Volumes, name)
 	if err != nil {
-		return info, errors.Wrapf(err, "etcd.GetValue failed, key: %s", etcd.ResourcePrefix(etcd.Containers, name))
+		return info, errors.Wrapf(err, "store.GetValue failed, key: %s", store.ResourcePrefix(store.Containers, name))
 	}
 
-	if err = json.Unmarshal(infoBytes, &info); err != nil {
-		return info, errors.WithMessage(err, "json.Unmarshal failed")
+	if err = models.DecodeRecord(models.KindVolume, infoBytes, &info); err != nil {
+		return info, errors.WithMessage(err, "models.DecodeRecord failed")
 	}
 	return
 }
 
 func (vs *VolumeService) GetVolumeHistory(name string) ([]*models.VolumeHistoryItem, error) {
-	replicaSet, err := etcd.GetRevisionRange(etcd.Volumes, name)
+	replicaSet, err := store.GetVersionRange(store.Volumes, name)
 	if err != nil {
-		return nil, errors.Wrapf(err, "etcd.GetRevisionRange failed, key: %s",
-			etcd.ResourcePrefix(etcd.Volumes, name))
+		return nil, errors.Wrapf(err, "store.GetVersionRange failed, key: %s",
+			store.ResourcePrefix(store.Volumes, name))
 	}
 
 	resp := make([]*models.VolumeHistoryItem, 0, len(replicaSet))
 	for _, combine := range replicaSet {
 		var info models.EtcdVolumeInfo
-		err := json.Unmarshal(combine.Value, &info)
+		err := models.DecodeRecord(models.KindVolume, combine.Value, &info)
 		if err != nil {
-			return nil, errors.Wrapf(err, "json.Unmarshal failed, value: %s", combine.Value)
+			return nil, errors.Wrapf(err, "models.DecodeRecord failed, value: %s", combine.Value)
 		}
 		resp = append(resp, &models.VolumeHistoryItem{
 			Version:    combine.Version,
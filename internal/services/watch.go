@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"path"
+	"sort"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/schedulers"
+	"github.com/mayooot/gpu-docker-api/internal/store"
+)
+
+type WatchService struct{}
+
+// Watch calls fn for every change of replicaSet, volume and gpu after revision rev,
+// until ctx is done or an error occurs. If rev is 0, it starts from now.
+func (ws *WatchService) Watch(ctx context.Context, rev int64, fn func(*models.Event)) error {
+	err := store.Watch(ctx, rev, func(we *store.WatchEvent) {
+		events, err := ws.toEvents(we)
+		if err != nil {
+			log.Errorf("services.Watch, failed to convert etcd event, resource: %s, key: %s, revision: %d, error: %v",
+				we.Resource, we.Key, we.Revision, err)
+			return
+		}
+		for _, event := range events {
+			fn(event)
+		}
+	})
+	if err != nil {
+		return errors.WithMessage(err, "store.Watch failed")
+	}
+	return nil
+}
+
+// toEvents converts a change of etcd key to typed events,
+// changes of the keys that users don't care about are ignored.
+func (ws *WatchService) toEvents(we *store.WatchEvent) ([]*models.Event, error) {
+	switch we.Resource {
+	case store.Containers:
+		return ws.containerEvents(we)
+	case store.Volumes:
+		return ws.volumeEvents(we)
+	case store.Gpus:
+		return ws.gpuEvents(we)
+	default:
+		return nil, nil
+	}
+}
+
+func (ws *WatchService) containerEvents(we *store.WatchEvent) ([]*models.Event, error) {
+	name, sub := path.Split(we.Key)
+	if len(name) == 0 {
+		// the key of replicaSet itself, it points to the current version
+		if we.Deleted {
+			return []*models.Event{{Type: models.ReplicaSetDeleted, Name: we.Key, Revision: we.Revision}}, nil
+		}
+		var info models.EtcdContainerInfo
+		if err := models.DecodeRecord(models.KindContainer, we.Value, &info); err != nil {
+			return nil, errors.Wrapf(err, "models.DecodeRecord failed, value: %s", we.Value)
+		}
+		eventType := models.ReplicaSetPatched
+		if info.Version == 1 {
+			eventType = models.ReplicaSetCreated
+		}
+		return []*models.Event{{Type: eventType, Name: we.Key, Version: info.Version, Revision: we.Revision}}, nil
+	}
+
+	if sub != containerStateKey || we.Deleted {
+		return nil, nil
+	}
+	var state models.ContainerState
+	if err := models.DecodeRecord(models.KindContainerState, we.Value, &state); err != nil {
+		return nil, errors.Wrapf(err, "models.DecodeRecord failed, value: %s", we.Value)
+	}
+	eventType := models.ReplicaSetContinued
+	switch state.State {
+	case models.ContainerStopped:
+		eventType = models.ReplicaSetStopped
+	case models.ContainerPaused:
+		eventType = models.ReplicaSetPaused
+	}
+	return []*models.Event{{Type: eventType, Name: path.Clean(name), Version: state.Version, Revision: we.Revision}}, nil
+}
+
+func (ws *WatchService) volumeEvents(we *store.WatchEvent) ([]*models.Event, error) {
+	if name, _ := path.Split(we.Key); len(name) != 0 {
+		// versions of volume
+		return nil, nil
+	}
+	if we.Deleted {
+		return []*models.Event{{Type: models.VolumeDeleted, Name: we.Key, Revision: we.Revision}}, nil
+	}
+
+	var info models.EtcdVolumeInfo
+	if err := models.DecodeRecord(models.KindVolume, we.Value, &info); err != nil {
+		return nil, errors.Wrapf(err, "models.DecodeRecord failed, value: %s", we.Value)
+	}
+	eventType := models.VolumeResized
+	if info.Version == 1 {
+		eventType = models.VolumeCreated
+	}
+	return []*models.Event{{Type: eventType, Name: we.Key, Version: info.Version, Revision: we.Revision}}, nil
+}
+
+func (ws *WatchService) gpuEvents(we *store.WatchEvent) ([]*models.Event, error) {
+	if we.Deleted {
+		return nil, nil
+	}
+	prev, err := schedulers.ParseGpuStatus(we.PrevValue)
+	if err != nil {
+		return nil, errors.WithMessage(err, "schedulers.ParseGpuStatus failed")
+	}
+	cur, err := schedulers.ParseGpuStatus(we.Value)
+	if err != nil {
+		return nil, errors.WithMessage(err, "schedulers.ParseGpuStatus failed")
+	}
+
+	var allocated, released []string
+	for uuid, used := range cur {
+		if used == prev[uuid] {
+			continue
+		}
+		if used == 1 {
+			allocated = append(allocated, uuid)
+		} else {
+			released = append(released, uuid)
+		}
+	}
+	sort.Strings(allocated)
+	sort.Strings(released)
+
+	events := make([]*models.Event, 0, 2)
+	if len(allocated) > 0 {
+		events = append(events, &models.Event{Type: models.GpuAllocated, Gpus: allocated, Revision: we.Revision})
+	}
+	if len(released) > 0 {
+		events = append(events, &models.Event{Type: models.GpuReleased, Gpus: released, Revision: we.Revision})
+	}
+	return events, nil
+}
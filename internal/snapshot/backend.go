@@ -0,0 +1,36 @@
+package snapshot
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Backend is where the snapshot manifests and the file contents are saved,
+// keys are slash separated, e.g. blobs/sha256/ab/abcd.zst.
+type Backend interface {
+	// Put saves the content of r as key, a partially written key is never visible.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get opens key, it fails with SnapshotNotFoundError if key does not exist.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	// List returns the objects whose keys start with prefix.
+	List(ctx context.Context, prefix string) ([]Object, error)
+	Del(ctx context.Context, key string) error
+	// Location returns where key is saved, it is only used to show to users.
+	Location(key string) string
+}
+
+type Object struct {
+	Key  string
+	Size int64
+	// ModTime is when the object is last put, by the clock of the backend
+	ModTime time.Time
+}
+
+var backend Backend
+
+// InitSnapshot sets the backend that the snapshots are saved in.
+func InitSnapshot(b Backend) {
+	backend = b
+}
@@ -0,0 +1,113 @@
+package snapshot
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+type localBackend struct {
+	root string
+}
+
+// NewLocalBackend saves the snapshots in the directory root on local disk.
+func NewLocalBackend(root string) (Backend, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, errors.Wrapf(err, "filepath.Abs failed, path: %s", root)
+	}
+	if err = os.MkdirAll(root, 0755); err != nil {
+		return nil, errors.Wrapf(err, "os.MkdirAll failed, path: %s", root)
+	}
+	return &localBackend{root: root}, nil
+}
+
+func (l *localBackend) Put(_ context.Context, key string, r io.Reader) error {
+	name := l.Location(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return errors.Wrapf(err, "os.MkdirAll failed, path: %s", filepath.Dir(name))
+	}
+	// written to a temporary file first, so that a crash never leaves a broken key
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return errors.Wrapf(err, "os.CreateTemp failed, key: %s", key)
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return errors.Wrapf(err, "failed to write key: %s", key)
+	}
+	return nil
+}
+
+func (l *localBackend) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(l.Location(key))
+	if os.IsNotExist(err) {
+		return nil, errors.Wrapf(xerrors.NewSnapshotNotFoundError(), "key: %s", key)
+	}
+	return f, errors.Wrapf(err, "os.Open failed, key: %s", key)
+}
+
+func (l *localBackend) Exists(_ context.Context, key string) (bool, error) {
+	_, err := os.Stat(l.Location(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, errors.Wrapf(err, "os.Stat failed, key: %s", key)
+}
+
+func (l *localBackend) List(_ context.Context, prefix string) ([]Object, error) {
+	objects := make([]Object, 0)
+	// only the directory that prefix is in is walked
+	start := l.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		start = l.Location(prefix[:i])
+	}
+	if _, err := os.Stat(start); os.IsNotExist(err) {
+		return objects, nil
+	}
+	err := filepath.WalkDir(start, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		key := filepath.ToSlash(strings.TrimPrefix(name, l.root+string(filepath.Separator)))
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, Object{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return objects, errors.Wrapf(err, "filepath.WalkDir failed, prefix: %s", prefix)
+}
+
+func (l *localBackend) Del(_ context.Context, key string) error {
+	err := os.Remove(l.Location(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return errors.Wrapf(err, "os.Remove failed, key: %s", key)
+}
+
+func (l *localBackend) Location(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(key))
+}
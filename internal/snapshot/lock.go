@@ -0,0 +1,131 @@
+package snapshot
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// The snapshots are saved under shared locks and swept under an exclusive lock, so that a sweep never deletes
+// the blobs of a snapshot which is being saved and not referenced by its manifest yet.
+// The locks are saved in the backend, e.g. locks/shared-1a2b3c4d.json, because the instances sharing a bucket
+// can't see the locks in the memory of each other.
+const (
+	locksDir = "locks"
+
+	sharedLock    = "shared"
+	exclusiveLock = "exclusive"
+
+	// a lock is put again every lockRefreshInterval while it is held,
+	// a lock that is not put again within lockStaleAfter is left by a crashed instance and ignored.
+	lockRefreshInterval = time.Minute
+	lockStaleAfter      = 5 * time.Minute
+
+	// lockRetryInterval is how often a save checks whether the sweep holding the exclusive lock is done
+	lockRetryInterval = time.Second
+)
+
+// lock takes a shared lock, or an exclusive lock if exclusive is true, and returns the function to release it.
+// A shared lock waits until the exclusive lock is released, an exclusive lock fails with SnapshotLockedError
+// if another lock is held.
+func lock(ctx context.Context, exclusive bool) (func(), error) {
+	kind := sharedLock
+	if exclusive {
+		kind = exclusiveLock
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, errors.Wrap(err, "rand.Read failed")
+	}
+	key := fmt.Sprintf("%s/%s-%s.json", locksDir, kind, hex.EncodeToString(id))
+
+	// the lock is put before the others are checked, so that of two locks taken at the same time,
+	// at least one sees the other
+	for {
+		if err := putLock(ctx, key); err != nil {
+			return nil, err
+		}
+		conflict, err := lockConflict(ctx, key, exclusive)
+		if err == nil && !conflict {
+			break
+		}
+		_ = backend.Del(context.Background(), key)
+		if err != nil {
+			return nil, err
+		}
+		if exclusive {
+			return nil, errors.Wrapf(xerrors.NewSnapshotLockedError(), "key: %s", key)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+
+	refreshCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(lockRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-refreshCtx.Done():
+				return
+			case <-ticker.C:
+				if err := putLock(refreshCtx, key); err != nil && refreshCtx.Err() == nil {
+					log.Warnf("snapshot.lock, failed to refresh lock: %s, error: %v", key, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		if err := backend.Del(context.Background(), key); err != nil {
+			log.Warnf("snapshot.lock, failed to release lock: %s, error: %v", key, err)
+		}
+	}, nil
+}
+
+func putLock(ctx context.Context, key string) error {
+	return backend.Put(ctx, key, strings.NewReader(fmt.Sprintf(`{"createTime":%q}`, time.Now().Format("2006-01-02 15:04:05"))))
+}
+
+// lockConflict reports whether another lock that conflicts with the lock of key is held.
+// The age of the locks is compared with the lock of key, so the clock of this instance doesn't matter.
+func lockConflict(ctx context.Context, key string, exclusive bool) (bool, error) {
+	locks, err := backend.List(ctx, locksDir+"/")
+	if err != nil {
+		return false, err
+	}
+	var now time.Time
+	for _, obj := range locks {
+		if obj.Key == key {
+			now = obj.ModTime
+		}
+	}
+	if now.IsZero() {
+		return false, errors.Errorf("lock: %s is not found after it is put", key)
+	}
+
+	for _, obj := range locks {
+		if obj.Key == key || now.Sub(obj.ModTime) > lockStaleAfter {
+			continue
+		}
+		if exclusive || strings.HasPrefix(obj.Key, locksDir+"/"+exclusiveLock+"-") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,124 @@
+package snapshot
+
+import (
+	"context"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// s3PartSize is the part size of multipart uploads, the content is streamed,
+// so a part is buffered in memory before it is uploaded.
+const s3PartSize = 16 << 20
+
+// S3Config is the config of an S3-compatible object storage, e.g. AWS S3 or MinIO.
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Secure    bool
+	// Prefix is prepended to every key, so that several deployments can share one bucket
+	Prefix string
+}
+
+type s3Backend struct {
+	cli    *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3Backend saves the snapshots in an S3-compatible object storage, the bucket is created if it does not exist.
+func NewS3Backend(cfg S3Config) (Backend, error) {
+	cli, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.Secure,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "minio.New failed, endpoint: %s", cfg.Endpoint)
+	}
+
+	ctx := context.Background()
+	exist, err := cli.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "minio.BucketExists failed, endpoint: %s, bucket: %s", cfg.Endpoint, cfg.Bucket)
+	}
+	if !exist {
+		if err = cli.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			return nil, errors.Wrapf(err, "minio.MakeBucket failed, endpoint: %s, bucket: %s", cfg.Endpoint, cfg.Bucket)
+		}
+	}
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if len(prefix) != 0 {
+		prefix += "/"
+	}
+	return &s3Backend{cli: cli, bucket: cfg.Bucket, prefix: prefix}, nil
+}
+
+func (s *s3Backend) Put(ctx context.Context, key string, r io.Reader) error {
+	_, err := s.cli.PutObject(ctx, s.bucket, s.key(key), r, -1, minio.PutObjectOptions{PartSize: s3PartSize})
+	return errors.Wrapf(err, "minio.PutObject failed, key: %s", key)
+}
+
+func (s *s3Backend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := s.cli.GetObject(ctx, s.bucket, s.key(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "minio.GetObject failed, key: %s", key)
+	}
+	// the object is requested lazily, stat it to know whether it exists
+	if _, err = obj.Stat(); err != nil {
+		_ = obj.Close()
+		if isNoSuchKey(err) {
+			return nil, errors.Wrapf(xerrors.NewSnapshotNotFoundError(), "key: %s", key)
+		}
+		return nil, errors.Wrapf(err, "minio.Object.Stat failed, key: %s", key)
+	}
+	return obj, nil
+}
+
+func (s *s3Backend) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.cli.StatObject(ctx, s.bucket, s.key(key), minio.StatObjectOptions{})
+	if err != nil {
+		if isNoSuchKey(err) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "minio.StatObject failed, key: %s", key)
+	}
+	return true, nil
+}
+
+func (s *s3Backend) List(ctx context.Context, prefix string) ([]Object, error) {
+	objects := make([]Object, 0)
+	for info := range s.cli.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.key(prefix), Recursive: true}) {
+		if info.Err != nil {
+			return nil, errors.Wrapf(info.Err, "minio.ListObjects failed, prefix: %s", prefix)
+		}
+		objects = append(objects, Object{Key: info.Key[len(s.prefix):], Size: info.Size, ModTime: info.LastModified})
+	}
+	return objects, nil
+}
+
+func (s *s3Backend) Del(ctx context.Context, key string) error {
+	err := s.cli.RemoveObject(ctx, s.bucket, s.key(key), minio.RemoveObjectOptions{})
+	return errors.Wrapf(err, "minio.RemoveObject failed, key: %s", key)
+}
+
+func (s *s3Backend) Location(key string) string {
+	return "s3://" + path.Join(s.bucket, s.key(key))
+}
+
+func (s *s3Backend) key(key string) string {
+	return s.prefix + key
+}
+
+func isNoSuchKey(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
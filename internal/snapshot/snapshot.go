@@ -0,0 +1,646 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// A snapshot is saved as a manifest, e.g. manifests/foo/foo-1.json.zst, which lists the files of the merged layer,
+// and the content of every regular file is saved once by its digest, e.g. blobs/sha256/ab/abcd.zst,
+// so a file that is not changed between versions, or is shared by replicaSets, is only saved once.
+// The data of a docker volume bound to the replicaSet version is saved with it, e.g. manifests/foo/volumes/foo-1/bar-2.json.zst.
+// Both are compressed by zstd.
+const (
+	manifestsDir = "manifests"
+	blobsDir     = "blobs/sha256"
+
+	// putBlobAttempts is how many times a file is read again if it is changed while it is being saved
+	putBlobAttempts = 3
+)
+
+const (
+	typeDir      = "dir"
+	typeFile     = "file"
+	typeSymlink  = "symlink"
+	typeHardlink = "hardlink"
+	typeDevice   = "device"
+	typeFifo     = "fifo"
+	// typeWhiteout is a file deleted from the image, it is only saved in the snapshot of an upper layer
+	typeWhiteout = "whiteout"
+)
+
+// overlayOpaqueXattr marks a directory of an overlay upper layer whose files in the image are hidden.
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+type manifest struct {
+	ReplicaSet string `json:"replicaSet"`
+	Version    int64  `json:"version"`
+	// Volume is set if it is the snapshot of a volume bound to the replicaSet version
+	Volume string `json:"volume,omitempty"`
+	// Layer and Image are set if it is the snapshot of a container, see models.Snapshot
+	Layer      string   `json:"layer,omitempty"`
+	Image      string   `json:"image,omitempty"`
+	CreateTime string   `json:"createTime"`
+	Size       int64    `json:"size"`
+	StoredSize int64    `json:"storedSize"`
+	Entries    []*entry `json:"entries"`
+}
+
+// entry is a file of the snapshot, Path is relative to the root of the merged layer.
+type entry struct {
+	Path    string      `json:"path"`
+	Type    string      `json:"type"`
+	Mode    fs.FileMode `json:"mode"`
+	Uid     int         `json:"uid"`
+	Gid     int         `json:"gid"`
+	ModTime int64       `json:"modTime"`
+	Size    int64       `json:"size,omitempty"`
+	Digest  string      `json:"digest,omitempty"`
+	// Link is the target of a symlink, or the path of the first entry of a hardlink
+	Link string `json:"link,omitempty"`
+	Rdev uint64 `json:"rdev,omitempty"`
+	// Opaque is set if the directory of an upper layer hides the same directory of the image
+	Opaque bool `json:"opaque,omitempty"`
+}
+
+// Save saves the files under src, the merged layer of a container, as the snapshot of the replicaSet version,
+// only the files that are not saved by other snapshots are stored.
+func Save(ctx context.Context, name string, version int64, src string) (*models.Snapshot, error) {
+	return SaveLayer(ctx, name, version, src, models.SnapshotLayerMerged, "")
+}
+
+// SaveLayer saves the files under src, the layer of a container created from the image, as the snapshot
+// of the replicaSet version. The whiteouts and opaque directories of an upper layer are saved, so the files
+// deleted in the container are deleted again by Restore.
+func SaveLayer(ctx context.Context, name string, version int64, src, layer, image string) (*models.Snapshot, error) {
+	m := &manifest{ReplicaSet: name, Version: version, Layer: layer, Image: image}
+	if err := save(ctx, m, src); err != nil {
+		return nil, err
+	}
+	return m.snapshot(), nil
+}
+
+// SaveVolume saves the files under src, the mountpoint of the volume, as the snapshot of the volume
+// bound to the replicaSet version. It is removed together with the snapshot of the replicaSet version.
+func SaveVolume(ctx context.Context, name string, version int64, volume, src string) (*models.VolumeSnapshot, error) {
+	m := &manifest{ReplicaSet: name, Version: version, Volume: volume}
+	if err := save(ctx, m, src); err != nil {
+		return nil, err
+	}
+	return &models.VolumeSnapshot{
+		Volume:     volume,
+		Location:   backend.Location(m.key()),
+		Size:       m.Size,
+		StoredSize: m.StoredSize,
+	}, nil
+}
+
+func save(ctx context.Context, m *manifest, src string) error {
+	unlock, err := lock(ctx, false)
+	if err != nil {
+		return errors.WithMessage(err, "snapshot.lock failed")
+	}
+	defer unlock()
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return errors.Wrap(err, "zstd.NewWriter failed")
+	}
+	defer enc.Close()
+
+	m.CreateTime = time.Now().Format("2006-01-02 15:04:05")
+	m.Entries = make([]*entry, 0)
+	type inode struct{ dev, ino uint64 }
+	links := make(map[inode]string)
+	err = filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		e := &entry{
+			Path:    filepath.ToSlash(rel),
+			Mode:    info.Mode(),
+			Uid:     int(st.Uid),
+			Gid:     int(st.Gid),
+			ModTime: info.ModTime().UnixNano(),
+		}
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			e.Type = typeDir
+			e.Opaque = m.Layer == models.SnapshotLayerUpper && isOpaque(p)
+		case mode&fs.ModeSymlink != 0:
+			e.Type = typeSymlink
+			if e.Link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			if st.Nlink > 1 {
+				key := inode{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+				if first, ok := links[key]; ok {
+					e.Type, e.Link = typeHardlink, first
+					break
+				}
+				links[key] = e.Path
+			}
+			e.Type, e.Size = typeFile, info.Size()
+			stored, digest, err := putBlob(ctx, enc, p)
+			if err != nil {
+				return errors.WithMessagef(err, "failed to save %s", p)
+			}
+			e.Digest = digest
+			m.Size += e.Size
+			m.StoredSize += stored
+		case m.Layer == models.SnapshotLayerUpper && mode&fs.ModeCharDevice != 0 && st.Rdev == 0:
+			e.Type = typeWhiteout
+		case mode&fs.ModeDevice != 0:
+			e.Type, e.Rdev = typeDevice, uint64(st.Rdev)
+		case mode&fs.ModeNamedPipe != 0:
+			e.Type = typeFifo
+		default:
+			log.Warnf("snapshot.Save, %s is skipped, file mode: %s is not supported", p, mode)
+			return nil
+		}
+		m.Entries = append(m.Entries, e)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to walk %s", src)
+	}
+
+	return putManifest(ctx, enc, m)
+}
+
+// putBlob saves the content of the file if it is not saved yet, and returns its digest and the size stored.
+// The file may be changed while it is saved, e.g. by a running container, then it is read again.
+func putBlob(ctx context.Context, enc *zstd.Encoder, name string) (stored int64, digest string, err error) {
+	for attempt := 0; attempt < putBlobAttempts; attempt++ {
+		if digest, err = digestFile(name); err != nil {
+			return 0, "", err
+		}
+		key := blobKey(digest)
+		exist, err := backend.Exists(ctx, key)
+		if err != nil {
+			return 0, "", err
+		}
+		if exist {
+			return 0, digest, nil
+		}
+
+		f, err := os.Open(name)
+		if err != nil {
+			return 0, "", errors.Wrapf(err, "os.Open failed, name: %s", name)
+		}
+		h := sha256.New()
+		stored, err = put(ctx, enc, key, io.TeeReader(f, h))
+		_ = f.Close()
+		if err != nil {
+			return 0, "", err
+		}
+		if hex.EncodeToString(h.Sum(nil)) == digest {
+			return stored, digest, nil
+		}
+		// the content saved does not match the key
+		if err = backend.Del(ctx, key); err != nil {
+			return 0, "", err
+		}
+	}
+	return 0, "", errors.Errorf("%s is changed every time it is read", name)
+}
+
+func digestFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", errors.Wrapf(err, "os.Open failed, name: %s", name)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", errors.Wrapf(err, "failed to read %s", name)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// put compresses the content of r and saves it as key, it returns the compressed size.
+func put(ctx context.Context, enc *zstd.Encoder, key string, r io.Reader) (int64, error) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		enc.Reset(pw)
+		_, err := io.Copy(enc, r)
+		if closeErr := enc.Close(); err == nil {
+			err = closeErr
+		}
+		_ = pw.CloseWithError(err)
+	}()
+
+	cr := &countingReader{r: pr}
+	err := backend.Put(ctx, key, cr)
+	// the encoder is reused after the goroutine exits
+	_ = pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+	return cr.n, err
+}
+
+func putManifest(ctx context.Context, enc *zstd.Encoder, m *manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal failed")
+	}
+	_, err = put(ctx, enc, m.key(), bytes.NewReader(data))
+	return err
+}
+
+func getManifest(ctx context.Context, key string) (*manifest, error) {
+	r, err := backend.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	dec, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "zstd.NewReader failed, key: %s", key)
+	}
+	defer dec.Close()
+
+	var m manifest
+	if err = json.NewDecoder(dec).Decode(&m); err != nil {
+		return nil, errors.Wrapf(err, "json.Decode failed, key: %s", key)
+	}
+	return &m, nil
+}
+
+// Restore writes the files of the snapshot of the replicaSet version to dest,
+// the files in dest are overwritten, ownership, modes and modification times are kept.
+// If it is the snapshot of an upper layer, dest is the merged layer of a container created from the same image,
+// the whiteouts are deleted from dest and the opaque directories are emptied before their files are written.
+// It fails with SnapshotNotFoundError if the snapshot does not exist.
+func Restore(ctx context.Context, name string, version int64, dest string) error {
+	return restore(ctx, manifestKey(name, version), dest)
+}
+
+// RestoreVolume writes the files of the snapshot of the volume bound to the replicaSet version to dest,
+// the same as Restore.
+func RestoreVolume(ctx context.Context, name string, version int64, volume, dest string) error {
+	return restore(ctx, volumeManifestKey(name, version, volume), dest)
+}
+
+func restore(ctx context.Context, key, dest string) error {
+	m, err := getManifest(ctx, key)
+	if err != nil {
+		return err
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return errors.Wrap(err, "zstd.NewReader failed")
+	}
+	defer dec.Close()
+
+	dirs := make([]*entry, 0)
+	for _, e := range m.Entries {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		target := filepath.Join(dest, filepath.FromSlash(path.Clean("/"+e.Path)))
+		if err = restoreEntry(ctx, dec, dest, target, e); err != nil {
+			return errors.WithMessagef(err, "failed to restore %s", target)
+		}
+		switch e.Type {
+		case typeDir:
+			dirs = append(dirs, e)
+			continue
+		case typeWhiteout:
+			continue
+		}
+		if err = setAttrs(target, e); err != nil {
+			return errors.Wrapf(err, "failed to set attributes of %s", target)
+		}
+	}
+	// the modification times of directories are changed by their children, so they are set at last
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target := filepath.Join(dest, filepath.FromSlash(path.Clean("/"+dirs[i].Path)))
+		if err = setAttrs(target, dirs[i]); err != nil {
+			return errors.Wrapf(err, "failed to set attributes of %s", target)
+		}
+	}
+	return nil
+}
+
+func restoreEntry(ctx context.Context, dec *zstd.Decoder, dest, target string, e *entry) error {
+	// an existing file of another type is replaced, and a whiteout is just deleted
+	if info, err := os.Lstat(target); err == nil {
+		keep := e.Type == typeDir && info.IsDir() || e.Type == typeFile && info.Mode().IsRegular()
+		if !keep {
+			if err = os.RemoveAll(target); err != nil {
+				return err
+			}
+		} else if e.Opaque {
+			if err = removeChildren(target); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch e.Type {
+	case typeDir:
+		return os.MkdirAll(target, 0755)
+	case typeWhiteout:
+		return nil
+	case typeFile:
+		r, err := backend.Get(ctx, blobKey(e.Digest))
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if err = dec.Reset(r); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, dec)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	case typeSymlink:
+		return os.Symlink(e.Link, target)
+	case typeHardlink:
+		return os.Link(filepath.Join(dest, filepath.FromSlash(path.Clean("/"+e.Link))), target)
+	case typeDevice:
+		mode := uint32(syscall.S_IFBLK)
+		if e.Mode&fs.ModeCharDevice != 0 {
+			mode = syscall.S_IFCHR
+		}
+		return syscall.Mknod(target, mode|uint32(e.Mode.Perm()), int(e.Rdev))
+	case typeFifo:
+		return syscall.Mkfifo(target, uint32(e.Mode.Perm()))
+	default:
+		return errors.Errorf("unknown entry type: %s", e.Type)
+	}
+}
+
+// removeChildren deletes everything in the directory but the directory itself.
+func removeChildren(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isOpaque reports whether the directory of an upper layer is opaque, the xattr can only be read by root.
+func isOpaque(dir string) bool {
+	value := make([]byte, 1)
+	n, err := unix.Lgetxattr(dir, overlayOpaqueXattr, value)
+	return err == nil && n == 1 && value[0] == 'y'
+}
+
+func setAttrs(target string, e *entry) error {
+	// the ownership can only be changed by root
+	_ = os.Lchown(target, e.Uid, e.Gid)
+	if e.Type == typeSymlink {
+		return nil
+	}
+	// chown clears the setuid and setgid bits, so the mode is set after it
+	if err := os.Chmod(target, e.Mode.Perm()|e.Mode&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+	modTime := time.Unix(0, e.ModTime)
+	return os.Chtimes(target, modTime, modTime)
+}
+
+// Get returns the summary of the snapshot of the replicaSet version,
+// it fails with SnapshotNotFoundError if the snapshot does not exist.
+func Get(ctx context.Context, name string, version int64) (*models.Snapshot, error) {
+	m, err := getManifest(ctx, manifestKey(name, version))
+	if err != nil {
+		return nil, err
+	}
+	return m.snapshot(), nil
+}
+
+func Exists(ctx context.Context, name string, version int64) (bool, error) {
+	return backend.Exists(ctx, manifestKey(name, version))
+}
+
+// List returns the versions of the snapshots of every replicaSet.
+func List(ctx context.Context) (map[string][]int64, error) {
+	objects, err := backend.List(ctx, manifestsDir+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make(map[string][]int64)
+	for _, obj := range objects {
+		// e.g. manifests/foo/foo-1.json.zst
+		parts := strings.Split(obj.Key, "/")
+		if len(parts) != 3 {
+			continue
+		}
+		v, ok := strings.CutPrefix(strings.TrimSuffix(parts[2], ".json.zst"), parts[1]+"-")
+		version, err := strconv.ParseInt(v, 10, 64)
+		if !ok || err != nil {
+			continue
+		}
+		snapshots[parts[1]] = append(snapshots[parts[1]], version)
+	}
+	return snapshots, nil
+}
+
+// Remove deletes the snapshot of the replicaSet version,
+// the contents that are not referenced by other snapshots are deleted by a sweep in the background.
+func Remove(ctx context.Context, name string, version int64) error {
+	if err := backend.Del(ctx, manifestKey(name, version)); err != nil {
+		return err
+	}
+	// the snapshots of the volumes bound to the version
+	volumes, err := backend.List(ctx, volumeManifestKey(name, version, ""))
+	if err != nil {
+		return err
+	}
+	for _, obj := range volumes {
+		if err = backend.Del(ctx, obj.Key); err != nil {
+			return err
+		}
+	}
+	scheduleSweep()
+	return nil
+}
+
+// Sweep deletes the contents that are not referenced by any snapshot, and returns the size freed.
+// It fails with SnapshotLockedError if a snapshot is being saved or swept, by this instance or another one
+// sharing the backend.
+func Sweep(ctx context.Context) (int64, error) {
+	unlock, err := lock(ctx, true)
+	if err != nil {
+		return 0, errors.WithMessage(err, "snapshot.lock failed")
+	}
+	defer unlock()
+
+	manifests, err := backend.List(ctx, manifestsDir+"/")
+	if err != nil {
+		return 0, err
+	}
+	referenced := make(map[string]struct{})
+	for _, obj := range manifests {
+		m, err := getManifest(ctx, obj.Key)
+		if err != nil {
+			// nothing is deleted, a blob might be referenced by the unreadable manifest
+			return 0, errors.WithMessagef(err, "failed to read manifest: %s", obj.Key)
+		}
+		for _, e := range m.Entries {
+			if e.Type == typeFile {
+				referenced[blobKey(e.Digest)] = struct{}{}
+			}
+		}
+	}
+
+	blobs, err := backend.List(ctx, blobsDir+"/")
+	if err != nil {
+		return 0, err
+	}
+	var freed int64
+	for _, obj := range blobs {
+		if _, ok := referenced[obj.Key]; ok {
+			continue
+		}
+		if err = backend.Del(ctx, obj.Key); err != nil {
+			return freed, err
+		}
+		freed += obj.Size
+	}
+	return freed, nil
+}
+
+// sweeper runs at most one sweep in the background, a sweep scheduled while it is running runs after it.
+var sweeper struct {
+	sync.Mutex
+	running, pending bool
+}
+
+func scheduleSweep() {
+	sweeper.Lock()
+	defer sweeper.Unlock()
+	if sweeper.running {
+		sweeper.pending = true
+		return
+	}
+	sweeper.running = true
+
+	go func() {
+		for {
+			freed, err := Sweep(context.Background())
+			if xerrors.IsSnapshotLockedError(err) {
+				log.Infof("snapshot.Sweep is skipped, snapshots are being saved or swept")
+			} else if err != nil {
+				log.Errorf("snapshot.Sweep failed, error: %v", err)
+			} else if freed > 0 {
+				log.Infof("snapshot.Sweep, %d bytes are freed", freed)
+			}
+
+			sweeper.Lock()
+			if !sweeper.pending {
+				sweeper.running = false
+				sweeper.Unlock()
+				return
+			}
+			sweeper.pending = false
+			sweeper.Unlock()
+		}
+	}()
+}
+
+// Location returns where the manifest of the snapshot is saved.
+func Location(name string, version int64) string {
+	return backend.Location(manifestKey(name, version))
+}
+
+func (m *manifest) snapshot() *models.Snapshot {
+	return &models.Snapshot{
+		ReplicaSet: m.ReplicaSet,
+		Version:    m.Version,
+		Location:   Location(m.ReplicaSet, m.Version),
+		Size:       m.Size,
+		StoredSize: m.StoredSize,
+		CreateTime: m.CreateTime,
+		Layer:      m.Layer,
+		Image:      m.Image,
+	}
+}
+
+func (m *manifest) key() string {
+	if len(m.Volume) != 0 {
+		return volumeManifestKey(m.ReplicaSet, m.Version, m.Volume)
+	}
+	return manifestKey(m.ReplicaSet, m.Version)
+}
+
+func manifestKey(name string, version int64) string {
+	return fmt.Sprintf("%s/%s/%s-%d.json.zst", manifestsDir, name, name, version)
+}
+
+// volumeManifestKey returns the key of the snapshot of the volume bound to the replicaSet version,
+// it is the prefix of the snapshots of all volumes bound to the version if volume is empty.
+func volumeManifestKey(name string, version int64, volume string) string {
+	key := fmt.Sprintf("%s/%s/volumes/%s-%d/", manifestsDir, name, name, version)
+	if len(volume) == 0 {
+		return key
+	}
+	return key + volume + ".json.zst"
+}
+
+func blobKey(digest string) string {
+	return fmt.Sprintf("%s/%s/%s.zst", blobsDir, digest[:2], digest)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,327 @@
+package snapshot
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// The tests are run against the local backend, and against S3 if a MinIO endpoint is configured, e.g.
+// SNAPSHOT_TEST_S3_ENDPOINT=127.0.0.1:9000 SNAPSHOT_TEST_S3_ACCESS_KEY=minioadmin SNAPSHOT_TEST_S3_SECRET_KEY=minioadmin
+
+func TestLocalBackend(t *testing.T) {
+	testBackend(t, func(t *testing.T) Backend {
+		b, err := NewLocalBackend(t.TempDir())
+		if err != nil {
+			t.Fatalf("NewLocalBackend failed: %v", err)
+		}
+		return b
+	})
+}
+
+func TestS3Backend(t *testing.T) {
+	endpoint := os.Getenv("SNAPSHOT_TEST_S3_ENDPOINT")
+	if len(endpoint) == 0 {
+		t.Skip("SNAPSHOT_TEST_S3_ENDPOINT is not set")
+	}
+	testBackend(t, func(t *testing.T) Backend {
+		// every test has its own prefix, so that the tests never sweep the blobs of each other
+		id := make([]byte, 4)
+		_, _ = rand.Read(id)
+		b, err := NewS3Backend(S3Config{
+			Endpoint:  endpoint,
+			Bucket:    "gpu-docker-api-test",
+			AccessKey: os.Getenv("SNAPSHOT_TEST_S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("SNAPSHOT_TEST_S3_SECRET_KEY"),
+			Prefix:    "test-" + hex.EncodeToString(id),
+		})
+		if err != nil {
+			t.Fatalf("NewS3Backend failed: %v", err)
+		}
+		t.Cleanup(func() {
+			objects, _ := b.List(context.Background(), "")
+			for _, obj := range objects {
+				_ = b.Del(context.Background(), obj.Key)
+			}
+		})
+		return b
+	})
+}
+
+func TestStaleLock(t *testing.T) {
+	b, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBackend failed: %v", err)
+	}
+	InitSnapshot(b)
+	// the lock left by a crashed instance is not put again
+	unlock, err := lock(context.Background(), false)
+	if err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	locks, err := b.List(context.Background(), locksDir+"/")
+	if err != nil || len(locks) != 1 {
+		t.Fatalf("got %d locks, error: %v, want 1", len(locks), err)
+	}
+	stale := time.Now().Add(-2 * lockStaleAfter)
+	mustDo(t, os.Chtimes(b.Location(locks[0].Key), stale, stale))
+
+	if _, err = Sweep(context.Background()); err != nil {
+		t.Fatalf("Sweep with a stale lock failed: %v", err)
+	}
+	unlock()
+}
+
+func testBackend(t *testing.T, newBackend func(t *testing.T) Backend) {
+	for _, tc := range []struct {
+		name string
+		fn   func(t *testing.T)
+	}{
+		{"SaveRestore", testSaveRestore},
+		{"SaveDedup", testSaveDedup},
+		{"Sweep", testSweep},
+		{"SweepLocked", testSweepLocked},
+		{"SaveWaitsForSweep", testSaveWaitsForSweep},
+		{"RestoreUpperLayer", testRestoreUpperLayer},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			InitSnapshot(newBackend(t))
+			tc.fn(t)
+		})
+	}
+}
+
+func testSaveRestore(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "etc/config"), "config")
+	writeFile(t, filepath.Join(src, "with space/.hidden"), "hidden")
+	mustDo(t, os.Chmod(filepath.Join(src, "etc/config"), 0600))
+	mustDo(t, os.Symlink("etc/config", filepath.Join(src, "link")))
+	mustDo(t, os.Link(filepath.Join(src, "etc/config"), filepath.Join(src, "hardlink")))
+	mustDo(t, syscall.Mkfifo(filepath.Join(src, "fifo"), 0644))
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local)
+	mustDo(t, os.Chtimes(filepath.Join(src, "etc/config"), modTime, modTime))
+	// a file left in dest is overwritten
+	writeFile(t, filepath.Join(dest, "etc/config"), "old config, longer than the new one")
+
+	s, err := Save(context.Background(), "foo", 1, src)
+	if err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if s.ReplicaSet != "foo" || s.Version != 1 || s.Size != int64(len("config")+len("hidden")) || s.Layer != models.SnapshotLayerMerged {
+		t.Fatalf("got snapshot %+v, want foo-1 of the merged layer with size %d", s, len("config")+len("hidden"))
+	}
+	if got, err := Get(context.Background(), "foo", 1); err != nil || !reflect.DeepEqual(got, s) {
+		t.Fatalf("Get returned %+v, %v, want %+v", got, err, s)
+	}
+	if snapshots, err := List(context.Background()); err != nil || len(snapshots["foo"]) != 1 || snapshots["foo"][0] != 1 {
+		t.Fatalf("List returned %v, %v, want foo-1", snapshots, err)
+	}
+
+	if err = Restore(context.Background(), "foo", 1, dest); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	for name, want := range map[string]string{"etc/config": "config", "with space/.hidden": "hidden", "hardlink": "config"} {
+		if got := readFile(t, filepath.Join(dest, name)); got != want {
+			t.Errorf("got %q of %s, want %q", got, name, want)
+		}
+	}
+	info, err := os.Lstat(filepath.Join(dest, "etc/config"))
+	mustDo(t, err)
+	if info.Mode() != 0600 || !info.ModTime().Equal(modTime) {
+		t.Errorf("got mode %s, modification time %s, want %s, %s", info.Mode(), info.ModTime(), os.FileMode(0600), modTime)
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "link")); err != nil || target != "etc/config" {
+		t.Errorf("got symlink -> %s, error: %v, want etc/config", target, err)
+	}
+	first, err := os.Stat(filepath.Join(dest, "etc/config"))
+	mustDo(t, err)
+	second, err := os.Stat(filepath.Join(dest, "hardlink"))
+	mustDo(t, err)
+	if !os.SameFile(first, second) {
+		t.Errorf("hardlink is restored as a separate file")
+	}
+	if info, err = os.Lstat(filepath.Join(dest, "fifo")); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("fifo is not restored, error: %v", err)
+	}
+
+	err = Restore(context.Background(), "foo", 2, dest)
+	if !xerrors.IsSnapshotNotFoundError(err) {
+		t.Fatalf("Restore of a missing snapshot returned %v, want SnapshotNotFoundError", err)
+	}
+}
+
+func testSaveDedup(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a"), "shared content")
+	first, err := Save(context.Background(), "foo", 1, src)
+	if err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	// the same content is only stored once, across versions and replicaSets
+	writeFile(t, filepath.Join(src, "b"), "shared content")
+	for _, name := range []string{"foo", "bar"} {
+		second, err := Save(context.Background(), name, 2, src)
+		if err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		if second.Size != 2*first.Size || second.StoredSize != 0 {
+			t.Errorf("got size %d, stored size %d of %s-2, want %d, 0", second.Size, second.StoredSize, name, 2*first.Size)
+		}
+	}
+}
+
+func testSweep(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "shared"), "shared content")
+	writeFile(t, filepath.Join(src, "old"), "old content")
+	if _, err := Save(context.Background(), "foo", 1, src); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	mustDo(t, os.Remove(filepath.Join(src, "old")))
+	writeFile(t, filepath.Join(src, "new"), "new content")
+	if _, err := Save(context.Background(), "foo", 2, src); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// nothing is freed while every blob is referenced
+	if freed, err := Sweep(context.Background()); err != nil || freed != 0 {
+		t.Fatalf("Sweep returned %d, %v, want nothing freed", freed, err)
+	}
+	// the manifest is deleted directly, Remove would sweep in the background
+	mustDo(t, backend.Del(context.Background(), manifestKey("foo", 1)))
+	freed, err := Sweep(context.Background())
+	if err != nil || freed == 0 {
+		t.Fatalf("Sweep returned %d, %v, want the blob of old freed", freed, err)
+	}
+	blobs, err := backend.List(context.Background(), blobsDir+"/")
+	mustDo(t, err)
+	if len(blobs) != 2 {
+		t.Fatalf("got %d blobs after sweep, want the blobs of shared and new", len(blobs))
+	}
+
+	dest := t.TempDir()
+	if err = Restore(context.Background(), "foo", 2, dest); err != nil {
+		t.Fatalf("Restore after sweep failed: %v", err)
+	}
+	if got := readFile(t, filepath.Join(dest, "shared")); got != "shared content" {
+		t.Errorf("got %q of shared, want %q", got, "shared content")
+	}
+}
+
+func testSweepLocked(t *testing.T) {
+	// a snapshot is being saved by another instance
+	unlock, err := lock(context.Background(), false)
+	if err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if _, err = Sweep(context.Background()); !xerrors.IsSnapshotLockedError(err) {
+		t.Fatalf("Sweep returned %v while a snapshot is being saved, want SnapshotLockedError", err)
+	}
+	unlock()
+	if _, err = Sweep(context.Background()); err != nil {
+		t.Fatalf("Sweep failed after the lock is released: %v", err)
+	}
+	locks, err := backend.List(context.Background(), locksDir+"/")
+	if err != nil || len(locks) != 0 {
+		t.Fatalf("got %d locks after they are released, error: %v, want none", len(locks), err)
+	}
+}
+
+func testSaveWaitsForSweep(t *testing.T) {
+	unlock, err := lock(context.Background(), true)
+	if err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a"), "content")
+	done := make(chan error, 1)
+	go func() {
+		_, err := Save(context.Background(), "foo", 1, src)
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		t.Fatalf("Save returned %v while the sweep holds the lock, want it to wait", err)
+	case <-time.After(2 * lockRetryInterval):
+	}
+	unlock()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("Save failed after the sweep is done: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Save is still waiting after the sweep is done")
+	}
+}
+
+func testRestoreUpperLayer(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the whiteouts and the opaque directories can only be created by root")
+	}
+	upper, merged := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(merged, "deleted"), "deleted in the container")
+	writeFile(t, filepath.Join(merged, "opaque/from image"), "hidden in the container")
+	writeFile(t, filepath.Join(merged, "kept"), "kept")
+	// the whiteout of a deleted file is a char device 0/0
+	mustDo(t, unix.Mknod(filepath.Join(upper, "deleted"), unix.S_IFCHR, 0))
+	writeFile(t, filepath.Join(upper, "opaque/new"), "new")
+	if err := unix.Lsetxattr(filepath.Join(upper, "opaque"), overlayOpaqueXattr, []byte("y"), 0); err != nil {
+		t.Skipf("trusted xattrs are not supported: %v", err)
+	}
+
+	s, err := SaveLayer(context.Background(), "foo", 1, upper, models.SnapshotLayerUpper, "sha256:image")
+	if err != nil {
+		t.Fatalf("SaveLayer failed: %v", err)
+	}
+	if s.Layer != models.SnapshotLayerUpper || s.Image != "sha256:image" {
+		t.Fatalf("got layer %s, image %s, want %s, sha256:image", s.Layer, s.Image, models.SnapshotLayerUpper)
+	}
+	if err = Restore(context.Background(), "foo", 1, merged); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	for _, name := range []string{"deleted", "opaque/from image"} {
+		if _, err = os.Lstat(filepath.Join(merged, name)); !os.IsNotExist(err) {
+			t.Errorf("%s is not deleted, error: %v", name, err)
+		}
+	}
+	for name, want := range map[string]string{"opaque/new": "new", "kept": "kept"} {
+		if got := readFile(t, filepath.Join(merged, name)); got != want {
+			t.Errorf("got %q of %s, want %q", got, name, want)
+		}
+	}
+}
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	mustDo(t, os.MkdirAll(filepath.Dir(name), 0755))
+	mustDo(t, os.WriteFile(name, []byte(content), 0644))
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	content, err := os.ReadFile(name)
+	mustDo(t, err)
+	return string(content)
+}
+
+func mustDo(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/models"
+)
+
+// loadBatchSize is the number of keys put in one transaction,
+// etcd limits the operations of a transaction to 128 by default.
+const loadBatchSize = 100
+
+// ephemeral resources are owned by the running instances, they are never backed up or restored.
+var ephemeral = []Resource{Leader, Locks}
+
+// Dump returns all keys under CommonPrefix except the ephemeral ones, keys are relative to CommonPrefix.
+func Dump() ([]*KeyValue, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), OperationDuration)
+	defer cancel()
+	prefix := CommonPrefix + "/"
+	kvs, err := Default.List(ctx, prefix)
+	if err != nil {
+		return nil, errors.Wrapf(err, "store.Dump failed, prefix: %s", prefix)
+	}
+
+	dump := make([]*KeyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		kv.Key = strings.TrimPrefix(kv.Key, prefix)
+		if isEphemeral(kv.Key) {
+			continue
+		}
+		dump = append(dump, kv)
+	}
+	return dump, nil
+}
+
+// Load puts all kvs to the store, keys are relative to CommonPrefix.
+func Load(kvs []*KeyValue) error {
+	for start := 0; start < len(kvs); start += loadBatchSize {
+		end := min(start+loadBatchSize, len(kvs))
+		ops := make([]Op, 0, end-start)
+		for _, kv := range kvs[start:end] {
+			if isEphemeral(kv.Key) {
+				continue
+			}
+			ops = append(ops, PutOp(CommonPrefix+"/"+kv.Key, kv.Value))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), OperationDuration)
+		err := Default.Txn(ctx, ops...)
+		cancel()
+		if err != nil {
+			return errors.Wrapf(err, "store.Load failed, %d of %d keys are loaded", start, len(kvs))
+		}
+	}
+	return nil
+}
+
+// CompareAndPut sets the value of key only if it is still at revision rev, key is relative to CommonPrefix,
+// it returns false without writing if key has been changed or deleted since then.
+func CompareAndPut(key string, value []byte, rev int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), OperationDuration)
+	defer cancel()
+	ok, err := Default.CompareAndPut(ctx, CommonPrefix+"/"+key, value, rev)
+	if err != nil {
+		return false, errors.Wrapf(err, "store.CompareAndPut failed, key: %s, revision: %d", key, rev)
+	}
+	return ok, nil
+}
+
+// Remove deletes keys, keys are relative to CommonPrefix.
+func Remove(keys []string) error {
+	for start := 0; start < len(keys); start += loadBatchSize {
+		end := min(start+loadBatchSize, len(keys))
+		ops := make([]Op, 0, end-start)
+		for _, key := range keys[start:end] {
+			ops = append(ops, DelOp(CommonPrefix+"/"+key))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), OperationDuration)
+		err := Default.Txn(ctx, ops...)
+		cancel()
+		if err != nil {
+			return errors.Wrapf(err, "store.Remove failed, %d of %d keys are removed", start, len(keys))
+		}
+	}
+	return nil
+}
+
+// IsEmpty reports whether there is no replicaSet, volume or merge record in the store,
+// and no version of them is recorded in the version maps.
+func IsEmpty() (bool, error) {
+	for _, resource := range []Resource{Containers, Volumes, Merges} {
+		kvs, err := List(resource)
+		if err != nil {
+			return false, err
+		}
+		if len(kvs) != 0 {
+			return false, nil
+		}
+	}
+
+	// the version maps are saved even if they are empty
+	kvs, err := List(Versions)
+	if err != nil {
+		return false, err
+	}
+	for _, kv := range kvs {
+		var versions map[string]int64
+		if err = models.DecodeRecord(models.KindVersionMap, kv.Value, &versions); err != nil {
+			return false, errors.WithMessagef(err, "key: %s", kv.Key)
+		}
+		if len(versions) != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func isEphemeral(key string) bool {
+	resource, _, _ := strings.Cut(key, "/")
+	for _, r := range ephemeral {
+		if resource == r {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+var (
+	kvBucket    = []byte("kv")
+	metaBucket  = []byte("meta")
+	revisionKey = []byte("revision")
+)
+
+// boltStore is an embedded file-backed store, it is used on a single node without etcd.
+// Every value is saved with the revision it was modified at, in the first 8 bytes.
+type boltStore struct {
+	// serializes transactions and the publishing of their events
+	sync.Mutex
+
+	db  *bolt.DB
+	hub *watchHub
+}
+
+func NewBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "bolt.Open failed, path: %s", path)
+	}
+
+	var rev int64
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(kvBucket); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		if v := meta.Get(revisionKey); v != nil {
+			rev = int64(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.Wrapf(err, "failed to init bolt buckets, path: %s", path)
+	}
+
+	// events before restart are not kept, so watchers can't resume from them
+	return &boltStore{db: db, hub: newWatchHub(rev)}, nil
+}
+
+func (s *boltStore) Put(ctx context.Context, key string, value []byte) error {
+	return s.Txn(ctx, PutOp(key, value))
+}
+
+func (s *boltStore) Get(_ context.Context, key string) (*KeyValue, error) {
+	var kv *KeyValue
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(kvBucket).Get([]byte(key)); v != nil {
+			kv = decodeKeyValue([]byte(key), v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if kv == nil {
+		return nil, xerrors.NewNotExistInStoreError()
+	}
+	return kv, nil
+}
+
+func (s *boltStore) List(_ context.Context, prefix string) ([]*KeyValue, error) {
+	kvs := make([]*KeyValue, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(kvBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			kvs = append(kvs, decodeKeyValue(k, v))
+		}
+		return nil
+	})
+	return kvs, err
+}
+
+func (s *boltStore) Del(ctx context.Context, key string) error {
+	return s.Txn(ctx, DelOp(key))
+}
+
+func (s *boltStore) Txn(_ context.Context, ops ...Op) error {
+	_, err := s.update(nil, ops)
+	return err
+}
+
+func (s *boltStore) CompareAndPut(_ context.Context, key string, value []byte, rev int64) (bool, error) {
+	return s.update(func(kv *bolt.Bucket) bool {
+		prev := kv.Get([]byte(key))
+		return prev != nil && decodeKeyValue([]byte(key), prev).Revision == rev
+	}, []Op{PutOp(key, value)})
+}
+
+// update applies ops in one bolt transaction if cmp is nil or returns true,
+// it returns false without writing if cmp returns false.
+func (s *boltStore) update(cmp func(kv *bolt.Bucket) bool, ops []Op) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var (
+		events  []*Event
+		applied bool
+	)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		events = make([]*Event, 0, len(ops))
+		kv, meta := tx.Bucket(kvBucket), tx.Bucket(metaBucket)
+		if cmp != nil && !cmp(kv) {
+			return nil
+		}
+		applied = true
+
+		var rev int64
+		if v := meta.Get(revisionKey); v != nil {
+			rev = int64(binary.BigEndian.Uint64(v))
+		}
+		rev++
+
+		del := func(key []byte) error {
+			prev := kv.Get(key)
+			if prev == nil {
+				return nil
+			}
+			events = append(events, &Event{
+				Key:       string(key),
+				PrevValue: decodeKeyValue(key, prev).Value,
+				Deleted:   true,
+				Revision:  rev,
+			})
+			return kv.Delete(key)
+		}
+
+		for _, op := range ops {
+			switch op.Type {
+			case OpPut:
+				ev := &Event{Key: op.Key, Value: op.Value, Revision: rev}
+				if prev := kv.Get([]byte(op.Key)); prev != nil {
+					ev.PrevValue = decodeKeyValue([]byte(op.Key), prev).Value
+				}
+				if err := kv.Put([]byte(op.Key), encodeValue(rev, op.Value)); err != nil {
+					return err
+				}
+				events = append(events, ev)
+			case OpDel:
+				if err := del([]byte(op.Key)); err != nil {
+					return err
+				}
+			case OpDelPrefix:
+				var keys [][]byte
+				c := kv.Cursor()
+				for k, _ := c.Seek([]byte(op.Key)); k != nil && bytes.HasPrefix(k, []byte(op.Key)); k, _ = c.Next() {
+					keys = append(keys, append([]byte{}, k...))
+				}
+				for _, k := range keys {
+					if err := del(k); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(rev))
+		return meta.Put(revisionKey, buf)
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "bolt.Update failed")
+	}
+	if !applied {
+		return false, nil
+	}
+
+	s.hub.publish(events)
+	return true, nil
+}
+
+func (s *boltStore) Watch(ctx context.Context, prefix string, rev int64, fn func(*Event)) error {
+	return s.hub.watch(ctx, prefix, rev, fn)
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func encodeValue(rev int64, value []byte) []byte {
+	buf := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(buf, uint64(rev))
+	copy(buf[8:], value)
+	return buf
+}
+
+// decodeKeyValue copies the key and value, because they are only valid in the bolt transaction.
+func decodeKeyValue(key, value []byte) *KeyValue {
+	return &KeyValue{
+		Key:      string(key),
+		Value:    append([]byte{}, value[8:]...),
+		Revision: int64(binary.BigEndian.Uint64(value[:8])),
+	}
+}
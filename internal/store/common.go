@@ -0,0 +1,108 @@
+package store
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// CommonPrefix is the common prefix for all keys, it is changed by namespace,
+	// so that several deployments can share one etcd cluster.
+	CommonPrefix = "/gpu-docker-api/apis/v1"
+
+	// OperationDuration is the timeout of every single request to the store.
+	OperationDuration = 1 * time.Second
+)
+
+type Resource = string
+
+const (
+	Containers Resource = "containers"
+	Volumes    Resource = "volumes"
+	Versions   Resource = "versions"
+	Merges     Resource = "merges"
+	Gpus       Resource = "gpus"
+	Ports      Resource = "ports"
+	Leader     Resource = "leader"
+	Locks      Resource = "locks"
+	Migrations Resource = "migrations"
+	Operations Resource = "operations"
+)
+
+// PutKeyValue puts the value of key, if Version is greater than 0,
+// the value is also saved as that version of key, see PutVersion.
+type PutKeyValue struct {
+	Key      string   `json:"key"`
+	Value    *string  `json:"value"`
+	Resource Resource `json:"resource"`
+	Version  int64    `json:"version,omitempty"`
+}
+
+// DelKey deletes key and all versions of it, if Version is greater than 0,
+// only that version of key is deleted, see DelVersion.
+type DelKey struct {
+	Resource Resource `json:"resource"`
+	Key      string   `json:"key"`
+	Version  int64    `json:"version,omitempty"`
+}
+
+func Put(resource Resource, key string, value *string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), OperationDuration)
+	defer cancel()
+	err := Default.Put(ctx, ResourcePrefix(resource, key), []byte(*value))
+	if err != nil {
+		return errors.Wrapf(err, "store.Put failed, resource %s, key: %s, value: %s", resource, key, *value)
+	}
+	return nil
+}
+
+func GetValue(resource Resource, key string) ([]byte, error) {
+	kv, err := get(ResourcePrefix(resource, key))
+	if err != nil {
+		return nil, err
+	}
+	return kv.Value, nil
+}
+
+// Del deletes key and everything under it, such as all versions of key.
+func Del(resource Resource, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), OperationDuration)
+	defer cancel()
+	return Default.Txn(ctx, DelKey{Resource: resource, Key: key}.Ops()...)
+}
+
+// List returns all keys under the resource, keys are relative to the resource.
+func List(resource Resource) ([]*KeyValue, error) {
+	return ListChildren(resource, "")
+}
+
+// ListChildren returns all keys under key of the resource, keys are relative to key,
+// e.g. the key of containers/foo/snapshots/1 is 1 if key is foo/snapshots.
+func ListChildren(resource Resource, key string) ([]*KeyValue, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), OperationDuration)
+	defer cancel()
+	prefix := ResourcePrefix(resource, key) + "/"
+	kvs, err := Default.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	kvs = overlayList(prefix, kvs)
+	for _, kv := range kvs {
+		kv.Key = kv.Key[len(prefix):]
+	}
+	return kvs, nil
+}
+
+func get(key string) (*KeyValue, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), OperationDuration)
+	defer cancel()
+	kv, err := Default.Get(ctx, key)
+	return overlayGet(key, kv, err)
+}
+
+func ResourcePrefix(prefix Resource, name string) string {
+	return path.Join(CommonPrefix, prefix, name)
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+const (
+	// maxHistoryEvents is how many recent events are kept in memory by the embedded stores,
+	// a watcher can only resume from a revision covered by them.
+	maxHistoryEvents = 1024
+
+	// watcherBufferSize is how many events a watcher can fall behind,
+	// a slower watcher is closed and has to resume from its last revision.
+	watcherBufferSize = 256
+)
+
+// watchHub implements Watch for the embedded stores, which have no watch of their own.
+type watchHub struct {
+	sync.Mutex
+
+	// events whose revision is less than or equal to compacted are no longer in history
+	compacted int64
+	history   []*Event
+	watchers  map[*watcher]struct{}
+}
+
+type watcher struct {
+	prefix string
+	ch     chan *Event
+}
+
+func newWatchHub(rev int64) *watchHub {
+	return &watchHub{
+		compacted: rev,
+		history:   make([]*Event, 0, maxHistoryEvents),
+		watchers:  make(map[*watcher]struct{}),
+	}
+}
+
+// publish notifies watchers of events, it must be called in the order of revision.
+func (h *watchHub) publish(events []*Event) {
+	h.Lock()
+	defer h.Unlock()
+
+	for _, ev := range events {
+		h.history = append(h.history, ev)
+		for w := range h.watchers {
+			if !strings.HasPrefix(ev.Key, w.prefix) {
+				continue
+			}
+			select {
+			case w.ch <- ev:
+			default:
+				close(w.ch)
+				delete(h.watchers, w)
+			}
+		}
+	}
+
+	if drop := len(h.history) - maxHistoryEvents; drop > 0 {
+		h.compacted = h.history[drop-1].Revision
+		h.history = append(make([]*Event, 0, maxHistoryEvents), h.history[drop:]...)
+	}
+}
+
+func (h *watchHub) watch(ctx context.Context, prefix string, rev int64, fn func(*Event)) error {
+	h.Lock()
+	if rev > 0 && rev < h.compacted {
+		h.Unlock()
+		return errors.Wrapf(xerrors.NewRevisionCompactedError(), "revision: %d, compact revision: %d", rev, h.compacted)
+	}
+	var replay []*Event
+	if rev > 0 {
+		for _, ev := range h.history {
+			if ev.Revision > rev && strings.HasPrefix(ev.Key, prefix) {
+				replay = append(replay, ev)
+			}
+		}
+	}
+	w := &watcher{prefix: prefix, ch: make(chan *Event, watcherBufferSize)}
+	h.watchers[w] = struct{}{}
+	h.Unlock()
+
+	defer func() {
+		h.Lock()
+		delete(h.watchers, w)
+		h.Unlock()
+	}()
+
+	for _, ev := range replay {
+		fn(ev)
+	}
+	for {
+		select {
+		case ev, ok := <-w.ch:
+			if !ok {
+				return errors.Wrap(xerrors.NewRevisionCompactedError(), "watcher is too slow to keep up with changes")
+			}
+			fn(ev)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// memoryStore keeps everything in memory, it is lost after the process exits, so it is only used for tests.
+type memoryStore struct {
+	sync.RWMutex
+
+	rev int64
+	kvs map[string]*KeyValue
+	hub *watchHub
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{
+		kvs: make(map[string]*KeyValue),
+		hub: newWatchHub(0),
+	}
+}
+
+func (s *memoryStore) Put(ctx context.Context, key string, value []byte) error {
+	return s.Txn(ctx, PutOp(key, value))
+}
+
+func (s *memoryStore) Get(_ context.Context, key string) (*KeyValue, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	kv, ok := s.kvs[key]
+	if !ok {
+		return nil, xerrors.NewNotExistInStoreError()
+	}
+	return &KeyValue{Key: kv.Key, Value: kv.Value, Revision: kv.Revision}, nil
+}
+
+func (s *memoryStore) List(_ context.Context, prefix string) ([]*KeyValue, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	kvs := make([]*KeyValue, 0)
+	for key, kv := range s.kvs {
+		if strings.HasPrefix(key, prefix) {
+			kvs = append(kvs, &KeyValue{Key: kv.Key, Value: kv.Value, Revision: kv.Revision})
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return kvs[i].Key < kvs[j].Key
+	})
+	return kvs, nil
+}
+
+func (s *memoryStore) Del(ctx context.Context, key string) error {
+	return s.Txn(ctx, DelOp(key))
+}
+
+func (s *memoryStore) Txn(_ context.Context, ops ...Op) error {
+	s.Lock()
+	defer s.Unlock()
+	s.apply(ops)
+	return nil
+}
+
+func (s *memoryStore) CompareAndPut(_ context.Context, key string, value []byte, rev int64) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if kv, ok := s.kvs[key]; !ok || kv.Revision != rev {
+		return false, nil
+	}
+	s.apply([]Op{PutOp(key, value)})
+	return true, nil
+}
+
+// apply applies ops at the next revision, the lock must be held.
+func (s *memoryStore) apply(ops []Op) {
+	s.rev++
+	events := make([]*Event, 0, len(ops))
+	del := func(key string) {
+		if kv, ok := s.kvs[key]; ok {
+			delete(s.kvs, key)
+			events = append(events, &Event{Key: key, PrevValue: kv.Value, Deleted: true, Revision: s.rev})
+		}
+	}
+	for _, op := range ops {
+		switch op.Type {
+		case OpPut:
+			ev := &Event{Key: op.Key, Value: op.Value, Revision: s.rev}
+			if kv, ok := s.kvs[op.Key]; ok {
+				ev.PrevValue = kv.Value
+			}
+			s.kvs[op.Key] = &KeyValue{Key: op.Key, Value: op.Value, Revision: s.rev}
+			events = append(events, ev)
+		case OpDel:
+			del(op.Key)
+		case OpDelPrefix:
+			for key := range s.kvs {
+				if strings.HasPrefix(key, op.Key) {
+					del(key)
+				}
+			}
+		}
+	}
+	s.hub.publish(events)
+}
+
+func (s *memoryStore) Watch(ctx context.Context, prefix string, rev int64, fn func(*Event)) error {
+	return s.hub.watch(ctx, prefix, rev, fn)
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
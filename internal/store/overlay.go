@@ -0,0 +1,95 @@
+package store
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// overlay returns the queued writes which may change the keys under prefix, in the order they are written.
+// The writes are not in the store yet, so reads apply them on what is read from the store to see their own writes.
+var overlay func(prefix string) []Op
+
+// SetOverlay sets where the queued writes come from, see workQueue.
+func SetOverlay(fn func(prefix string) []Op) {
+	overlay = fn
+}
+
+// Ops returns the operations on the store to put the value.
+func (kv PutKeyValue) Ops() []Op {
+	ops := []Op{PutOp(ResourcePrefix(kv.Resource, kv.Key), []byte(*kv.Value))}
+	if kv.Version > 0 {
+		ops = append(ops, PutOp(VersionKey(kv.Resource, kv.Key, kv.Version), []byte(*kv.Value)))
+	}
+	return ops
+}
+
+// Ops returns the operations on the store to delete the key.
+func (k DelKey) Ops() []Op {
+	if k.Version > 0 {
+		return []Op{DelOp(VersionKey(k.Resource, k.Key, k.Version))}
+	}
+	return []Op{
+		DelOp(ResourcePrefix(k.Resource, k.Key)),
+		DelPrefixOp(ResourcePrefix(k.Resource, k.Key) + "/"),
+	}
+}
+
+// overlayGet applies the queued writes of key on the result of reading it from the store.
+func overlayGet(key string, kv *KeyValue, err error) (*KeyValue, error) {
+	if overlay == nil || (err != nil && !xerrors.IsNotExistInStoreError(err)) {
+		return kv, err
+	}
+	for _, op := range overlay(key) {
+		switch {
+		case op.Type == OpPut && op.Key == key:
+			kv, err = &KeyValue{Key: key, Value: op.Value}, nil
+		case op.Type == OpDel && op.Key == key,
+			op.Type == OpDelPrefix && strings.HasPrefix(key, op.Key):
+			kv, err = nil, xerrors.NewNotExistInStoreError()
+		}
+	}
+	return kv, err
+}
+
+// overlayList applies the queued writes under prefix on the result of listing it from the store, kvs are sorted by key.
+func overlayList(prefix string, kvs []*KeyValue) []*KeyValue {
+	if overlay == nil {
+		return kvs
+	}
+	ops := overlay(prefix)
+	if len(ops) == 0 {
+		return kvs
+	}
+
+	m := make(map[string]*KeyValue, len(kvs))
+	for _, kv := range kvs {
+		m[kv.Key] = kv
+	}
+	for _, op := range ops {
+		switch op.Type {
+		case OpPut:
+			if strings.HasPrefix(op.Key, prefix) {
+				m[op.Key] = &KeyValue{Key: op.Key, Value: op.Value}
+			}
+		case OpDel:
+			delete(m, op.Key)
+		case OpDelPrefix:
+			for key := range m {
+				if strings.HasPrefix(key, op.Key) {
+					delete(m, key)
+				}
+			}
+		}
+	}
+
+	merged := make([]*KeyValue, 0, len(m))
+	for _, kv := range m {
+		merged = append(merged, kv)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Key < merged[j].Key
+	})
+	return merged
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"context"
+	"path"
+	"time"
+)
+
+// Store is where all the state of gpu-docker-api is saved,
+// etcd is used by default, and an embedded file-backed store can be used on a single node.
+type Store interface {
+	// Put sets the value of key.
+	Put(ctx context.Context, key string, value []byte) error
+	// Get returns the value of key, it returns NotExistInStoreError if key does not exist.
+	Get(ctx context.Context, key string) (*KeyValue, error)
+	// List returns all keys with prefix sorted by key, it is used to read the history of resources.
+	List(ctx context.Context, prefix string) ([]*KeyValue, error)
+	// Del deletes key, it is not an error if key does not exist.
+	Del(ctx context.Context, key string) error
+	// Txn applies all ops atomically, they share the same revision.
+	Txn(ctx context.Context, ops ...Op) error
+	// CompareAndPut sets the value of key only if it is still at revision rev,
+	// it returns false without writing if key has been changed or deleted since then.
+	CompareAndPut(ctx context.Context, key string, value []byte, rev int64) (bool, error)
+	// Watch calls fn for every change of the keys with prefix after revision rev, until ctx is done or an error occurs.
+	// If rev is 0, it starts from now. It returns RevisionCompactedError if rev is too old to resume from.
+	Watch(ctx context.Context, prefix string, rev int64, fn func(*Event)) error
+	Close() error
+}
+
+type KeyValue struct {
+	Key      string
+	Value    []byte
+	Revision int64
+}
+
+// Event is a change of key, Revision is the revision of the store when the change happened.
+type Event struct {
+	Key       string
+	Value     []byte
+	PrevValue []byte
+	Deleted   bool
+	Revision  int64
+}
+
+type OpType int
+
+const (
+	OpPut OpType = iota
+	OpDel
+	OpDelPrefix
+)
+
+type Op struct {
+	Type  OpType
+	Key   string
+	Value []byte
+}
+
+func PutOp(key string, value []byte) Op {
+	return Op{Type: OpPut, Key: key, Value: value}
+}
+
+func DelOp(key string) Op {
+	return Op{Type: OpDel, Key: key}
+}
+
+func DelPrefixOp(prefix string) Op {
+	return Op{Type: OpDelPrefix, Key: prefix}
+}
+
+// Default is the store used by services, schedulers and version maps.
+var Default Store
+
+// InitStore sets the default store, keys are saved under /<namespace>/apis/v1,
+// and every request to the store fails if it is not finished within operationTimeout.
+func InitStore(s Store, namespace string, operationTimeout time.Duration) {
+	Default = s
+	CommonPrefix = path.Join("/", namespace, "apis/v1")
+	OperationDuration = operationTimeout
+}
+
+func CloseStore() error {
+	return Default.Close()
+}
@@ -0,0 +1,319 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// The conformance suite is run against every embedded store, they must behave like etcd.
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return NewMemoryStore()
+	})
+}
+
+func TestBoltStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		s, err := NewBoltStore(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatalf("NewBoltStore failed: %v", err)
+		}
+		return s
+	})
+}
+
+func TestBoltStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	s, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("NewBoltStore failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	mustPut(t, s, "/a", "1")
+	mustPut(t, s, "/b", "2")
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if s, err = NewBoltStore(path); err != nil {
+		t.Fatalf("NewBoltStore failed: %v", err)
+	}
+	defer s.Close()
+	kv := mustGet(t, s, "/b")
+	if string(kv.Value) != "2" || kv.Revision != 2 {
+		t.Fatalf("got %s at revision %d after reopen, want 2 at revision 2", kv.Value, kv.Revision)
+	}
+	// the revision keeps increasing after reopen
+	mustPut(t, s, "/c", "3")
+	if kv = mustGet(t, s, "/c"); kv.Revision != 3 {
+		t.Fatalf("got revision %d after reopen, want 3", kv.Revision)
+	}
+	// the events before reopen are not kept
+	err = s.Watch(ctx, "/", 1, func(*Event) {})
+	if !xerrors.IsRevisionCompactedError(err) {
+		t.Fatalf("Watch from a revision before reopen returned %v, want RevisionCompactedError", err)
+	}
+}
+
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	for _, tc := range []struct {
+		name string
+		fn   func(t *testing.T, s Store)
+	}{
+		{"PutGet", testPutGet},
+		{"List", testList},
+		{"Del", testDel},
+		{"Txn", testTxn},
+		{"CompareAndPut", testCompareAndPut},
+		{"DelPrefix", testDelPrefix},
+		{"WatchResume", testWatchResume},
+		{"WatchLive", testWatchLive},
+		{"WatchCompacted", testWatchCompacted},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newStore(t)
+			defer s.Close()
+			tc.fn(t, s)
+		})
+	}
+}
+
+func testPutGet(t *testing.T, s Store) {
+	if _, err := s.Get(context.Background(), "/a"); !xerrors.IsNotExistInStoreError(err) {
+		t.Fatalf("Get of a missing key returned %v, want NotExistInStoreError", err)
+	}
+
+	mustPut(t, s, "/a", "1")
+	kv := mustGet(t, s, "/a")
+	if kv.Key != "/a" || string(kv.Value) != "1" || kv.Revision != 1 {
+		t.Fatalf("got %+v, want /a=1 at revision 1", kv)
+	}
+
+	mustPut(t, s, "/a", "2")
+	if kv = mustGet(t, s, "/a"); string(kv.Value) != "2" || kv.Revision != 2 {
+		t.Fatalf("got %s at revision %d, want 2 at revision 2", kv.Value, kv.Revision)
+	}
+}
+
+func testList(t *testing.T, s Store) {
+	for _, key := range []string{"/b/2", "/a", "/b/1", "/bb", "/b/3"} {
+		mustPut(t, s, key, key)
+	}
+	kvs, err := s.List(context.Background(), "/b/")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	assertKeys(t, kvs, "/b/1", "/b/2", "/b/3")
+
+	if kvs, err = s.List(context.Background(), "/c/"); err != nil || len(kvs) != 0 {
+		t.Fatalf("List of a missing prefix returned %d keys, error: %v, want none", len(kvs), err)
+	}
+}
+
+func testDel(t *testing.T, s Store) {
+	mustPut(t, s, "/a", "1")
+	if err := s.Del(context.Background(), "/a"); err != nil {
+		t.Fatalf("Del failed: %v", err)
+	}
+	if _, err := s.Get(context.Background(), "/a"); !xerrors.IsNotExistInStoreError(err) {
+		t.Fatalf("Get of a deleted key returned %v, want NotExistInStoreError", err)
+	}
+	if err := s.Del(context.Background(), "/missing"); err != nil {
+		t.Fatalf("Del of a missing key failed: %v", err)
+	}
+}
+
+func testTxn(t *testing.T, s Store) {
+	mustPut(t, s, "/old", "0")
+	err := s.Txn(context.Background(), PutOp("/a", []byte("1")), PutOp("/b", []byte("2")), DelOp("/old"))
+	if err != nil {
+		t.Fatalf("Txn failed: %v", err)
+	}
+
+	a, b := mustGet(t, s, "/a"), mustGet(t, s, "/b")
+	if string(a.Value) != "1" || string(b.Value) != "2" {
+		t.Fatalf("got /a=%s /b=%s, want /a=1 /b=2", a.Value, b.Value)
+	}
+	// the ops of a transaction share the same revision
+	if a.Revision != 2 || b.Revision != 2 {
+		t.Fatalf("got revisions %d and %d, want both 2", a.Revision, b.Revision)
+	}
+	if _, err = s.Get(context.Background(), "/old"); !xerrors.IsNotExistInStoreError(err) {
+		t.Fatalf("Get of a key deleted by Txn returned %v, want NotExistInStoreError", err)
+	}
+}
+
+func testCompareAndPut(t *testing.T, s Store) {
+	mustPut(t, s, "/a", "1")
+	rev := mustGet(t, s, "/a").Revision
+
+	ok, err := s.CompareAndPut(context.Background(), "/a", []byte("2"), rev)
+	if err != nil || !ok {
+		t.Fatalf("CompareAndPut at the current revision returned %t, %v, want true", ok, err)
+	}
+	// the key has been changed since rev
+	ok, err = s.CompareAndPut(context.Background(), "/a", []byte("3"), rev)
+	if err != nil || ok {
+		t.Fatalf("CompareAndPut at a stale revision returned %t, %v, want false", ok, err)
+	}
+	if kv := mustGet(t, s, "/a"); string(kv.Value) != "2" || kv.Revision != rev+1 {
+		t.Fatalf("got %s at revision %d, want 2 at revision %d", kv.Value, kv.Revision, rev+1)
+	}
+
+	if ok, err = s.CompareAndPut(context.Background(), "/missing", []byte("1"), rev); err != nil || ok {
+		t.Fatalf("CompareAndPut of a missing key returned %t, %v, want false", ok, err)
+	}
+	if _, err = s.Get(context.Background(), "/missing"); !xerrors.IsNotExistInStoreError(err) {
+		t.Fatalf("Get of a key not put by CompareAndPut returned %v, want NotExistInStoreError", err)
+	}
+}
+
+func testDelPrefix(t *testing.T, s Store) {
+	for _, key := range []string{"/a/1", "/a/2", "/ab", "/b"} {
+		mustPut(t, s, key, key)
+	}
+	rev := mustGet(t, s, "/b").Revision
+
+	events := collect(t, s, "/", rev, 2, func() {
+		if err := s.Txn(context.Background(), DelPrefixOp("/a/")); err != nil {
+			t.Errorf("Txn failed: %v", err)
+		}
+	})
+	for _, ev := range events {
+		if !ev.Deleted || string(ev.PrevValue) != ev.Key || ev.Revision != rev+1 {
+			t.Fatalf("got event %+v, want the deletion of %s at revision %d", ev, ev.Key, rev+1)
+		}
+	}
+
+	kvs, err := s.List(context.Background(), "/")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	assertKeys(t, kvs, "/ab", "/b")
+}
+
+func testWatchResume(t *testing.T, s Store) {
+	mustPut(t, s, "/a", "1")
+	mustPut(t, s, "/other", "x")
+	mustPut(t, s, "/a", "2")
+	mustPut(t, s, "/b", "3")
+
+	// the events after revision 1 are replayed, the keys out of the prefix are skipped
+	events := collect(t, s, "/a", 1, 1, nil)
+	if ev := events[0]; ev.Key != "/a" || string(ev.Value) != "2" || string(ev.PrevValue) != "1" || ev.Revision != 3 {
+		t.Fatalf("got event %+v, want /a=2 with the previous value 1 at revision 3", ev)
+	}
+
+	events = collect(t, s, "/", 2, 2, nil)
+	if events[0].Revision != 3 || events[1].Revision != 4 {
+		t.Fatalf("got revisions %d and %d, want 3 and 4", events[0].Revision, events[1].Revision)
+	}
+}
+
+func testWatchLive(t *testing.T, s Store) {
+	mustPut(t, s, "/a", "1")
+
+	events := collect(t, s, "/", 1, 2, func() {
+		mustPut(t, s, "/b", "2")
+		if err := s.Del(context.Background(), "/a"); err != nil {
+			t.Errorf("Del failed: %v", err)
+		}
+	})
+	if events[0].Key != "/b" || events[0].Deleted {
+		t.Fatalf("got event %+v, want the put of /b", events[0])
+	}
+	if events[1].Key != "/a" || !events[1].Deleted || string(events[1].PrevValue) != "1" {
+		t.Fatalf("got event %+v, want the deletion of /a", events[1])
+	}
+}
+
+func testWatchCompacted(t *testing.T, s Store) {
+	// the events of revision 1 and 2 are dropped from the history
+	for i := 0; i < maxHistoryEvents+2; i++ {
+		mustPut(t, s, fmt.Sprintf("/k/%d", i), "v")
+	}
+	// a watch that is not rejected returns the deadline error instead of blocking
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := s.Watch(ctx, "/", 1, func(*Event) {})
+	if !xerrors.IsRevisionCompactedError(err) {
+		t.Fatalf("Watch from a compacted revision returned %v, want RevisionCompactedError", err)
+	}
+
+	// the latest events can still be resumed from
+	last := int64(maxHistoryEvents + 2)
+	events := collect(t, s, "/", last-1, 1, nil)
+	if events[0].Revision != last {
+		t.Fatalf("got revision %d, want %d", events[0].Revision, last)
+	}
+}
+
+// collect watches prefix from rev, runs change, and returns the first n events.
+func collect(t *testing.T, s Store, prefix string, rev int64, n int, change func()) []*Event {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ch := make(chan *Event, n)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Watch(ctx, prefix, rev, func(ev *Event) {
+			select {
+			case ch <- ev:
+			default:
+			}
+		})
+	}()
+	if change != nil {
+		change()
+	}
+
+	events := make([]*Event, 0, n)
+	for len(events) < n {
+		select {
+		case ev := <-ch:
+			events = append(events, ev)
+		case err := <-done:
+			t.Fatalf("Watch returned %v after %d events, want %d events", err, len(events), n)
+		case <-ctx.Done():
+			t.Fatalf("got %d events, want %d", len(events), n)
+		}
+	}
+	cancel()
+	<-done
+	return events
+}
+
+func mustPut(t *testing.T, s Store, key, value string) {
+	t.Helper()
+	if err := s.Put(context.Background(), key, []byte(value)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+}
+
+func mustGet(t *testing.T, s Store, key string) *KeyValue {
+	t.Helper()
+	kv, err := s.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get of %s failed: %v", key, err)
+	}
+	return kv
+}
+
+func assertKeys(t *testing.T, kvs []*KeyValue, keys ...string) {
+	t.Helper()
+	got := make([]string, 0, len(kvs))
+	for _, kv := range kvs {
+		got = append(got, kv.Key)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(keys) {
+		t.Fatalf("got keys %v, want %v", got, keys)
+	}
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// Every version of a replicaSet or volume is stored as its own key, e.g.
+// /gpu-docker-api/apis/v1/containers/foo/versions/3,
+// and the key of the resource itself, e.g. /gpu-docker-api/apis/v1/containers/foo,
+// always points to the current version, it holds the same value as the current version key.
+const versionsDir = "versions"
+
+type (
+	ReplicaSet = []*combine
+	Value      = []byte
+)
+
+type combine struct {
+	Version  int64
+	Revision int64
+	Value    Value
+}
+
+// PutVersion saves value as the version of key and moves the current version pointer to it in one transaction.
+func PutVersion(resource Resource, key string, version int64, value *string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), OperationDuration)
+	defer cancel()
+	err := Default.Txn(ctx, PutKeyValue{Resource: resource, Key: key, Value: value, Version: version}.Ops()...)
+	if err != nil {
+		return errors.Wrapf(err, "store.PutVersion failed, resource %s, key: %s, version: %d, value: %s", resource, key, version, *value)
+	}
+	return nil
+}
+
+// DelVersion deletes a specific version of key, the current version pointer is not changed.
+func DelVersion(resource Resource, key string, version int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), OperationDuration)
+	defer cancel()
+	err := Default.Del(ctx, VersionKey(resource, key, version))
+	if err != nil {
+		return errors.Wrapf(err, "store.DelVersion failed, resource %s, key: %s, version: %d", resource, key, version)
+	}
+	return nil
+}
+
+// GetVersionRange returns all versions of key with a single range read, the latest version comes first.
+func GetVersionRange(resource Resource, key string) (ReplicaSet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), OperationDuration)
+	defer cancel()
+	prefix := versionsPrefix(resource, key)
+	kvs, err := Default.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	kvs = overlayList(prefix, kvs)
+	if len(kvs) == 0 {
+		return nil, xerrors.NewNotExistInStoreError()
+	}
+
+	set := make([]*combine, 0, len(kvs))
+	for _, kv := range kvs {
+		version, err := strconv.ParseInt(path.Base(kv.Key), 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid version key: %s", kv.Key)
+		}
+		set = append(set, &combine{
+			Version:  version,
+			Revision: kv.Revision,
+			Value:    kv.Value,
+		})
+	}
+	sort.Slice(set, func(i, j int) bool {
+		return set[i].Version > set[j].Version
+	})
+	return set, nil
+}
+
+// GetVersion returns the value of a specific version of key.
+func GetVersion(resource Resource, key string, version int64) (Value, error) {
+	kv, err := get(VersionKey(resource, key, version))
+	if err != nil {
+		if xerrors.IsNotExistInStoreError(err) {
+			return nil, errors.Errorf("not found version :%d", version)
+		}
+		return nil, err
+	}
+	return kv.Value, nil
+}
+
+func versionsPrefix(resource Resource, key string) string {
+	return ResourcePrefix(resource, path.Join(key, versionsDir)) + "/"
+}
+
+func VersionKey(resource Resource, key string, version int64) string {
+	return versionsPrefix(resource, key) + strconv.FormatInt(version, 10)
+}
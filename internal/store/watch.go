@@ -0,0 +1,34 @@
+package store
+
+import (
+	"context"
+	"strings"
+)
+
+// WatchEvent is a change of a key under CommonPrefix.
+type WatchEvent struct {
+	Resource  Resource
+	Key       string
+	Revision  int64
+	Deleted   bool
+	Value     Value
+	PrevValue Value
+}
+
+// Watch watches all keys under CommonPrefix and calls fn for every change, until ctx is done or an error occurs.
+// If rev is greater than 0, it starts from the change after rev, so that a client can resume from the last
+// revision it has seen, it fails if rev has been compacted.
+func Watch(ctx context.Context, rev int64, fn func(*WatchEvent)) error {
+	prefix := CommonPrefix + "/"
+	return Default.Watch(ctx, prefix, rev, func(ev *Event) {
+		resource, key, _ := strings.Cut(strings.TrimPrefix(ev.Key, prefix), "/")
+		fn(&WatchEvent{
+			Resource:  resource,
+			Key:       key,
+			Revision:  ev.Revision,
+			Deleted:   ev.Deleted,
+			Value:     ev.Value,
+			PrevValue: ev.PrevValue,
+		})
+	})
+}
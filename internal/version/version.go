@@ -1,9 +1,12 @@
 package version
 
 import (
-	"encoding/json"
+	"context"
+	"sync"
 
-	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/models"
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	"github.com/mayooot/gpu-docker-api/internal/workQueue"
 	"github.com/mayooot/gpu-docker-api/internal/xerrors"
 )
 
@@ -22,7 +25,12 @@ type (
 	version = int64
 )
 
-type versionMap map[name]version
+type versionMap struct {
+	sync.RWMutex
+
+	key string
+	m   map[name]version
+}
 
 func InitVersionMap() error {
 	var err error
@@ -40,57 +48,82 @@ func InitVersionMap() error {
 }
 
 func CloseVersionMap() error {
-	if err := etcd.Put(etcd.Versions, containerVersionMapKey, ContainerVersionMap.serialize()); err != nil {
+	if err := store.Put(store.Versions, containerVersionMapKey, ContainerVersionMap.serialize()); err != nil {
 		return err
 	}
-	if err := etcd.Put(etcd.Versions, volumeVersionMapKey, VolumeVersionMap.serialize()); err != nil {
+	if err := store.Put(store.Versions, volumeVersionMapKey, VolumeVersionMap.serialize()); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (vm *versionMap) serialize() *string {
-	bytes, _ := json.Marshal(vm)
-	tmp := string(bytes)
-	return &tmp
+	vm.RLock()
+	defer vm.RUnlock()
+
+	return models.EncodeRecord(models.KindVersionMap, vm.m)
+}
+
+// persist saves the version map to etcd asynchronously,
+// so that a standby can reload the latest state when it becomes the leader.
+func (vm *versionMap) persist(ctx context.Context) {
+	workQueue.Enqueue(ctx, store.PutKeyValue{
+		Resource: store.Versions,
+		Key:      vm.key,
+		Value:    vm.serialize(),
+	})
 }
 
-func (vm *versionMap) Set(key name, value version) {
-	(*vm)[key] = value
+func (vm *versionMap) Set(ctx context.Context, key name, value version) {
+	vm.Lock()
+	vm.m[key] = value
+	vm.Unlock()
+	vm.persist(ctx)
 }
 
 func (vm *versionMap) Get(key name) (version, bool) {
-	v, ok := (*vm)[key]
+	vm.RLock()
+	defer vm.RUnlock()
+
+	v, ok := vm.m[key]
 	return v, ok
 }
 
 func (vm *versionMap) Exist(key name) bool {
-	_, ok := (*vm)[key]
+	vm.RLock()
+	defer vm.RUnlock()
+
+	_, ok := vm.m[key]
 	return ok
 }
 
-func (vm *versionMap) Remove(key name) {
-	delete(*vm, key)
+func (vm *versionMap) Remove(ctx context.Context, key name) {
+	vm.Lock()
+	delete(vm.m, key)
+	vm.Unlock()
+	vm.persist(ctx)
 }
 
 func initVersionMapFormEtcd(key string) (vm *versionMap, err error) {
-	bytes, err := etcd.GetValue(etcd.Versions, key)
+	bytes, err := store.GetValue(store.Versions, key)
 	if err != nil {
-		if xerrors.IsNotExistInEtcdError(err) {
+		if xerrors.IsNotExistInStoreError(err) {
 			err = nil
 		} else {
 			return vm, err
 		}
 	}
 
-	vm = newVersionMap()
+	vm = newVersionMap(key)
 	if len(bytes) != 0 {
-		err = json.Unmarshal(bytes, &vm)
+		err = models.DecodeRecord(models.KindVersionMap, bytes, &vm.m)
 	}
 	return vm, err
 }
 
-func newVersionMap() *versionMap {
-	m := make(versionMap)
-	return &m
+func newVersionMap(key string) *versionMap {
+	return &versionMap{
+		key: key,
+		m:   make(map[name]version),
+	}
 }
@@ -0,0 +1,189 @@
+package workQueue
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/store"
+)
+
+// failedRetention is how many of the latest operations keep their failures for Wait.
+const failedRetention = 1024
+
+// seq is the sequence of the operations queued in this process, it is not saved in the wal.
+var seq atomic.Uint64
+
+// inflight holds the queued operations which are not written to the store yet,
+// held is those of them held behind a dead letter, see lane,
+// changed is closed and replaced whenever an operation is finished or held.
+var inflight = struct {
+	sync.Mutex
+	entries map[uint64]*Entry
+	held    map[uint64]error
+	failed  map[uint64]error
+	changed chan struct{}
+}{
+	entries: make(map[uint64]*Entry),
+	held:    make(map[uint64]error),
+	failed:  make(map[uint64]error),
+	changed: make(chan struct{}),
+}
+
+func track(e *Entry) {
+	e.seq = seq.Add(1)
+	inflight.Lock()
+	inflight.entries[e.seq] = e
+	inflight.Unlock()
+}
+
+func untrack(e *Entry, err error) {
+	inflight.Lock()
+	defer inflight.Unlock()
+
+	delete(inflight.entries, e.seq)
+	delete(inflight.held, e.seq)
+	if err != nil {
+		inflight.failed[e.seq] = err
+		for s := range inflight.failed {
+			if s+failedRetention < e.seq {
+				delete(inflight.failed, s)
+			}
+		}
+	}
+	close(inflight.changed)
+	inflight.changed = make(chan struct{})
+}
+
+// hold marks the operation as held behind a dead letter, it is still queued, but Wait fails with err instead of waiting.
+func hold(e *Entry, err error) {
+	inflight.Lock()
+	defer inflight.Unlock()
+
+	if _, ok := inflight.held[e.seq]; ok {
+		inflight.held[e.seq] = err
+		return
+	}
+	inflight.held[e.seq] = err
+	close(inflight.changed)
+	inflight.changed = make(chan struct{})
+}
+
+// release unmarks the operation held by hold.
+func release(e *Entry) {
+	inflight.Lock()
+	delete(inflight.held, e.seq)
+	inflight.Unlock()
+}
+
+type collectorKey struct{}
+
+// collector records the sequences of the operations enqueued with a context, see WithCollector.
+type collector struct {
+	sync.Mutex
+	seqs []uint64
+}
+
+// WithCollector returns a context that records the operations enqueued with it and the contexts derived from it,
+// so that the writes of a request can be waited for without waiting for those of the concurrent requests.
+func WithCollector(ctx context.Context) context.Context {
+	return context.WithValue(ctx, collectorKey{}, &collector{})
+}
+
+// Collected returns the sequences of the operations enqueued with ctx, see WithCollector.
+func Collected(ctx context.Context) []uint64 {
+	c, ok := ctx.Value(collectorKey{}).(*collector)
+	if !ok {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	return append([]uint64(nil), c.seqs...)
+}
+
+func collect(ctx context.Context, e *Entry) {
+	if c, ok := ctx.Value(collectorKey{}).(*collector); ok {
+		c.Lock()
+		c.seqs = append(c.seqs, e.seq)
+		c.Unlock()
+	}
+}
+
+// Wait waits until the operations of seqs are written to the store, see Collected,
+// it returns an error if any of them is moved to the dead letters or held behind one, or ctx is done before that.
+func Wait(ctx context.Context, seqs []uint64) error {
+	for {
+		inflight.Lock()
+		busy := 0
+		var failed error
+		for _, s := range seqs {
+			if err, ok := inflight.failed[s]; ok {
+				failed = err
+				break
+			}
+			if err, ok := inflight.held[s]; ok {
+				failed = err
+				break
+			}
+			if _, ok := inflight.entries[s]; ok {
+				busy++
+			}
+		}
+		changed := inflight.changed
+		inflight.Unlock()
+
+		if failed != nil {
+			return failed
+		}
+		if busy == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "%d of %d operations are not written to the store yet", busy, len(seqs))
+		}
+	}
+}
+
+// overlay returns the operations on the store of the queued operations which may change the keys under prefix.
+func overlay(prefix string) []store.Op {
+	inflight.Lock()
+	entries := make([]*Entry, 0, len(inflight.entries))
+	for _, e := range inflight.entries {
+		entries = append(entries, e)
+	}
+	inflight.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+	// the entries are ordered as in their lanes, a retried dead letter is tracked again with a new seq,
+	// but it keeps its id, and is still older than the entries held behind it
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].ID != entries[j].ID {
+			return entries[i].ID < entries[j].ID
+		}
+		return entries[i].seq < entries[j].seq
+	})
+
+	ops := make([]store.Op, 0)
+	for _, e := range entries {
+		var entryOps []store.Op
+		switch {
+		case e.Put != nil:
+			entryOps = e.Put.Ops()
+		case e.Del != nil:
+			entryOps = e.Del.Ops()
+		}
+		for _, op := range entryOps {
+			if strings.HasPrefix(op.Key, prefix) || op.Type == store.OpDelPrefix && strings.HasPrefix(prefix, op.Key) {
+				ops = append(ops, op)
+			}
+		}
+	}
+	return ops
+}
@@ -0,0 +1,190 @@
+package workQueue
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+var (
+	pendingBucket    = []byte("pending")
+	deadLetterBucket = []byte("deadLetters")
+	// ackedBucket saves the id of the latest written entry of every lane key
+	ackedBucket = []byte("acked")
+)
+
+// Entry is an operation in the write-ahead log, exactly one of Put and Del is set.
+type Entry struct {
+	ID         uint64             `json:"id"`
+	Put        *store.PutKeyValue `json:"put,omitempty"`
+	Del        *store.DelKey      `json:"del,omitempty"`
+	Attempts   int                `json:"attempts"`
+	LastError  string             `json:"lastError,omitempty"`
+	CreateTime string             `json:"createTime"`
+
+	// seq orders the operations queued in this process, see inflight
+	seq uint64
+}
+
+// wal saves the operations that are not written to the store yet, so that they survive a crash.
+// An operation is in the pending bucket until it is written, and it is moved to the dead letter bucket
+// if it still fails after the max attempts. The id of the latest written operation of every lane key is
+// kept, so that a dead letter older than it is never written over it.
+type wal struct {
+	db *bolt.DB
+}
+
+func openWal(path string) (*wal, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "bolt.Open failed, path: %s", path)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{pendingBucket, deadLetterBucket, ackedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.Wrapf(err, "failed to init wal buckets, path: %s", path)
+	}
+	return &wal{db: db}, nil
+}
+
+// append assigns an id to the entry and saves it as pending.
+func (w *wal) append(e *Entry) error {
+	return w.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pendingBucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		e.ID = id
+		return putEntry(b, e)
+	})
+}
+
+// update saves the attempts and last error of a pending entry.
+func (w *wal) update(e *Entry) error {
+	return w.db.Update(func(tx *bolt.Tx) error {
+		return putEntry(tx.Bucket(pendingBucket), e)
+	})
+}
+
+// ack deletes a pending entry after it is written to the store, and records it as the latest written entry of its lane key.
+func (w *wal) ack(e *Entry) error {
+	return w.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(pendingBucket).Delete(itob(e.ID)); err != nil {
+			return err
+		}
+		acked := tx.Bucket(ackedBucket)
+		key := []byte(e.laneKey())
+		if v := acked.Get(key); v != nil && btoi(v) > e.ID {
+			return nil
+		}
+		return acked.Put(key, itob(e.ID))
+	})
+}
+
+// lastAcked returns the id of the latest written entry of the lane key, 0 if there is none.
+func (w *wal) lastAcked(key string) (uint64, error) {
+	var id uint64
+	err := w.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(ackedBucket).Get([]byte(key)); v != nil {
+			id = btoi(v)
+		}
+		return nil
+	})
+	return id, err
+}
+
+// bury moves a pending entry to the dead letter bucket.
+func (w *wal) bury(e *Entry) error {
+	return w.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(pendingBucket).Delete(itob(e.ID)); err != nil {
+			return err
+		}
+		return putEntry(tx.Bucket(deadLetterBucket), e)
+	})
+}
+
+// revive moves an entry from the dead letter bucket back to pending, its id and its place among the entries
+// of the same lane key are kept, and its attempts are reset. check is called with the entry before it is moved.
+// It fails with DeadLetterNotFoundError if there is no such entry, and with DeadLetterOutOfDateError
+// if a later entry of the same lane key has been written.
+func (w *wal) revive(id uint64, check func(e *Entry) error) (*Entry, error) {
+	var e *Entry
+	err := w.db.Update(func(tx *bolt.Tx) error {
+		dead := tx.Bucket(deadLetterBucket)
+		v := dead.Get(itob(id))
+		if v == nil {
+			return xerrors.NewDeadLetterNotFoundError()
+		}
+		e = &Entry{}
+		err := json.Unmarshal(v, e)
+		if err != nil {
+			return err
+		}
+		if acked := tx.Bucket(ackedBucket).Get([]byte(e.laneKey())); acked != nil && btoi(acked) > id {
+			return errors.Wrapf(xerrors.NewDeadLetterOutOfDateError(), "operation: %d of %s is written after it",
+				btoi(acked), e.laneKey())
+		}
+		if err = check(e); err != nil {
+			return err
+		}
+		if err = dead.Delete(itob(id)); err != nil {
+			return err
+		}
+		e.Attempts = 0
+		return putEntry(tx.Bucket(pendingBucket), e)
+	})
+	return e, err
+}
+
+// list returns all entries of the bucket in the order they are appended.
+func (w *wal) list(bucket []byte) ([]*Entry, error) {
+	entries := make([]*Entry, 0)
+	err := w.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(_, v []byte) error {
+			e := &Entry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func (w *wal) close() error {
+	return w.db.Close()
+}
+
+func putEntry(b *bolt.Bucket, e *Entry) error {
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return b.Put(itob(e.ID), v)
+}
+
+// itob encodes id in big endian, so that the entries are iterated in the order they are appended.
+func itob(id uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, id)
+	return b
+}
+
+func btoi(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
@@ -2,57 +2,394 @@ package workQueue
 
 import (
 	"context"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/ngaut/log"
+	"github.com/pkg/errors"
 
-	"github.com/mayooot/gpu-docker-api/internal/etcd"
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
 )
 
-const _maxContainerCount = 110
+const (
+	_maxContainerCount = 110
 
-var Queue chan interface{}
+	// the delay before the n-th retry is retryBaseDelay * 2^(n-1), but no more than retryMaxDelay
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+var (
+	queue       chan *Entry
+	journal     *wal
+	maxAttempts int
+
+	// backlog is the operations left by the last run which are not replayed at startup,
+	// because they failed or an earlier operation of their lane key failed, they are written by SyncLoop
+	backlog []*Entry
+)
+
+// InitWorkQueue opens the write-ahead log at walPath and replays the operations left by the last run,
+// it must be called before the state is loaded from the store, so that the loaded state is up-to-date.
+// An operation is moved to the dead letter list after it fails attempts times.
+func InitWorkQueue(walPath string, attempts int) error {
+	var err error
+	if journal, err = openWal(walPath); err != nil {
+		return err
+	}
+	queue = make(chan *Entry, _maxContainerCount)
+	maxAttempts = attempts
+
+	store.SetOverlay(overlay)
 
-func InitWorkQueue() {
-	Queue = make(chan interface{}, _maxContainerCount)
+	// the dead letters hold the later operations of their lane keys, unless a later one has been written
+	// before the dead letters were held, such a dead letter is out of date and can't be retried
+	deadLetters, err := journal.list(deadLetterBucket)
+	if err != nil {
+		return errors.Wrap(err, "failed to list dead letters")
+	}
+	for _, e := range deadLetters {
+		key := e.laneKey()
+		acked, err := journal.lastAcked(key)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get the latest written operation of %s", key)
+		}
+		if acked < e.ID {
+			lanes.get(key).dead = append(lanes.get(key).dead, e.ID)
+		}
+	}
+
+	pending, err := journal.list(pendingBucket)
+	if err != nil {
+		return errors.Wrap(err, "failed to list pending operations")
+	}
+	// failed is the lane keys with an operation failed to replay, the later operations of them are not replayed
+	failed := make(map[string]bool)
+	for _, e := range pending {
+		key := e.laneKey()
+		if failed[key] || lanes.get(key).holds(e) {
+			track(e)
+			backlog = append(backlog, e)
+			continue
+		}
+		if err = apply(e); err != nil {
+			log.Errorf("workQueue, failed to replay operation: %d, error: %v", e.ID, err)
+			failed[key] = true
+			track(e)
+			backlog = append(backlog, e)
+			continue
+		}
+		_ = journal.ack(e)
+	}
+	if len(pending) != 0 {
+		log.Infof("workQueue, %d pending operations are replayed, %d of them are left to SyncLoop", len(pending), len(backlog))
+	}
+	return nil
+}
+
+// Enqueue saves the operation to the write-ahead log, then it is written to the store by SyncLoop asynchronously.
+// v must be a store.PutKeyValue or store.DelKey, the operation is recorded by the collector of ctx, see WithCollector.
+func Enqueue(ctx context.Context, v interface{}) {
+	e := &Entry{CreateTime: time.Now().Format("2006-01-02 15:04:05")}
+	switch v := v.(type) {
+	case store.PutKeyValue:
+		e.Put = &v
+	case store.DelKey:
+		e.Del = &v
+	default:
+		log.Errorf("workQueue, unknown operation: %T", v)
+		return
+	}
+
+	if err := journal.append(e); err != nil {
+		// the operation is still written, but it is lost if the process dies before that
+		log.Errorf("workQueue, failed to append operation to wal, error: %v", err)
+	}
+	track(e)
+	collect(ctx, e)
+	queue <- e
 }
 
+// SyncLoop writes the queued operations to the store until ctx is done.
+// Operations on the same replicaSet or volume, including its versions, retention and state,
+// are written one by one in the order they are queued, and a failed one blocks the later ones until
+// it succeeds. If it is moved to the dead letters, the later ones are held until it is retried and written.
+// Operations on different keys are written in parallel.
 func SyncLoop(ctx context.Context, wg *sync.WaitGroup) {
+	lanes.Lock()
+	lanes.ctx, lanes.wg = ctx, wg
+	// the backlog is queued before the operations enqueued since startup
+	for _, e := range backlog {
+		lanes.get(e.laneKey()).push(e)
+	}
+	backlog = nil
+	for key, l := range lanes.m {
+		l.start(key)
+	}
+	lanes.Unlock()
+
 	for {
 		select {
-		case v := <-Queue:
-			switch v := v.(type) {
-			case etcd.PutKeyValue:
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					if err := etcd.Put(v.Resource, v.Key, v.Value); err != nil {
-						log.Error(err.Error())
-						Queue <- v
-						return
-					}
-					log.Infof("put to etcd successfully, resource %s, key: %s, value: %s", v.Resource, v.Key, *v.Value)
-				}()
-			case etcd.DelKey:
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					if err := etcd.Del(v.Resource, v.Key); err != nil {
-						log.Error(err.Error())
-						Queue <- v
-						return
-					}
-					log.Infof("delete etcd key successfully, resource %s, key: %s", v.Resource, v.Key)
-				}()
-			default:
-				//	nothing to do
-			}
+		case e := <-queue:
+			lanes.Lock()
+			key := e.laneKey()
+			l := lanes.get(key)
+			l.push(e)
+			l.start(key)
+			lanes.Unlock()
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// lanes holds the operations waiting to be written of every key, see laneKey.
+var lanes = &laneSet{m: make(map[string]*lane)}
+
+type laneSet struct {
+	sync.Mutex
+	m map[string]*lane
+	// ctx and wg are those of SyncLoop, no lane is started before it
+	ctx context.Context
+	wg  *sync.WaitGroup
+}
+
+// get returns the lane of key, it is created if it does not exist.
+func (ls *laneSet) get(key string) *lane {
+	l, ok := ls.m[key]
+	if !ok {
+		l = &lane{}
+		ls.m[key] = l
+	}
+	return l
+}
+
+// lane is the operations of a key, they are written one by one in the order of their ids.
+// The methods of lane must be called with lanes locked.
+type lane struct {
+	entries []*Entry
+	// running is true if a goroutine is writing the entries
+	running bool
+	// dead is the ids of the dead letters of the key, the entries after the oldest of them are held
+	dead []uint64
+}
+
+// laneKey returns the resource and the name of replicaSet or volume that the operation belongs to,
+// e.g. the lane key of containers/foo/state is containers/foo.
+func (e *Entry) laneKey() string {
+	var resource, key string
+	switch {
+	case e.Put != nil:
+		resource, key = e.Put.Resource, e.Put.Key
+	case e.Del != nil:
+		resource, key = e.Del.Resource, e.Del.Key
+	}
+	name, _, _ := strings.Cut(key, "/")
+	return resource + "/" + name
+}
+
+// holds reports whether e is held behind a dead letter of the lane.
+func (l *lane) holds(e *Entry) bool {
+	for _, id := range l.dead {
+		if id < e.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// push adds e to the lane in the order of ids, a retried dead letter keeps its id, so it goes before
+// the entries held behind it.
+func (l *lane) push(e *Entry) {
+	i := len(l.entries)
+	for i > 0 && l.entries[i-1].ID > e.ID {
+		i--
+	}
+	l.entries = append(l.entries, nil)
+	copy(l.entries[i+1:], l.entries[i:])
+	l.entries[i] = e
+	l.updateHolds()
+}
+
+// updateHolds makes Wait fail on the held entries instead of waiting for them.
+func (l *lane) updateHolds() {
+	for _, e := range l.entries {
+		if l.holds(e) {
+			hold(e, errors.Errorf("operation: %d is held behind the dead letters: %v", e.ID, l.dead))
+		} else {
+			release(e)
+		}
+	}
+}
+
+// start starts a goroutine to write the lane if it is idle and its first entry is not held.
+func (l *lane) start(key string) {
+	if l.running || len(l.entries) == 0 || l.holds(l.entries[0]) || lanes.ctx == nil {
+		return
+	}
+	l.running = true
+	lanes.wg.Add(1)
+	go func() {
+		defer lanes.wg.Done()
+		runLane(lanes.ctx, key, l)
+	}()
+}
+
+func runLane(ctx context.Context, key string, l *lane) {
+	for {
+		lanes.Lock()
+		if len(l.entries) == 0 || l.holds(l.entries[0]) {
+			l.running = false
+			if len(l.entries) == 0 && len(l.dead) == 0 {
+				delete(lanes.m, key)
+			}
+			lanes.Unlock()
+			return
+		}
+		e := l.entries[0]
+		lanes.Unlock()
+
+		done, buried := process(ctx, e)
+		lanes.Lock()
+		if !done {
+			// the rest are still pending in the wal, and will be replayed at next startup
+			l.running = false
+			lanes.Unlock()
+			return
+		}
+		l.entries = l.entries[1:]
+		if buried {
+			// the later entries must not be written before it, they wait until it is retried
+			l.dead = append(l.dead, e.ID)
+			l.updateHolds()
+			if len(l.entries) != 0 {
+				log.Warnf("workQueue, %d operations of %s are held behind dead letter: %d", len(l.entries), key, e.ID)
+			}
+		}
+		lanes.Unlock()
+	}
+}
+
+// process writes the operation to the store, it retries with exponential backoff if failed,
+// and moves the operation to the dead letters after it fails maxAttempts times, buried is true in that case.
+// done is false if ctx is done before the operation is finished.
+func process(ctx context.Context, e *Entry) (done, buried bool) {
+	for {
+		err := apply(e)
+		if err == nil {
+			if err = journal.ack(e); err != nil {
+				log.Errorf("workQueue, failed to ack operation: %d, error: %v", e.ID, err)
+			}
+			untrack(e, nil)
+			return true, false
+		}
+
+		e.Attempts++
+		e.LastError = err.Error()
+		if e.Attempts >= maxAttempts {
+			log.Errorf("workQueue, operation: %d failed %d times, moved to dead letters, error: %v", e.ID, e.Attempts, err)
+			if err = journal.bury(e); err != nil {
+				log.Errorf("workQueue, failed to move operation: %d to dead letters, error: %v", e.ID, err)
+			}
+			untrack(e, errors.Errorf("operation: %d is moved to dead letters, error: %s", e.ID, e.LastError))
+			return true, true
+		}
+
+		delay := retryBaseDelay << (e.Attempts - 1)
+		if delay > retryMaxDelay || delay <= 0 {
+			delay = retryMaxDelay
+		}
+		log.Errorf("workQueue, operation: %d failed %d times, retry after %s, error: %v", e.ID, e.Attempts, delay, err)
+		if err = journal.update(e); err != nil {
+			log.Errorf("workQueue, failed to update operation: %d, error: %v", e.ID, err)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false, false
+		}
+	}
+}
+
+func apply(e *Entry) error {
+	switch {
+	case e.Put != nil:
+		v := e.Put
+		var err error
+		if v.Version > 0 {
+			err = store.PutVersion(v.Resource, v.Key, v.Version, v.Value)
+		} else {
+			err = store.Put(v.Resource, v.Key, v.Value)
+		}
+		if err != nil {
+			return err
+		}
+		log.Infof("put to store successfully, resource %s, key: %s, value: %s", v.Resource, v.Key, *v.Value)
+	case e.Del != nil:
+		v := e.Del
+		var err error
+		if v.Version > 0 {
+			err = store.DelVersion(v.Resource, v.Key, v.Version)
+		} else {
+			err = store.Del(v.Resource, v.Key)
+		}
+		if err != nil {
+			return err
+		}
+		log.Infof("delete store key successfully, resource %s, key: %s, version: %d", v.Resource, v.Key, v.Version)
+	}
+	return nil
+}
+
+// Pending returns the operations that are not written to the store yet.
+func Pending() ([]*Entry, error) {
+	return journal.list(pendingBucket)
+}
+
+// DeadLetters returns the operations that failed maxAttempts times.
+func DeadLetters() ([]*Entry, error) {
+	return journal.list(deadLetterBucket)
+}
+
+// Retry moves a dead letter back to its lane, it is written before the operations held behind it.
+// It fails with DeadLetterNotFoundError if id does not exist, and with DeadLetterOutOfDateError if a later
+// operation of the same replicaSet or volume has been written or is being written, because writing the dead letter
+// would overwrite it with an older value.
+func Retry(id uint64) (*Entry, error) {
+	lanes.Lock()
+	defer lanes.Unlock()
+
+	e, err := journal.revive(id, func(e *Entry) error {
+		key := e.laneKey()
+		if l, ok := lanes.m[key]; ok && l.running && len(l.entries) != 0 && l.entries[0].ID > id {
+			return errors.Wrapf(xerrors.NewDeadLetterOutOfDateError(), "operation: %d of %s is being written",
+				l.entries[0].ID, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	track(e)
+	key := e.laneKey()
+	l := lanes.get(key)
+	for i, dead := range l.dead {
+		if dead == id {
+			l.dead = append(l.dead[:i], l.dead[i+1:]...)
+			break
+		}
+	}
+	l.push(e)
+	l.start(key)
+	return e, nil
+}
+
 func Close() {
-	close(Queue)
+	if err := journal.close(); err != nil {
+		log.Errorf("workQueue, failed to close wal, error: %v", err)
+	}
 }
@@ -0,0 +1,384 @@
+package workQueue
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mayooot/gpu-docker-api/internal/store"
+	"github.com/mayooot/gpu-docker-api/internal/xerrors"
+)
+
+// flakyStore delays every write by up to maxDelay, fails the writes of the values in failures,
+// and records the values written to every key in order.
+type flakyStore struct {
+	store.Store
+
+	sync.Mutex
+	maxDelay time.Duration
+	// failures is how many more times the write of a value fails
+	failures map[string]int
+	written  map[string][]string
+}
+
+func newFlakyStore(maxDelay time.Duration) *flakyStore {
+	return &flakyStore{
+		Store:    store.NewMemoryStore(),
+		maxDelay: maxDelay,
+		failures: make(map[string]int),
+		written:  make(map[string][]string),
+	}
+}
+
+func (s *flakyStore) Put(ctx context.Context, key string, value []byte) error {
+	return s.Txn(ctx, store.PutOp(key, value))
+}
+
+func (s *flakyStore) Txn(ctx context.Context, ops ...store.Op) error {
+	if s.maxDelay > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(s.maxDelay))))
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for _, op := range ops {
+		if s.failures[string(op.Value)] > 0 {
+			s.failures[string(op.Value)]--
+			return errors.Errorf("injected failure of %s", op.Value)
+		}
+	}
+	if err := s.Store.Txn(ctx, ops...); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.Type == store.OpPut {
+			s.written[op.Key] = append(s.written[op.Key], string(op.Value))
+		}
+	}
+	return nil
+}
+
+func (s *flakyStore) fail(value string, times int) {
+	s.Lock()
+	s.failures[value] = times
+	s.Unlock()
+}
+
+// values returns the values written to the container of name.
+func (s *flakyStore) values(name string) []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string(nil), s.written[store.ResourcePrefix(store.Containers, name)]...)
+}
+
+// setup inits the work queue with a wal at walPath on s, the global state of the last test is dropped.
+func setup(t *testing.T, s store.Store, walPath string, attempts int) {
+	store.InitStore(s, "test", time.Second)
+	lanes = &laneSet{m: make(map[string]*lane)}
+	backlog = nil
+	if err := InitWorkQueue(walPath, attempts); err != nil {
+		t.Fatalf("InitWorkQueue failed: %v", err)
+	}
+	t.Cleanup(Close)
+}
+
+// startSyncLoop runs SyncLoop until the test is finished.
+func startSyncLoop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		SyncLoop(ctx, &wg)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		wg.Wait()
+	})
+}
+
+func put(name, value string) store.PutKeyValue {
+	return store.PutKeyValue{Resource: store.Containers, Key: name, Value: &value}
+}
+
+// waitCollected waits for the operations enqueued with collected, see WithCollector.
+func waitCollected(t *testing.T, collected context.Context, timeout time.Duration) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return Wait(ctx, Collected(collected))
+}
+
+// eventually fails the test if cond is not true within a few seconds.
+func eventually(t *testing.T, cond func() bool, format string, args ...interface{}) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLaneOrder(t *testing.T) {
+	s := newFlakyStore(2 * time.Millisecond)
+	setup(t, s, filepath.Join(t.TempDir(), "wal.db"), 5)
+	startSyncLoop(t)
+
+	const keys, ops = 8, 20
+	for k := 0; k < keys; k++ {
+		for i := 0; i < ops; i++ {
+			// some writes of every key fail a few times before they succeed
+			if i%7 == k%7 {
+				s.fail(fmt.Sprintf("foo%d-%d", k, i), 1+k%3)
+			}
+		}
+	}
+
+	collected := WithCollector(context.Background())
+	var wg sync.WaitGroup
+	for k := 0; k < keys; k++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			for i := 0; i < ops; i++ {
+				Enqueue(collected, put(fmt.Sprintf("foo%d", k), fmt.Sprintf("foo%d-%d", k, i)))
+				time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+			}
+		}(k)
+	}
+	wg.Wait()
+	if n := len(Collected(collected)); n != keys*ops {
+		t.Fatalf("got %d collected operations, want %d", n, keys*ops)
+	}
+	if err := waitCollected(t, collected, 10*time.Second); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+
+	for k := 0; k < keys; k++ {
+		want := make([]string, 0, ops)
+		for i := 0; i < ops; i++ {
+			want = append(want, fmt.Sprintf("foo%d-%d", k, i))
+		}
+		if got := s.values(fmt.Sprintf("foo%d", k)); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got writes %v of foo%d, want %v", got, k, want)
+		}
+	}
+}
+
+func TestWaitCollected(t *testing.T) {
+	s := newFlakyStore(0)
+	setup(t, s, filepath.Join(t.TempDir(), "wal.db"), 5)
+	startSyncLoop(t)
+	// the write of the concurrent request is retried for at least 300ms
+	s.fail("bar-0", 2)
+
+	ctx := context.Background()
+	other := WithCollector(ctx)
+	Enqueue(other, put("bar", "bar-0"))
+	collected := WithCollector(ctx)
+	Enqueue(collected, put("foo", "foo-0"))
+	Enqueue(collected, put("foo", "foo-1"))
+
+	// only the writes enqueued with the context are waited for
+	if err := waitCollected(t, collected, 200*time.Millisecond); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if got := s.values("foo"); !reflect.DeepEqual(got, []string{"foo-0", "foo-1"}) {
+		t.Fatalf("got writes %v of foo, want foo-0 and foo-1", got)
+	}
+	if err := waitCollected(t, other, 50*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait returned %v, want the deadline error", err)
+	}
+	if err := waitCollected(t, other, 10*time.Second); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	// a context without collector waits for nothing
+	if err := waitCollected(t, ctx, time.Millisecond); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+}
+
+func TestDeadLetterHoldsLane(t *testing.T) {
+	s := newFlakyStore(time.Millisecond)
+	setup(t, s, filepath.Join(t.TempDir(), "wal.db"), 1)
+	startSyncLoop(t)
+	s.fail("foo-1", 1)
+
+	ctx := context.Background()
+	Enqueue(ctx, put("foo", "foo-0"))
+	Enqueue(ctx, put("foo", "foo-1"))
+	collected := WithCollector(ctx)
+	Enqueue(collected, put("foo", "foo-2"))
+	Enqueue(ctx, put("bar", "bar-0"))
+
+	// the write after the dead letter fails Wait instead of blocking it
+	if err := waitCollected(t, collected, 10*time.Second); err == nil || !strings.Contains(err.Error(), "held behind the dead letters") {
+		t.Fatalf("Wait returned %v, want the error of a held operation", err)
+	}
+	collected = WithCollector(ctx)
+	Enqueue(collected, put("foo", "foo-3"))
+	if err := waitCollected(t, collected, 10*time.Second); err == nil || !strings.Contains(err.Error(), "held behind the dead letters") {
+		t.Fatalf("Wait returned %v, want the error of a held operation", err)
+	}
+	eventually(t, func() bool { return len(s.values("bar")) == 1 }, "bar-0 is not written")
+	if got := s.values("foo"); !reflect.DeepEqual(got, []string{"foo-0"}) {
+		t.Fatalf("got writes %v of foo, want only foo-0", got)
+	}
+
+	deadLetters, err := DeadLetters()
+	if err != nil || len(deadLetters) != 1 || *deadLetters[0].Put.Value != "foo-1" {
+		t.Fatalf("got dead letters %v, error: %v, want foo-1", deadLetters, err)
+	}
+	pending, err := Pending()
+	if err != nil || len(pending) != 2 {
+		t.Fatalf("got %d pending operations, error: %v, want the 2 held ones", len(pending), err)
+	}
+
+	// the retried dead letter is written before the held ones
+	if _, err = Retry(deadLetters[0].ID); err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+	eventually(t, func() bool { return len(s.values("foo")) == 4 }, "foo is not written after its dead letter is retried")
+	if got, want := s.values("foo"), []string{"foo-0", "foo-1", "foo-2", "foo-3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got writes %v of foo, want %v", got, want)
+	}
+	if pending, err = Pending(); err != nil || len(pending) != 0 {
+		t.Fatalf("got %d pending operations, error: %v, want none", len(pending), err)
+	}
+}
+
+func TestRetryOutOfDate(t *testing.T) {
+	setup(t, newFlakyStore(0), filepath.Join(t.TempDir(), "wal.db"), 1)
+
+	// a dead letter buried before a later write of the same key is saved, as by an older version
+	old := &Entry{Put: &store.PutKeyValue{Resource: store.Containers, Key: "foo"}}
+	later := &Entry{Put: &store.PutKeyValue{Resource: store.Containers, Key: "foo/state"}}
+	for _, e := range []*Entry{old, later} {
+		if err := journal.append(e); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+	if err := journal.bury(old); err != nil {
+		t.Fatalf("bury failed: %v", err)
+	}
+	if err := journal.ack(later); err != nil {
+		t.Fatalf("ack failed: %v", err)
+	}
+
+	if _, err := Retry(old.ID); !xerrors.IsDeadLetterOutOfDateError(err) {
+		t.Fatalf("Retry returned %v, want DeadLetterOutOfDateError", err)
+	}
+	if deadLetters, err := DeadLetters(); err != nil || len(deadLetters) != 1 {
+		t.Fatalf("got %d dead letters, error: %v, want the refused one", len(deadLetters), err)
+	}
+	if _, err := Retry(old.ID + 100); !xerrors.IsDeadLetterNotFoundError(err) {
+		t.Fatalf("Retry returned %v, want DeadLetterNotFoundError", err)
+	}
+}
+
+func TestReplayHoldsLane(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.db")
+	w, err := openWal(walPath)
+	if err != nil {
+		t.Fatalf("openWal failed: %v", err)
+	}
+	// the operations left by the last run, baz-0 was moved to the dead letters
+	entries := make(map[string]*Entry)
+	for _, pair := range [][2]string{{"foo", "foo-0"}, {"foo", "foo-1"}, {"bar", "bar-0"}, {"baz", "baz-0"}, {"baz", "baz-1"}, {"foo", "foo-2"}} {
+		value := pair[1]
+		e := &Entry{Put: &store.PutKeyValue{Resource: store.Containers, Key: pair[0], Value: &value}}
+		if err = w.append(e); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+		entries[pair[1]] = e
+	}
+	if err = w.bury(entries["baz-0"]); err != nil {
+		t.Fatalf("bury failed: %v", err)
+	}
+	_ = w.close()
+
+	s := newFlakyStore(time.Millisecond)
+	s.fail("foo-0", 1)
+	setup(t, s, walPath, 3)
+	// the later writes of foo are not replayed after foo-0 fails, nor those of baz behind its dead letter
+	if got := s.values("foo"); len(got) != 0 {
+		t.Fatalf("got writes %v of foo at replay, want none", got)
+	}
+	if got := s.values("baz"); len(got) != 0 {
+		t.Fatalf("got writes %v of baz at replay, want none", got)
+	}
+	if got := s.values("bar"); !reflect.DeepEqual(got, []string{"bar-0"}) {
+		t.Fatalf("got writes %v of bar at replay, want bar-0", got)
+	}
+
+	// the operations enqueued after startup are written after the backlog
+	Enqueue(context.Background(), put("foo", "foo-3"))
+	startSyncLoop(t)
+	eventually(t, func() bool { return len(s.values("foo")) == 4 }, "the backlog of foo is not written")
+	if got, want := s.values("foo"), []string{"foo-0", "foo-1", "foo-2", "foo-3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got writes %v of foo, want %v", got, want)
+	}
+	if got := s.values("baz"); len(got) != 0 {
+		t.Fatalf("got writes %v of baz, want none before its dead letter is retried", got)
+	}
+
+	if _, err = Retry(entries["baz-0"].ID); err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+	eventually(t, func() bool { return len(s.values("baz")) == 2 }, "baz is not written after its dead letter is retried")
+	if got, want := s.values("baz"), []string{"baz-0", "baz-1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got writes %v of baz, want %v", got, want)
+	}
+}
+
+func TestRetryKeepsOverlayOrder(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.db")
+	w, err := openWal(walPath)
+	if err != nil {
+		t.Fatalf("openWal failed: %v", err)
+	}
+	// foo-0 was moved to the dead letters, foo-1 is held behind it
+	entries := make(map[string]*Entry)
+	for _, value := range []string{"foo-0", "foo-1"} {
+		value := value
+		e := &Entry{Put: &store.PutKeyValue{Resource: store.Containers, Key: "foo", Value: &value}}
+		if err = w.append(e); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+		entries[value] = e
+	}
+	if err = w.bury(entries["foo-0"]); err != nil {
+		t.Fatalf("bury failed: %v", err)
+	}
+	_ = w.close()
+
+	s := newFlakyStore(time.Millisecond)
+	setup(t, s, walPath, 3)
+	if _, err = Retry(entries["foo-0"].ID); err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+	// the retried dead letter is queued after foo-1 in this process, but it is still written before it
+	value, err := store.GetValue(store.Containers, "foo")
+	if err != nil || string(value) != "foo-1" {
+		t.Fatalf("got value %s of foo before it is written, error: %v, want foo-1", value, err)
+	}
+
+	startSyncLoop(t)
+	eventually(t, func() bool { return len(s.values("foo")) == 2 }, "foo is not written after its dead letter is retried")
+	if got, want := s.values("foo"), []string{"foo-0", "foo-1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got writes %v of foo, want %v", got, want)
+	}
+	if value, err = store.GetValue(store.Containers, "foo"); err != nil || string(value) != "foo-1" {
+		t.Fatalf("got value %s of foo, error: %v, want foo-1", value, err)
+	}
+}
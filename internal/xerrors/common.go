@@ -5,8 +5,12 @@ import (
 )
 
 const (
-	noPatchRequired    = "no patch required"
-	noRollbackRequired = "no rollback required"
+	noPatchRequired     = "no patch required"
+	noRollbackRequired  = "no rollback required"
+	operationInProgress = "operation in progress"
+	deadLetterNotFound  = "dead letter not found"
+	deadLetterOutOfDate = "dead letter out of date"
+	operationNotFound   = "operation not found"
 )
 
 func NewNoPatchRequiredError() error {
@@ -30,3 +34,47 @@ func IsNoRollbackRequiredError(err error) bool {
 	}
 	return errors.Cause(err).Error() == noRollbackRequired
 }
+
+func NewOperationInProgressError() error {
+	return errors.New(operationInProgress)
+}
+
+func IsOperationInProgressError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == operationInProgress
+}
+
+func NewDeadLetterNotFoundError() error {
+	return errors.New(deadLetterNotFound)
+}
+
+func IsDeadLetterNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == deadLetterNotFound
+}
+
+func NewDeadLetterOutOfDateError() error {
+	return errors.New(deadLetterOutOfDate)
+}
+
+func IsDeadLetterOutOfDateError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == deadLetterOutOfDate
+}
+
+func NewOperationNotFoundError() error {
+	return errors.New(operationNotFound)
+}
+
+func IsOperationNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == operationNotFound
+}
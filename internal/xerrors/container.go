@@ -4,7 +4,15 @@ import (
 	"github.com/pkg/errors"
 )
 
-const containerExisted = "container existed"
+const (
+	containerExisted  = "container existed"
+	snapshotNotFound  = "snapshot not found"
+	snapshotLocked    = "snapshot locked"
+	imageNotFound     = "image not found"
+	containerNotFound = "container not found"
+	fileNotFound      = "file not found"
+	fileTooLarge      = "file too large"
+)
 
 func NewContainerExistedError() error {
 	return errors.New(containerExisted)
@@ -16,3 +24,69 @@ func IsContainerExistedError(err error) bool {
 	}
 	return errors.Cause(err).Error() == containerExisted
 }
+
+func NewSnapshotNotFoundError() error {
+	return errors.New(snapshotNotFound)
+}
+
+func IsSnapshotNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == snapshotNotFound
+}
+
+func NewSnapshotLockedError() error {
+	return errors.New(snapshotLocked)
+}
+
+func IsSnapshotLockedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == snapshotLocked
+}
+
+func NewImageNotFoundError() error {
+	return errors.New(imageNotFound)
+}
+
+func IsImageNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == imageNotFound
+}
+
+func NewContainerNotFoundError() error {
+	return errors.New(containerNotFound)
+}
+
+func IsContainerNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == containerNotFound
+}
+
+func NewFileNotFoundError() error {
+	return errors.New(fileNotFound)
+}
+
+func IsFileNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == fileNotFound
+}
+
+func NewFileTooLargeError() error {
+	return errors.New(fileTooLarge)
+}
+
+func IsFileTooLargeError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == fileTooLarge
+}
@@ -0,0 +1,44 @@
+package xerrors
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	notExistInStore   = "not exist in store"
+	revisionCompacted = "revision has been compacted"
+	storeNotEmpty     = "store is not empty"
+)
+
+func NewNotExistInStoreError() error {
+	return errors.New(notExistInStore)
+}
+
+func IsNotExistInStoreError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == notExistInStore
+}
+
+func NewRevisionCompactedError() error {
+	return errors.New(revisionCompacted)
+}
+
+func IsRevisionCompactedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == revisionCompacted
+}
+
+func NewStoreNotEmptyError() error {
+	return errors.New(storeNotEmpty)
+}
+
+func IsStoreNotEmptyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err).Error() == storeNotEmpty
+}
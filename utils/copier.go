@@ -0,0 +1,378 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// copyChunkSize is how many bytes are copied between two checks of cancellation and progress reports.
+const copyChunkSize = 8 << 20
+
+// CopyProgress is reported to the caller of CopyDir while the files are being copied.
+type CopyProgress struct {
+	Files      int64 `json:"files"`
+	Bytes      int64 `json:"bytes"`
+	TotalFiles int64 `json:"totalFiles"`
+	TotalBytes int64 `json:"totalBytes"`
+}
+
+// ProgressFunc is called after every copied file and every copied chunk of a large file.
+type ProgressFunc func(CopyProgress)
+
+// CopyDir copies the contents of the directory src into the directory dest, including the files whose names start with a dot.
+// Ownership, modes including setuid, setgid and sticky bits, times, symlinks, hardlinks, devices, fifos
+// and extended attributes (so ACLs too) are preserved, holes of sparse files are kept.
+// Existing files of dest are replaced, the other files of dest are left as they are.
+// It stops with the error of ctx when ctx is done, progress is optional.
+func CopyDir(ctx context.Context, src, dest string, progress ProgressFunc) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return errors.Wrapf(err, "os.Stat failed, src: %s", src)
+	}
+	if !srcInfo.IsDir() {
+		return errors.Errorf("%s is not a directory", src)
+	}
+	if err = os.MkdirAll(dest, 0755); err != nil {
+		return errors.Wrapf(err, "os.MkdirAll failed, dest: %s", dest)
+	}
+	destInfo, err := os.Stat(dest)
+	if err != nil {
+		return errors.Wrapf(err, "os.Stat failed, dest: %s", dest)
+	}
+	// the files would be removed before they are copied
+	if os.SameFile(srcInfo, destInfo) {
+		return errors.Errorf("src: %s and dest: %s are the same directory", src, dest)
+	}
+
+	c := &copier{
+		ctx:      ctx,
+		src:      src,
+		dest:     dest,
+		progress: progress,
+		links:    make(map[inode]string),
+	}
+	if progress != nil {
+		if err = c.count(); err != nil {
+			return err
+		}
+	}
+	return c.copy()
+}
+
+type inode struct {
+	dev, ino uint64
+}
+
+type copier struct {
+	ctx       context.Context
+	src, dest string
+	progress  ProgressFunc
+	stat      CopyProgress
+	// the first copied path of every source inode with more than one link
+	links map[inode]string
+}
+
+// count walks src first, so that the totals of the progress are known.
+func (c *copier) count() error {
+	seen := make(map[inode]struct{})
+	err := filepath.WalkDir(c.src, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = c.ctx.Err(); err != nil {
+			return err
+		}
+		if name == c.src {
+			return nil
+		}
+		c.stat.TotalFiles++
+		if d.Type().IsRegular() {
+			st, err := lstat(name)
+			if err != nil {
+				return err
+			}
+			// the contents of hardlinks are copied once
+			if st.Nlink > 1 {
+				key := inode{dev: uint64(st.Dev), ino: st.Ino}
+				if _, ok := seen[key]; ok {
+					return nil
+				}
+				seen[key] = struct{}{}
+			}
+			c.stat.TotalBytes += st.Size
+		}
+		return nil
+	})
+	return errors.Wrapf(err, "filepath.WalkDir failed, src: %s", c.src)
+}
+
+func (c *copier) copy() error {
+	// the attributes of a directory are set after its contents, otherwise its times are changed by them
+	// and a read-only directory can't be written
+	var dirs []string
+	err := filepath.WalkDir(c.src, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = c.ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(c.src, name)
+		if err != nil {
+			return err
+		}
+		if err = c.copyEntry(name, filepath.Join(c.dest, rel)); err != nil {
+			return errors.Wrapf(err, "failed to copy %s", rel)
+		}
+		if d.IsDir() {
+			dirs = append(dirs, rel)
+		}
+		if name != c.src {
+			c.stat.Files++
+			c.report()
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to copy %s to %s", c.src, c.dest)
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		src, dest := filepath.Join(c.src, dirs[i]), filepath.Join(c.dest, dirs[i])
+		st, err := lstat(src)
+		if err != nil {
+			return errors.Wrapf(err, "failed to copy %s", dirs[i])
+		}
+		if err = copyAttrs(src, dest, st); err != nil {
+			return errors.Wrapf(err, "failed to copy attributes of %s", dirs[i])
+		}
+	}
+	return nil
+}
+
+func (c *copier) copyEntry(src, dest string) error {
+	st, err := lstat(src)
+	if err != nil {
+		return err
+	}
+	mode := st.Mode & syscall.S_IFMT
+
+	// an existing file of another type, or an existing file that may be a hardlink of another file, is replaced
+	if info, err := os.Lstat(dest); err == nil {
+		if mode == syscall.S_IFDIR && info.IsDir() {
+			return os.Chmod(dest, 0700|info.Mode().Perm())
+		}
+		if err = os.RemoveAll(dest); err != nil {
+			return err
+		}
+	}
+
+	switch mode {
+	case syscall.S_IFDIR:
+		// writable until its attributes are copied
+		return os.Mkdir(dest, 0700)
+	case syscall.S_IFREG:
+		if st.Nlink > 1 {
+			key := inode{dev: uint64(st.Dev), ino: st.Ino}
+			if first, ok := c.links[key]; ok {
+				return os.Link(first, dest)
+			}
+			c.links[key] = dest
+		}
+		if err = c.copyFile(src, dest, st); err != nil {
+			return err
+		}
+	case syscall.S_IFLNK:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err = os.Symlink(link, dest); err != nil {
+			return err
+		}
+	case syscall.S_IFBLK, syscall.S_IFCHR, syscall.S_IFIFO, syscall.S_IFSOCK:
+		if err = syscall.Mknod(dest, mode|0600, int(st.Rdev)); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("unknown file type: %o", mode)
+	}
+	return copyAttrs(src, dest, st)
+}
+
+func (c *copier) copyFile(src, dest string, st *syscall.Stat_t) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	// fewer blocks are allocated than the size needs, the holes are skipped
+	if st.Blocks*512 < st.Size {
+		err = c.copySparse(in, out, st.Size)
+	} else {
+		err = c.copyRange(in, out, st.Size)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// copyRange copies n bytes from the current offset of in to the current offset of out,
+// copy_file_range is used by io.CopyN for two files.
+func (c *copier) copyRange(in, out *os.File, n int64) error {
+	for n > 0 {
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+		written, err := io.CopyN(out, in, min(n, copyChunkSize))
+		n -= written
+		c.stat.Bytes += written
+		c.report()
+		// the file is truncated while it is copied
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *copier) copySparse(in, out *os.File, size int64) error {
+	var offset int64
+	for offset < size {
+		data, err := in.Seek(offset, unix.SEEK_DATA)
+		if errors.Is(err, syscall.ENXIO) {
+			// no data after offset
+			data = size
+		} else if err != nil {
+			return err
+		}
+		// holes are counted as copied
+		c.stat.Bytes += min(data, size) - offset
+		if data >= size {
+			break
+		}
+		hole, err := in.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return err
+		}
+		if _, err = out.Seek(data, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err = in.Seek(data, io.SeekStart); err != nil {
+			return err
+		}
+		if err = c.copyRange(in, out, hole-data); err != nil {
+			return err
+		}
+		offset = hole
+	}
+	// the trailing hole
+	return out.Truncate(size)
+}
+
+func (c *copier) report() {
+	if c.progress != nil {
+		c.progress(c.stat)
+	}
+}
+
+func lstat(name string) (*syscall.Stat_t, error) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(name, &st); err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return &st, nil
+}
+
+// copyAttrs copies the ownership, extended attributes, mode and times of src to dest, symlinks are not followed.
+func copyAttrs(src, dest string, st *syscall.Stat_t) error {
+	// the ownership can only be changed by root
+	if err := os.Lchown(dest, int(st.Uid), int(st.Gid)); err != nil && os.Geteuid() == 0 {
+		return err
+	}
+	// chown drops security.capability, so the extended attributes are copied after it
+	if err := copyXattrs(src, dest); err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		// chown clears the setuid and setgid bits, so the mode is set after it
+		if err := syscall.Chmod(dest, st.Mode&07777); err != nil {
+			return &fs.PathError{Op: "chmod", Path: dest, Err: err}
+		}
+	}
+	ts := []unix.Timespec{unix.NsecToTimespec(st.Atim.Nano()), unix.NsecToTimespec(st.Mtim.Nano())}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, dest, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &fs.PathError{Op: "utimes", Path: dest, Err: err}
+	}
+	return nil
+}
+
+func copyXattrs(src, dest string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil
+		}
+		return &fs.PathError{Op: "llistxattr", Path: src, Err: err}
+	}
+	if size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(src, buf); err != nil {
+		return &fs.PathError{Op: "llistxattr", Path: src, Err: err}
+	}
+
+	var value []byte
+	for _, name := range splitXattrNames(buf[:size]) {
+		n, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			return &fs.PathError{Op: "lgetxattr", Path: src, Err: err}
+		}
+		if cap(value) < n {
+			value = make([]byte, n)
+		}
+		if n, err = unix.Lgetxattr(src, name, value[:n]); err != nil {
+			return &fs.PathError{Op: "lgetxattr", Path: src, Err: err}
+		}
+		if err = unix.Lsetxattr(dest, name, value[:n], 0); err != nil {
+			// e.g. the file system of dest does not support the namespace, or user xattrs on a symlink
+			if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+				continue
+			}
+			return &fs.PathError{Op: "lsetxattr", Path: dest, Err: err}
+		}
+	}
+	return nil
+}
+
+// splitXattrNames splits the null terminated names returned by listxattr.
+func splitXattrNames(buf []byte) []string {
+	names := make([]string, 0)
+	start := 0
+	for i, b := range buf {
+		if b == 0 {
+			if i > start {
+				names = append(names, string(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return names
+}
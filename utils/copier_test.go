@@ -0,0 +1,253 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// capSetuid is a security.capability value (VFS_CAP_REVISION_2) granting cap_setuid+ep.
+var capSetuid = []byte{
+	0x01, 0x00, 0x00, 0x02,
+	0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+func TestCopyDirNames(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		".hidden":               "dot file",
+		".config/settings.json": "{}",
+		"with space/a b.txt":    "spaces",
+		"with space/.x y":       "dot and space",
+	}
+	for name, content := range files {
+		writeFile(t, filepath.Join(src, name), content)
+	}
+
+	if err := CopyDir(context.Background(), src, dest, nil); err != nil {
+		t.Fatalf("CopyDir failed: %v", err)
+	}
+	for name, content := range files {
+		if got := readFile(t, filepath.Join(dest, name)); got != content {
+			t.Errorf("got %q of %s, want %q", got, name, content)
+		}
+	}
+}
+
+func TestCopyDirLinks(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "data/file"), "content")
+	mustDo(t, os.Symlink("data/file", filepath.Join(src, "relative")))
+	mustDo(t, os.Symlink("/nonexistent/target", filepath.Join(src, "dangling")))
+	mustDo(t, os.Link(filepath.Join(src, "data/file"), filepath.Join(src, "hardlink")))
+
+	if err := CopyDir(context.Background(), src, dest, nil); err != nil {
+		t.Fatalf("CopyDir failed: %v", err)
+	}
+	for name, want := range map[string]string{"relative": "data/file", "dangling": "/nonexistent/target"} {
+		got, err := os.Readlink(filepath.Join(dest, name))
+		if err != nil || got != want {
+			t.Errorf("got symlink %s -> %s, error: %v, want %s", name, got, err, want)
+		}
+	}
+
+	first, err := os.Stat(filepath.Join(dest, "data/file"))
+	mustDo(t, err)
+	second, err := os.Stat(filepath.Join(dest, "hardlink"))
+	mustDo(t, err)
+	if !os.SameFile(first, second) {
+		t.Errorf("hardlink is copied as a separate file")
+	}
+}
+
+func TestCopyDirModes(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "setuid"), "#!/bin/sh")
+	mustDo(t, os.Chmod(filepath.Join(src, "setuid"), 0755|os.ModeSetuid))
+	mustDo(t, os.Mkdir(filepath.Join(src, "sticky"), 0755))
+	mustDo(t, os.Chmod(filepath.Join(src, "sticky"), 0777|os.ModeSticky))
+	// a read-only directory is written before its mode is set
+	writeFile(t, filepath.Join(src, "readonly/file"), "content")
+	mustDo(t, os.Chmod(filepath.Join(src, "readonly"), 0555))
+
+	if err := CopyDir(context.Background(), src, dest, nil); err != nil {
+		t.Fatalf("CopyDir failed: %v", err)
+	}
+	for name, want := range map[string]os.FileMode{
+		"setuid":   0755 | os.ModeSetuid,
+		"sticky":   0777 | os.ModeSticky | os.ModeDir,
+		"readonly": 0555 | os.ModeDir,
+	} {
+		info, err := os.Lstat(filepath.Join(dest, name))
+		if err != nil || info.Mode() != want {
+			t.Errorf("got mode %s of %s, error: %v, want %s", info.Mode(), name, err, want)
+		}
+	}
+	_ = os.Chmod(filepath.Join(dest, "readonly"), 0755)
+}
+
+func TestCopyDirXattrs(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	name := filepath.Join(src, "file")
+	writeFile(t, name, "content")
+	if err := unix.Lsetxattr(name, "user.test", []byte("value"), 0); err != nil {
+		t.Skipf("user xattrs are not supported: %v", err)
+	}
+
+	if err := CopyDir(context.Background(), src, dest, nil); err != nil {
+		t.Fatalf("CopyDir failed: %v", err)
+	}
+	if got := getXattr(t, filepath.Join(dest, "file"), "user.test"); string(got) != "value" {
+		t.Errorf("got xattr %q, want %q", got, "value")
+	}
+}
+
+func TestCopyDirCapabilities(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the ownership and capabilities can only be set by root")
+	}
+	src, dest := t.TempDir(), t.TempDir()
+	name := filepath.Join(src, "ping")
+	writeFile(t, name, "binary")
+	mustDo(t, os.Chown(name, 1000, 1000))
+	if err := unix.Lsetxattr(name, "security.capability", capSetuid, 0); err != nil {
+		t.Skipf("file capabilities are not supported: %v", err)
+	}
+
+	if err := CopyDir(context.Background(), src, dest, nil); err != nil {
+		t.Fatalf("CopyDir failed: %v", err)
+	}
+	st, err := lstat(filepath.Join(dest, "ping"))
+	mustDo(t, err)
+	if st.Uid != 1000 || st.Gid != 1000 {
+		t.Errorf("got owner %d:%d, want 1000:1000", st.Uid, st.Gid)
+	}
+	// chown drops the capabilities, they must be set after it
+	if got := getXattr(t, filepath.Join(dest, "ping"), "security.capability"); !bytes.Equal(got, capSetuid) {
+		t.Errorf("got capabilities %x, want %x", got, capSetuid)
+	}
+}
+
+func TestCopyDirSparse(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	const size = 64 << 20
+	f, err := os.Create(filepath.Join(src, "sparse"))
+	mustDo(t, err)
+	_, err = f.WriteAt([]byte("head"), 0)
+	mustDo(t, err)
+	_, err = f.WriteAt([]byte("tail"), size-4)
+	mustDo(t, err)
+	mustDo(t, f.Close())
+	st, err := lstat(filepath.Join(src, "sparse"))
+	mustDo(t, err)
+	if st.Blocks*512 >= size {
+		t.Skip("sparse files are not supported")
+	}
+
+	if err = CopyDir(context.Background(), src, dest, nil); err != nil {
+		t.Fatalf("CopyDir failed: %v", err)
+	}
+	copied, err := lstat(filepath.Join(dest, "sparse"))
+	mustDo(t, err)
+	if copied.Size != size || copied.Blocks*512 >= size {
+		t.Errorf("got size %d with %d blocks, want size %d with holes", copied.Size, copied.Blocks, size)
+	}
+	content, err := os.ReadFile(filepath.Join(dest, "sparse"))
+	mustDo(t, err)
+	if string(content[:4]) != "head" || string(content[size-4:]) != "tail" {
+		t.Errorf("the data around the hole is not copied")
+	}
+}
+
+func TestCopyDirProgress(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "a"), "12345")
+	writeFile(t, filepath.Join(src, "dir/b"), "123")
+	// the contents of a hardlink are counted once
+	mustDo(t, os.Link(filepath.Join(src, "a"), filepath.Join(src, "dir/c")))
+	mustDo(t, os.Symlink("a", filepath.Join(src, "d")))
+
+	var last CopyProgress
+	err := CopyDir(context.Background(), src, dest, func(p CopyProgress) {
+		if p.Files < last.Files || p.Bytes < last.Bytes {
+			t.Errorf("progress goes back from %+v to %+v", last, p)
+		}
+		last = p
+	})
+	if err != nil {
+		t.Fatalf("CopyDir failed: %v", err)
+	}
+	want := CopyProgress{Files: 5, Bytes: 8, TotalFiles: 5, TotalBytes: 8}
+	if last != want {
+		t.Errorf("got progress %+v, want %+v", last, want)
+	}
+}
+
+func TestCopyDirCancel(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		writeFile(t, filepath.Join(src, name), name)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := CopyDir(ctx, src, dest, func(p CopyProgress) {
+		if p.Files == 1 {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("CopyDir returned %v, want %v", err, context.Canceled)
+	}
+	entries, err := os.ReadDir(dest)
+	mustDo(t, err)
+	if len(entries) != 1 {
+		t.Errorf("got %d files copied after cancel, want 1", len(entries))
+	}
+}
+
+func TestCopyDirSameDir(t *testing.T) {
+	src := t.TempDir()
+	if err := CopyDir(context.Background(), src, src, nil); err == nil {
+		t.Fatalf("CopyDir into itself succeeded")
+	}
+}
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	mustDo(t, os.MkdirAll(filepath.Dir(name), 0755))
+	mustDo(t, os.WriteFile(name, []byte(content), 0644))
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	content, err := os.ReadFile(name)
+	mustDo(t, err)
+	return string(content)
+}
+
+func getXattr(t *testing.T, name, attr string) []byte {
+	t.Helper()
+	value := make([]byte, 256)
+	n, err := unix.Lgetxattr(name, attr, value)
+	if err != nil {
+		if errors.Is(err, syscall.ENODATA) {
+			return nil
+		}
+		t.Fatalf("lgetxattr %s of %s failed: %v", attr, name, err)
+	}
+	return value[:n]
+}
+
+func mustDo(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
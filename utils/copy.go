@@ -2,29 +2,22 @@ package utils
 
 import (
 	"context"
-	"fmt"
+	"time"
 
-	"github.com/commander-cli/cmd"
+	"github.com/ngaut/log"
 	"github.com/pkg/errors"
 
 	"github.com/mayooot/gpu-docker-api/internal/docker"
 )
 
-var (
-	cpRFPOption = "cp -rf -p %s/* %s/"
-)
+// progressInterval is how often the progress of copying is logged.
+const progressInterval = 5 * time.Second
 
-func CopyDir(src, dest string) error {
-	command := fmt.Sprintf(cpRFPOption, src, dest)
-	if err := cmd.NewCommand(command).Execute(); err != nil {
-		return errors.Wrapf(err, "cmd.Execute failed, command %s, src:%s, dest: %s", command, src, dest)
-	}
-	return nil
-}
+const overlay2Driver = "overlay2"
 
 // CopyOldMergedToNewContainerMerged is used to copy the merged layer from the old container
 // to the new container during patch operations.
-func CopyOldMergedToNewContainerMerged(oldContainer, newContainer string) error {
+func CopyOldMergedToNewContainerMerged(ctx context.Context, oldContainer, newContainer string, progress ProgressFunc) error {
 	oldMerged, err := GetContainerMergedLayer(oldContainer)
 	if err != nil {
 		return errors.WithMessage(err, "GetContainerMergedLayer failed")
@@ -34,12 +27,74 @@ func CopyOldMergedToNewContainerMerged(oldContainer, newContainer string) error
 		return errors.WithMessage(err, "GetContainerMergedLayer failed")
 	}
 
-	if err = CopyDir(oldMerged, newMerged); err != nil {
-		return errors.WithMessage(err, "copyDir failed")
+	if err = CopyDir(ctx, oldMerged, newMerged, logProgress("container: "+oldContainer, progress)); err != nil {
+		return errors.WithMessage(err, "CopyDir failed")
 	}
 	return nil
 }
 
+// CopyOldUpperToNewContainerUpper is used to copy only the writable layer from the old container
+// to the new container during patch operations, the new container must be created but not started,
+// because the upper layer of a mounted overlay can't be changed.
+// The whiteouts of the deleted files are copied too, so the new container sees the same files as the old one.
+// It returns false without copying anything if the containers are not based on the same image or not on overlay2,
+// then the caller should copy the merged layer after the new container is started.
+func CopyOldUpperToNewContainerUpper(ctx context.Context, oldContainer, newContainer string, progress ProgressFunc) (bool, error) {
+	oldResp, err := docker.Cli.ContainerInspect(ctx, oldContainer)
+	if err != nil {
+		return false, errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", oldContainer)
+	}
+	newResp, err := docker.Cli.ContainerInspect(ctx, newContainer)
+	if err != nil {
+		return false, errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", newContainer)
+	}
+
+	oldUpper, newUpper := oldResp.GraphDriver.Data["UpperDir"], newResp.GraphDriver.Data["UpperDir"]
+	if oldResp.GraphDriver.Name != overlay2Driver || newResp.GraphDriver.Name != overlay2Driver ||
+		len(oldUpper) == 0 || len(newUpper) == 0 {
+		log.Infof("copy all files of container: %s, the storage driver is not %s", oldContainer, overlay2Driver)
+		return false, nil
+	}
+	// the whiteouts only hide the files of the same lower layers
+	if oldResp.Image != newResp.Image {
+		log.Infof("copy all files of container: %s, the image is changed from %s to %s", oldContainer, oldResp.Image, newResp.Image)
+		return false, nil
+	}
+
+	if err = CopyDir(ctx, oldUpper, newUpper, logProgress("container: "+oldContainer, progress)); err != nil {
+		return false, errors.WithMessage(err, "CopyDir failed")
+	}
+	return true, nil
+}
+
+// GetContainerUpperLayer returns the writable layer of the container, it is empty if the storage driver is not overlay2.
+func GetContainerUpperLayer(name string) (string, error) {
+	resp, err := docker.Cli.ContainerInspect(context.TODO(), name)
+	if err != nil {
+		return "", errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", name)
+	}
+	if resp.GraphDriver.Name != overlay2Driver {
+		return "", nil
+	}
+	return resp.GraphDriver.Data["UpperDir"], nil
+}
+
+// GetContainerChangedLayer returns the layer holding the files changed in the container and the ID of its image,
+// upper is true if it is the writable layer of overlay2, otherwise it is the merged layer.
+func GetContainerChangedLayer(name string) (dir string, upper bool, image string, err error) {
+	resp, err := docker.Cli.ContainerInspect(context.TODO(), name)
+	if err != nil {
+		return "", false, "", errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", name)
+	}
+	if dir = resp.GraphDriver.Data["UpperDir"]; resp.GraphDriver.Name == overlay2Driver && len(dir) != 0 {
+		return dir, true, resp.Image, nil
+	}
+	if dir = resp.GraphDriver.Data["MergedDir"]; len(dir) == 0 {
+		return "", false, "", errors.Errorf("the merged dir of container: %s is not found", name)
+	}
+	return dir, false, resp.Image, nil
+}
+
 func GetContainerMergedLayer(name string) (string, error) {
 	resp, err := docker.Cli.ContainerInspect(context.TODO(), name)
 	if err != nil || len(resp.GraphDriver.Data["MergedDir"]) == 0 {
@@ -50,7 +105,7 @@ func GetContainerMergedLayer(name string) (string, error) {
 
 // CopyOldMountPointToContainerMountPoint is used to copy the volume data from the old container
 // to the new container during patch operations.
-func CopyOldMountPointToContainerMountPoint(oldVolume, newVolume string) error {
+func CopyOldMountPointToContainerMountPoint(ctx context.Context, oldVolume, newVolume string, progress ProgressFunc) error {
 	oldMountPoint, err := GetVolumeMountPoint(oldVolume)
 	if err != nil {
 		return errors.WithMessage(err, "GetVolumeMountPoint failed")
@@ -60,8 +115,8 @@ func CopyOldMountPointToContainerMountPoint(oldVolume, newVolume string) error {
 		return errors.WithMessage(err, "GetVolumeMountPoint failed")
 	}
 
-	if err = CopyDir(oldMountPoint, newMountPoint); err != nil {
-		return errors.WithMessage(err, "copyDir failed")
+	if err = CopyDir(ctx, oldMountPoint, newMountPoint, logProgress("volume: "+oldVolume, progress)); err != nil {
+		return errors.WithMessage(err, "CopyDir failed")
 	}
 	return nil
 }
@@ -74,3 +129,19 @@ func GetVolumeMountPoint(name string) (string, error) {
 	}
 	return resp.Mountpoint, nil
 }
+
+// logProgress logs the progress of copying every progressInterval, so that a long copy can be followed in the logs,
+// the progress is also passed to next if it is not nil.
+func logProgress(what string, next ProgressFunc) ProgressFunc {
+	var last time.Time
+	return func(p CopyProgress) {
+		if next != nil {
+			next(p)
+		}
+		if time.Since(last) < progressInterval && p.Files < p.TotalFiles {
+			return
+		}
+		last = time.Now()
+		log.Infof("copying %s, files: %d/%d, bytes: %d/%d", what, p.Files, p.TotalFiles, p.Bytes, p.TotalBytes)
+	}
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// layer makes the directories of an overlay layer under root, files maps the paths to their contents,
+// the whiteouts and opaque directories are made as overlayfs does.
+type layer struct {
+	files     map[string]string
+	links     map[string]string
+	whiteouts []string
+	opaques   []string
+}
+
+func (l layer) make(t *testing.T, root string) string {
+	t.Helper()
+	mustDo(t, os.MkdirAll(root, 0755))
+	for name, content := range l.files {
+		writeFile(t, filepath.Join(root, name), content)
+	}
+	for name, target := range l.links {
+		mustDo(t, os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755))
+		mustDo(t, os.Symlink(target, filepath.Join(root, name)))
+	}
+	for _, name := range l.whiteouts {
+		mustDo(t, os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755))
+		mustDo(t, syscall.Mknod(filepath.Join(root, name), syscall.S_IFCHR|0000, 0))
+	}
+	for _, name := range l.opaques {
+		mustDo(t, os.MkdirAll(filepath.Join(root, name), 0755))
+		if err := unix.Lsetxattr(filepath.Join(root, name), overlayOpaqueXattr, []byte("y"), 0); err != nil {
+			t.Skipf("trusted xattrs are not supported: %v", err)
+		}
+	}
+	return root
+}
+
+func skipIfNotRoot(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("the whiteouts and trusted xattrs can only be made by root")
+	}
+}
+
+// TestCopyUpperWhiteouts copies an upper layer as CopyOldUpperToNewContainerUpper does,
+// then mounts it on the lower layer to check that the new container sees the same files.
+func TestCopyUpperWhiteouts(t *testing.T) {
+	skipIfNotRoot(t)
+	dir := t.TempDir()
+	lower := layer{files: map[string]string{
+		"etc/hosts":           "localhost",
+		"etc/deleted.conf":    "deleted in the container",
+		"cache/lower-only":    "hidden by the opaque dir",
+		"cache/lower-changed": "changed in the container",
+	}}.make(t, filepath.Join(dir, "lower"))
+	oldUpper := layer{
+		files:     map[string]string{"cache/lower-changed": "changed", "root/model.pt": "model"},
+		whiteouts: []string{"etc/deleted.conf"},
+		opaques:   []string{"cache"},
+	}.make(t, filepath.Join(dir, "old-upper"))
+	newUpper := filepath.Join(dir, "new-upper")
+	mustDo(t, os.Mkdir(newUpper, 0755))
+
+	if err := CopyDir(context.Background(), oldUpper, newUpper, nil); err != nil {
+		t.Fatalf("CopyDir failed: %v", err)
+	}
+	st, err := lstat(filepath.Join(newUpper, "etc/deleted.conf"))
+	mustDo(t, err)
+	if !isWhiteout(st) {
+		t.Errorf("got mode %o rdev %d of the whiteout, want a 0/0 character device", st.Mode, st.Rdev)
+	}
+	if !isOpaque(filepath.Join(newUpper, "cache")) {
+		t.Errorf("the opaque xattr of cache is not copied")
+	}
+
+	merged, work := filepath.Join(dir, "merged"), filepath.Join(dir, "work")
+	mustDo(t, os.Mkdir(merged, 0755))
+	mustDo(t, os.Mkdir(work, 0755))
+	opts := "lowerdir=" + lower + ",upperdir=" + newUpper + ",workdir=" + work
+	if err = unix.Mount("overlay", merged, "overlay", 0, opts); err != nil {
+		t.Skipf("overlay can't be mounted: %v", err)
+	}
+	defer func() { _ = unix.Unmount(merged, 0) }()
+
+	for name, want := range map[string]string{
+		"etc/hosts":           "localhost",
+		"cache/lower-changed": "changed",
+		"root/model.pt":       "model",
+	} {
+		if got := readFile(t, filepath.Join(merged, name)); got != want {
+			t.Errorf("got %q of %s in the new container, want %q", got, name, want)
+		}
+	}
+	for _, name := range []string{"etc/deleted.conf", "cache/lower-only"} {
+		if _, err = os.Lstat(filepath.Join(merged, name)); !os.IsNotExist(err) {
+			t.Errorf("%s is seen in the new container, error: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/ngaut/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/mayooot/gpu-docker-api/internal/docker"
+)
+
+// overlayOpaqueXattr marks a directory of an overlay layer whose lower directories are hidden.
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+// ReplayOldUpperOnNewContainerUpper copies the writable layer of the old container to the new container,
+// which is created from another image but not started, so that the files added, changed and deleted in the old container
+// are added, changed and deleted on top of the new image too.
+// It returns the paths changed in the old container that are also changed between the old image and the new image,
+// the files of the old container are kept for them.
+func ReplayOldUpperOnNewContainerUpper(ctx context.Context, oldContainer, newContainer string, progress ProgressFunc) ([]string, error) {
+	oldResp, err := docker.Cli.ContainerInspect(ctx, oldContainer)
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", oldContainer)
+	}
+	newResp, err := docker.Cli.ContainerInspect(ctx, newContainer)
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker.ContainerInspect failed, name: %s", newContainer)
+	}
+	if oldResp.GraphDriver.Name != overlay2Driver || newResp.GraphDriver.Name != overlay2Driver {
+		return nil, errors.Errorf("the storage driver is not %s, the writable layer of container: %s can't be replayed",
+			overlay2Driver, oldContainer)
+	}
+	oldUpper, newUpper := oldResp.GraphDriver.Data["UpperDir"], newResp.GraphDriver.Data["UpperDir"]
+	if len(oldUpper) == 0 || len(newUpper) == 0 {
+		return nil, errors.Errorf("the upper dir of container: %s or container: %s is not found", oldContainer, newContainer)
+	}
+
+	// LowerDir is a list of directories separated by colons
+	conflicts, err := overlayConflicts(ctx, oldUpper,
+		filepath.SplitList(oldResp.GraphDriver.Data["LowerDir"]), filepath.SplitList(newResp.GraphDriver.Data["LowerDir"]))
+	if err != nil {
+		return nil, errors.WithMessage(err, "overlayConflicts failed")
+	}
+	if len(conflicts) != 0 {
+		log.Warnf("%d files changed in container: %s are changed by the image %s too, the files of the container are kept",
+			len(conflicts), oldContainer, newResp.Config.Image)
+	}
+
+	if err = CopyDir(ctx, oldUpper, newUpper, logProgress("container: "+oldContainer, progress)); err != nil {
+		return nil, errors.WithMessage(err, "CopyDir failed")
+	}
+	return conflicts, nil
+}
+
+// overlayConflicts returns the paths in upper, except the directories, whose files differ between the old lower layers
+// and the new lower layers, the top layer comes first.
+func overlayConflicts(ctx context.Context, upper string, oldLowers, newLowers []string) ([]string, error) {
+	conflicts := make([]string, 0)
+	err := filepath.WalkDir(upper, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(upper, name)
+		if err != nil {
+			return err
+		}
+
+		same, err := sameLayerFile(lookupLayers(oldLowers, rel), lookupLayers(newLowers, rel))
+		if err != nil {
+			return errors.Wrapf(err, "failed to compare %s", rel)
+		}
+		if !same {
+			conflicts = append(conflicts, "/"+rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "filepath.WalkDir failed, upper: %s", upper)
+	}
+	return conflicts, nil
+}
+
+// lookupLayers returns the file of rel in the overlay of the layers, it is empty if there is no such file.
+// Only the whiteouts of rel itself and the opaque directory containing it are considered.
+func lookupLayers(layers []string, rel string) string {
+	for _, layer := range layers {
+		name := filepath.Join(layer, rel)
+		if st, err := lstat(name); err == nil {
+			if isWhiteout(st) {
+				return ""
+			}
+			return name
+		}
+		if isOpaque(filepath.Dir(name)) {
+			return ""
+		}
+	}
+	return ""
+}
+
+// isWhiteout reports whether the file is a character device with 0/0 device number,
+// which marks a deleted file in an overlay layer.
+func isWhiteout(st *syscall.Stat_t) bool {
+	return st.Mode&syscall.S_IFMT == syscall.S_IFCHR && st.Rdev == 0
+}
+
+func isOpaque(dir string) bool {
+	value := make([]byte, 1)
+	n, err := unix.Lgetxattr(dir, overlayOpaqueXattr, value)
+	return err == nil && n == 1 && value[0] == 'y'
+}
+
+// sameLayerFile reports whether the files a and b of two layers are the same,
+// an empty name means there is no such file.
+func sameLayerFile(a, b string) (bool, error) {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b), nil
+	}
+	stA, err := lstat(a)
+	if err != nil {
+		return false, err
+	}
+	stB, err := lstat(b)
+	if err != nil {
+		return false, err
+	}
+	if stA.Mode != stB.Mode {
+		return false, nil
+	}
+
+	switch stA.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		if stA.Size != stB.Size {
+			return false, nil
+		}
+		// the same file of a layer shared by both images
+		if stA.Dev == stB.Dev && stA.Ino == stB.Ino {
+			return true, nil
+		}
+		return sameContents(a, b)
+	case syscall.S_IFLNK:
+		linkA, err := os.Readlink(a)
+		if err != nil {
+			return false, err
+		}
+		linkB, err := os.Readlink(b)
+		if err != nil {
+			return false, err
+		}
+		return linkA == linkB, nil
+	case syscall.S_IFBLK, syscall.S_IFCHR:
+		return stA.Rdev == stB.Rdev, nil
+	default:
+		return true, nil
+	}
+}
+
+func sameContents(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA, bufB := make([]byte, 32<<10), make([]byte, 32<<10)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if na != nb || !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			if errB == io.EOF || errB == io.ErrUnexpectedEOF {
+				return false, nil
+			}
+			return false, errB
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOverlayConflicts(t *testing.T) {
+	skipIfNotRoot(t)
+	dir := t.TempDir()
+	oldBase := layer{
+		files: map[string]string{
+			"app/main.py":      "print('hello')",
+			"etc/config":       "old",
+			"etc/removed.conf": "removed by the new image",
+			"etc/deleted.conf": "deleted in the container",
+			"opt/lib/file":     "old lib",
+			"opt/same/file":    "same",
+		},
+		links: map[string]string{"bin/python": "python3.10"},
+	}.make(t, filepath.Join(dir, "old-base"))
+	// the new image has a layer of its own on top of the old base layer
+	newTop := layer{
+		files: map[string]string{
+			"etc/config": "new",
+			"added.txt":  "added by the new image",
+		},
+		links:     map[string]string{"bin/python": "python3.11"},
+		whiteouts: []string{"etc/removed.conf"},
+		opaques:   []string{"opt/lib"},
+	}.make(t, filepath.Join(dir, "new-top"))
+	upper := layer{
+		files: map[string]string{
+			"app/main.py":      "print('changed')",
+			"etc/config":       "changed in the container",
+			"etc/removed.conf": "changed in the container",
+			"added.txt":        "added in the container",
+			"opt/lib/file":     "changed lib",
+			"opt/same/file":    "changed",
+			"root/model.pt":    "only in the container",
+		},
+		links:     map[string]string{"bin/python": "python3.12"},
+		whiteouts: []string{"etc/deleted.conf"},
+	}.make(t, filepath.Join(dir, "upper"))
+
+	conflicts, err := overlayConflicts(context.Background(), upper, []string{oldBase}, []string{newTop, oldBase})
+	if err != nil {
+		t.Fatalf("overlayConflicts failed: %v", err)
+	}
+	want := []string{
+		// added by the new image
+		"/added.txt",
+		// a symbolic link changed by the new image
+		"/bin/python",
+		// changed by the new image
+		"/etc/config",
+		// deleted by a whiteout of the new image
+		"/etc/removed.conf",
+		// hidden by an opaque directory of the new image
+		"/opt/lib/file",
+	}
+	if !reflect.DeepEqual(conflicts, want) {
+		t.Errorf("got conflicts %v, want %v", conflicts, want)
+	}
+}
+
+func TestSameLayerFile(t *testing.T) {
+	skipIfNotRoot(t)
+	dir := t.TempDir()
+	a := layer{
+		files:     map[string]string{"same": "content", "size": "short", "content": "aaaa"},
+		whiteouts: []string{"whiteout"},
+	}.make(t, filepath.Join(dir, "a"))
+	// whiteout is a regular file in b
+	b := layer{
+		files: map[string]string{"same": "content", "size": "longer", "content": "bbbb", "whiteout": ""},
+	}.make(t, filepath.Join(dir, "b"))
+	mustDo(t, os.Link(filepath.Join(a, "same"), filepath.Join(b, "hardlink")))
+
+	for _, tc := range []struct {
+		a, b string
+		want bool
+	}{
+		{filepath.Join(a, "same"), filepath.Join(b, "same"), true},
+		{filepath.Join(a, "same"), filepath.Join(b, "hardlink"), true},
+		{filepath.Join(a, "size"), filepath.Join(b, "size"), false},
+		{filepath.Join(a, "content"), filepath.Join(b, "content"), false},
+		{filepath.Join(a, "whiteout"), filepath.Join(b, "whiteout"), false},
+		{filepath.Join(a, "same"), "", false},
+		{"", "", true},
+	} {
+		got, err := sameLayerFile(tc.a, tc.b)
+		if err != nil || got != tc.want {
+			t.Errorf("sameLayerFile(%s, %s) = %t, error: %v, want %t", tc.a, tc.b, got, err, tc.want)
+		}
+	}
+}